@@ -21,15 +21,38 @@ import (
 	"github.com/satori/go.uuid"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	DefaultPingInterval = 10 * time.Second
+	// MinPingInterval keeps agents from flooding the server with pings.
+	MinPingInterval = time.Second
+	// ServerReadTimeout is the default agent read timeout of the server,
+	// agents pinging less often are disconnected as stalled.
+	ServerReadTimeout = 60 * time.Second
+)
+
+var (
+	ErrIdleTimeout = Err("Agent is idle for too long")
+	ErrStopped     = Err("Agent is stopped")
+)
+
 var (
 	buildSession *BuildSession
 	logger       *Logger
 	config       *Config
 	AgentId      string
+
+	// stopSignal is the stop channel of the running agent, it is nil
+	// when no agent is running
+	stopSignal   chan bool
+	stopSignalMu sync.Mutex
+	buildsWG     sync.WaitGroup
 )
 
 func LogDebug(format string, v ...interface{}) {
@@ -40,16 +63,24 @@ func LogInfo(format string, v ...interface{}) {
 	logger.Info.Printf(format, v...)
 }
 
+func LogWarn(format string, v ...interface{}) {
+	logger.Warn.Printf(format, v...)
+}
+
+func LogError(format string, v ...interface{}) {
+	logger.Error.Output(2, Sprintf(format, v...))
+}
+
 func GetConfig() *Config {
 	return config
 }
 
 func Initialize() {
 	config = LoadConfig()
-	logger = MakeLogger(config.LogDir, "gocd-golang-agent.log", config.OutputDebugLog)
+	logger = MakeLogger(config.LogDir, "gocd-golang-agent.log", config.LogLevel)
 	LogInfo(">>>>>>> go >>>>>>>")
 	LogInfo("working directory: %v", config.WorkingDir)
-	if _, err := os.Stat(config.WorkingDir); err != nil {
+	if err := PrepareWorkingDir(config.WorkingDir); err != nil {
 		logger.Error.Fatal(err)
 	}
 
@@ -57,30 +88,113 @@ func Initialize() {
 		logger.Error.Fatal(err)
 	}
 
-	if _, err := os.Stat(config.AgentIdFile); err == nil {
-		data, err2 := ioutil.ReadFile(config.AgentIdFile)
-		if err2 != nil {
-			logger.Error.Printf("failed to read uuid file(%v): %v", config.AgentIdFile, err2)
-		} else {
-			AgentId = string(data)
+	if exe, err := os.Executable(); err != nil {
+		LogWarn("failed to find agent binary: %v", err)
+	} else {
+		executable = exe
+		if rolledBack, err := RollbackUnconfirmedUpdate(exe); err != nil {
+			LogWarn("roll back agent binary update failed: %v", err)
+		} else if rolledBack {
+			LogInfo("restarting agent %v", exe)
+			logger.Error.Fatal(execAgent(exe))
 		}
 	}
+
+	AgentId = config.AgentUUID
 	if AgentId == "" {
-		AgentId = uuid.NewV4().String()
-		ioutil.WriteFile(config.AgentIdFile, []byte(AgentId), 0644)
+		id, err := LoadAgentId(config.AgentIdFile)
+		if err != nil {
+			logger.Error.Printf("failed to persist uuid file(%v): %v", config.AgentIdFile, err)
+		}
+		AgentId = id
 	}
 }
 
+// LoadAgentId returns the agent uuid persisted in idFile. A new uuid is
+// generated and written to idFile when there is none, so that an agent
+// keeps its identity across restarts. The new uuid is returned with the
+// error when it could not be persisted.
+func LoadAgentId(idFile string) (string, error) {
+	data, err := ioutil.ReadFile(idFile)
+	if err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	}
+	id := uuid.NewV4().String()
+	if err != nil && !os.IsNotExist(err) {
+		return id, err
+	}
+	return id, ioutil.WriteFile(idFile, []byte(id), 0644)
+}
+
+// Stop asks the running agent to cancel the current build, deregister
+// from the server and return ErrStopped from Start. It does nothing when
+// no agent is running.
+func Stop() {
+	stopSignalMu.Lock()
+	defer stopSignalMu.Unlock()
+	select {
+	case stopSignal <- true:
+	default:
+	}
+}
+
+// newStopSignal replaces the stop channel by a new one for the agent
+// being started, stop signals sent to previous runs are dropped.
+func newStopSignal() chan bool {
+	stopSignalMu.Lock()
+	defer stopSignalMu.Unlock()
+	stopSignal = make(chan bool, 1)
+	return stopSignal
+}
+
+func clearStopSignal(stop chan bool) {
+	stopSignalMu.Lock()
+	defer stopSignalMu.Unlock()
+	if stopSignal == stop {
+		stopSignal = nil
+	}
+}
+
+// Start runs the agent with a new AgentState holding the secrets loaded
+// from SecretsFile and the environment variables of SecretsEnvPrefix of
+// config, see StartWithState.
 func Start() error {
+	secrets, err := LoadSecrets(config.SecretsFile, config.SecretsEnvPrefix)
+	if err != nil {
+		return err
+	}
+	state := NewAgentState()
+	state.SetSecrets(secrets)
+	return StartWithState(state)
+}
+
+// StartWithState registers the agent and processes messages from the
+// server until the connection is closed or the agent is stopped, state
+// is updated with the cookie and the build being run.
+func StartWithState(state *AgentState) error {
+	stop := newStopSignal()
+	defer clearStopSignal(stop)
 	err := Register()
 	if err != nil {
 		return err
 	}
+	if executable != "" {
+		if err := ConfirmUpdate(executable); err != nil {
+			LogWarn("confirm agent binary update failed: %v", err)
+		}
+	}
 
 	httpClient, err := GoServerRemoteClient(true)
 	if err != nil {
 		return err
 	}
+	if config.SelfUpdate {
+		if err := selfUpdate(httpClient); err != nil {
+			return err
+		}
+	}
 
 	conn, err := MakeWebsocketConnection(config.WssServerURL(), config.HttpsServerURL())
 	if err != nil {
@@ -89,17 +203,36 @@ func Start() error {
 	defer conn.Close()
 	defer closeBuildSession()
 
-	pingTick := time.NewTicker(10 * time.Second)
-	ping(conn.Send)
+	pingTick := time.NewTicker(config.PingInterval)
+	defer pingTick.Stop()
+	var idleCheck <-chan time.Time
+	if config.IdleTimeout > 0 {
+		idleTick := time.NewTicker(idleCheckInterval(config.IdleTimeout))
+		defer idleTick.Stop()
+		idleCheck = idleTick.C
+	}
+	lastActive := time.Now()
+	ping(state, conn.Send)
 	for {
 		select {
 		case <-pingTick.C:
-			ping(conn.Send)
+			ping(state, conn.Send)
+		case <-stop:
+			shutdown(conn.Send)
+			return ErrStopped
+		case <-idleCheck:
+			if state.RuntimeStatus() != RuntimeStatusIdle {
+				lastActive = time.Now()
+			} else if time.Since(lastActive) >= config.IdleTimeout {
+				LogInfo("no build for %v, shutting down", config.IdleTimeout)
+				return ErrIdleTimeout
+			}
 		case msg, ok := <-conn.Received:
 			if !ok {
 				return Err("Websocket connection is closed")
 			}
-			err := processMessage(msg, httpClient, conn.Send)
+			lastActive = time.Now()
+			err := processMessage(state, msg, httpClient, conn.Send)
 			if err != nil {
 				return err
 			}
@@ -107,10 +240,44 @@ func Start() error {
 	}
 }
 
-func processMessage(msg *protocol.Message, httpClient *http.Client, send chan *protocol.Message) error {
+// ParsePingInterval parses a duration like "30s", it rejects intervals
+// shorter than MinPingInterval or not shorter than ServerReadTimeout.
+func ParsePingInterval(value string) (time.Duration, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if interval < MinPingInterval {
+		return 0, Err("ping interval %v is shorter than %v", interval, MinPingInterval)
+	}
+	if interval >= ServerReadTimeout {
+		return 0, Err("ping interval %v is not shorter than the server read timeout %v", interval, ServerReadTimeout)
+	}
+	return interval, nil
+}
+
+func idleCheckInterval(timeout time.Duration) time.Duration {
+	interval := timeout / 10
+	if interval <= 0 {
+		return timeout
+	}
+	if interval > 10*time.Second {
+		return 10 * time.Second
+	}
+	return interval
+}
+
+func processMessage(state *AgentState, msg *protocol.Message, httpClient *http.Client, send chan *protocol.Message) error {
+	if !protocol.SupportedVersion(msg.Version) {
+		LogWarn("received %v message of unsupported protocol version %v", msg.Action, msg.Version)
+	}
 	switch msg.Action {
 	case protocol.SetCookieAction:
-		SetState("cookie", msg.DataString())
+		cookie, err := msg.StringData()
+		if err != nil {
+			return err
+		}
+		state.SetCookie(cookie)
 	case protocol.CancelBuildAction:
 		closeBuildSession()
 	case protocol.ReregisterAction:
@@ -118,9 +285,11 @@ func processMessage(msg *protocol.Message, httpClient *http.Client, send chan *p
 		return Err("received reregister message")
 	case protocol.BuildAction:
 		closeBuildSession()
-		build := msg.DataBuild()
-		SetState("buildLocator", build.BuildLocator)
-		SetState("buildLocatorForDisplay", build.BuildLocatorForDisplay)
+		build, err := msg.BuildData()
+		if err != nil {
+			return err
+		}
+		state.SetBuildLocator(build.BuildLocator, build.BuildLocatorForDisplay)
 		curl, err := config.MakeFullServerURL(build.ConsoleUrl)
 		if err != nil {
 			return err
@@ -129,39 +298,77 @@ func processMessage(msg *protocol.Message, httpClient *http.Client, send chan *p
 		if err != nil {
 			return err
 		}
+		var purl *url.URL
+		if build.PropertyBaseUrl != "" {
+			if purl, err = config.MakeFullServerURL(build.PropertyBaseUrl); err != nil {
+				return err
+			}
+		}
+		console := MakeBuildConsole(httpClient, curl)
+		artifacts := NewArtifacts(httpClient, console)
+		artifacts.ChecksumAlgorithm = config.ChecksumAlgorithm
 		buildSession = MakeBuildSession(
 			build.BuildId,
 			build.BuildCommand,
-			MakeBuildConsole(httpClient, curl),
-			&Artifacts{httpClient: httpClient},
+			console,
+			artifacts,
 			aurl,
 			send,
 			config.WorkingDir,
 		)
+		buildSession.State = state
+		buildSession.DryRun = config.DryRun
+		buildSession.UploadConcurrency = config.UploadConcurrency
+		buildSession.UploadChunkSize = config.UploadChunkSize
+		buildSession.BuildSummary = config.BuildSummary
+		buildSession.StrictEnvExpansion = config.StrictEnvExpansion
+		buildSession.ExecAllowlist = config.ExecAllowlist
+		buildSession.ExecDenylist = config.ExecDenylist
+		buildSession.CommandAllowlist = config.CommandAllowlist
+		buildSession.CommandDenylist = config.CommandDenylist
+		buildSession.ExecShell = config.ExecShell
+		buildSession.PropertyBaseURL = purl
+		buildSession.Timeout = build.Timeout
+		buildSession.AddEnv(build.Env)
+		buildSession.AddSecureEnv(build.SecureEnv)
+		buildSession.MaskSecrets(state.Secrets())
+		if build.Resume != nil {
+			buildSession.ResumeIndex = build.Resume.Index
+			buildSession.AddEnv(build.Resume.Env)
+		}
 		buildSession.ReplaceEcho("${agent.location}", config.WorkingDir)
 		buildSession.ReplaceEcho("${agent.hostname}", config.Hostname)
 		buildSession.ReplaceEcho("${date}", func() string { return time.Now().Format("2006-01-02 15:04:05 PDT") })
-		go processBuild(send, buildSession)
+		buildsWG.Add(1)
+		go processBuild(state, send, buildSession)
 	default:
 		panic(Sprintf("Unknown message action: %+v", msg))
 	}
 	return nil
 }
 
-func processBuild(send chan *protocol.Message, buildSession *BuildSession) {
+func processBuild(state *AgentState, send chan *protocol.Message, buildSession *BuildSession) {
 	defer func() {
-		SetState("runtimeStatus", "Idle")
-		ping(send)
+		state.SetRuntimeStatus(RuntimeStatusIdle)
+		ping(state, send)
 		logger.Debug.Printf("! exit goroutine: process build command message")
+		buildsWG.Done()
 	}()
-	SetState("runtimeStatus", "Building")
-	ping(send)
+	state.SetRuntimeStatus(RuntimeStatusBuilding)
+	ping(state, send)
 	buildSession.Run()
 	LogInfo("done")
 }
 
-func ping(send chan *protocol.Message) {
-	send <- protocol.PingMessage(GetAgentRuntimeInfo())
+func shutdown(send chan *protocol.Message) {
+	LogInfo("shutting down")
+	closeBuildSession()
+	buildsWG.Wait()
+	send <- protocol.DeregisterMessage(AgentId)
+}
+
+func ping(state *AgentState, send chan *protocol.Message) {
+	send <- protocol.PingMessage(state.RuntimeInfo())
 }
 
 func closeBuildSession() {
@@ -18,6 +18,7 @@ package agent_test
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	. "github.com/gocd-contrib/gocd-golang-agent/agent"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
@@ -26,6 +27,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -42,6 +44,7 @@ var (
 	goServer     *server.Server
 	stateLog     *StateLog
 	buildId      string
+	agentState   *AgentState
 	agentStopped chan bool
 )
 
@@ -51,11 +54,350 @@ func TestSetCookieAfterConnected(t *testing.T) {
 	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
 
 	assert.Equal(t, "agent Building", stateLog.Next())
-	assert.NotEqual(t, "", GetState("cookie"))
+	assert.NotEqual(t, "", agentState.Cookie())
 	assert.Equal(t, "build Passed", stateLog.Next())
 	assert.Equal(t, "agent Idle", stateLog.Next())
 }
 
+func TestSendBearerTokenToAuthenticatedServer(t *testing.T) {
+	goServer.SetAuthenticator(server.BearerToken("secret"))
+	GetConfig().AuthToken = "secret"
+	defer func() {
+		goServer.SetAuthenticator(nil)
+		GetConfig().AuthToken = ""
+	}()
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", trimTimestamp(log))
+}
+
+func TestQueueBuildWhenAgentIsBusy(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	secondBuildId := buildId + "2"
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("sleep", "0.5"))
+	goServer.SendBuild(AgentId, secondBuildId, protocol.EchoCommand("second"))
+	assert.Equal(t, 1, goServer.QueueDepth(AgentId))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	assert.Equal(t, 0, goServer.QueueDepth(AgentId))
+
+	log, err := goServer.ConsoleLog(secondBuildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "second\n", trimTimestamp(log))
+}
+
+func TestSendBuildToResource(t *testing.T) {
+	GetConfig().AgentAutoRegisterResources = []string{"docker", "linux"}
+	defer func() { GetConfig().AgentAutoRegisterResources = nil }()
+	setUp(t)
+	defer tearDown()
+
+	reg := goServer.Registration(AgentId)
+	assert.NotNil(t, reg)
+	assert.Equal(t, []string{"docker", "linux"}, reg.Resources)
+
+	err := goServer.SendBuildToResource([]string{"windows"}, buildId, protocol.EchoCommand("hello"))
+	assert.NotNil(t, err)
+
+	err = goServer.SendBuildToResource([]string{"linux"}, buildId, protocol.EchoCommand("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", trimTimestamp(log))
+}
+
+func TestPingReportsSystemLoad(t *testing.T) {
+	info := NewAgentState().RuntimeInfo()
+	if runtime.GOOS == "linux" {
+		assert.True(t, info.LoadAverage >= 0, "load average should be non-negative")
+		assert.True(t, info.FreeMemory > 0, "free memory should be positive")
+	}
+	data, err := json.Marshal(info)
+	assert.Nil(t, err)
+	assert.True(t, contains(string(data), `"loadAverage":`))
+	assert.True(t, contains(string(data), `"freeMemory":`))
+}
+
+func TestParsePingInterval(t *testing.T) {
+	interval, err := ParsePingInterval("30s")
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, interval)
+
+	_, err = ParsePingInterval("100ms")
+	assert.NotNil(t, err)
+	_, err = ParsePingInterval("60s")
+	assert.NotNil(t, err)
+	_, err = ParsePingInterval("2m")
+	assert.NotNil(t, err)
+	_, err = ParsePingInterval("often")
+	assert.NotNil(t, err)
+}
+
+func TestLoadAgentIdPersistsGeneratedUuid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-id-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	idFile := filepath.Join(dir, "agent-id")
+
+	id, err := LoadAgentId(idFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 36, len(id))
+	data, err := ioutil.ReadFile(idFile)
+	assert.Nil(t, err)
+	assert.Equal(t, id, string(data))
+
+	reloaded, err := LoadAgentId(idFile)
+	assert.Nil(t, err)
+	assert.Equal(t, id, reloaded)
+
+	assert.Nil(t, ioutil.WriteFile(idFile, []byte("agent-1\n"), 0644))
+	reloaded, err = LoadAgentId(idFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "agent-1", reloaded)
+}
+
+func TestStopCancelsBuildAndDeregisters(t *testing.T) {
+	pc, _, _, _ := runtime.Caller(0)
+	parts := strings.Split(runtime.FuncForPC(pc).Name(), ".")
+	buildId = parts[len(parts)-1]
+	stateLog.Reset(buildId, AgentId)
+
+	done := make(chan error)
+	go func() {
+		done <- Start()
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	goServer.SendBuild(AgentId, buildId, protocol.ExecCommand("sleep", "5"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	Stop()
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	assert.Equal(t, "agent Disconnected", stateLog.Next())
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrStopped, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop")
+	}
+	assert.True(t, goServer.AgentRuntimeInfo(AgentId) == nil, "agent should be removed from server")
+}
+
+func TestStopWithoutRunningAgentDoesNotStopNextStart(t *testing.T) {
+	Stop()
+	setUp(t)
+	defer tearDown()
+
+	goServer.SendBuild(AgentId, buildId, protocol.EchoCommand("hello"))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
+func TestShutdownAfterIdleTimeout(t *testing.T) {
+	GetConfig().IdleTimeout = 100 * time.Millisecond
+	defer func() { GetConfig().IdleTimeout = 0 }()
+	stateLog.Reset("", AgentId)
+
+	done := make(chan error)
+	go func() {
+		done <- Start()
+	}()
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrIdleTimeout, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not shutdown after idle timeout")
+	}
+}
+
+func TestRegisterRetriesUntilServerIsUp(t *testing.T) {
+	RegisterRetryBaseDelay = time.Millisecond
+	defer func() { RegisterRetryBaseDelay = time.Second }()
+	GetConfig().RegistrationPath = "/flaky-register"
+	defer func() { GetConfig().RegistrationPath = server.RegistrationPath }()
+	attempts := 0
+	goServer.HandleFunc("/flaky-register", func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, req, server.RegistrationPath, http.StatusTemporaryRedirect)
+	})
+
+	assert.Nil(t, CleanRegistration())
+	assert.Nil(t, Register())
+	assert.Equal(t, 3, attempts)
+	_, err := os.Stat(GetConfig().AgentCertFile)
+	assert.Nil(t, err)
+}
+
+func TestRegisterDoesNotRetryRejectedRegistration(t *testing.T) {
+	RegisterRetryBaseDelay = time.Millisecond
+	defer func() { RegisterRetryBaseDelay = time.Second }()
+	GetConfig().RegistrationPath = "/rejected-register"
+	defer func() { GetConfig().RegistrationPath = server.RegistrationPath }()
+	attempts := 0
+	goServer.HandleFunc("/rejected-register", func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusForbidden)
+	})
+
+	assert.Nil(t, CleanRegistration())
+	assert.NotNil(t, Register())
+	assert.Equal(t, 1, attempts)
+}
+
+func TestUpdateAgentBinaryAdvertisedByServer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("tested with sh")
+	}
+	setUp(t)
+	defer tearDown()
+	dir, err := ioutil.TempDir("", "self-update")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	exe := filepath.Join(dir, "agent")
+	assert.Nil(t, ioutil.WriteFile(exe, []byte("#!/bin/sh\necho 1.0\n"), 0755))
+	update := filepath.Join(dir, "update")
+	assert.Nil(t, ioutil.WriteFile(update, []byte("#!/bin/sh\necho 2.0\n"), 0755))
+	client, err := GoServerRemoteClient(true)
+	assert.Nil(t, err)
+
+	updated, err := UpdateAgentBinary(client, exe)
+	assert.Nil(t, err)
+	assert.False(t, updated, "server not distributing agent binary")
+
+	goServer.AgentBinaryFile = update
+	goServer.AgentBinaryVersion = "3.0"
+	defer func() { goServer.AgentBinaryFile, goServer.AgentBinaryVersion = "", "" }()
+	_, err = UpdateAgentBinary(client, exe)
+	assert.NotNil(t, err)
+	assert.Equal(t, "downloaded agent binary is version 2.0, expected 3.0", err.Error())
+	content, err := ioutil.ReadFile(exe)
+	assert.Nil(t, err)
+	assert.Equal(t, "#!/bin/sh\necho 1.0\n", string(content))
+	_, err = os.Stat(exe + ".new")
+	assert.True(t, os.IsNotExist(err), "downloaded binary should be removed")
+
+	goServer.AgentBinaryVersion = "2.0"
+	updated, err = UpdateAgentBinary(client, exe)
+	assert.Nil(t, err)
+	assert.True(t, updated, "agent binary should be updated")
+	content, err = ioutil.ReadFile(exe)
+	assert.Nil(t, err)
+	assert.Equal(t, "#!/bin/sh\necho 2.0\n", string(content))
+	content, err = ioutil.ReadFile(exe + ".old")
+	assert.Nil(t, err)
+	assert.Equal(t, "#!/bin/sh\necho 1.0\n", string(content))
+
+	updated, err = UpdateAgentBinary(client, exe)
+	assert.Nil(t, err)
+	assert.False(t, updated, "agent binary is up to date")
+
+	rolledBack, err := RollbackUnconfirmedUpdate(exe)
+	assert.Nil(t, err)
+	assert.False(t, rolledBack, "first start of updated binary")
+	assert.Nil(t, ConfirmUpdate(exe))
+	rolledBack, err = RollbackUnconfirmedUpdate(exe)
+	assert.Nil(t, err)
+	assert.False(t, rolledBack, "update is confirmed")
+	content, err = ioutil.ReadFile(exe)
+	assert.Nil(t, err)
+	assert.Equal(t, "#!/bin/sh\necho 2.0\n", string(content))
+}
+
+func TestRollbackUnconfirmedAgentBinaryUpdate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("tested with sh")
+	}
+	setUp(t)
+	defer tearDown()
+	dir, err := ioutil.TempDir("", "self-update")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	exe := filepath.Join(dir, "agent")
+	assert.Nil(t, ioutil.WriteFile(exe, []byte("#!/bin/sh\necho 1.0\n"), 0755))
+	update := filepath.Join(dir, "update")
+	assert.Nil(t, ioutil.WriteFile(update, []byte("#!/bin/sh\necho 2.0\n"), 0755))
+	client, err := GoServerRemoteClient(true)
+	assert.Nil(t, err)
+	goServer.AgentBinaryFile = update
+	goServer.AgentBinaryVersion = "2.0"
+	defer func() { goServer.AgentBinaryFile, goServer.AgentBinaryVersion = "", "" }()
+
+	updated, err := UpdateAgentBinary(client, exe)
+	assert.Nil(t, err)
+	assert.True(t, updated, "agent binary should be updated")
+	rolledBack, err := RollbackUnconfirmedUpdate(exe)
+	assert.Nil(t, err)
+	assert.False(t, rolledBack, "first start of updated binary")
+	rolledBack, err = RollbackUnconfirmedUpdate(exe)
+	assert.Nil(t, err)
+	assert.True(t, rolledBack, "updated binary did not confirm")
+	content, err := ioutil.ReadFile(exe)
+	assert.Nil(t, err)
+	assert.Equal(t, "#!/bin/sh\necho 1.0\n", string(content))
+
+	_, err = UpdateAgentBinary(client, exe)
+	assert.NotNil(t, err, "rolled back binary should not be updated to again")
+	content, err = ioutil.ReadFile(exe)
+	assert.Nil(t, err)
+	assert.Equal(t, "#!/bin/sh\necho 1.0\n", string(content))
+}
+
+func TestRejectServerCertificateSignedByUnexpectedCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mitm")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "private.pem")
+	assert.Nil(t, server.NewCert("localhost").Generate(certFile, keyFile))
+	mitm := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.Nil(t, err)
+	mitm.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	mitm.StartTLS()
+	defer mitm.Close()
+	mitmUrl := strings.Replace(mitm.URL, "127.0.0.1", "localhost", 1)
+
+	assert.Nil(t, ReadGoServerCACert())
+	client, err := GoServerRemoteClient(false)
+	assert.Nil(t, err)
+	_, err = client.Get(mitmUrl)
+	assert.NotNil(t, err)
+	assert.True(t, contains(err.Error(), "certificate signed by unknown authority"), err.Error())
+
+	GetConfig().InsecureSkipVerify = true
+	defer func() { GetConfig().InsecureSkipVerify = false }()
+	client, err = GoServerRemoteClient(false)
+	assert.Nil(t, err)
+	resp, err := client.Get(mitmUrl)
+	assert.Nil(t, err)
+	resp.Body.Close()
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
@@ -82,6 +424,7 @@ func TestMain(m *testing.M) {
 	os.Setenv("GOCD_SERVER_URL", goServerUrl)
 	os.Setenv("GOCD_SERVER_WEB_SOCKET_PATH", server.WebSocketPath)
 	os.Setenv("GOCD_SERVER_REGISTRATION_PATH", server.RegistrationPath)
+	os.Setenv("GOCD_SERVER_AGENT_BINARY_PATH", server.AgentBinaryPath)
 	os.Setenv("GOCD_AGENT_WORKING_DIR", agentWorkingDir)
 	os.Setenv("GOCD_AGENT_LOG_DIR", agentWorkingDir)
 
@@ -105,7 +448,7 @@ func startServer(workingDir string) {
 		certFile,
 		keyFile,
 		workingDir,
-		MakeLogger(workingDir, "server.log", true).Info)
+		MakeLogger(workingDir, "server.log", LogLevelDebug).Info)
 	goServer.StateListeners = []server.StateListener{stateLog}
 
 	go func() {
@@ -286,9 +629,10 @@ func relativePath(wd string) string {
 }
 
 func startAgent(t *testing.T) chan bool {
+	agentState = NewAgentState()
 	done := make(chan bool)
 	go func() {
-		err := Start()
+		err := StartWithState(agentState)
 		if err.Error() != "received reregister message" {
 			t.Error("Unexpected error to quit agent: ", err)
 		}
@@ -19,20 +19,39 @@ package agent
 import (
 	"archive/zip"
 	"bytes"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/satori/go.uuid"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// etags caches ETags of downloaded files by their destination paths.
+var etags = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
 type Artifacts struct {
+	// ChecksumAlgorithm is the checksum uploaded with artifacts for the
+	// server to verify, md5 by default or sha256.
+	ChecksumAlgorithm string
+
 	httpClient *http.Client
+	console    io.Writer
+}
+
+func NewArtifacts(httpClient *http.Client, console io.Writer) *Artifacts {
+	return &Artifacts{httpClient: httpClient, console: console}
 }
 
 func (u *Artifacts) DownloadFile(source *url.URL, destPath string) (err error) {
@@ -41,11 +60,35 @@ func (u *Artifacts) DownloadFile(source *url.URL, destPath string) (err error) {
 	if err != nil {
 		return err
 	}
+	ifNoneMatch := cachedETag(destPath)
 	destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return
 	}
-	return u.downloadFile(source, destFile)
+	etag, err := u.downloadFile(source, destFile, ifNoneMatch)
+	if err == nil && etag != "" {
+		etags.Lock()
+		etags.m[destPath] = etag
+		etags.Unlock()
+	}
+	return
+}
+
+// cachedETag returns the ETag of the last download to destPath, if the
+// file is not changed after it is downloaded. The server ETag is the
+// quoted md5 of the file.
+func cachedETag(destPath string) string {
+	etags.Lock()
+	etag := etags.m[destPath]
+	etags.Unlock()
+	if etag == "" {
+		return ""
+	}
+	md5, err := ComputeMd5(destPath)
+	if err != nil || `"`+md5+`"` != etag {
+		return ""
+	}
+	return etag
 }
 
 func (u *Artifacts) DownloadDir(source *url.URL, destPath string) error {
@@ -55,20 +98,45 @@ func (u *Artifacts) DownloadDir(source *url.URL, destPath string) error {
 	}
 	defer os.Remove(zipfile.Name())
 	LogDebug("tmp file created for download zipped dir")
-	err = u.downloadFile(source, zipfile)
+	_, err = u.downloadFile(source, zipfile, "")
 	if err != nil {
 		return err
 	}
 
-	zipReader, err := zip.OpenReader(zipfile.Name())
+	return u.unzip(zipfile.Name(), filepath.Dir(destPath))
+}
+
+// DownloadArchive downloads the zip artifact uploaded by UploadArchive,
+// verifies its checksum and extracts it into destDir.
+func (u *Artifacts) DownloadArchive(source *url.URL, srcPath, destDir, checksumFname string) error {
+	zipfile, err := ioutil.TempFile("", "archive.zip")
 	if err != nil {
 		return err
 	}
-	LogDebug("unzip to %v", destPath)
+	defer os.Remove(zipfile.Name())
+	_, err = u.downloadFile(source, zipfile, "")
+	if err != nil {
+		return err
+	}
+	err = u.VerifyChecksumFile(srcPath, zipfile.Name(), checksumFname)
+	if err != nil {
+		return err
+	}
+	return u.unzip(zipfile.Name(), destDir)
+}
+
+func (u *Artifacts) unzip(zipfile, destDir string) error {
+	zipReader, err := zip.OpenReader(zipfile)
+	if err != nil {
+		return err
+	}
+	LogDebug("unzip to %v", destDir)
 	defer zipReader.Close()
-	destDir := filepath.Dir(destPath)
 	for _, file := range zipReader.File {
 		dest := filepath.Join(destDir, file.FileHeader.Name)
+		if !IsSubPath(dest, destDir) {
+			return Err("Zip entry %v is outside of the destination directory", file.FileHeader.Name)
+		}
 		if file.FileHeader.FileInfo().IsDir() {
 			LogDebug("mkdirs %v", dest)
 			err = Mkdirs(dest)
@@ -84,34 +152,63 @@ func (u *Artifacts) DownloadDir(source *url.URL, destPath string) error {
 	return nil
 }
 
-func (u *Artifacts) downloadFile(source *url.URL, destFile *os.File) (err error) {
+// downloadFile downloads source to destFile and returns the response
+// ETag. Nothing is written when the server responds not modified for
+// the ifNoneMatch ETag.
+func (u *Artifacts) downloadFile(source *url.URL, destFile *os.File, ifNoneMatch string) (etag string, err error) {
 	defer destFile.Close()
 	LogDebug("download file %v => %v", source, destFile.Name())
-	retry := 0
-startDownload:
-	resp, err := u.httpClient.Get(source.String())
+	statusCode, err := retry(u.log, Sprintf("Download %v", source), func(attempt int) (int, error) {
+		var statusCode int
+		statusCode, etag, err = u.get(source, destFile, ifNoneMatch)
+		return statusCode, err
+	})
 	if err != nil {
 		return
 	}
+	if statusCode == http.StatusNotModified {
+		LogDebug("%v is not modified", source)
+		return
+	}
+	if statusCode != http.StatusOK {
+		return "", Err("Failed to download [%v]. Server response: %v", source, statusCode)
+	}
+	return
+}
+
+func (u *Artifacts) get(source *url.URL, destFile *os.File, ifNoneMatch string) (int, string, error) {
+startDownload:
+	req, err := http.NewRequest(http.MethodGet, source.String(), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	resp, err := u.httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
 	LogDebug("response: %v", resp.Status)
 	if resp.StatusCode == http.StatusAccepted {
 		LogDebug("Server responsed StatusAccepted, sleep 1 sec and start download again")
+		resp.Body.Close()
 		time.Sleep(1 * time.Second)
 		goto startDownload
 	}
+	etag := resp.Header.Get("ETag")
 	if resp.StatusCode != http.StatusOK {
-		if retry < 3 {
-			retry++
-			LogDebug("sleep %v sec and start download again", retry)
-			time.Sleep(time.Duration(retry) * time.Second)
-			goto startDownload
-		} else {
-			return Err("tried %v times to download [%v] and all failed.", retry, source)
-		}
+		return resp.StatusCode, etag, nil
 	}
-	defer resp.Body.Close()
-	_, err = io.Copy(destFile, resp.Body)
-	return
+	if err := destFile.Truncate(0); err != nil {
+		return 0, "", err
+	}
+	if _, err := destFile.Seek(0, io.SeekStart); err != nil {
+		return 0, "", err
+	}
+	_, err = io.Copy(destFile, newProgressReader(resp.Body, resp.ContentLength, source.String(), u.log))
+	return resp.StatusCode, etag, err
 }
 
 func (u *Artifacts) VerifyChecksum(srcPath, destPath, checksumFname string) error {
@@ -135,19 +232,27 @@ func (u *Artifacts) VerifyChecksum(srcPath, destPath, checksumFname string) erro
 	}
 }
 
+// VerifyChecksumFile verifies the file by the checksum of srcFname in
+// the checksum file, which is either the md5 checksum file or the
+// checksum manifest having md5 or sha256 digests.
 func (u *Artifacts) VerifyChecksumFile(srcFname, fname, checksumFname string) error {
-	md5, err := ComputeMd5(fname)
+	data, err := ioutil.ReadFile(checksumFname)
 	if err != nil {
 		return err
 	}
-	checksum, err := ioutil.ReadFile(checksumFname)
+	checksums, err := protocol.ParseChecksums(data)
 	if err != nil {
 		return err
 	}
-	properties := ParseChecksum(string(checksum))
-	if properties[srcFname] == "" {
-		return Err("[WARN] The md5checksum value of the artifact [%v] was not found on the server. Hence, Go could not verify the integrity of its contents.", srcFname)
-	} else if properties[srcFname] != md5 {
+	expected := protocol.IndexChecksums(checksums)[srcFname]
+	if expected == nil {
+		return Err("[WARN] The checksum value of the artifact [%v] was not found on the server. Hence, Go could not verify the integrity of its contents.", srcFname)
+	}
+	actual, err := ComputeChecksum(fname)
+	if err != nil {
+		return err
+	}
+	if !expected.Matches(actual) {
 		return Err("[ERROR] Verification of the integrity of the artifact [%v] failed. The artifact file on the server may have changed since its original upload.", srcFname)
 	} else {
 		return nil
@@ -160,12 +265,19 @@ func (u *Artifacts) Upload(source, destPath string, destURL *url.URL) (err error
 	if err != nil {
 		return
 	}
-	var body bytes.Buffer
-	writer := multipart.NewWriter(&body)
-	err = u.writeFilePart(writer, zipped, "zipfile")
+	info, err := os.Stat(zipped)
 	if err != nil {
 		return
 	}
+	// the multipart body is streamed from the zipped file, only the
+	// part headers and the checksum part are kept in memory
+	var head bytes.Buffer
+	writer := multipart.NewWriter(&head)
+	_, err = writer.CreateFormFile("zipfile", filepath.Base(zipped))
+	if err != nil {
+		return
+	}
+	headLen := head.Len()
 	err = u.writePart(writer, bytes.NewBufferString(checksum), "file_checksum", "checksum_file")
 	if err != nil {
 		return
@@ -174,53 +286,181 @@ func (u *Artifacts) Upload(source, destPath string, destURL *url.URL) (err error
 	if err != nil {
 		return
 	}
+	prefix, suffix := head.Bytes()[:headLen], head.Bytes()[headLen:]
 
-	attempt := 1
-tryPost:
-	attemptUrl := AppendUrlParam(destURL, "attempt", strconv.Itoa(attempt))
-	statusCode, err := u.post(source, writer.FormDataContentType(), attemptUrl, &body)
-	// client side errors, no retry
+	statusCode, err := retry(u.log, Sprintf("Upload %v", source), func(attempt int) (int, error) {
+		file, err := os.Open(zipped)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		body := io.MultiReader(bytes.NewReader(prefix), file, bytes.NewReader(suffix))
+		contentLength := int64(len(prefix)) + info.Size() + int64(len(suffix))
+		attemptUrl := AppendUrlParam(destURL, "attempt", strconv.Itoa(attempt))
+		return u.send(http.MethodPost, writer.FormDataContentType(), attemptUrl, body, contentLength)
+	})
 	if err != nil {
 		return
 	}
-	// success
+	return uploadResult(source, info.Size(), statusCode)
+}
+
+// UploadChunked uploads the file source as the artifact destPath in
+// chunks of chunkSize bytes, each chunk is retried on its own. The
+// server assembles the chunks and verifies the md5 of the file once all
+// of them are uploaded.
+func (u *Artifacts) UploadChunked(source, destPath string, destURL *url.URL, chunkSize int64) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	checksum, err := ComputeChecksum(source)
+	if err != nil {
+		return err
+	}
+	uploadId := uuid.NewV4().String()
+	count := (info.Size() + chunkSize - 1) / chunkSize
+	if count == 0 {
+		count = 1
+	}
+	u.log("Uploading %v in %v chunks\n", source, count)
+	for i := int64(0); i < count; i++ {
+		offset := i * chunkSize
+		size := chunkSize
+		if offset+size > info.Size() {
+			size = info.Size() - offset
+		}
+		chunkChecksum, err := computeSectionChecksum(source, offset, size)
+		if err != nil {
+			return err
+		}
+		params := map[string]string{
+			protocol.ChunkedUploadParam: uploadId,
+			protocol.ChunkIndexParam:    strconv.FormatInt(i, 10),
+		}
+		if u.ChecksumAlgorithm == protocol.ChecksumSha256 {
+			params[protocol.ChunkSha256Param] = chunkChecksum.Sha256
+		} else {
+			params[protocol.ChunkMd5Param] = chunkChecksum.Md5
+		}
+		chunkURL := withQuery(destURL, params)
+		statusCode, err := retry(u.log, Sprintf("Upload chunk %v of %v", i+1, source), func(attempt int) (int, error) {
+			file, err := os.Open(source)
+			if err != nil {
+				return 0, err
+			}
+			defer file.Close()
+			statusCode, err := u.send(http.MethodPut, "application/octet-stream", chunkURL, io.NewSectionReader(file, offset, size), size)
+			if err == nil && statusCode == protocol.ChunkChecksumMismatchStatus {
+				// the chunk is corrupted on the way, send it again
+				err = Err("chunk is corrupted")
+			}
+			return statusCode, err
+		})
+		if err != nil {
+			return err
+		}
+		if err := uploadResult(source, info.Size(), statusCode); err != nil {
+			return err
+		}
+	}
+	params := map[string]string{
+		protocol.ChunkedUploadParam: uploadId,
+		protocol.ChunkCountParam:    strconv.FormatInt(count, 10),
+		protocol.ArtifactFileParam:  destPath,
+	}
+	if u.ChecksumAlgorithm == protocol.ChecksumSha256 {
+		params[protocol.ArtifactSha256Param] = checksum.Sha256
+	} else {
+		params[protocol.ArtifactMd5Param] = checksum.Md5
+	}
+	completeURL := withQuery(destURL, params)
+	statusCode, err := retry(u.log, Sprintf("Upload %v", source), func(attempt int) (int, error) {
+		return u.send(http.MethodPost, "application/octet-stream", completeURL, http.NoBody, 0)
+	})
+	if err != nil {
+		return err
+	}
+	return uploadResult(source, info.Size(), statusCode)
+}
+
+func uploadResult(source string, size int64, statusCode int) error {
 	if statusCode == http.StatusCreated {
-		return
+		return nil
 	}
-	// handle errors
 	if statusCode == http.StatusRequestEntityTooLarge {
-		info, _ := os.Stat(zipped)
-		return Err("Artifact upload for file %s (Size: %d) was denied by the server. This usually happens when server runs out of disk space.", source, info.Size())
-	}
-	// retry for other errors
-	if attempt < 3 {
-		attempt++
-		goto tryPost
+		return Err("Artifact upload for file %s (Size: %d) was denied by the server. This usually happens when server runs out of disk space.", source, size)
 	}
 	return Err("Failed to upload %v. Server response: %v", source, statusCode)
 }
 
-func (u *Artifacts) post(source, contentType string, destURL *url.URL, body *bytes.Buffer) (statusCode int, err error) {
-	req, err := http.NewRequest("POST", destURL.String(), body)
+func withQuery(base *url.URL, params map[string]string) *url.URL {
+	u := *base
+	query := u.Query()
+	for name, value := range params {
+		query.Set(name, value)
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// UploadArchive uploads the directory source as a single zip artifact
+// at destPath, entries are named by their path relative to the parent
+// of source and keep their file modes.
+func (u *Artifacts) UploadArchive(source, destPath string, destURL *url.URL) error {
+	zipped, _, err := u.zipSource(source, filepath.Base(source))
+	defer os.Remove(zipped)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	archive := filepath.Join(tmpDir, path.Base(destPath))
+	if err := os.Rename(zipped, archive); err != nil {
+		return err
+	}
+	return u.Upload(archive, destPath, destURL)
+}
+
+// SetProperty defines build property name with value at propertyURL.
+func (u *Artifacts) SetProperty(propertyURL *url.URL, name, value string) error {
+	form := url.Values{"value": {value}}.Encode()
+	statusCode, err := u.send(http.MethodPost, "application/x-www-form-urlencoded",
+		withQuery(propertyURL, map[string]string{"name": name}), strings.NewReader(form), int64(len(form)))
+	if err != nil {
+		return err
+	}
+	if statusCode != http.StatusCreated {
+		return Err("Failed to set property %v. Server response: %v", name, statusCode)
+	}
+	return nil
+}
+
+func (u *Artifacts) send(method, contentType string, destURL *url.URL, body io.Reader, contentLength int64) (statusCode int, err error) {
+	req, err := http.NewRequest(method, destURL.String(), body)
 	if err != nil {
 		return
 	}
+	req.ContentLength = contentLength
 	req.Header.Add("Content-Type", contentType)
 
 	resp, err := u.httpClient.Do(req)
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
 	return resp.StatusCode, nil
 }
 
-func (u *Artifacts) writeFilePart(writer *multipart.Writer, path, paramName string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return err
+func (u *Artifacts) log(format string, a ...interface{}) {
+	if u.console == nil {
+		LogInfo(format, a...)
+		return
 	}
-	defer file.Close()
-	return u.writePart(writer, file, paramName, filepath.Base(path))
+	u.console.Write([]byte(Sprintf(format, a...)))
 }
 
 func (u *Artifacts) writePart(writer *multipart.Writer, src io.Reader, fieldname, filename string) error {
@@ -232,6 +472,23 @@ func (u *Artifacts) writePart(writer *multipart.Writer, src io.Reader, fieldname
 	return err
 }
 
+// writeChecksum writes the checksum line of the file uploaded as dest,
+// "dest=md5", or a manifest line with the sha256 when ChecksumAlgorithm
+// is sha256.
+func (u *Artifacts) writeChecksum(w io.Writer, dest, path string) error {
+	checksum, err := ComputeChecksum(path)
+	if err != nil {
+		return err
+	}
+	checksum.Path = dest
+	if u.ChecksumAlgorithm != protocol.ChecksumSha256 {
+		_, err := io.WriteString(w, Sprintf("%v=%v\n", dest, checksum.Md5))
+		return err
+	}
+	checksum.Md5 = ""
+	return protocol.WriteChecksums(w, []*protocol.ArtifactChecksum{checksum})
+}
+
 func (u *Artifacts) zipSource(source string, dest string) (string, string, error) {
 	zipfile, err := ioutil.TempFile("", "tmp.zip")
 	if err != nil {
@@ -266,18 +523,22 @@ func (u *Artifacts) zipSource(source string, dest string) (string, string, error
 			}
 		}
 
-		md5, err := ComputeMd5(path)
-		if err != nil {
+		if err := u.writeChecksum(&checksum, destFile, path); err != nil {
 			return err
 		}
-		checksum.WriteString(Sprintf("%v=%v\n", destFile, md5))
 
 		file, err := os.Open(path)
 		if err != nil {
 			return err
 		}
 		defer file.Close()
-		writer, err := w.Create(destFile)
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = destFile
+		header.Method = zip.Deflate
+		writer, err := w.CreateHeader(header)
 		if err != nil {
 			return err
 		}
@@ -299,11 +560,20 @@ func (u *Artifacts) extractFile(file *zip.File, dest string) error {
 	if err != nil {
 		return err
 	}
-	destFile, err := os.Create(dest)
+	perm := file.Mode().Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return err
 	}
-	defer destFile.Close()
 	_, err = io.Copy(destFile, rc)
-	return err
+	if err1 := destFile.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dest, perm)
 }
@@ -17,15 +17,26 @@
 package agent_test
 
 import (
+	"archive/zip"
 	"bytes"
+	"crypto/md5"
 	. "github.com/gocd-contrib/gocd-golang-agent/agent"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/gocd-contrib/gocd-golang-agent/stream"
 	"github.com/xli/assert"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestUploadArtifactFailed(t *testing.T) {
@@ -65,6 +76,215 @@ func TestIgnoreUnmatchError(t *testing.T) {
 	assert.Equal(t, "agent Idle", stateLog.Next())
 }
 
+func TestUploadArtifactsConcurrently(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createPipelineDir()
+	expected := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		fname := Sprintf("file%02d.txt", i)
+		writeFile(filepath.Join(wd, "outputs"), fname, Sprintf("content of %v", fname))
+		expected["reports/"+fname] = Sprintf("%x", md5.Sum([]byte("content of "+fname)))
+	}
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("outputs/*.txt", "reports", "false").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	checksum, err := goServer.Checksum(buildId)
+	assert.Nil(t, err)
+	actual := make(map[string]string)
+	for _, line := range split(filterComments(checksum), "\n") {
+		if line != "" {
+			parts := split(line, "=")
+			actual[parts[0]] = parts[1]
+		}
+	}
+	assert.Equal(t, expected, actual)
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, strings.Count(log, "Uploading artifacts from"))
+}
+
+func TestUploadArtifactsConcurrencyIsLimited(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-concurrency-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 12; i++ {
+		writeFile(filepath.Join(dir, "outputs"), Sprintf("file%02d.txt", i), "content")
+	}
+
+	var mu sync.Mutex
+	inflight, maxInflight := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		inflight++
+		if inflight > maxInflight {
+			maxInflight = inflight
+		}
+		mu.Unlock()
+		ioutil.ReadAll(req.Body)
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	console := &lockedBuffer{}
+	u, _ := url.Parse(ts.URL)
+	session := MakeBuildSession("upload", protocol.UploadArtifactCommand("outputs/*.txt", "reports", "false"),
+		stream.NopCloser(console), NewArtifacts(http.DefaultClient, console), u, make(chan *protocol.Message, 10), dir)
+	session.UploadConcurrency = 3
+	assert.Nil(t, session.ProcessCommand())
+
+	assert.Equal(t, 3, maxInflight)
+	log := console.String()
+	assert.Equal(t, 12, strings.Count(log, "Uploading artifacts from"))
+	for i := 1; i <= 12; i++ {
+		assert.True(t, contains(log, Sprintf("Uploaded %v of 12 artifacts matching", i)), log)
+	}
+}
+
+func TestUploadLargeArtifactInChunks(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	GetConfig().UploadChunkSize = 1000
+	defer func() { GetConfig().UploadChunkSize = 0 }()
+	goServer.SetMaxRequestEntitySize(2000)
+	defer goServer.SetMaxRequestEntitySize(0)
+
+	wd := createPipelineDir()
+	large := make([]byte, 4500)
+	rand.Read(large)
+	writeFile(wd, "large.bin", string(large))
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("large.bin", "dist", "false").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	uploaded, err := ioutil.ReadFile(goServer.ArtifactFile(buildId, "dist/large.bin"))
+	assert.Nil(t, err)
+	assert.Equal(t, large, uploaded)
+	checksum, err := goServer.Checksum(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(checksum, Sprintf("dist/large.bin=%x", md5.Sum(large))), checksum)
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, "in 5 chunks"), log)
+}
+
+func TestUploadChunkedResendsCorruptedChunk(t *testing.T) {
+	RetryBaseDelay = time.Millisecond
+	defer func() { RetryBaseDelay = time.Second }()
+	var mu sync.Mutex
+	received := make(map[string][]byte)
+	attempts := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		if req.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		chunk, _ := ioutil.ReadAll(req.Body)
+		index := query.Get(protocol.ChunkIndexParam)
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[index]++
+		if index == "1" && attempts[index] == 1 {
+			chunk[0] ^= 0xff
+		}
+		if Sprintf("%x", md5.Sum(chunk)) != query.Get(protocol.ChunkMd5Param) {
+			w.WriteHeader(protocol.ChunkChecksumMismatchStatus)
+			return
+		}
+		received[index] = chunk
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "chunked")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	content := make([]byte, 2500)
+	rand.Read(content)
+	file.Write(content)
+	file.Close()
+	destURL, _ := url.Parse(server.URL)
+
+	var console bytes.Buffer
+	err = NewArtifacts(http.DefaultClient, &console).UploadChunked(file.Name(), "large.bin", destURL, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"0": 1, "1": 2, "2": 1}, attempts)
+	assert.Equal(t, content, append(append(received["0"], received["1"]...), received["2"]...))
+	assert.True(t, contains(console.String(), "chunk is corrupted"), console.String())
+}
+
+func TestDownloadProgressIsReportedToConsole(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", Sprintf("%v", len(content)))
+		}
+		for i := 0; i < len(content); i += 10000 {
+			w.Write(content[i : i+10000])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "download-progress-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var console bytes.Buffer
+	u, _ := url.Parse(ts.URL + "/file")
+	assert.Nil(t, NewArtifacts(http.DefaultClient, &console).DownloadFile(u, filepath.Join(dir, "file")))
+	lines := split(strings.TrimSpace(console.String()), "\n")
+	assert.Equal(t, Sprintf("Downloading %v (100000 bytes)", u), lines[0])
+	assert.Equal(t, "Downloaded 100000 of 100000 bytes (100%)", lines[len(lines)-1])
+	assert.True(t, len(lines) <= 12, console.String())
+
+	console.Reset()
+	u, _ = url.Parse(ts.URL + "/file?chunked=true")
+	assert.Nil(t, NewArtifacts(http.DefaultClient, &console).DownloadFile(u, filepath.Join(dir, "chunked")))
+	lines = split(strings.TrimSpace(console.String()), "\n")
+	assert.Equal(t, Sprintf("Downloading %v", u), lines[0])
+	assert.Equal(t, "Downloaded 100000 bytes", lines[len(lines)-1])
+}
+
+func TestUploadArtifactsConcurrentlyStopsAtFailure(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SetMaxRequestEntitySize(10000)
+	defer goServer.SetMaxRequestEntitySize(0)
+
+	wd := createPipelineDir()
+	for i := 0; i < 50; i++ {
+		content := "small"
+		if i == 10 {
+			large := make([]byte, 20000)
+			rand.Read(large)
+			content = string(large)
+		}
+		writeFile(filepath.Join(wd, "outputs"), Sprintf("file%02d.txt", i), content)
+	}
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("outputs/*.txt", "", "false").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, "file10.txt (Size: "), log)
+	assert.True(t, contains(log, "was denied by the server"), log)
+	assert.True(t, strings.Count(log, "Uploading artifacts from") < 50, log)
+}
+
 func TestUploadArtifactFailedWhenServerHasNotEnoughDiskspace(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -86,12 +306,96 @@ func TestUploadArtifactFailedWhenServerHasNotEnoughDiskspace(t *testing.T) {
 	log, err := goServer.ConsoleLog(buildId)
 	assert.Nil(t, err)
 	f := `Uploading artifacts from %v/large.txt to [defaultRoot]
-ERROR: Artifact upload for file %v/large.txt (Size: 609) was denied by the server. This usually happens when server runs out of disk space.
+ERROR: Artifact upload for file %v/large.txt (Size: %v) was denied by the server. This usually happens when server runs out of disk space.
 `
-	expected := Sprintf(f, wd, wd)
+	expected := Sprintf(f, wd, wd, zippedSize(t, filepath.Join(wd, "large.txt")))
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+// zippedSize returns the size of the zip the agent uploads for file.
+func zippedSize(t *testing.T, file string) int {
+	info, err := os.Stat(file)
+	assert.Nil(t, err)
+	content, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	var zipped bytes.Buffer
+	w := zip.NewWriter(&zipped)
+	header, err := zip.FileInfoHeader(info)
+	assert.Nil(t, err)
+	header.Name = info.Name()
+	header.Method = zip.Deflate
+	f, err := w.CreateHeader(header)
+	assert.Nil(t, err)
+	f.Write(content)
+	assert.Nil(t, w.Close())
+	return zipped.Len()
+}
+
+func TestUploadLargeArtifactIsStreamed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "large-upload")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	size := int64(64 * 1024 * 1024)
+	f, err := os.Create(filepath.Join(dir, "large.bin"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Truncate(size))
+	assert.Nil(t, f.Close())
+
+	var received, contentLength int64
+	var uploaded *zip.File
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		contentLength = req.ContentLength
+		body := &countingReader{r: req.Body}
+		req.Body = ioutil.NopCloser(body)
+		form, err := req.MultipartReader()
+		assert.Nil(t, err)
+		for {
+			part, err := form.NextPart()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			if part.FormName() != "zipfile" {
+				continue
+			}
+			zipped := filepath.Join(dir, "received.zip")
+			out, err := os.Create(zipped)
+			assert.Nil(t, err)
+			_, err = io.Copy(out, part)
+			assert.Nil(t, err)
+			assert.Nil(t, out.Close())
+			zr, err := zip.OpenReader(zipped)
+			assert.Nil(t, err)
+			uploaded = zr.File[0]
+			zr.Close()
+		}
+		received = body.n
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+	destURL, _ := url.Parse(ts.URL)
+
+	var console bytes.Buffer
+	assert.Nil(t, NewArtifacts(http.DefaultClient, &console).Upload(filepath.Join(dir, "large.bin"), "large.bin", destURL))
+	// the body length is known upfront from the zipped file and matches
+	// the bytes streamed to the server
+	assert.True(t, contentLength > 0, Sprintf("content length %v", contentLength))
+	assert.Equal(t, contentLength, received)
+	assert.Equal(t, "large.bin", uploaded.Name)
+	assert.Equal(t, uint64(size), uploaded.UncompressedSize64)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 func TestUploadDirectory1(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -275,6 +579,172 @@ func TestUploadDestIsWindowPathFormat(t *testing.T) {
 
 }
 
+func TestUploadToNestedDestAndDownloadBack(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("src/hello/4.txt", "libs/nested/", "false").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	_, err := os.Stat(goServer.ArtifactFile(buildId, "libs/nested/4.txt"))
+	assert.Nil(t, err)
+
+	srcPath := "libs/nested/4.txt"
+	goServer.SendBuild(AgentId, buildId, protocol.DownloadFileCommand(srcPath,
+		goServer.ArtifactUrl(buildId, srcPath), "downloaded/4.txt",
+		goServer.ChecksumUrl(buildId), "build.md5").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	md5, err := ComputeMd5(filepath.Join(wd, "downloaded/4.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, testFileContentMD5, md5)
+}
+
+func TestUploadAndDownloadWithSha256Checksum(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	GetConfig().ChecksumAlgorithm = protocol.ChecksumSha256
+	goServer.ChecksumAlgorithm = protocol.ChecksumSha256
+	defer func() {
+		GetConfig().ChecksumAlgorithm = protocol.ChecksumMd5
+		goServer.ChecksumAlgorithm = protocol.ChecksumMd5
+	}()
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("src/hello/4.txt", "libs", "false").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	checksums, err := goServer.ChecksumManifest(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(checksums))
+	expected, err := ComputeChecksum(filepath.Join(wd, "src/hello/4.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, expected.Sha256, checksums[0].Sha256)
+
+	srcPath := "libs/4.txt"
+	goServer.SendBuild(AgentId, buildId, protocol.DownloadFileCommand(srcPath,
+		goServer.ArtifactUrl(buildId, srcPath), "downloaded/4.txt",
+		goServer.ChecksumManifestUrl(buildId), "build.manifest").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(wd, "downloaded/4.txt"), []byte("changed"), 0644))
+	assert.Nil(t, ioutil.WriteFile(goServer.ArtifactFile(buildId, srcPath), []byte("tampered"), 0644))
+	goServer.SendBuild(AgentId, buildId, protocol.DownloadFileCommand(srcPath,
+		goServer.ArtifactUrl(buildId, srcPath), "downloaded/4.txt",
+		goServer.ChecksumManifestUrl(buildId), "build.manifest").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+}
+
+func TestUploadToDestContainingExportedVariable(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("COUNTER", "7", "false"),
+		protocol.UploadArtifactCommand("src/hello/4.txt", "reports/${COUNTER}", "false").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	_, err := os.Stat(goServer.ArtifactFile(buildId, "reports/7/4.txt"))
+	assert.Nil(t, err)
+}
+
+func TestSecureVariableIsMaskedInExpandedArtifactPath(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("TOKEN", "s3cret", "true"),
+		protocol.UploadArtifactCommand("nofile-${TOKEN}", "", "false").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	expected := Sprintf("setting environment variable 'TOKEN' to value '********'\nERROR: stat %v/nofile-********: no such file or directory\n", wd)
+	assert.Equal(t, expected, trimTimestamp(log))
+}
+
+func TestExpandedArtifactPathOutsideOfSandboxFailsBuild(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExportCommand("OUT", "../../../..", "false"),
+		protocol.DownloadFileCommand("libs/4.txt", goServer.ArtifactUrl(buildId, "libs/4.txt"), "${OUT}/4.txt",
+			goServer.ChecksumUrl(buildId), "build.md5").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(trimTimestamp(log),
+		"ERROR: Path ${OUT}/4.txt is outside the agent sandbox after expanding environment variables\n"), log)
+}
+
+func TestUploadAndDownloadArtifactsWithSpecialCharactersInNames(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	names := []string{"my report (1).html", "a+b.txt", "x&y=z.txt", "100%.txt", "报告.txt"}
+	for _, name := range names {
+		assert.Nil(t, writeFile(filepath.Join(wd, "outputs"), name, name))
+	}
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("outputs/*", "reports", "false").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	var commands []*protocol.BuildCommand
+	for _, name := range names {
+		srcPath := "reports/" + name
+		commands = append(commands, protocol.DownloadFileCommand(srcPath, goServer.ArtifactUrl(buildId, srcPath),
+			"downloaded/"+name, goServer.ChecksumUrl(buildId), "build.md5").Setwd(relativePath(wd)))
+	}
+	goServer.SendBuild(AgentId, buildId, commands...)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+	for _, name := range names {
+		content, err := ioutil.ReadFile(filepath.Join(wd, "downloaded", name))
+		assert.Nil(t, err)
+		assert.Equal(t, name, string(content))
+	}
+}
+
+func TestUploadArtifactRejectsDestOutsideOfArtifactsDir(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("src/hello/4.txt", "libs/../../console", "false").Setwd(relativePath(wd)))
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "ERROR: Artifact destination libs/../../console is outside of the artifacts directory\n", trimTimestamp(log))
+}
+
 func TestProcessMultipleUploadArtifactCommands(t *testing.T) {
 	setUp(t)
 	defer tearDown()
@@ -307,6 +777,53 @@ dest/world2/10.txt=41e43efb30d3fbfcea93542157809ac0
 	assert.Equal(t, checksum, filterComments(uploadedChecksum))
 }
 
+func TestUploadArtifactOnlyOnFailure(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.FailCommand("tests failed"),
+		protocol.UploadArtifactOnFailureCommand("src/hello/3.txt", "failure", "false").Setwd(relativePath(wd)),
+		protocol.UploadArtifactOnSuccessCommand("src/hello/4.txt", "success", "false").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, Sprintf("Uploading artifacts from %v/src/hello/3.txt to failure", wd)), log)
+	assert.True(t, contains(log, "Skip uploading artifacts from src/hello/4.txt, build is Failed"), log)
+	uploadedChecksum, err := goServer.Checksum(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "failure/3.txt=41e43efb30d3fbfcea93542157809ac0\n", filterComments(uploadedChecksum))
+}
+
+func TestUploadArtifactOnlyOnSuccess(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+
+	wd := createTestProjectInPipelineDir()
+	goServer.SendBuild(AgentId, buildId,
+		protocol.UploadArtifactOnFailureCommand("src/hello/3.txt", "failure", "false").Setwd(relativePath(wd)),
+		protocol.UploadArtifactOnSuccessCommand("src/hello/4.txt", "success", "false").Setwd(relativePath(wd)),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+	assert.True(t, contains(log, "Skip uploading artifacts from src/hello/3.txt, build is Passed"), log)
+	assert.True(t, contains(log, Sprintf("Uploading artifacts from %v/src/hello/4.txt to success", wd)), log)
+	uploadedChecksum, err := goServer.Checksum(buildId)
+	assert.Nil(t, err)
+	assert.Equal(t, "success/4.txt=41e43efb30d3fbfcea93542157809ac0\n", filterComments(uploadedChecksum))
+}
+
 func testUpload(t *testing.T, srcPath, destDir, checksum string, src2dest map[string]string) {
 	wd := createTestProjectInPipelineDir()
 	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand(srcPath, destDir, "false").Setwd(relativePath(wd)))
@@ -319,7 +836,8 @@ func testUpload(t *testing.T, srcPath, destDir, checksum string, src2dest map[st
 
 	uploadedChecksum, err := goServer.Checksum(buildId)
 	assert.Nil(t, err)
-	assert.Equal(t, checksum, filterComments(uploadedChecksum))
+	// files matched by wildcards are uploaded concurrently
+	assert.Equal(t, sortLines(checksum), sortLines(filterComments(uploadedChecksum)))
 
 	uploadedDir := goServer.ArtifactFile(buildId, "")
 	count := 0
@@ -383,6 +901,48 @@ func TestDownloadArtifactDir(t *testing.T) {
 	testDownload(t, wd, "artifacts/src/hello", "dest", []string{"dest/hello/3.txt", "dest/hello/4.txt"}, true)
 }
 
+func TestDownloadArtifactDirPreservesContentAndModes(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	files := map[string]os.FileMode{
+		"bin/run.sh":          0755,
+		"bin/data/random.bin": 0644,
+		"bin/data/readonly":   0444,
+	}
+	random := rand.New(rand.NewSource(1))
+	for name, mode := range files {
+		data := make([]byte, 64*1024)
+		random.Read(data)
+		path := filepath.Join(wd, name)
+		assert.Nil(t, Mkdirs(filepath.Dir(path)))
+		assert.Nil(t, ioutil.WriteFile(path, data, mode))
+		assert.Nil(t, os.Chmod(path, mode))
+	}
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("bin", "", "false").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	goServer.SendBuild(AgentId, buildId, protocol.DownloadDirCommand("bin",
+		goServer.ArtifactUrl(buildId, "bin"), "dest",
+		goServer.ChecksumUrl(buildId), "build.md5").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	for name, mode := range files {
+		expected, err := ioutil.ReadFile(filepath.Join(wd, name))
+		assert.Nil(t, err)
+		actual, err := ioutil.ReadFile(filepath.Join(wd, "dest", name))
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(expected, actual), name+" content should be the same")
+		info, err := os.Stat(filepath.Join(wd, "dest", name))
+		assert.Nil(t, err)
+		assert.Equal(t, mode, info.Mode().Perm())
+	}
+}
+
 func testDownload(t *testing.T, wd, srcPath, destDir string, destFiles []string, sourceIsDir bool) {
 	goServer.SendBuild(AgentId, buildId, protocol.UploadArtifactCommand("src", "artifacts", "false").Setwd(relativePath(wd)))
 	assert.Equal(t, "agent Building", stateLog.Next())
@@ -430,12 +990,24 @@ func assertConsoleLog(t *testing.T, wd string, src2dest map[string]string) {
 		expected[i] = Sprintf("Uploading artifacts from %v/%v to %v", wd, src, dest)
 		i++
 	}
-	actual := split(trimTimestamp(log), "\n")
+	var actual []string
+	for _, line := range split(trimTimestamp(log), "\n") {
+		// progress of uploading files matched by wildcards
+		if !startWith(line, "Uploaded ") {
+			actual = append(actual, line)
+		}
+	}
 	sort.Strings(expected)
 	sort.Strings(actual)
 	assert.Equal(t, Join("\n", expected...), Join("\n", actual...))
 }
 
+func sortLines(str string) string {
+	lines := split(str, "\n")
+	sort.Strings(lines)
+	return Join("\n", lines...)
+}
+
 func filterComments(str string) string {
 	var ret bytes.Buffer
 	for _, l := range split(str, "\n") {
@@ -447,3 +1019,64 @@ func filterComments(str string) string {
 	}
 	return ret.String()
 }
+
+func TestUploadDirAsArchiveAndDownloadBack(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	wd := createPipelineDir()
+	files := map[string]os.FileMode{
+		"node_modules/run.sh":          0755,
+		"node_modules/lib/index.js":    0644,
+		"node_modules/lib/readme.txt":  0444,
+		"node_modules/lib/a/b/deep.js": 0600,
+	}
+	for name, mode := range files {
+		path := filepath.Join(wd, name)
+		assert.Nil(t, Mkdirs(filepath.Dir(path)))
+		assert.Nil(t, ioutil.WriteFile(path, []byte("content of "+name), mode))
+		assert.Nil(t, os.Chmod(path, mode))
+	}
+	goServer.SendBuild(AgentId, buildId, protocol.UploadArchiveCommand("node_modules", "cache", "false").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	checksum, err := goServer.Checksum(buildId)
+	assert.Nil(t, err)
+	lines := split(filterComments(checksum), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.True(t, startWith(lines[0], "cache/node_modules.zip="))
+
+	goServer.SendBuild(AgentId, buildId, protocol.DownloadArchiveCommand("cache/node_modules.zip",
+		goServer.ArtifactUrl(buildId, "cache/node_modules.zip"), "dest",
+		goServer.ChecksumUrl(buildId), "build.md5").Setwd(relativePath(wd)))
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Passed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	for name, mode := range files {
+		actual, err := ioutil.ReadFile(filepath.Join(wd, "dest", name))
+		assert.Nil(t, err)
+		assert.Equal(t, "content of "+name, string(actual))
+		info, err := os.Stat(filepath.Join(wd, "dest", name))
+		assert.Nil(t, err)
+		assert.Equal(t, mode, info.Mode().Perm())
+	}
+}
+
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
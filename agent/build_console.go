@@ -18,10 +18,13 @@ package agent
 
 import (
 	"bytes"
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/gocd-contrib/gocd-golang-agent/stream"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -29,6 +32,7 @@ type BuildConsole struct {
 	Url        *url.URL
 	HttpClient *http.Client
 	buffer     *bytes.Buffer
+	offset     int64
 	stop       chan bool
 	closed     chan bool
 	write      chan []byte
@@ -82,22 +86,64 @@ func (console *BuildConsole) Write(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// Flush uploads the buffered console log at the offset the server has
+// acknowledged. Bytes are dropped from the buffer only once the server
+// acknowledges them, so that a failed upload is resumed by the next
+// flush without duplicating or losing bytes.
 func (console *BuildConsole) Flush() {
 	if console.buffer.Len() == 0 {
 		return
 	}
 	LogDebug("ConsoleLog: \n%v", console.buffer.String())
 
+	_, err := retry(LogInfo, "Upload console log", func(attempt int) (int, error) {
+		return console.upload()
+	})
+	if err != nil {
+		logger.Error.Printf("build console flush failed, %v bytes are kept for next flush: %v", console.buffer.Len(), err)
+	}
+}
+
+func (console *BuildConsole) upload() (int, error) {
+	data := console.buffer.Bytes()
+	u := *console.Url
+	query := u.Query()
+	query.Set(protocol.ConsoleOffsetParam, strconv.FormatInt(console.offset, 10))
+	u.RawQuery = query.Encode()
 	req := http.Request{
 		Method:        http.MethodPut,
-		URL:           console.Url,
-		Body:          ioutil.NopCloser(console.buffer),
-		ContentLength: int64(console.buffer.Len()),
+		URL:           &u,
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
 		Close:         true,
 	}
-	_, err := console.HttpClient.Do(&req)
+	resp, err := console.HttpClient.Do(&req)
 	if err != nil {
-		logger.Error.Printf("build console flush failed: %v", err)
+		return 0, err
+	}
+	resp.Body.Close()
+	received, err := strconv.ParseInt(resp.Header.Get(protocol.ConsoleOffsetHeader), 10, 64)
+	if err == nil {
+		console.acknowledge(received)
+	} else if resp.StatusCode < 300 {
+		// server does not track console offset
+		console.acknowledge(console.offset + int64(len(data)))
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return resp.StatusCode, fmt.Errorf("server received console log up to offset %v", console.offset)
+	}
+	return resp.StatusCode, nil
+}
+
+// acknowledge drops bytes the server received up to offset from the
+// buffer.
+func (console *BuildConsole) acknowledge(offset int64) {
+	if offset < console.offset {
+		logger.Error.Printf("server lost console log from offset %v to %v", offset, console.offset)
+	} else if n := offset - console.offset; n < int64(console.buffer.Len()) {
+		console.buffer.Next(int(n))
+	} else {
+		console.buffer.Reset()
 	}
-	console.buffer.Reset()
+	console.offset = offset
 }
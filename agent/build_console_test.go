@@ -0,0 +1,79 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBuildConsoleResumesDroppedUploadWithoutDuplicates(t *testing.T) {
+	RetryBaseDelay = time.Millisecond
+	defer func() { RetryBaseDelay = time.Second }()
+
+	var mu sync.Mutex
+	var received []byte
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		data, _ := ioutil.ReadAll(req.Body)
+		offset, err := strconv.Atoi(req.URL.Query().Get(protocol.ConsoleOffsetParam))
+		assert.Nil(t, err)
+		if offset > len(received) {
+			w.Header().Set(protocol.ConsoleOffsetHeader, strconv.Itoa(len(received)))
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if end := offset + len(data); end > len(received) {
+			received = append(received, data[len(received)-offset:]...)
+		}
+		if requests == 1 {
+			// drop the connection after the bytes are received
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set(protocol.ConsoleOffsetHeader, strconv.Itoa(len(received)))
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	console := MakeBuildConsole(http.DefaultClient, u)
+	console.Write([]byte("hello\n"))
+	console.Write([]byte("world\n"))
+	assert.Nil(t, console.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, requests)
+	lines := split(strings.TrimSpace(string(received)), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.True(t, contains(lines[0], "hello"), lines[0])
+	assert.True(t, contains(lines[1], "world"), lines[1])
+}
@@ -0,0 +1,34 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+)
+
+// resumedCommand returns the build command without the top level
+// commands before ResumeIndex, or a fail command when the build does
+// not have that many commands.
+func (s *BuildSession) resumedCommand() *protocol.BuildCommand {
+	commands := s.command.SubCommands
+	if s.ResumeIndex >= len(commands) {
+		return protocol.FailCommand(Sprintf("Can not resume build from command %v, it has %v commands", s.ResumeIndex+1, len(commands)))
+	}
+	s.ConsoleLog("Resuming build from command %v of %v\n", s.ResumeIndex+1, len(commands))
+	resumed := *s.command
+	resumed.SubCommands = commands[s.ResumeIndex:]
+	return &resumed
+}
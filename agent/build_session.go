@@ -24,13 +24,19 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	DefaultSecretMask           = "********"
 	DefaultCancelCommandTimeout = 25 * time.Second
+	DefaultUploadConcurrency    = 4
+
+	// ConsoleTimestampFormat is RFC3339 with milliseconds.
+	ConsoleTimestampFormat = "2006-01-02T15:04:05.000Z07:00"
 )
 
 var (
@@ -62,12 +68,106 @@ func Executors() map[string]Executor {
 		protocol.CommandFail:                CommandFail,
 		protocol.CommandGenerateTestReport:  CommandGenerateTestReport,
 		protocol.CommandGenerateProperty:    NotImplemented,
+		protocol.CommandDumpEnv:             CommandDumpEnv,
+		protocol.CommandWriteFile:           CommandWriteFile,
+		protocol.CommandScript:              CommandScript,
+		protocol.CommandWaitFor:             CommandWaitFor,
+	}
+}
+
+// dryRunCommands are executed in dry run mode, they only change the
+// session state or print to console.
+var dryRunCommands = map[string]bool{
+	protocol.CommandExport:  true,
+	protocol.CommandEcho:    true,
+	protocol.CommandSecret:  true,
+	protocol.CommandCompose: true,
+	protocol.CommandCond:    true,
+	protocol.CommandAnd:     true,
+	protocol.CommandOr:      true,
+	protocol.CommandDumpEnv: true,
+}
+
+// buildHooks are the callbacks registered on a build session, they are
+// shared with the sessions of its on cancel commands.
+type buildHooks struct {
+	console      []func([]byte)
+	commandStart []func(string)
+	result       []func(string)
+}
+
+// hookedConsole calls console hooks with the output before writing it
+// to the console, prefixing each line with timestamps when they are set.
+type hookedConsole struct {
+	io.WriteCloser
+	hooks      *buildHooks
+	mu         sync.Mutex
+	timestamps *stream.PrefixWriter
+}
+
+func (c *hookedConsole) Write(p []byte) (int, error) {
+	for _, fn := range c.hooks.console {
+		fn(p)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timestamps != nil {
+		return c.timestamps.Write(p)
 	}
+	return c.WriteCloser.Write(p)
+}
+
+func consoleTimestamp() []byte {
+	return []byte(time.Now().Format(ConsoleTimestampFormat + " "))
 }
 
 type BuildSession struct {
+	// DryRun logs commands with side effects to console instead of
+	// executing them, and all tests pass.
+	DryRun bool
+	// UploadConcurrency is the max number of files uploaded at the
+	// same time for an artifact source with wildcards.
+	UploadConcurrency int
+	// UploadChunkSize is the size of the chunks files larger than it
+	// are uploaded in, zero means files are uploaded in one request.
+	UploadChunkSize int64
+	// BuildSummary uploads the build result, which is always sent to
+	// the server, as protocol.BuildSummaryPath artifact when the build
+	// ends.
+	BuildSummary bool
+	// TimestampConsole prefixes each console line with the time it is
+	// written in ConsoleTimestampFormat, after secrets are masked. The
+	// BuildConsole of agents prefixes timestamps already.
+	TimestampConsole bool
+	// StrictEnvExpansion fails commands referencing undefined
+	// environment variables in their args, see expandEnv.
+	StrictEnvExpansion bool
+	// Timeout cancels the build and fails it when it runs longer, zero
+	// means no limit.
+	Timeout time.Duration
+	// State is the agent state reported with build status reports.
+	State *AgentState
+	// ExecAllowlist and ExecDenylist are glob patterns of executables
+	// exec commands may or may not run, see checkExec.
+	ExecAllowlist []string
+	ExecDenylist  []string
+	// CommandAllowlist and CommandDenylist are names of build commands
+	// the agent may or may not run, see checkCommand.
+	CommandAllowlist []string
+	CommandDenylist  []string
+	// ExecShell is the shell command line, e.g. ["bash", "-c"], running
+	// exec commands flagged as shell form, see execShell.
+	ExecShell []string
+	// ResumeIndex is the top level build command the build starts
+	// from, the commands before it are skipped.
+	ResumeIndex int
+	// PropertyBaseURL is where build properties, e.g. the counts of
+	// generated test reports, are defined; nil means they are not sent.
+	PropertyBaseURL *url.URL
+
 	send                  chan *protocol.Message
 	console               io.WriteCloser
+	summary               *buildSummary
 	artifacts             *Artifacts
 	command               *protocol.BuildCommand
 	artifactUploadBaseURL *url.URL
@@ -85,6 +185,12 @@ type BuildSession struct {
 	wd      string
 
 	executors map[string]Executor
+
+	closeMu  sync.Mutex
+	timedOut bool
+
+	hooks       *buildHooks
+	secureFiles *secureFiles
 }
 
 func MakeBuildSession(buildId string,
@@ -95,6 +201,8 @@ func MakeBuildSession(buildId string,
 	send chan *protocol.Message,
 	rootDir string) *BuildSession {
 
+	hooks := &buildHooks{}
+	console = &hookedConsole{WriteCloser: console, hooks: hooks}
 	secrets := stream.NewSubstituteWriter(console)
 	return &BuildSession{
 		buildId:               buildId,
@@ -111,13 +219,54 @@ func MakeBuildSession(buildId string,
 		echo:                  stream.NewSubstituteWriter(secrets),
 		rootDir:               rootDir,
 		executors:             Executors(),
+		State:                 NewAgentState(),
+		hooks:                 hooks,
+		secureFiles:           &secureFiles{},
 	}
 }
 
+// OnConsole registers fn to be called with the console output of the
+// build, secrets are masked. fn must not retain the bytes.
+func (s *BuildSession) OnConsole(fn func([]byte)) {
+	s.hooks.console = append(s.hooks.console, fn)
+}
+
+// OnCommandStart registers fn to be called with the name of each build
+// command before it is processed.
+func (s *BuildSession) OnCommandStart(fn func(name string)) {
+	s.hooks.commandStart = append(s.hooks.commandStart, fn)
+}
+
+// OnResult registers fn to be called with the build status when the
+// build is completed.
+func (s *BuildSession) OnResult(fn func(buildStatus string)) {
+	s.hooks.result = append(s.hooks.result, fn)
+}
+
 func (s *BuildSession) Close() error {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
 	return closeAndWait(s.cancel, s.done, CancelBuildTimeout)
 }
 
+func (s *BuildSession) timeout() {
+	s.closeMu.Lock()
+	if isClosedChan(s.done) {
+		s.closeMu.Unlock()
+		return
+	}
+	s.timedOut = true
+	s.closeMu.Unlock()
+	LogInfo("build timed out after %v, canceling", s.Timeout)
+	s.Close()
+}
+
+func (s *BuildSession) isTimedOut() bool {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	return s.timedOut
+}
+
 func (s *BuildSession) isCanceled() bool {
 	if s.buildStatus == protocol.BuildCanceled {
 		return true
@@ -131,12 +280,36 @@ func (s *BuildSession) isCanceled() bool {
 }
 
 func (s *BuildSession) Run() error {
+	s.summary = newBuildSummary()
+	if console, ok := s.console.(*hookedConsole); ok && s.TimestampConsole {
+		console.timestamps = stream.NewPrefixWriter(console.WriteCloser, consoleTimestamp)
+	}
 	defer func() {
+		if s.isTimedOut() {
+			s.buildStatus = protocol.BuildFailed
+			s.ConsoleLog("ERROR: build timed out after %v\n", s.Timeout)
+		}
+		s.shredSecureFiles()
+		result := s.summary.build(s.buildId, s.buildStatus)
+		if s.BuildSummary && s.artifacts != nil {
+			s.uploadSummary(result)
+		}
 		s.console.Close()
+		for _, fn := range s.hooks.result {
+			fn(s.buildStatus)
+		}
+		s.send <- protocol.BuildResultMessage(result)
 		s.send <- protocol.CompletedMessage(s.Report(""))
 		LogInfo("Build completed")
 	}()
+	if s.Timeout > 0 {
+		timer := time.AfterFunc(s.Timeout, s.timeout)
+		defer timer.Stop()
+	}
 	LogInfo("Build started, root directory: %v", s.rootDir)
+	if s.ResumeIndex > 0 {
+		s.command = s.resumedCommand()
+	}
 	return s.ProcessCommand()
 }
 
@@ -165,7 +338,17 @@ func (s *BuildSession) process(cmd *protocol.BuildCommand) (err error) {
 	if s.testFailed(cmd.Test) {
 		return nil
 	}
+	if s.hooks != nil {
+		for _, fn := range s.hooks.commandStart {
+			fn(cmd.Name)
+		}
+	}
 
+	summarized := s.summary != nil && len(cmd.SubCommands) == 0
+	var summaryIndex int
+	if summarized {
+		summaryIndex = s.summary.commandStarted(cmd)
+	}
 	err = s.doProcess(cmd)
 	if s.isCanceled() {
 		LogInfo("build canceled")
@@ -176,19 +359,35 @@ func (s *BuildSession) process(cmd *protocol.BuildCommand) (err error) {
 		LogInfo(errMsg)
 		s.ConsoleLog(errMsg)
 	}
+	if summarized {
+		s.summary.commandCompleted(summaryIndex, commandResult(s.isCanceled(), err))
+	}
 
 	return
 }
 
+func commandResult(canceled bool, err error) string {
+	if canceled {
+		return protocol.BuildCanceled
+	} else if err != nil {
+		return protocol.BuildFailed
+	}
+	return protocol.BuildPassed
+}
+
 func (s *BuildSession) doProcess(cmd *protocol.BuildCommand) error {
+	cmd, err := s.expandEnv(cmd)
+	if err != nil {
+		return err
+	}
 	s.wd = filepath.Clean(filepath.Join(s.rootDir, cmd.WorkingDirectory))
 	s.debugLog("set wd to %v", s.wd)
 
-	if !strings.HasPrefix(s.wd, s.rootDir) {
+	if !IsSubPath(s.wd, s.rootDir) {
 		return Err("Working directory[%v] is outside the agent sandbox.", s.wd)
 	}
-	_, err := os.Stat(s.wd)
-	if err != nil {
+	_, err = os.Stat(s.wd)
+	if err != nil && !s.DryRun {
 		if os.IsNotExist(err) {
 			return Err("Working directory \"%v\" is not a directory", s.wd)
 		} else {
@@ -196,14 +395,38 @@ func (s *BuildSession) doProcess(cmd *protocol.BuildCommand) error {
 		}
 	}
 
+	if err := s.checkCommand(cmd.Name); err != nil {
+		return err
+	}
 	exec := s.executors[cmd.Name]
 	if exec == nil {
 		return Err("Unknown build command: %v", cmd.Name)
+	} else if s.DryRun && !dryRunCommands[cmd.Name] {
+		s.dryRunLog(cmd)
+		return nil
 	} else {
 		return exec(s, cmd)
 	}
 }
 
+func (s *BuildSession) dryRunLog(cmd *protocol.BuildCommand) {
+	args := make([]string, 0, len(cmd.Args))
+	for name, value := range cmd.Args {
+		if name == "content" && cmd.Args["secure"] == "true" {
+			value = DefaultSecretMask
+		}
+		args = append(args, name+"="+value)
+	}
+	sort.Strings(args)
+	envs := make([]string, 0, len(s.envs))
+	for name, value := range s.envs {
+		envs = append(envs, name+"="+value)
+	}
+	sort.Strings(envs)
+	s.secrets.Write([]byte(Sprintf("[dry-run] %v %v\n  wd: %v\n  env: %v\n",
+		cmd.Name, strings.Join(args, " "), s.wd, strings.Join(envs, " "))))
+}
+
 func (s *BuildSession) testFailed(test *protocol.BuildCommand) bool {
 	if test == nil {
 		return false
@@ -228,6 +451,18 @@ func (s *BuildSession) onCancel(cmd *protocol.BuildCommand) {
 		return
 	}
 	cancel := &BuildSession{
+		DryRun:                s.DryRun,
+		UploadConcurrency:     s.UploadConcurrency,
+		UploadChunkSize:       s.UploadChunkSize,
+		State:                 s.State,
+		ExecAllowlist:         s.ExecAllowlist,
+		ExecDenylist:          s.ExecDenylist,
+		CommandAllowlist:      s.CommandAllowlist,
+		CommandDenylist:       s.CommandDenylist,
+		ExecShell:             s.ExecShell,
+		PropertyBaseURL:       s.PropertyBaseURL,
+		hooks:                 s.hooks,
+		secureFiles:           s.secureFiles,
 		buildId:               s.buildId,
 		console:               s.console,
 		artifacts:             s.artifacts,
@@ -256,7 +491,18 @@ func (s *BuildSession) onCancel(cmd *protocol.BuildCommand) {
 
 func (s *BuildSession) processTestCommand(cmd *protocol.BuildCommand) (bytes.Buffer, error) {
 	var output bytes.Buffer
+	if s.DryRun {
+		return output, nil
+	}
 	session := &BuildSession{
+		State:                 s.State,
+		ExecAllowlist:         s.ExecAllowlist,
+		ExecDenylist:          s.ExecDenylist,
+		CommandAllowlist:      s.CommandAllowlist,
+		CommandDenylist:       s.CommandDenylist,
+		ExecShell:             s.ExecShell,
+		PropertyBaseURL:       s.PropertyBaseURL,
+		secureFiles:           s.secureFiles,
 		buildId:               s.buildId,
 		artifacts:             s.artifacts,
 		artifactUploadBaseURL: s.artifactUploadBaseURL,
@@ -279,15 +525,60 @@ func (s *BuildSession) processTestCommand(cmd *protocol.BuildCommand) (bytes.Buf
 
 func (s *BuildSession) Report(jobState string) *protocol.Report {
 	return &protocol.Report{
-		AgentRuntimeInfo: GetAgentRuntimeInfo(),
+		AgentRuntimeInfo: s.State.RuntimeInfo(),
 		BuildId:          s.buildId,
 		JobState:         jobState,
 		Result:           s.buildStatus,
 	}
 }
 
+func (s *BuildSession) reportExecResult(command string, exitCode int, signal string) {
+	if s.summary != nil {
+		s.summary.execCompleted(exitCode, signal)
+	}
+	s.send <- protocol.ExecResultMessage(&protocol.ExecResult{
+		BuildId:  s.buildId,
+		Command:  command,
+		ExitCode: exitCode,
+		Signal:   signal,
+	})
+}
+
+// ConsoleLog writes to the build console with secrets masked.
 func (s *BuildSession) ConsoleLog(format string, a ...interface{}) {
-	s.console.Write([]byte(Sprintf(format, a...)))
+	s.secrets.Write([]byte(Sprintf(format, a...)))
+}
+
+func (s *BuildSession) AddEnv(env map[string]string) {
+	for name, value := range env {
+		s.envs[name] = value
+	}
+}
+
+func (s *BuildSession) AddSecureEnv(env map[string]string) {
+	for name, value := range env {
+		s.envs[name] = value
+		if value != "" {
+			s.secrets.Substitutions[value] = DefaultSecretMask
+		}
+	}
+}
+
+// MaskSecrets masks the values of secrets in the console output.
+func (s *BuildSession) MaskSecrets(secrets map[string]string) {
+	for _, value := range secrets {
+		if value != "" {
+			s.secrets.Substitutions[value] = DefaultSecretMask
+		}
+	}
+}
+
+func (s *BuildSession) environ() []string {
+	env := os.Environ()
+	for name, value := range s.envs {
+		env = append(env, name+"="+value)
+	}
+	return env
 }
 
 func (s *BuildSession) ReplaceEcho(name string, value interface{}) {
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// buildSummary records the commands processed by a build session,
+// durations are measured by the monotonic clock readings of time.Now.
+type buildSummary struct {
+	mu       sync.Mutex
+	start    time.Time
+	commands []*protocol.CommandResult
+	starts   []time.Time
+}
+
+func newBuildSummary() *buildSummary {
+	return &buildSummary{start: time.Now()}
+}
+
+// commandStarted records cmd and returns its index, which is passed to
+// commandCompleted with the result of the command.
+func (b *buildSummary) commandStarted(cmd *protocol.BuildCommand) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result := &protocol.CommandResult{Name: cmd.Name}
+	if cmd.Name == protocol.CommandExec {
+		result.Command = cmd.Args["command"]
+	}
+	b.commands = append(b.commands, result)
+	b.starts = append(b.starts, time.Now())
+	return len(b.commands) - 1
+}
+
+func (b *buildSummary) commandCompleted(i int, result string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.commands[i].Result = result
+	b.commands[i].DurationMs = durationMs(time.Since(b.starts[i]))
+}
+
+// execCompleted records the exit code of the last started command,
+// which is the exec command reporting it.
+func (b *buildSummary) execCompleted(exitCode int, signal string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.commands) == 0 {
+		return
+	}
+	last := b.commands[len(b.commands)-1]
+	last.ExitCode = &exitCode
+	last.Signal = signal
+}
+
+// uploaded adds n to the bytes uploaded by the last started command,
+// files matching an artifact source with wildcards are uploaded
+// concurrently.
+func (b *buildSummary) uploaded(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.commands) == 0 {
+		return
+	}
+	b.commands[len(b.commands)-1].BytesUploaded += n
+}
+
+func (b *buildSummary) build(buildId, result string) *protocol.BuildResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &protocol.BuildResult{
+		BuildId:    buildId,
+		Result:     result,
+		DurationMs: durationMs(time.Since(b.start)),
+		Commands:   b.commands,
+	}
+}
+
+func durationMs(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// uploadSummary uploads the build result as protocol.BuildSummaryPath
+// artifact, a failed upload is warned in console and does not change
+// the build result.
+func (s *BuildSession) uploadSummary(result *protocol.BuildResult) {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		s.warn("Failed to generate build summary: %v", err)
+		return
+	}
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		s.warn("Failed to generate build summary: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, path.Base(protocol.BuildSummaryPath))
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		s.warn("Failed to generate build summary: %v", err)
+		return
+	}
+	destURL := AppendUrlParam(AppendUrlPath(s.artifactUploadBaseURL, path.Dir(protocol.BuildSummaryPath)),
+		"buildId", s.buildId)
+	if err := s.artifacts.Upload(file, protocol.BuildSummaryPath, destURL); err != nil {
+		s.warn("Failed to upload build summary: %v", err)
+	}
+}
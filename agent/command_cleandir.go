@@ -44,12 +44,12 @@ func Cleandir(log io.Writer, root string, allows ...string) error {
 		if allows[i] == root {
 			return nil
 		}
-		if strings.HasPrefix(root, allows[i]) {
+		if IsSubPath(root, allows[i]) {
 			return Err("Cannot clean directory. Folder %v is outside the base folder %v", allows[i], root)
 		}
 	}
 	w := stream.NewSubstituteWriter(log)
-	w.Substitutions[" "+root+"/"] = " "
+	w.Substitutions[" "+root+string(filepath.Separator)] = " "
 	return cleandir(w, root, allows...)
 }
 
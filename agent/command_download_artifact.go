@@ -37,6 +37,13 @@ func CommandDownloadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error
 		return err
 	}
 	srcPath := cmd.Args["src"]
+	if archive := cmd.Args["archive"]; archive == protocol.ArchiveZip {
+		absDestDir := filepath.Join(s.wd, cmd.Args["dest"])
+		s.debugLog("download archive %v to %v", srcURL, absDestDir)
+		return s.artifacts.DownloadArchive(srcURL, srcPath, absDestDir, absChecksumFile)
+	} else if archive != "" {
+		return Err("Unsupported artifact archive format: %v", archive)
+	}
 	absDestPath := filepath.Join(s.wd, cmd.Args["dest"])
 	if cmd.Name == protocol.CommandDownloadDir {
 		_, fname := filepath.Split(srcPath)
@@ -0,0 +1,36 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"sort"
+)
+
+// CommandDumpEnv prints the session environment variables sorted by
+// name, secret values are masked.
+func CommandDumpEnv(s *BuildSession, cmd *protocol.BuildCommand) error {
+	names := make([]string, 0, len(s.envs))
+	for name := range s.envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.secrets.Write([]byte(Sprintf("%v=%v\n", name, s.envs[name])))
+	}
+	return nil
+}
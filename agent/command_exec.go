@@ -17,35 +17,86 @@
 package agent
 
 import (
+	"bytes"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
 	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
 )
 
 func CommandExec(s *BuildSession, cmd *protocol.BuildCommand) error {
+	command := cmd.Args["command"]
 	args, err := cmd.ListArg("args")
 	if err != nil {
 		return err
 	}
-	execCmd := exec.Command(cmd.Args["command"], args...)
+	if cmd.Args["shell"] == "true" {
+		if len(args) > 0 {
+			return Err("exec in shell form takes the whole command line as command, args %v are not supported", args)
+		}
+		shell := s.execShell()
+		command, args = shell[0], append(shell[1:len(shell):len(shell)], command)
+	}
+	if err := s.checkExec(command); err != nil {
+		return err
+	}
+	execCmd := exec.Command(command, args...)
+	var output bytes.Buffer
 	execCmd.Stdout = s.secrets
+	if cmd.Args["property"] != "" {
+		execCmd.Stdout = io.MultiWriter(s.secrets, &output)
+	}
 	execCmd.Stderr = s.secrets
 	execCmd.Dir = s.wd
+	execCmd.Env = s.environ()
+	startProcessGroup(execCmd)
+	// the process is started before waiting in another goroutine, so that
+	// cancel sees execCmd.Process
+	if err := execCmd.Start(); err != nil {
+		return err
+	}
 	done := make(chan error)
 	go func() {
-		done <- execCmd.Run()
+		done <- execCmd.Wait()
 	}()
 
 	select {
 	case <-s.cancel:
 		s.debugLog("received cancel signal")
-		LogInfo("kill process(%v) %v", execCmd.Process, cmd.Args)
-		if err := execCmd.Process.Kill(); err != nil {
+		LogInfo("kill process(%v) %v", execCmd.Process.Pid, cmd.Args)
+		if err := killProcessTree(execCmd); err != nil {
 			s.ConsoleLog("Kill command %v failed, error: %v\n", cmd.Args, err)
 		} else {
-			LogInfo("process %v is killed", execCmd.Process)
+			LogInfo("process %v is killed", execCmd.Process.Pid)
+			s.reportExecResult(cmd.Args["command"], -1, "killed")
 		}
 		return Err("%v is canceled", cmd.Args)
 	case err := <-done:
+		if state := execCmd.ProcessState; state != nil {
+			status := state.Sys().(syscall.WaitStatus)
+			if status.Signaled() {
+				s.reportExecResult(cmd.Args["command"], -1, status.Signal().String())
+			} else {
+				s.reportExecResult(cmd.Args["command"], status.ExitStatus(), "")
+			}
+		}
+		if name := cmd.Args["property"]; err == nil && name != "" && s.PropertyBaseURL != nil {
+			return s.artifacts.SetProperty(s.PropertyBaseURL, name, strings.TrimSpace(output.String()))
+		}
 		return err
 	}
 }
+
+// execShell returns ExecShell, or the default shell of the agent
+// operating system when it is empty.
+func (s *BuildSession) execShell() []string {
+	if len(s.ExecShell) > 0 {
+		return s.ExecShell
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"cmd", "/C"}
+	}
+	return []string{"/bin/sh", "-c"}
+}
@@ -33,6 +33,9 @@ func CommandExport(s *BuildSession, cmd *protocol.BuildCommand) error {
 	displayValue := value
 	if secure == "true" {
 		displayValue = DefaultSecretMask
+		if value != "" {
+			s.secrets.Substitutions[value] = DefaultSecretMask
+		}
 	}
 	_, override := s.envs[name]
 	if override || os.Getenv(name) != "" {
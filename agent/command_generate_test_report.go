@@ -17,20 +17,31 @@
 package agent
 
 import (
-	"github.com/bmatcuk/doublestar"
+	"encoding/xml"
 	"github.com/gocd-contrib/gocd-golang-agent/junit"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"html/template"
 	"os"
 	"path/filepath"
-	"sort"
-	"strings"
+	"strconv"
 	"github.com/gocd-contrib/gocd-golang-agent/nunit"
 )
 
+// Build properties the counts of generated test reports are defined as.
+const (
+	TestsTotalCountProperty    = "tests_total_count"
+	TestsFailedCountProperty   = "tests_failed_count"
+	TestsErrorCountProperty    = "tests_error_count"
+	TestsIgnoredCountProperty  = "tests_ignored_count"
+	TestsTotalDurationProperty = "tests_total_duration"
+)
+
+// UnitTestReport is the summary of test reports, Failures counts both
+// failed tests and tests with errors, which are counted by Errors too.
 type UnitTestReport struct {
 	Tests     int
 	Failures  int
+	Errors    int
 	Skipped   int
 	Time      float64
 	TestCases []*TestCase
@@ -38,6 +49,7 @@ type UnitTestReport struct {
 
 type TestCase struct {
 	Name    string
+	Time    float64
 	Failure *Failure
 	Error   *Error
 }
@@ -57,6 +69,7 @@ type Error struct {
 func (r *UnitTestReport) Merge(another *UnitTestReport) {
 	r.Tests += another.Tests
 	r.Failures += another.Failures
+	r.Errors += another.Errors
 	r.Skipped += another.Skipped
 	r.Time += another.Time
 	r.TestCases = append(r.TestCases, another.TestCases...)
@@ -87,7 +100,29 @@ func CommandGenerateTestReport(s *BuildSession, cmd *protocol.BuildCommand) erro
 
 	report.Merge(nUnitRep)
 
-	return uploadUnitTestReportArtifacts(s, uploadPath, report)
+	if err := uploadUnitTestReportArtifacts(s, uploadPath, report); err != nil {
+		return err
+	}
+	return setUnitTestReportProperties(s, report)
+}
+
+func setUnitTestReportProperties(s *BuildSession, report *UnitTestReport) error {
+	if s.PropertyBaseURL == nil {
+		return nil
+	}
+	properties := []struct{ name, value string }{
+		{TestsTotalCountProperty, strconv.Itoa(report.Tests)},
+		{TestsFailedCountProperty, strconv.Itoa(report.Failures)},
+		{TestsErrorCountProperty, strconv.Itoa(report.Errors)},
+		{TestsIgnoredCountProperty, strconv.Itoa(report.Skipped)},
+		{TestsTotalDurationProperty, strconv.FormatFloat(report.Time, 'f', 3, 64)},
+	}
+	for _, p := range properties {
+		if err := s.artifacts.SetProperty(s.PropertyBaseURL, p.name, p.value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func uploadUnitTestReportArtifacts(s *BuildSession, uploadPath string, req *UnitTestReport) error {
@@ -116,7 +151,7 @@ func uploadUnitTestReportArtifacts(s *BuildSession, uploadPath string, req *Unit
 	if err != nil {
 		return err
 	}
-	return uploadArtifacts(s, file.Name(), uploadPath, false)
+	return uploadArtifacts(s, file.Name(), uploadPath, false, false)
 }
 
 func generateUnitTestReportFromNunitReport(s *BuildSession, srcs []string) (report *UnitTestReport, err error) {
@@ -126,12 +161,11 @@ func generateUnitTestReportFromNunitReport(s *BuildSession, srcs []string) (repo
 
 	for _, src := range srcs {
 		path := filepath.Join(s.wd, src)
-		if strings.Contains(path, "*") {
-			matches, err1 := doublestar.Glob(path)
+		if HasWildcard(path) {
+			matches, err1 := Glob(path, s.rootDir)
 			if err1 != nil {
 				err = err1
 			}
-			sort.Strings(matches)
 			for _, fpath := range matches {
 				generateNUnitTestReport(s, results, fpath)
 			}
@@ -145,6 +179,7 @@ func generateUnitTestReportFromNunitReport(s *BuildSession, srcs []string) (repo
 	report.Tests = results.Total
 	report.Skipped = results.Skipped
 	report.Failures = results.Failures + results.Errors
+	report.Errors = results.Errors
 	report.Time = results.Time
 
 	report.TestCases = mapNunitTestCaseToTemplate(results.TestCases)
@@ -159,12 +194,11 @@ func generateUnitTestReportFromJunitReport(s *BuildSession, srcs []string) (repo
 
 	for _, src := range srcs {
 		path := filepath.Join(s.wd, src)
-		if strings.Contains(path, "*") {
-			matches, err1 := doublestar.Glob(path)
+		if HasWildcard(path) {
+			matches, err1 := Glob(path, s.rootDir)
 			if err1 != nil {
 				err = err1
 			}
-			sort.Strings(matches)
 			for _, fpath := range matches {
 				generateJunitTestReport(s, suite, fpath)
 			}
@@ -178,6 +212,7 @@ func generateUnitTestReportFromJunitReport(s *BuildSession, srcs []string) (repo
 	report.Tests = suite.Tests
 	report.Skipped = suite.Skipped
 	report.Failures = suite.Failures + suite.Errors
+	report.Errors = suite.Errors
 	report.TestCases = mapJunitTestCaseToTemplate(suite.TestCases)
 	report.Time = suite.Time
 
@@ -195,7 +230,10 @@ func generateNUnitTestReport(s *BuildSession, result *nunit.TestResults, path st
 
 func generateJunitTestReport(s *BuildSession, result *junit.TestSuite, path string) {
 	err := junit.GenerateJunitTestReport(result, path)
-	if err != nil {
+	if _, ok := err.(*xml.SyntaxError); ok {
+		s.ConsoleLog("Ignoring malformed test report %v: %v\n", path, err)
+		return
+	} else if err != nil {
 		s.debugLog("ignore %v for error: %v", path, err)
 		return
 	}
@@ -206,6 +244,7 @@ func mapJunitTestCaseToTemplate(testCases []*junit.TestCase) (results []*TestCas
 	for _, item := range testCases {
 		t := new(TestCase)
 		t.Name = item.Name
+		t.Time = item.Time
 		if item.Failure != nil {
 			t.Failure = new(Failure)
 			t.Failure.StackTrace = item.Failure.StackTrace
@@ -223,6 +262,7 @@ func mapNunitTestCaseToTemplate(testCases []*nunit.TestCase) (results []*TestCas
 	for _, item := range testCases {
 		t := new(TestCase)
 		t.Name = item.Name
+		t.Time = item.Time
 		if item.Failure != nil {
 			t.Failure = new(Failure)
 			t.Failure.StackTrace = item.Failure.StackTrace.Content
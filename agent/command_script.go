@@ -0,0 +1,75 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// CommandScript writes the script body to a temp file in the sandbox and
+// executes it by the shell as an exec command, so that it is checked
+// by the exec allowlist and can be canceled. The temp file is removed
+// after the script exits.
+func CommandScript(s *BuildSession, cmd *protocol.BuildCommand) error {
+	shell := cmd.Args["shell"]
+	if shell == "" {
+		shell = "sh"
+		if runtime.GOOS == "windows" {
+			shell = "cmd"
+		}
+	}
+	ext, args, err := scriptShell(shell)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.rootDir, ".script-*"+ext)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(cmd.Args["body"])
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	script, err := filepath.Abs(f.Name())
+	if err != nil {
+		return err
+	}
+	s.debugLog("run script %v by %v", script, shell)
+	return CommandExec(s, protocol.ExecCommand(append(args, script)...))
+}
+
+// scriptShell returns the script file extension and the command line,
+// without the script file, of the shell.
+func scriptShell(shell string) (string, []string, error) {
+	switch shell {
+	case "sh", "bash":
+		return ".sh", []string{shell}, nil
+	case "cmd":
+		return ".cmd", []string{"cmd", "/c"}, nil
+	case "powershell":
+		return ".ps1", []string{"powershell", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File"}, nil
+	}
+	return "", nil, Err("Unknown script shell %v, it should be one of sh, bash, cmd and powershell", shell)
+}
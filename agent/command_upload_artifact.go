@@ -17,41 +17,62 @@
 package agent
 
 import (
-	"github.com/bmatcuk/doublestar"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
+	"sync"
 )
 
 func CommandUploadArtifact(s *BuildSession, cmd *protocol.BuildCommand) error {
 	src := cmd.Args["src"]
-	destDir := cmd.Args["dest"]
+	destDir := strings.Replace(cmd.Args["dest"], "\\", "/", -1)
 	ignoreUnmatchError := cmd.Args["ignoreUnmatchError"] == "true"
+	archive := cmd.Args["archive"]
+	if archive != "" && archive != protocol.ArchiveZip {
+		return Err("Unsupported artifact archive format: %v", archive)
+	}
 
+	for _, part := range strings.Split(destDir, "/") {
+		if part == ".." {
+			return Err("Artifact destination %v is outside of the artifacts directory", destDir)
+		}
+	}
+	onlyOnFailure := cmd.Args[protocol.UploadOnlyOnFailure] == "true"
+	onlyOnSuccess := cmd.Args[protocol.UploadOnlyOnSuccess] == "true"
+	if onlyOnFailure && onlyOnSuccess {
+		return Err("Artifact upload can not be both %v and %v", protocol.UploadOnlyOnFailure, protocol.UploadOnlyOnSuccess)
+	}
+	if onlyOnFailure && s.buildStatus != protocol.BuildFailed || onlyOnSuccess && s.buildStatus != protocol.BuildPassed {
+		s.ConsoleLog("Skip uploading artifacts from %v, build is %v\n", src, s.buildStatus)
+		return nil
+	}
 	absSrc := filepath.Join(s.wd, src)
-	return uploadArtifacts(s, absSrc, strings.Replace(destDir, "\\", "/", -1), ignoreUnmatchError)
+	return uploadArtifacts(s, absSrc, destDir, ignoreUnmatchError, archive != "")
 }
 
-func uploadArtifacts(s *BuildSession, source, destDir string, ignoreUnmatchError bool) (err error) {
-	if strings.Contains(source, "*") {
-		matches, err := doublestar.Glob(source)
+func uploadArtifacts(s *BuildSession, source, destDir string, ignoreUnmatchError, archive bool) (err error) {
+	if HasWildcard(source) {
+		matches, err := Glob(source, s.rootDir)
 		if err != nil {
 			return err
 		}
-		sort.Strings(matches)
 		base := BaseDirOfPathWithWildcard(source)
 		baseLen := len(base)
-		for _, file := range matches {
-			fileDir, _ := filepath.Split(file)
+		var progressMu sync.Mutex
+		uploaded := 0
+		return uploadConcurrently(s.uploadConcurrency(), len(matches), func(i int) error {
+			fileDir, _ := filepath.Split(matches[i])
 			dest := Join("/", destDir, fileDir[baseLen:len(fileDir)-1])
-			err = uploadArtifacts(s, file, dest, ignoreUnmatchError)
-			if err != nil {
+			if err := uploadArtifacts(s, matches[i], dest, ignoreUnmatchError, archive); err != nil {
 				return err
 			}
-		}
-		return nil
+			progressMu.Lock()
+			defer progressMu.Unlock()
+			uploaded++
+			s.ConsoleLog("Uploaded %v of %v artifacts matching %v\n", uploaded, len(matches), source)
+			return nil
+		})
 	}
 
 	srcInfo, err := os.Stat(source)
@@ -63,15 +84,43 @@ func uploadArtifacts(s *BuildSession, source, destDir string, ignoreUnmatchError
 	}
 	s.ConsoleLog("Uploading artifacts from %v to %v\n", source, destDescription(destDir))
 
-	var destPath string
-	if destDir != "" {
-		destPath = Join("/", destDir, srcInfo.Name())
-	} else {
-		destPath = srcInfo.Name()
-	}
 	destURL := AppendUrlParam(AppendUrlPath(s.artifactUploadBaseURL, destDir),
 		"buildId", s.buildId)
-	return s.artifacts.Upload(source, destPath, destURL)
+	if archive && srcInfo.IsDir() {
+		err = s.artifacts.UploadArchive(source, artifactPath(destDir, srcInfo.Name()+".zip"), destURL)
+	} else if s.UploadChunkSize > 0 && srcInfo.Mode().IsRegular() && srcInfo.Size() > s.UploadChunkSize {
+		err = s.artifacts.UploadChunked(source, artifactPath(destDir, srcInfo.Name()), destURL, s.UploadChunkSize)
+	} else {
+		err = s.artifacts.Upload(source, artifactPath(destDir, srcInfo.Name()), destURL)
+	}
+	if err == nil && s.summary != nil {
+		s.summary.uploaded(sourceSize(source, srcInfo))
+	}
+	return
+}
+
+// sourceSize returns the total size of the files of the artifact source.
+func sourceSize(source string, info os.FileInfo) int64 {
+	if !info.IsDir() {
+		return info.Size()
+	}
+	var size int64
+	filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// artifactPath returns the path of the artifact relative to the build
+// artifacts directory, the server rejects absolute artifact paths.
+func artifactPath(destDir, name string) string {
+	if destDir != "" {
+		return strings.TrimPrefix(Join("/", destDir, name), "/")
+	}
+	return name
 }
 
 func destDescription(path string) string {
@@ -81,3 +130,49 @@ func destDescription(path string) string {
 		return path
 	}
 }
+
+// uploadConcurrently calls upload for 0 to n-1 with at most concurrency
+// uploads running at the same time. After the first error, no more
+// uploads are started and the error is returned.
+func uploadConcurrently(concurrency, n int, upload func(i int) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	jobs := make(chan int)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := upload(i); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	var err error
+	for i := 0; i < n && err == nil; i++ {
+		select {
+		case jobs <- i:
+		case err = <-errs:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return err
+}
+
+func (s *BuildSession) uploadConcurrency() int {
+	if s.UploadConcurrency > 0 {
+		return s.UploadConcurrency
+	}
+	return DefaultUploadConcurrency
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	DefaultWaitForInterval = time.Second
+	DefaultWaitForTimeout  = 5 * time.Minute
+	WaitForProgressPeriod  = 10 * time.Second
+)
+
+// CommandWaitFor polls the condition until it is satisfied, the build is
+// canceled or the timeout is reached; a still waiting message is written
+// to the console every WaitForProgressPeriod.
+func CommandWaitFor(s *BuildSession, cmd *protocol.BuildCommand) error {
+	interval, err := durationArg(cmd, "interval", DefaultWaitForInterval)
+	if err != nil {
+		return err
+	}
+	timeout, err := durationArg(cmd, "timeout", DefaultWaitForTimeout)
+	if err != nil {
+		return err
+	}
+	desc, ready, err := waitForCondition(s, cmd, interval)
+	if err != nil {
+		return err
+	}
+
+	s.ConsoleLog("Waiting for %v\n", desc)
+	start := time.Now()
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastProgress := start
+	for {
+		if ready() {
+			s.ConsoleLog("%v is ready after %v\n", desc, time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		select {
+		case <-s.cancel:
+			return nil
+		case <-deadline:
+			return Err("Timed out after %v waiting for %v", timeout, desc)
+		case now := <-ticker.C:
+			if now.Sub(lastProgress) >= WaitForProgressPeriod {
+				lastProgress = now
+				s.ConsoleLog("Still waiting for %v (%v)\n", desc, now.Sub(start).Round(time.Second))
+			}
+		}
+	}
+}
+
+// waitForCondition returns the description and the probe of the
+// condition given by the command args.
+func waitForCondition(s *BuildSession, cmd *protocol.BuildCommand, interval time.Duration) (string, func() bool, error) {
+	probeTimeout := interval
+	if probeTimeout < time.Second {
+		probeTimeout = time.Second
+	}
+	if url := cmd.Args[protocol.WaitForURL]; url != "" {
+		client := &http.Client{Timeout: probeTimeout}
+		return Sprintf("%v to respond 200", url), func() bool {
+			resp, err := client.Get(url)
+			if err != nil {
+				s.debugLog("wait for %v: %v", url, err)
+				return false
+			}
+			resp.Body.Close()
+			return resp.StatusCode == http.StatusOK
+		}, nil
+	}
+	if addr := cmd.Args[protocol.WaitForPort]; addr != "" {
+		return Sprintf("port %v to open", addr), func() bool {
+			conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+			if err != nil {
+				s.debugLog("wait for %v: %v", addr, err)
+				return false
+			}
+			conn.Close()
+			return true
+		}, nil
+	}
+	if path := cmd.Args[protocol.WaitForFile]; path != "" {
+		fullPath := filepath.Join(s.wd, path)
+		return Sprintf("file %v to exist", path), func() bool {
+			_, err := os.Stat(fullPath)
+			return err == nil
+		}, nil
+	}
+	return "", nil, Err("waitFor requires one of %v, %v and %v",
+		protocol.WaitForURL, protocol.WaitForPort, protocol.WaitForFile)
+}
+
+func durationArg(cmd *protocol.BuildCommand, name string, defaultValue time.Duration) (time.Duration, error) {
+	arg := cmd.Args[name]
+	if arg == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(arg)
+	if err != nil || d <= 0 {
+		return 0, Err("Invalid waitFor %v %q, it should be a positive duration", name, arg)
+	}
+	return d, nil
+}
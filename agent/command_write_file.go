@@ -0,0 +1,113 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"encoding/base64"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var MaxWriteFileSize = 1024 * 1024
+
+func CommandWriteFile(s *BuildSession, cmd *protocol.BuildCommand) error {
+	dest := filepath.Join(s.wd, cmd.Args["dest"])
+	if !IsSubPath(dest, s.rootDir) {
+		return Err("Destination file[%v] is outside the agent sandbox.", dest)
+	}
+	content, err := base64.StdEncoding.DecodeString(cmd.Args["content"])
+	if err != nil {
+		return Err("Invalid content of file %v: %v", dest, err)
+	}
+	if len(content) > MaxWriteFileSize {
+		return Err("File %v (Size: %v) is larger than acceptable size (%v)", dest, len(content), MaxWriteFileSize)
+	}
+	var mode os.FileMode = 0644
+	if cmd.Args["secure"] == "true" {
+		mode = 0600
+		if len(content) > 0 {
+			s.secrets.Substitutions[string(content)] = DefaultSecretMask
+		}
+		s.secureFiles.add(dest)
+	}
+	s.debugLog("write %v bytes to %v", len(content), dest)
+	if err := Mkdirs(filepath.Dir(dest)); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dest, content, mode); err != nil {
+		return err
+	}
+	return os.Chmod(dest, mode)
+}
+
+// secureFiles are the files written by secure write file commands of a
+// build, shared with its nested sessions.
+type secureFiles struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (f *secureFiles) add(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, path)
+}
+
+func (f *secureFiles) take() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	paths := f.paths
+	f.paths = nil
+	return paths
+}
+
+// shredSecureFiles overwrites the secure files of the build with zeros
+// and removes them, it runs when the build is completed whatever the
+// result is.
+func (s *BuildSession) shredSecureFiles() {
+	for _, path := range s.secureFiles.take() {
+		s.debugLog("shred secure file %v", path)
+		if err := shred(path); err != nil && !os.IsNotExist(err) {
+			s.warn("Failed to shred secure file %v: %v", path, err)
+		}
+	}
+}
+
+func shred(path string) error {
+	os.Chmod(path, 0600)
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = f.Write(make([]byte, info.Size()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -17,10 +17,12 @@
 package agent
 
 import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -33,14 +35,15 @@ type Config struct {
 	ContextPath        string
 	WebSocketPath      string
 	RegistrationPath   string
+	AgentBinaryPath    string
 	WorkingDir         string
 	LogDir             string
 	ConfigDir          string
 	IpAddress          string
 
 	AgentAutoRegisterKey             string
-	AgentAutoRegisterResources       string
-	AgentAutoRegisterEnvironments    string
+	AgentAutoRegisterResources       []string
+	AgentAutoRegisterEnvironments    []string
 	AgentAutoRegisterElasticAgentId  string
 	AgentAutoRegisterElasticPluginId string
 
@@ -48,7 +51,30 @@ type Config struct {
 	AgentPrivateKeyFile string
 	AgentCertFile       string
 	AgentIdFile         string
-	OutputDebugLog      bool
+	AgentUUID           string
+	PathPrefixFile      string
+	LogLevel            LogLevel
+	AuthToken           string
+	SecretsFile         string
+	SecretsEnvPrefix    string
+	InsecureSkipVerify  bool
+	DryRun              bool
+	SelfUpdate          bool
+	BuildSummary        bool
+	StrictEnvExpansion  bool
+	UploadConcurrency   int
+	UploadChunkSize     int64
+	ChecksumAlgorithm   string
+	ExecAllowlist       []string
+	ExecDenylist        []string
+	CommandAllowlist    []string
+	CommandDenylist     []string
+	ExecShell           []string
+
+	IdleTimeout         time.Duration
+	PingInterval        time.Duration
+	RegisterTimeout     time.Duration
+	RegisterMaxAttempts int
 }
 
 func LoadConfig() *Config {
@@ -66,11 +92,47 @@ func LoadConfig() *Config {
 	}
 	wd = filepath.Clean(wd)
 	configDir := filepath.Join(wd, readEnv("GOCD_AGENT_CONFIG_DIR", "config"))
+	idleTimeout, err := time.ParseDuration(readEnv("GOCD_AGENT_IDLE_TIMEOUT", "0"))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_IDLE_TIMEOUT is invalid: %v", err))
+	}
+	pingInterval, err := ParsePingInterval(readEnv("GOCD_AGENT_PING_INTERVAL", DefaultPingInterval.String()))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_PING_INTERVAL is invalid: %v", err))
+	}
+	registerTimeout, err := time.ParseDuration(readEnv("GOCD_AGENT_REGISTER_TIMEOUT", "0"))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_REGISTER_TIMEOUT is invalid: %v", err))
+	}
+	registerMaxAttempts, err := strconv.Atoi(readEnv("GOCD_AGENT_REGISTER_MAX_ATTEMPTS", "0"))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_REGISTER_MAX_ATTEMPTS is invalid: %v", err))
+	}
+	defaultLogLevel := "info"
+	if os.Getenv("DEBUG") != "" {
+		defaultLogLevel = "debug"
+	}
+	logLevel, err := ParseLogLevel(readEnv("GOCD_AGENT_LOG_LEVEL", defaultLogLevel))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_LOG_LEVEL is invalid: %v", err))
+	}
+	uploadConcurrency, err := strconv.Atoi(readEnv("GOCD_AGENT_UPLOAD_CONCURRENCY", strconv.Itoa(DefaultUploadConcurrency)))
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_UPLOAD_CONCURRENCY is invalid: %v", err))
+	}
+	uploadChunkSize, err := strconv.ParseInt(readEnv("GOCD_AGENT_UPLOAD_CHUNK_SIZE", "0"), 10, 64)
+	if err != nil {
+		panic(Sprintf("GOCD_AGENT_UPLOAD_CHUNK_SIZE is invalid: %v", err))
+	}
+	checksumAlgorithm := readEnv("GOCD_AGENT_CHECKSUM_ALGORITHM", protocol.ChecksumMd5)
+	if checksumAlgorithm != protocol.ChecksumMd5 && checksumAlgorithm != protocol.ChecksumSha256 {
+		panic(Sprintf("GOCD_AGENT_CHECKSUM_ALGORITHM is invalid: %v is neither md5 nor sha256", checksumAlgorithm))
+	}
 	return &Config{
 		Hostname:                         hostname,
 		SendMessageTimeout:               120 * time.Second,
 		ServerUrl:                        serverUrl,
-		ServerHostAndPort:                serverUrl.Host,
+		ServerHostAndPort:                hostAndPort(serverUrl),
 		WorkingDir:                       wd,
 		LogDir:                           os.Getenv("GOCD_AGENT_LOG_DIR"),
 		ConfigDir:                        configDir,
@@ -78,15 +140,38 @@ func LoadConfig() *Config {
 		AgentPrivateKeyFile:              filepath.Join(configDir, "agent-private-key.pem"),
 		AgentCertFile:                    filepath.Join(configDir, "agent-cert.pem"),
 		AgentIdFile:                      filepath.Join(configDir, "agent-id"),
+		AgentUUID:                        os.Getenv("GOCD_AGENT_UUID"),
+		PathPrefixFile:                   filepath.Join(configDir, "server-path-prefix"),
 		AgentAutoRegisterKey:             os.Getenv("GOCD_AGENT_AUTO_REGISTER_KEY"),
-		AgentAutoRegisterResources:       os.Getenv("GOCD_AGENT_AUTO_REGISTER_RESOURCES"),
-		AgentAutoRegisterEnvironments:    os.Getenv("GOCD_AGENT_AUTO_REGISTER_ENVIRONMENTS"),
+		AgentAutoRegisterResources:       readListEnv("GOCD_AGENT_AUTO_REGISTER_RESOURCES"),
+		AgentAutoRegisterEnvironments:    readListEnv("GOCD_AGENT_AUTO_REGISTER_ENVIRONMENTS"),
 		AgentAutoRegisterElasticAgentId:  os.Getenv("GOCD_AGENT_AUTO_REGISTER_ELASTIC_AGENT_ID"),
 		AgentAutoRegisterElasticPluginId: os.Getenv("GOCD_AGENT_AUTO_REGISTER_ELASTIC_PLUGIN_ID"),
-		OutputDebugLog:                   os.Getenv("DEBUG") != "",
+		LogLevel:                         logLevel,
+		AuthToken:                        os.Getenv("GOCD_AGENT_AUTH_TOKEN"),
+		SecretsFile:                      os.Getenv("GOCD_AGENT_SECRETS_FILE"),
+		SecretsEnvPrefix:                 os.Getenv("GOCD_AGENT_SECRETS_ENV_PREFIX"),
+		InsecureSkipVerify:               os.Getenv("GOCD_AGENT_INSECURE_SKIP_VERIFY") != "",
+		DryRun:                           os.Getenv("GOCD_AGENT_DRY_RUN") != "",
+		SelfUpdate:                       os.Getenv("GOCD_AGENT_SELF_UPDATE") != "",
+		BuildSummary:                     os.Getenv("GOCD_AGENT_BUILD_SUMMARY") != "",
+		StrictEnvExpansion:               os.Getenv("GOCD_AGENT_STRICT_ENV_EXPANSION") != "",
 		WebSocketPath:                    readEnv("GOCD_SERVER_WEB_SOCKET_PATH", "/agent-websocket"),
 		RegistrationPath:                 readEnv("GOCD_SERVER_REGISTRATION_PATH", "/admin/agent"),
+		AgentBinaryPath:                  readEnv("GOCD_SERVER_AGENT_BINARY_PATH", "/admin/agent-binary"),
 		IpAddress:                        lookupIpAddress(),
+		IdleTimeout:                      idleTimeout,
+		PingInterval:                     pingInterval,
+		UploadConcurrency:                uploadConcurrency,
+		UploadChunkSize:                  uploadChunkSize,
+		ChecksumAlgorithm:                checksumAlgorithm,
+		ExecAllowlist:                    readListEnv("GOCD_AGENT_EXEC_ALLOWLIST"),
+		ExecDenylist:                     readListEnv("GOCD_AGENT_EXEC_DENYLIST"),
+		CommandAllowlist:                 readListEnv("GOCD_AGENT_COMMAND_ALLOWLIST"),
+		CommandDenylist:                  readListEnv("GOCD_AGENT_COMMAND_DENYLIST"),
+		ExecShell:                        readListEnv("GOCD_AGENT_EXEC_SHELL"),
+		RegisterTimeout:                  registerTimeout,
+		RegisterMaxAttempts:              registerMaxAttempts,
 	}
 }
 
@@ -106,6 +191,17 @@ func lookupIpAddress() string {
 	return "127.0.0.1"
 }
 
+// hostAndPort returns "host:port" of the https url for dialing, with
+// IPv6 hosts in brackets and the default https port when the url has
+// no port.
+func hostAndPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
 func (c *Config) HttpsServerURL() string {
 	return c.ServerUrl.String()
 }
@@ -122,6 +218,11 @@ func (c *Config) RegistrationURL() (*url.URL, error) {
 
 func (c *Config) MakeFullServerURL(u string) (*url.URL, error) {
 	if strings.HasPrefix(u, "/") {
+		// paths of a server mounted under ContextPath include it, which
+		// is in the server url already
+		if c.ContextPath != "" && strings.HasPrefix(u, c.ContextPath+"/") {
+			return c.ServerUrl.Parse(u)
+		}
 		return url.Parse(Join("/", c.HttpsServerURL(), u))
 	} else {
 		return url.Parse(u)
@@ -140,3 +241,13 @@ func readEnv(varname string, defaultVal string) string {
 		return val
 	}
 }
+
+func readListEnv(varname string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(varname), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigServerHostAndPort(t *testing.T) {
+	defer os.Setenv("GOCD_SERVER_URL", os.Getenv("GOCD_SERVER_URL"))
+	defer os.Setenv("GO_SERVER_URL", os.Getenv("GO_SERVER_URL"))
+
+	for serverUrl, expected := range map[string][]string{
+		"https://127.0.0.1:8154/go":    {"127.0.0.1:8154", "wss://127.0.0.1:8154/go"},
+		"https://[::1]:8154/go":        {"[::1]:8154", "wss://[::1]:8154/go"},
+		"https://[::1]/go":             {"[::1]:443", "wss://[::1]/go"},
+		"https://gocd.example.com/go":  {"gocd.example.com:443", "wss://gocd.example.com/go"},
+		"http://gocd.example.com:8153": {"gocd.example.com:8153", "wss://gocd.example.com:8153"},
+	} {
+		os.Setenv("GOCD_SERVER_URL", serverUrl)
+		config := LoadConfig()
+		assert.Equal(t, expected[0], config.ServerHostAndPort, serverUrl)
+		assert.Equal(t, Join("/", expected[1], config.WebSocketPath), config.WssServerURL(), serverUrl)
+	}
+}
+
+func TestMakeFullServerURLWithContextPath(t *testing.T) {
+	serverUrl, _ := url.Parse("https://proxy.example.com/gocd")
+	config := &Config{ServerUrl: serverUrl}
+	u, err := config.MakeFullServerURL("/console/builds/b1")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://proxy.example.com/gocd/console/builds/b1", u.String())
+
+	config.ContextPath = "/gocd"
+	u, err = config.MakeFullServerURL("/gocd/artifacts/builds/b1?file=a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://proxy.example.com/gocd/artifacts/builds/b1?file=a.txt", u.String())
+	u, err = config.MakeFullServerURL("https://other.example.com/gocd/console")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://other.example.com/gocd/console", u.String())
+}
+
+func TestLoadSecretsFromFileAndEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "secrets")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("# registry\nREGISTRY_PASSWORD=pa=ss\n\n TOKEN = abc\n"), 0600))
+	os.Setenv("TEST_SECRET_DB_PASSWORD", "db")
+	defer os.Unsetenv("TEST_SECRET_DB_PASSWORD")
+
+	secrets, err := LoadSecrets(file, "TEST_SECRET_")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"REGISTRY_PASSWORD": "pa=ss", "TOKEN": "abc", "DB_PASSWORD": "db"}, secrets)
+
+	secrets, err = LoadSecrets("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(secrets))
+
+	assert.Nil(t, ioutil.WriteFile(file, []byte("REGISTRY_PASSWORD\n"), 0600))
+	_, err = LoadSecrets(file, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, "line 1 of secrets file "+file+" is not name=value", err.Error())
+}
@@ -18,31 +18,19 @@ package agent
 
 import (
 	"strconv"
-	"syscall"
 )
 
+// UsableSpace returns free bytes available in the agent working
+// directory, or -1 when it is unknown.
 func UsableSpace() int64 {
-	_, free, err := diskSpace("/")
+	free, err := FreeDiskSpace(config.WorkingDir)
 	if err != nil {
 		LogInfo("Unknown diskspace, error: %v", err)
 		return -1
 	}
-	return free
+	return int64(free)
 }
 
 func UsableSpaceString() string {
 	return strconv.FormatInt(UsableSpace(), 10)
 }
-
-// Space returns total and free bytes available in a directory, e.g. `/`.
-// Think of it as "df" UNIX command.
-func diskSpace(path string) (total, free int64, err error) {
-	s := syscall.Statfs_t{}
-	err = syscall.Statfs(path, &s)
-	if err != nil {
-		return
-	}
-	total = int64(s.Bsize) * int64(s.Blocks)
-	free = int64(s.Bsize) * int64(s.Bfree)
-	return
-}
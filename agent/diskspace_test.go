@@ -0,0 +1,40 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFreeDiskSpace(t *testing.T) {
+	free, err := FreeDiskSpace(os.TempDir())
+	assert.Nil(t, err)
+	assert.True(t, free > 0, "expected free disk space of temp dir")
+}
+
+func TestFreeDiskSpaceOfMissingPath(t *testing.T) {
+	_, err := FreeDiskSpace(filepath.Join(os.TempDir(), "gocd-golang-agent-missing", "dir"))
+	assert.NotNil(t, err)
+}
+
+func TestUsableSpaceOfWorkingDir(t *testing.T) {
+	assert.True(t, UsableSpace() > 0, "expected usable space of working dir")
+}
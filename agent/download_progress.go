@@ -0,0 +1,83 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"io"
+	"time"
+)
+
+// DownloadProgressInterval is the min interval between download progress
+// lines, a line is also logged for every 10% downloaded.
+var DownloadProgressInterval = 5 * time.Second
+
+// progressReader logs the progress of reading a download of size bytes,
+// size is negative when it is unknown.
+type progressReader struct {
+	io.Reader
+	log        func(format string, a ...interface{})
+	size       int64
+	read       int64
+	lastLogged time.Time
+	lastPct    int64
+	done       bool
+}
+
+func newProgressReader(r io.Reader, size int64, source string, log func(format string, a ...interface{})) *progressReader {
+	if size >= 0 {
+		log("Downloading %v (%v bytes)\n", source, size)
+	} else {
+		log("Downloading %v\n", source)
+	}
+	return &progressReader{Reader: r, log: log, size: size, lastLogged: time.Now()}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	if err == io.EOF {
+		r.logProgress()
+		r.done = true
+	} else if n > 0 && r.shouldLog() {
+		r.logProgress()
+	}
+	return n, err
+}
+
+func (r *progressReader) shouldLog() bool {
+	if time.Since(r.lastLogged) >= DownloadProgressInterval {
+		return true
+	}
+	return r.size > 0 && r.percent()/10 > r.lastPct/10
+}
+
+func (r *progressReader) percent() int64 {
+	return r.read * 100 / r.size
+}
+
+func (r *progressReader) logProgress() {
+	if r.done {
+		return
+	}
+	r.lastLogged = time.Now()
+	if r.size > 0 {
+		r.lastPct = r.percent()
+		r.log("Downloaded %v of %v bytes (%v%%)\n", r.read, r.size, r.lastPct)
+	} else {
+		r.log("Downloaded %v bytes\n", r.read)
+	}
+}
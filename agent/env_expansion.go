@@ -0,0 +1,157 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// expandedArgs are the args of commands that are executables and file
+// paths, they are expanded by expandEnv like the "args" list of exec.
+var expandedArgs = []string{"command", "path", "src", "dest"}
+
+// localPathArgs are the args naming a path in the agent sandbox, they
+// must stay in the sandbox after expansion.
+var localPathArgs = map[string]string{
+	protocol.CommandUploadArtifact: "src",
+	protocol.CommandDownloadFile:   "dest",
+	protocol.CommandDownloadDir:    "dest",
+}
+
+// expandEnv returns cmd with ${VAR} and $VAR references in its working
+// directory, exec args and file paths replaced by the session
+// environment, and "$$" by a literal "$". Undefined variables are kept
+// as they are, or fail the command when StrictEnvExpansion is set.
+func (s *BuildSession) expandEnv(cmd *protocol.BuildCommand) (*protocol.BuildCommand, error) {
+	var undefined []string
+	expand := func(str string) string {
+		expanded, missing := expandEnvRefs(str, s.lookupEnv)
+		undefined = append(undefined, missing...)
+		return expanded
+	}
+	expandedCmd := *cmd
+	expandedCmd.WorkingDirectory = expand(cmd.WorkingDirectory)
+	expandedCmd.Args = make(map[string]string, len(cmd.Args))
+	for name, value := range cmd.Args {
+		expandedCmd.Args[name] = value
+	}
+	for _, name := range expandedArgs {
+		if name == "command" && cmd.Args["shell"] == "true" {
+			// the shell expands the command line
+			continue
+		}
+		if value, ok := cmd.Args[name]; ok {
+			expandedCmd.Args[name] = expand(value)
+		}
+	}
+	if _, ok := cmd.Args["args"]; ok && cmd.Name == protocol.CommandExec {
+		args, err := cmd.ListArg("args")
+		if err != nil {
+			return nil, err
+		}
+		for i, arg := range args {
+			args[i] = expand(arg)
+		}
+		expandedCmd.AddListArg("args", args)
+	}
+	if s.StrictEnvExpansion && len(undefined) > 0 {
+		return nil, Err("Undefined environment variables: %v", strings.Join(undefined, ", "))
+	}
+	if name, ok := localPathArgs[cmd.Name]; ok && expandedCmd.Args[name] != cmd.Args[name] {
+		wd := filepath.Join(s.rootDir, expandedCmd.WorkingDirectory)
+		if !IsSubPath(filepath.Join(wd, expandedCmd.Args[name]), s.rootDir) {
+			return nil, Err("Path %v is outside the agent sandbox after expanding environment variables", cmd.Args[name])
+		}
+	}
+	return &expandedCmd, nil
+}
+
+func (s *BuildSession) lookupEnv(name string) (string, bool) {
+	if value, ok := s.envs[name]; ok {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+// expandEnvRefs replaces ${NAME} and $NAME references in str by lookup
+// and "$$" by "$", references of undefined variables are kept and their
+// names returned.
+func expandEnvRefs(str string, lookup func(string) (string, bool)) (string, []string) {
+	var buf []byte
+	var undefined []string
+	for i := 0; i < len(str); i++ {
+		if str[i] != '$' {
+			buf = append(buf, str[i])
+			continue
+		}
+		if i+1 < len(str) && str[i+1] == '$' {
+			buf = append(buf, '$')
+			i++
+			continue
+		}
+		name, end := envRefName(str, i+1)
+		if name == "" {
+			buf = append(buf, str[i])
+			continue
+		}
+		if value, ok := lookup(name); ok {
+			buf = append(buf, value...)
+		} else {
+			buf = append(buf, str[i:end]...)
+			undefined = append(undefined, name)
+		}
+		i = end - 1
+	}
+	return string(buf), undefined
+}
+
+// envRefName returns the variable name of the reference starting at i,
+// after the "$", and the end of the reference; the name is empty when
+// there is no valid reference.
+func envRefName(str string, i int) (string, int) {
+	if i < len(str) && str[i] == '{' {
+		end := strings.IndexByte(str[i:], '}')
+		if end < 0 || !isEnvName(str[i+1:i+end]) {
+			return "", i
+		}
+		return str[i+1 : i+end], i + end + 1
+	}
+	end := i
+	for end < len(str) && isEnvNameChar(str[end], end == i) {
+		end++
+	}
+	return str[i:end], end
+}
+
+func isEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isEnvNameChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEnvNameChar(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// checkExec returns an error when the command matches ExecDenylist, or
+// ExecAllowlist is not empty and the command matches none of it. Deny
+// wins when both lists match.
+func (s *BuildSession) checkExec(command string) error {
+	if matchExec(s.ExecDenylist, command, s.wd) {
+		LogWarn("exec %v is denied", command)
+		return Err("exec %v is denied by the agent", command)
+	}
+	if len(s.ExecAllowlist) > 0 && !matchExec(s.ExecAllowlist, command, s.wd) {
+		LogWarn("exec %v is not allowed", command)
+		return Err("exec %v is not in the agent allowlist", command)
+	}
+	return nil
+}
+
+// matchExec returns whether the command matches any of the glob
+// patterns. Patterns with a path separator match the command path,
+// which is looked up in PATH for a bare command name and resolved
+// against the working directory wd for a relative path, others match
+// the base name of the command.
+func matchExec(patterns []string, command, wd string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	paths := []string{filepath.Clean(command)}
+	if path, err := lookExec(command, wd); err == nil {
+		if abs, err := filepath.Abs(path); err == nil {
+			paths = append(paths, abs)
+		}
+	}
+	for _, pattern := range patterns {
+		for _, p := range ExpandBraces(filepath.ToSlash(pattern)) {
+			for _, path := range paths {
+				name := filepath.ToSlash(path)
+				if !strings.Contains(p, "/") {
+					name = filepath.Base(path)
+				}
+				if ok, _ := filepath.Match(p, name); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// lookExec returns the path of the command as exec runs it in wd, a
+// relative path is resolved against wd rather than the agent working
+// directory.
+func lookExec(command, wd string) (string, error) {
+	if !strings.Contains(filepath.ToSlash(command), "/") {
+		return exec.LookPath(command)
+	}
+	if filepath.IsAbs(command) {
+		return command, nil
+	}
+	return filepath.Join(wd, command), nil
+}
+
+// compositeCommands only run other commands, they are allowed when
+// CommandAllowlist does not list them.
+var compositeCommands = map[string]bool{
+	protocol.CommandCompose: true,
+	protocol.CommandCond:    true,
+	protocol.CommandAnd:     true,
+	protocol.CommandOr:      true,
+}
+
+// checkCommand returns an error when the build command name is in
+// CommandDenylist, or CommandAllowlist is not empty and the name is not
+// in it. Denied commands are logged for auditing.
+func (s *BuildSession) checkCommand(name string) error {
+	if containsString(s.CommandDenylist, name) {
+		LogWarn("build %v: command %v is denied", s.buildId, name)
+		return Err("build command %v is denied by the agent", name)
+	}
+	if len(s.CommandAllowlist) > 0 && !containsString(s.CommandAllowlist, name) && !compositeCommands[name] {
+		LogWarn("build %v: command %v is not allowed", s.buildId, name)
+		return Err("build command %v is not in the agent allowlist", name)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const wildcards = "*?[{"
+
+func HasWildcard(pattern string) bool {
+	return strings.ContainsAny(pattern, wildcards)
+}
+
+// Glob returns the sorted list of files matching the absolute pattern.
+// Besides the filepath.Match syntax, "**" matches any number of
+// directories and "{a,b}" matches either alternative. Symbolic links
+// are never followed while searching, and links resolving outside of
+// the sandbox directory are excluded from the result.
+func Glob(pattern, sandbox string) ([]string, error) {
+	found := make(map[string]bool)
+	for _, p := range ExpandBraces(filepath.ToSlash(pattern)) {
+		if err := glob(p, sandbox, found); err != nil {
+			return nil, err
+		}
+	}
+	matches := make([]string, 0, len(found))
+	for m := range found {
+		matches = append(matches, m)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func glob(pattern, sandbox string, found map[string]bool) error {
+	if !HasWildcard(pattern) {
+		info, err := os.Lstat(filepath.FromSlash(pattern))
+		if err == nil {
+			addMatch(filepath.FromSlash(pattern), info, sandbox, found)
+		}
+		return nil
+	}
+	base := BaseDirOfPathWithWildcard(pattern)
+	root := filepath.FromSlash(base)
+	if base == "" {
+		root = "."
+		if strings.HasPrefix(pattern, "/") {
+			root = "/"
+		}
+	}
+	rest := strings.Split(strings.TrimPrefix(pattern[len(base):], "/"), "/")
+	recursive := strings.Contains(pattern, "**")
+	err := filepath.Walk(root, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(root, fpath)
+		if err != nil || rel == "." {
+			return err
+		}
+		segments := strings.Split(filepath.ToSlash(rel), "/")
+		if matchSegments(rest, segments) {
+			addMatch(fpath, info, sandbox, found)
+		}
+		if info.IsDir() && !recursive && len(segments) >= len(rest) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func addMatch(fpath string, info os.FileInfo, sandbox string, found map[string]bool) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		resolved, err := filepath.EvalSymlinks(fpath)
+		if err != nil || !isInside(resolved, sandbox) {
+			LogDebug("ignore %v, it links to outside of the sandbox", fpath)
+			return
+		}
+	}
+	found[fpath] = true
+}
+
+func isInside(fpath, dir string) bool {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	return IsSubPath(fpath, dir)
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], name[0])
+	return err == nil && ok && matchSegments(pattern[1:], name[1:])
+}
+
+// ExpandBraces expands "{a,b}" alternatives, e.g. "target/{a,b}/*.jar"
+// becomes "target/a/*.jar" and "target/b/*.jar".
+func ExpandBraces(pattern string) []string {
+	start := strings.Index(pattern, "{")
+	if start < 0 {
+		return []string{pattern}
+	}
+	depth := 0
+	var alternatives []string
+	last := start + 1
+	for i := start; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				alternatives = append(alternatives, pattern[last:i])
+				last = i + 1
+			}
+		case '}':
+			depth--
+			if depth == 0 {
+				alternatives = append(alternatives, pattern[last:i])
+				var ret []string
+				for _, alt := range alternatives {
+					ret = append(ret, ExpandBraces(pattern[:start]+alt+pattern[i+1:])...)
+				}
+				return ret
+			}
+		}
+	}
+	// unbalanced braces are matched literally
+	return []string{pattern}
+}
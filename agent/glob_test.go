@@ -0,0 +1,86 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandBraces(t *testing.T) {
+	assert.Equal(t, []string{"a/*.jar"}, ExpandBraces("a/*.jar"))
+	assert.Equal(t, []string{"target/a/*.jar", "target/b/*.jar"}, ExpandBraces("target/{a,b}/*.jar"))
+	assert.Equal(t, []string{"a/x.1", "a/y.1", "b.1"}, ExpandBraces("{a/{x,y},b}.1"))
+	assert.Equal(t, []string{"a{b"}, ExpandBraces("a{b"))
+}
+
+func TestGlob(t *testing.T) {
+	root, err := ioutil.TempDir("", "glob-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	createTestProject(root)
+	createTestFile(root+"/a/b/c/d/e", "deep.txt")
+
+	var tests = []struct {
+		pattern  string
+		expected []string
+	}{
+		{"*.txt", []string{"0.txt"}},
+		{"src/*/*.txt", []string{"src/hello/3.txt", "src/hello/4.txt"}},
+		{"**/3.txt", []string{"src/hello/3.txt"}},
+		{"**/e/*.txt", []string{"a/b/c/d/e/deep.txt"}},
+		{"a/**/deep.txt", []string{"a/b/c/d/e/deep.txt"}},
+		{"test/{world,world2}/1?.txt", []string{"test/world/10.txt", "test/world/11.txt", "test/world2/10.txt", "test/world2/11.txt"}},
+		{"{src,test}/*.txt", []string{"src/1.txt", "src/2.txt", "test/5.txt", "test/6.txt", "test/7.txt"}},
+		{"src/*", []string{"src/1.txt", "src/2.txt", "src/hello"}},
+		{"nothing/**/*.txt", []string{}},
+	}
+	for _, test := range tests {
+		matches, err := Glob(filepath.Join(root, test.pattern), root)
+		assert.Nil(t, err)
+		actual := []string{}
+		for _, m := range matches {
+			actual = append(actual, m[len(root)+1:])
+		}
+		assert.Equal(t, test.expected, actual, test.pattern)
+	}
+}
+
+func TestGlobDoesNotFollowSymlinksOutOfSandbox(t *testing.T) {
+	root, err := ioutil.TempDir("", "glob-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "glob-test-outside")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outside)
+
+	sandbox := filepath.Join(root, "sandbox")
+	createTestFile(sandbox, "in.txt")
+	createTestFile(outside, "secret.txt")
+	createTestFile(filepath.Join(outside, "dir"), "secret.txt")
+	assert.Nil(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(sandbox, "out.txt")))
+	assert.Nil(t, os.Symlink(filepath.Join(outside, "dir"), filepath.Join(sandbox, "dir")))
+	assert.Nil(t, os.Symlink(filepath.Join(sandbox, "in.txt"), filepath.Join(sandbox, "link.txt")))
+
+	matches, err := Glob(filepath.Join(sandbox, "**/*.txt"), sandbox)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(sandbox, "in.txt"), filepath.Join(sandbox, "link.txt")}, matches)
+}
@@ -22,16 +22,44 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = map[string]LogLevel{
+	"debug": LogLevelDebug,
+	"info":  LogLevelInfo,
+	"warn":  LogLevelWarn,
+	"error": LogLevelError,
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return LogLevelInfo, Err("unknown log level %q, expected one of debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
 type Logger struct {
 	Info  *log.Logger
 	Debug *log.Logger
+	Warn  *log.Logger
 	Error *log.Logger
 }
 
-func MakeLogger(logDir, file string, debug bool) *Logger {
-	var output, debugOutput io.Writer
+// MakeLogger creates loggers writing to file in logDir, or stdout when
+// logDir is empty; loggers below level discard their output.
+func MakeLogger(logDir, file string, level LogLevel) *Logger {
+	var output io.Writer
 	if logDir != "" {
 		fpath := filepath.Join(logDir, file)
 		var err error
@@ -43,15 +71,17 @@ func MakeLogger(logDir, file string, debug bool) *Logger {
 		output = os.Stdout
 	}
 
-	if debug {
-		debugOutput = output
-	} else {
-		debugOutput = ioutil.Discard
+	levelOutput := func(l LogLevel) io.Writer {
+		if l < level {
+			return ioutil.Discard
+		}
+		return output
 	}
 
-	debugLogger := log.New(debugOutput, "", 0)
-	infoLogger := log.New(output, "", 0)
-	errorLogger := log.New(output, "ERROR: ", log.Lshortfile)
+	debugLogger := log.New(levelOutput(LogLevelDebug), "", 0)
+	infoLogger := log.New(levelOutput(LogLevelInfo), "", 0)
+	warnLogger := log.New(levelOutput(LogLevelWarn), "WARN: ", 0)
+	errorLogger := log.New(levelOutput(LogLevelError), "ERROR: ", log.Lshortfile)
 
-	return &Logger{Debug: debugLogger, Info: infoLogger, Error: errorLogger}
+	return &Logger{Debug: debugLogger, Info: infoLogger, Warn: warnLogger, Error: errorLogger}
 }
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := ParseLogLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, LogLevelWarn, level)
+	level, err = ParseLogLevel("debug")
+	assert.Nil(t, err)
+	assert.Equal(t, LogLevelDebug, level)
+	_, err = ParseLogLevel("verbose")
+	assert.NotNil(t, err)
+}
+
+func TestLoggerSuppressesMessagesBelowLevel(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "log")
+	assert.Nil(t, err)
+	defer os.RemoveAll(logDir)
+
+	logger := MakeLogger(logDir, "agent.log", LogLevelWarn)
+	logger.Debug.Printf("debug message")
+	logger.Info.Printf("info message")
+	logger.Warn.Printf("warn message")
+	logger.Error.Printf("error message")
+
+	output, err := ioutil.ReadFile(filepath.Join(logDir, "agent.log"))
+	assert.Nil(t, err)
+	log := string(output)
+	assert.False(t, strings.Contains(log, "debug message"))
+	assert.False(t, strings.Contains(log, "info message"))
+	assert.True(t, strings.Contains(log, "WARN: warn message"))
+	assert.True(t, strings.Contains(log, "ERROR: "))
+	assert.True(t, strings.Contains(log, "error message"))
+}
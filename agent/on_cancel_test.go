@@ -19,6 +19,8 @@ import (
 	. "github.com/gocd-contrib/gocd-golang-agent/agent"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/xli/assert"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -52,6 +54,26 @@ compose on cancel
 	assert.Equal(t, expected, trimTimestamp(log))
 }
 
+func TestCancelKillsChildProcesses(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	marker := filepath.Join(pipelineDir(), "marker")
+	goServer.SendBuild(AgentId, buildId,
+		protocol.ExecCommand("sh", "-c", "(sleep 1; touch "+marker+") & wait"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+
+	goServer.Send(AgentId, protocol.CancelMessage())
+
+	assert.Equal(t, "build Cancelled", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	time.Sleep(1500 * time.Millisecond)
+	_, err := os.Stat(marker)
+	assert.True(t, os.IsNotExist(err), "child process should be killed")
+}
+
 func TestOnCancel2(t *testing.T) {
 	CancelCommandTimeout = 10 * time.Millisecond
 	defer func() {
@@ -125,3 +147,26 @@ func TestCancelBuildWhenBuildIsHangingOnTestCommand(t *testing.T) {
 	expected := "hello before cancel\n"
 	assert.Equal(t, expected, trimTimestamp(log))
 }
+
+func TestBuildTimeoutCancelsAndFailsBuild(t *testing.T) {
+	setUp(t)
+	defer tearDown()
+	goServer.SendBuildWithTimeout(AgentId, buildId, 500*time.Millisecond,
+		echo("echo before sleep"),
+		protocol.ExecCommand("sleep", "5").SetOnCancel(echo("read on cancel")),
+		echo("should not process this echo"),
+	)
+
+	assert.Equal(t, "agent Building", stateLog.Next())
+	assert.Equal(t, "build Failed", stateLog.Next())
+	assert.Equal(t, "agent Idle", stateLog.Next())
+
+	log, err := goServer.ConsoleLog(buildId)
+	assert.Nil(t, err)
+
+	expected := `echo before sleep
+read on cancel
+ERROR: build timed out after 500ms
+`
+	assert.Equal(t, expected, trimTimestamp(log))
+}
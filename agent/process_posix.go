@@ -0,0 +1,42 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// startProcessGroup makes the command the leader of a new process group,
+// so that killProcessTree can kill the processes it spawned as well.
+func startProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessTree(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// execAgent replaces the running process by the agent binary exe, it
+// returns only when exe cannot be executed.
+func execAgent(exe string) error {
+	return syscall.Exec(exe, append([]string{exe}, os.Args[1:]...), os.Environ())
+}
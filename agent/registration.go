@@ -23,12 +23,18 @@ import (
 	"encoding/pem"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// ReadGoServerCACert trusts the certificate of the server on first use,
+// connections to the server are verified against it afterwards.
 func ReadGoServerCACert() error {
 	_, err := os.Stat(config.GoServerCAFile)
 	if err == nil {
@@ -85,10 +91,14 @@ func GoServerTlsConfig(withClientCert bool) (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if config.InsecureSkipVerify {
+		LogWarn("server certificate is not verified, GOCD_AGENT_INSECURE_SKIP_VERIFY should only be used in development")
+	}
 	return &tls.Config{
-		Certificates: certs,
-		RootCAs:      roots,
-		ServerName:   serverName,
+		Certificates:       certs,
+		RootCAs:            roots,
+		ServerName:         serverName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
 	}, nil
 }
 
@@ -97,26 +107,113 @@ func GoServerRemoteClient(withClientCert bool) (*http.Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	tr := &http.Transport{
+	var tr http.RoundTripper = &http.Transport{
 		TLSClientConfig: config,
 	}
+	if token := GetConfig().AuthToken; token != "" {
+		tr = &bearerTokenTransport{token: token, base: tr}
+	}
 	return &http.Client{Transport: tr}, nil
 }
 
+type bearerTokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *bearerTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(r)
+}
+
+var (
+	RegisterRetryBaseDelay = 1 * time.Second
+	RegisterRetryMaxDelay  = 1 * time.Minute
+)
+
+// Register retries registration with exponential backoff and jitter
+// until it succeeds, the agent is stopped, or RegisterMaxAttempts or
+// RegisterTimeout of config is used up. Zero means no limit. A
+// registration the server rejects with a 4xx status is not retried,
+// except for 408 and 429.
 func Register() error {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := register()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(rejectedRegistration); ok {
+			return err
+		}
+		if config.RegisterMaxAttempts > 0 && attempt >= config.RegisterMaxAttempts {
+			return err
+		}
+		delay := registerRetryDelay(attempt)
+		if config.RegisterTimeout > 0 && time.Since(start)+delay > config.RegisterTimeout {
+			return err
+		}
+		LogWarn("register failed (attempt %v): %v, retry in %v", attempt, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-stopSignal:
+			return ErrStopped
+		}
+	}
+}
+
+// registerRetryDelay returns a random delay between the half and the
+// whole of the exponential backoff, so that agents restarted together
+// do not register at the same time.
+func registerRetryDelay(attempt int) time.Duration {
+	delay := RegisterRetryMaxDelay
+	if attempt < 32 && RegisterRetryBaseDelay<<uint(attempt-1) < delay {
+		delay = RegisterRetryBaseDelay << uint(attempt-1)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// rejectedRegistration is the error of the server rejecting the
+// registration with a 4xx status, which retrying does not fix.
+type rejectedRegistration struct {
+	error
+}
+
+func register() error {
 	if err := ReadGoServerCACert(); err != nil {
 		return err
 	}
 	if err := readAgentKeyAndCerts(registerData()); err != nil {
 		return err
 	}
+	return readPathPrefix()
+}
+
+// readPathPrefix reads the path prefix the server is mounted under, which
+// is saved at registration, into ContextPath of config.
+func readPathPrefix() error {
+	prefix, err := ioutil.ReadFile(config.PathPrefixFile)
+	if os.IsNotExist(err) {
+		config.ContextPath = ""
+		return nil
+	} else if err != nil {
+		return err
+	}
+	config.ContextPath = string(prefix)
 	return nil
 }
 
 func CleanRegistration() error {
 	files := []string{config.GoServerCAFile,
 		config.AgentPrivateKeyFile,
-		config.AgentCertFile}
+		config.AgentCertFile,
+		config.PathPrefixFile}
 	for _, f := range files {
 		_, err := os.Stat(f)
 		if err == nil {
@@ -137,11 +234,12 @@ func registerData() map[string]string {
 		"operatingSystem":               runtime.GOOS,
 		"usablespace":                   UsableSpaceString(),
 		"agentAutoRegisterKey":          config.AgentAutoRegisterKey,
-		"agentAutoRegisterResources":    config.AgentAutoRegisterResources,
-		"agentAutoRegisterEnvironments": config.AgentAutoRegisterEnvironments,
+		"agentAutoRegisterResources":    strings.Join(config.AgentAutoRegisterResources, ","),
+		"agentAutoRegisterEnvironments": strings.Join(config.AgentAutoRegisterEnvironments, ","),
 		"agentAutoRegisterHostname":     config.Hostname,
 		"elasticAgentId":                config.AgentAutoRegisterElasticAgentId,
 		"elasticPluginId":               config.AgentAutoRegisterElasticPluginId,
+		protocol.VersionParam:           strconv.Itoa(protocol.Version),
 	}
 }
 
@@ -173,6 +271,13 @@ func readAgentKeyAndCerts(params map[string]string) error {
 	}
 
 	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err := Err("Register failed, server responded %v", resp.Status)
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return rejectedRegistration{err}
+		}
+		return err
+	}
 	var registration protocol.Registration
 
 	dec := json.NewDecoder(resp.Body)
@@ -186,7 +291,7 @@ func readAgentKeyAndCerts(params map[string]string) error {
 
 	ioutil.WriteFile(config.AgentPrivateKeyFile, []byte(registration.AgentPrivateKey), 0600)
 	ioutil.WriteFile(config.AgentCertFile, []byte(registration.AgentCertificate), 0600)
-	return nil
+	return ioutil.WriteFile(config.PathPrefixFile, []byte(registration.PathPrefix), 0600)
 }
 
 func extractServerDN(certFileName string) (string, error) {
@@ -0,0 +1,49 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"time"
+)
+
+var (
+	RetryMaxAttempts = 3
+	RetryBaseDelay   = 1 * time.Second
+)
+
+// retry calls fn until it succeeds, the server responds with a client
+// error or RetryMaxAttempts is used up. Connection errors and 5xx
+// responses are retried with exponential backoff.
+func retry(log func(format string, a ...interface{}), action string, fn func(attempt int) (int, error)) (statusCode int, err error) {
+	for attempt := 1; ; attempt++ {
+		statusCode, err = fn(attempt)
+		if !shouldRetry(statusCode, err) || attempt >= RetryMaxAttempts {
+			return
+		}
+		delay := RetryBaseDelay * time.Duration(1<<uint(attempt-1))
+		if err != nil {
+			log("%v failed (attempt %v of %v): %v, retry in %v\n", action, attempt, RetryMaxAttempts, err, delay)
+		} else {
+			log("%v failed (attempt %v of %v): server responded %v, retry in %v\n", action, attempt, RetryMaxAttempts, statusCode, delay)
+		}
+		time.Sleep(delay)
+	}
+}
+
+func shouldRetry(statusCode int, err error) bool {
+	return err != nil || statusCode >= 500
+}
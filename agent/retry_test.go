@@ -0,0 +1,114 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	"bytes"
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadRetriesOnServerError(t *testing.T) {
+	RetryBaseDelay = time.Millisecond
+	defer func() { RetryBaseDelay = time.Second }()
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "retry-test")
+	assert.Nil(t, err)
+	var console bytes.Buffer
+	u, _ := url.Parse(ts.URL)
+	dest := filepath.Join(dir, "file.txt")
+	err = NewArtifacts(http.DefaultClient, &console).DownloadFile(u, dest)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, requests)
+	content, err := ioutil.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(content))
+	lines := split(console.String(), "\n")
+	assert.Equal(t, 5, len(lines))
+	assert.True(t, contains(lines[0], "(attempt 1 of 3): server responded 503, retry in 1ms"), lines[0])
+	assert.True(t, contains(lines[1], "(attempt 2 of 3): server responded 503, retry in 2ms"), lines[1])
+	assert.Equal(t, "Downloaded 5 of 5 bytes (100%)", lines[3])
+}
+
+func TestDownloadDoesNotRetryOnClientError(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "retry-test")
+	assert.Nil(t, err)
+	var console bytes.Buffer
+	u, _ := url.Parse(ts.URL)
+	err = NewArtifacts(http.DefaultClient, &console).DownloadFile(u, filepath.Join(dir, "file.txt"))
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, "", console.String())
+}
+
+func TestDownloadSendsIfNoneMatchForUnchangedFile(t *testing.T) {
+	etag := `"5d41402abc4b2a76b9719d911017c592"`
+	var ifNoneMatches []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ifNoneMatches = append(ifNoneMatches, req.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", etag)
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "etag-test")
+	assert.Nil(t, err)
+	u, _ := url.Parse(ts.URL)
+	dest := filepath.Join(dir, "file.txt")
+	artifacts := NewArtifacts(http.DefaultClient, ioutil.Discard)
+	assert.Nil(t, artifacts.DownloadFile(u, dest))
+	assert.Nil(t, artifacts.DownloadFile(u, dest))
+	content, err := ioutil.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	assert.Nil(t, ioutil.WriteFile(dest, []byte("changed"), 0644))
+	assert.Nil(t, artifacts.DownloadFile(u, dest))
+	content, err = ioutil.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(content))
+	assert.Equal(t, []string{"", etag, ""}, ifNoneMatches)
+}
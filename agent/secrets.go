@@ -0,0 +1,62 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// LoadSecrets loads the secrets masked in the console output of every
+// build, from file of name=value lines and from the environment
+// variables whose names start with envPrefix, named without the prefix.
+// Blank lines and lines starting with "#" are skipped. Errors never
+// include secret values.
+func LoadSecrets(file, envPrefix string) (map[string]string, error) {
+	secrets := make(map[string]string)
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			i := strings.Index(text, "=")
+			if i <= 0 {
+				return nil, Err("line %v of secrets file %v is not name=value", line, file)
+			}
+			secrets[strings.TrimSpace(text[:i])] = strings.TrimSpace(text[i+1:])
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if envPrefix != "" {
+		for _, env := range os.Environ() {
+			if i := strings.Index(env, "="); i > len(envPrefix) && strings.HasPrefix(env, envPrefix) {
+				secrets[env[len(envPrefix):i]] = env[i+1:]
+			}
+		}
+	}
+	return secrets, nil
+}
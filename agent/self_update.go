@@ -0,0 +1,229 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Version is the version of the agent binary, set at build time by
+// -ldflags "-X github.com/gocd-contrib/gocd-golang-agent/agent.Version=<version>".
+var Version = "dev"
+
+var (
+	ErrUpdated = Err("Agent binary is updated")
+
+	VerifyAgentBinaryTimeout = 30 * time.Second
+)
+
+// executable is the path of the running agent binary, resolved before
+// it could be renamed by an update.
+var executable string
+
+// selfUpdate updates the running agent binary and returns ErrUpdated
+// when it is replaced. Failed updates are logged and the agent keeps
+// running the current binary.
+func selfUpdate(client *http.Client) error {
+	if executable == "" {
+		LogWarn("skip agent binary update, the path of agent binary is unknown")
+		return nil
+	}
+	updated, err := UpdateAgentBinary(client, executable)
+	if err != nil {
+		LogWarn("update agent binary failed: %v", err)
+		return nil
+	}
+	if updated {
+		return ErrUpdated
+	}
+	return nil
+}
+
+// UpdateAgentBinary replaces the agent binary exe by the one advertised
+// by the server when their sha256 differ, and returns whether exe is
+// replaced. The downloaded binary is verified by its sha256 and by
+// running it with --version, which must print the advertised version,
+// before it replaces exe. The replaced binary is kept as exe.old, and
+// the update is marked unconfirmed, see RollbackUnconfirmedUpdate.
+func UpdateAgentBinary(client *http.Client, exe string) (bool, error) {
+	binaryURL, err := config.MakeFullServerURL(config.AgentBinaryPath)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Head(binaryURL.String())
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// the server does not distribute agent binaries
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, Err("checking agent binary failed, server responded %v", resp.Status)
+	}
+	version := resp.Header.Get(protocol.AgentBinaryVersionHeader)
+	expected := resp.Header.Get(protocol.AgentBinarySha256Header)
+	if expected == "" {
+		return false, Err("server did not advertise the sha256 of agent binary")
+	}
+	current, err := ComputeChecksum(exe)
+	if err != nil {
+		return false, err
+	}
+	if strings.EqualFold(current.Sha256, expected) {
+		return false, nil
+	}
+	if rejected, err := ioutil.ReadFile(exe + ".rejected"); err == nil && strings.EqualFold(strings.TrimSpace(string(rejected)), expected) {
+		return false, Err("agent binary %v was rolled back, skip updating to it", expected)
+	}
+
+	LogInfo("updating agent binary of version %v to %v", Version, version)
+	update := exe + ".new"
+	defer os.Remove(update)
+	if err := downloadAgentBinary(client, binaryURL.String(), update, expected); err != nil {
+		return false, err
+	}
+	if err := verifyAgentBinary(update, version); err != nil {
+		return false, err
+	}
+	backup := exe + ".old"
+	if err := os.Rename(exe, backup); err != nil {
+		return false, err
+	}
+	if err := os.Rename(update, exe); err != nil {
+		restoreAgentBinary(exe)
+		return false, err
+	}
+	if err := ioutil.WriteFile(exe+".update", []byte(expected), 0644); err != nil {
+		restoreAgentBinary(exe)
+		return false, err
+	}
+	return true, nil
+}
+
+func restoreAgentBinary(exe string) {
+	if err := os.Rename(exe+".old", exe); err != nil {
+		LogError("restore agent binary %v failed: %v", exe+".old", err)
+	}
+}
+
+// RollbackUnconfirmedUpdate is called when the agent binary exe starts
+// and returns whether exe is rolled back. An update is unconfirmed
+// until ConfirmUpdate is called by the updated binary. The first start
+// after an update is let run; an update still unconfirmed on the next
+// start is rolled back to exe.old, and its sha256 is kept in
+// exe.rejected so that it is not updated to again.
+func RollbackUnconfirmedUpdate(exe string) (bool, error) {
+	marker := exe + ".update"
+	data, err := ioutil.ReadFile(marker)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || fields[len(fields)-1] != "started" {
+		return false, ioutil.WriteFile(marker, []byte(strings.Join(append(fields, "started"), " ")), 0644)
+	}
+	LogWarn("agent binary update is not confirmed, roll back to %v", exe+".old")
+	if err := os.Rename(exe+".old", exe); err != nil {
+		return false, err
+	}
+	if len(fields) > 1 {
+		if err := ioutil.WriteFile(exe+".rejected", []byte(fields[0]), 0644); err != nil {
+			LogWarn("record rejected agent binary failed: %v", err)
+		}
+	}
+	return true, os.Remove(marker)
+}
+
+// ConfirmUpdate confirms the update of the agent binary exe, it is
+// called after the agent registered to the server.
+func ConfirmUpdate(exe string) error {
+	if err := os.Remove(exe + ".update"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func downloadAgentBinary(client *http.Client, binaryURL, dest, expected string) error {
+	resp, err := client.Get(binaryURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Err("download agent binary failed, server responded %v", resp.Status)
+	}
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), resp.Body)
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	if actual := Sprintf("%x", hash.Sum(nil)); !strings.EqualFold(actual, expected) {
+		return Err("downloaded agent binary sha256 %v does not match %v", actual, expected)
+	}
+	return nil
+}
+
+// verifyAgentBinary runs the agent binary with --version, so that a
+// binary not runnable on this agent does not replace the running one.
+func verifyAgentBinary(binary, version string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), VerifyAgentBinaryTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, binary, "--version").Output()
+	if err != nil {
+		return Err("run downloaded agent binary failed: %v", err)
+	}
+	if actual := strings.TrimSpace(string(output)); version != "" && actual != version {
+		return Err("downloaded agent binary is version %v, expected %v", actual, version)
+	}
+	return nil
+}
+
+// RestartAgent restarts the agent with its updated binary. It restores
+// the replaced binary and returns the error when the updated binary
+// cannot be started. The updated binary that starts but does not
+// register to the server is rolled back on its next start, see
+// RollbackUnconfirmedUpdate.
+func RestartAgent() error {
+	LogInfo("restarting agent %v", executable)
+	err := execAgent(executable)
+	restoreAgentBinary(executable)
+	if rerr := os.Remove(executable + ".update"); rerr != nil {
+		LogError("remove agent binary update marker failed: %v", rerr)
+	}
+	return err
+}
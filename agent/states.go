@@ -22,46 +22,104 @@ import (
 	"sync"
 )
 
-var state = map[string]string{
-	"runtimeStatus": "Idle",
+const (
+	RuntimeStatusIdle     = "Idle"
+	RuntimeStatusBuilding = "Building"
+)
+
+// AgentState is the state of a running agent reported to the server
+// in pings and build reports, it is safe for concurrent use.
+type AgentState struct {
+	mu                     sync.Mutex
+	cookie                 string
+	runtimeStatus          string
+	buildLocator           string
+	buildLocatorForDisplay string
+	secrets                map[string]string
+}
+
+func NewAgentState() *AgentState {
+	return &AgentState{runtimeStatus: RuntimeStatusIdle}
 }
 
-var lock sync.Mutex
+func (s *AgentState) Cookie() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cookie
+}
+
+func (s *AgentState) SetCookie(cookie string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	LogInfo("set cookie to %v", cookie)
+	s.cookie = cookie
+}
 
-func SetState(key, value string) {
-	lock.Lock()
-	defer lock.Unlock()
-	LogInfo("set %v to %v", key, value)
-	state[key] = value
+func (s *AgentState) RuntimeStatus() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.runtimeStatus
 }
 
-func GetState(key string) string {
-	lock.Lock()
-	defer lock.Unlock()
-	return state[key]
+func (s *AgentState) SetRuntimeStatus(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	LogInfo("set runtimeStatus to %v", status)
+	s.runtimeStatus = status
 }
 
-func GetAgentRuntimeInfo() *protocol.AgentRuntimeInfo {
-	info := protocol.AgentRuntimeInfo{
+func (s *AgentState) SetBuildLocator(locator, locatorForDisplay string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	LogInfo("set buildLocator to %v", locator)
+	s.buildLocator = locator
+	s.buildLocatorForDisplay = locatorForDisplay
+}
+
+// Secrets returns the secrets masked in the console output of every
+// build run by the agent, see LoadSecrets.
+func (s *AgentState) Secrets() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.secrets
+}
+
+func (s *AgentState) SetSecrets(secrets map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	LogInfo("set %v secrets", len(secrets))
+	s.secrets = secrets
+}
+
+func (s *AgentState) RuntimeInfo() *protocol.AgentRuntimeInfo {
+	load := CurrentSystemLoad()
+	usableSpace := UsableSpace()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	activeBuilds := 0
+	if s.runtimeStatus == RuntimeStatusBuilding {
+		activeBuilds = 1
+	}
+	return &protocol.AgentRuntimeInfo{
 		Identifier: &protocol.AgentIdentifier{
 			HostName:  config.Hostname,
 			IpAddress: config.IpAddress,
 			Uuid:      AgentId,
 		},
 		BuildingInfo: &protocol.AgentBuildingInfo{
-			BuildingInfo: GetState("buildLocatorForDisplay"),
-			BuildLocator: GetState("buildLocator"),
+			BuildingInfo: s.buildLocatorForDisplay,
+			BuildLocator: s.buildLocator,
 		},
-		RuntimeStatus:                GetState("runtimeStatus"),
+		RuntimeStatus:                s.runtimeStatus,
+		Cookie:                       s.cookie,
 		Location:                     config.WorkingDir,
-		UsableSpace:                  UsableSpace(),
+		UsableSpace:                  usableSpace,
+		LoadAverage:                  load.LoadAverage,
+		FreeMemory:                   load.FreeMemory,
+		ActiveBuilds:                 activeBuilds,
 		OperatingSystemName:          runtime.GOOS,
 		ElasticPluginId:              config.AgentAutoRegisterElasticPluginId,
 		ElasticAgentId:               config.AgentAutoRegisterElasticAgentId,
 		SupportsBuildCommandProtocol: true,
 	}
-	if cookie := GetState("cookie"); cookie != "" {
-		info.Cookie = cookie
-	}
-	return &info
 }
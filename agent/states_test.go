@@ -0,0 +1,65 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/agent"
+	"github.com/xli/assert"
+	"sync"
+	"testing"
+)
+
+func TestAgentStateConcurrentUpdatesAndPings(t *testing.T) {
+	state := NewAgentState()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			state.SetCookie(Sprintf("cookie-%v", i))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			state.SetBuildLocator(Sprintf("locator-%v", i), Sprintf("display-%v", i))
+			state.SetRuntimeStatus(RuntimeStatusBuilding)
+			state.SetRuntimeStatus(RuntimeStatusIdle)
+		}(i)
+		go func() {
+			defer wg.Done()
+			info := state.RuntimeInfo()
+			assert.True(t, info.RuntimeStatus == RuntimeStatusIdle || info.RuntimeStatus == RuntimeStatusBuilding)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, RuntimeStatusIdle, state.RuntimeStatus())
+	assert.NotEqual(t, "", state.Cookie())
+}
+
+func TestAgentStatesAreIndependent(t *testing.T) {
+	s1 := NewAgentState()
+	s2 := NewAgentState()
+	s1.SetCookie("cookie")
+	s1.SetRuntimeStatus(RuntimeStatusBuilding)
+
+	assert.Equal(t, "", s2.Cookie())
+	assert.Equal(t, RuntimeStatusIdle, s2.RuntimeStatus())
+	assert.Equal(t, "cookie", s1.RuntimeInfo().Cookie)
+	assert.Equal(t, RuntimeStatusBuilding, s1.RuntimeInfo().RuntimeStatus)
+	assert.Equal(t, 1, s1.RuntimeInfo().ActiveBuilds)
+	assert.Equal(t, 0, s2.RuntimeInfo().ActiveBuilds)
+}
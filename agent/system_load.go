@@ -0,0 +1,48 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+var SystemLoadCacheTTL = 30 * time.Second
+
+// SystemLoad is the load of the agent machine, -1 means unknown.
+type SystemLoad struct {
+	LoadAverage float64
+	FreeMemory  int64
+}
+
+var systemLoadCache struct {
+	mu        sync.Mutex
+	load      SystemLoad
+	updatedAt time.Time
+}
+
+// CurrentSystemLoad returns the system load cached for SystemLoadCacheTTL,
+// so that pings do not read it every time.
+func CurrentSystemLoad() SystemLoad {
+	systemLoadCache.mu.Lock()
+	defer systemLoadCache.mu.Unlock()
+	if time.Since(systemLoadCache.updatedAt) > SystemLoadCacheTTL {
+		systemLoadCache.load = readSystemLoad()
+		systemLoadCache.updatedAt = time.Now()
+	}
+	return systemLoadCache.load
+}
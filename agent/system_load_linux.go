@@ -0,0 +1,66 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agent
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func readSystemLoad() SystemLoad {
+	load := SystemLoad{LoadAverage: -1, FreeMemory: -1}
+	if data, err := ioutil.ReadFile("/proc/loadavg"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) > 0 {
+			if avg, err := strconv.ParseFloat(fields[0], 64); err == nil {
+				load.LoadAverage = avg
+			}
+		}
+	}
+	if free, err := readAvailableMemory("/proc/meminfo"); err == nil {
+		load.FreeMemory = free
+	} else {
+		LogDebug("read available memory failed: %v", err)
+	}
+	return load
+}
+
+func readAvailableMemory(meminfo string) (int64, error) {
+	f, err := os.Open(meminfo)
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return -1, err
+			}
+			return kb * 1024, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return -1, err
+	}
+	return -1, Err("MemAvailable is not found in %v", meminfo)
+}
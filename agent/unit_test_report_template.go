@@ -29,6 +29,20 @@ var UNIT_TEST_REPORT_TEMPLATE = `<div class="tests">
   </p>
 </div>
 
+{{if .TestCases}}
+<table class="section-table" cellpadding="2" cellspacing="0" border="0" width="98%">
+  <tr>
+    <td colspan="2" class="sectionheader">Test Timings</td>
+  </tr>
+  {{range .TestCases}}
+  <tr>
+    <td class="section-data">{{ .Name }}</td>
+    <td class="section-data test_duration">{{ .Time }}</td>
+  </tr>
+  {{end}}
+</table>
+{{end}}
+
 {{if .Failures }}
 <table class="section-table" cellpadding="2" cellspacing="0" border="0" width="98%">
   {{range .TestCases}}
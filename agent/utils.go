@@ -19,9 +19,12 @@ package agent
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -54,8 +57,21 @@ func Join(sep string, parts ...string) string {
 	return buf.String()
 }
 
+// IsSubPath returns true when path is dir or inside of dir. Paths are
+// compared by filepath.Rel, which ignores drive letter case on Windows.
+func IsSubPath(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func BaseDirOfPathWithWildcard(path string) string {
-	dir := strings.Split(path, "*")[0]
+	dir := path
+	if i := strings.IndexAny(path, wildcards); i > -1 {
+		dir = path[:i]
+	}
 	if dir == "" {
 		return ""
 	}
@@ -67,11 +83,13 @@ func BaseDirOfPathWithWildcard(path string) string {
 	return base[:len(base)-1]
 }
 
+// AppendUrlParam returns a copy of base with the query param set, the
+// value is query escaped and base is not changed.
 func AppendUrlParam(base *url.URL, paramName, paramValue string) *url.URL {
 	url, _ := url.Parse(base.String())
 	values := url.Query()
 	values.Set(paramName, paramValue)
-	base.RawQuery = values.Encode()
+	url.RawQuery = values.Encode()
 	return url
 }
 
@@ -85,6 +103,20 @@ func Mkdirs(path string) error {
 	return os.MkdirAll(path, 0755)
 }
 
+// PrepareWorkingDir creates dir when it is missing and checks it is
+// writable by creating a temp file in it.
+func PrepareWorkingDir(dir string) error {
+	if err := Mkdirs(dir); err != nil {
+		return Err("Working directory %v could not be created: %v", dir, err)
+	}
+	f, err := ioutil.TempFile(dir, ".write-check")
+	if err != nil {
+		return Err("Working directory %v is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
 func Sprintf(f string, args ...interface{}) string {
 	return fmt.Sprintf(f, args...)
 }
@@ -150,3 +182,37 @@ func ComputeMd5(filePath string) (string, error) {
 	var result []byte
 	return Sprintf("%x", hash.Sum(result)), nil
 }
+
+// ComputeChecksum returns the md5, sha256 and size of the file.
+func ComputeChecksum(filePath string) (*protocol.ArtifactChecksum, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readChecksum(file)
+}
+
+// computeSectionChecksum computes the checksum of size bytes of the file
+// starting at offset, e.g. a chunk of a chunked upload.
+func computeSectionChecksum(filePath string, offset, size int64) (*protocol.ArtifactChecksum, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readChecksum(io.NewSectionReader(file, offset, size))
+}
+
+func readChecksum(r io.Reader) (*protocol.ArtifactChecksum, error) {
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), r)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.ArtifactChecksum{
+		Md5:    Sprintf("%x", md5Hash.Sum(nil)),
+		Sha256: Sprintf("%x", sha256Hash.Sum(nil)),
+		Size:   size,
+	}, nil
+}
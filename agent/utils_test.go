@@ -18,6 +18,10 @@ package agent_test
 import (
 	. "github.com/gocd-contrib/gocd-golang-agent/agent"
 	"github.com/xli/assert"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -30,6 +34,43 @@ func TestBaseDirOfPathWithWildcard(t *testing.T) {
 	assert.Equal(t, "/hello/world", BaseDirOfPathWithWildcard("/hello/world/*.go"))
 	assert.Equal(t, "/hello/world", BaseDirOfPathWithWildcard("/hello/world/**/*.go"))
 	assert.Equal(t, "/hello/world", BaseDirOfPathWithWildcard("/hello/world/f*/*.go"))
+	assert.Equal(t, "/hello/world", BaseDirOfPathWithWildcard("/hello/world/?.go"))
+	assert.Equal(t, "/target", BaseDirOfPathWithWildcard("/target/{a,b}/*.jar"))
+}
+
+func TestAppendUrlParam(t *testing.T) {
+	base, err := url.Parse("https://localhost:8154/go/artifacts/builds/b1?file=a%20b.txt")
+	assert.Nil(t, err)
+	u := AppendUrlParam(base, "attempt", "1 & 2")
+	assert.Equal(t, "https://localhost:8154/go/artifacts/builds/b1?file=a%20b.txt", base.String())
+	assert.Equal(t, "a b.txt", u.Query().Get("file"))
+	assert.Equal(t, "1 & 2", u.Query().Get("attempt"))
+}
+
+func TestIsSubPath(t *testing.T) {
+	root := filepath.Join("pipelines", "p1")
+	assert.True(t, IsSubPath(root, root))
+	assert.True(t, IsSubPath(filepath.Join(root, "src"), root))
+	assert.True(t, IsSubPath(filepath.Join(root, "..foo"), root))
+	assert.True(t, !IsSubPath(filepath.Join("pipelines", "p10"), root))
+	assert.True(t, !IsSubPath(filepath.Join(root, "..", "p2"), root))
+	assert.True(t, !IsSubPath("pipelines", root))
+}
+
+func TestPrepareWorkingDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "working-dir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "agent", "work")
+	assert.Nil(t, PrepareWorkingDir(dir))
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(files))
+
+	file := filepath.Join(root, "file")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("hello"), 0644))
+	assert.NotNil(t, PrepareWorkingDir(filepath.Join(file, "work")))
 }
 
 func TestJoin(t *testing.T) {
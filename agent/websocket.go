@@ -19,6 +19,8 @@ package agent
 import (
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"golang.org/x/net/websocket"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -26,10 +28,38 @@ type WebsocketConnection struct {
 	Conn     *websocket.Conn
 	Send     chan *protocol.Message
 	Received chan *protocol.Message
+	sendDone chan bool
+}
+
+var SendMessagesOnCloseTimeout = 5 * time.Second
+
+// serverVersion is the protocol version of the server learned from the
+// messages it sent, messages are compressed and messages of actions
+// added by later versions are skipped until it is known.
+type serverVersion struct {
+	sync.Mutex
+	version int
+}
+
+func (v *serverVersion) get() int {
+	v.Lock()
+	defer v.Unlock()
+	return v.version
+}
+
+func (v *serverVersion) set(version int) {
+	v.Lock()
+	defer v.Unlock()
+	v.version = version
 }
 
 func (wc *WebsocketConnection) Close() {
 	close(wc.Send)
+	select {
+	case <-wc.sendDone:
+	case <-time.After(SendMessagesOnCloseTimeout):
+		LogInfo("wait for sending messages timeout, close websocket connection")
+	}
 	err := wc.Conn.Close()
 	if err != nil {
 		logger.Error.Printf("Close websocket connection failed: %v", err)
@@ -46,6 +76,7 @@ func MakeWebsocketConnection(wsLoc, httpLoc string) (*WebsocketConnection, error
 		return nil, err
 	}
 	wsConfig.TlsConfig = tlsConfig
+	wsConfig.Header.Set(protocol.VersionHeader, strconv.Itoa(protocol.Version))
 	LogInfo("connect to: %v", wsLoc)
 	ws, err := websocket.DialConfig(wsConfig)
 	if err != nil {
@@ -54,14 +85,17 @@ func MakeWebsocketConnection(wsLoc, httpLoc string) (*WebsocketConnection, error
 	ack := make(chan string)
 	send := make(chan *protocol.Message)
 	received := make(chan *protocol.Message)
+	sendDone := make(chan bool)
 
-	go startReceiveMessage(ws, received, ack)
-	go startSendMessage(ws, send, ack)
-	return &WebsocketConnection{Conn: ws, Send: send, Received: received}, nil
+	version := &serverVersion{}
+	go startReceiveMessage(ws, received, ack, version)
+	go startSendMessage(ws, send, ack, sendDone, version)
+	return &WebsocketConnection{Conn: ws, Send: send, Received: received, sendDone: sendDone}, nil
 }
 
-func startSendMessage(ws *websocket.Conn, send chan *protocol.Message, ack chan string) {
+func startSendMessage(ws *websocket.Conn, send chan *protocol.Message, ack chan string, done chan bool, version *serverVersion) {
 	defer LogDebug("! exit goroutine: send message")
+	defer close(done)
 	connClosed := false
 loop:
 	select {
@@ -71,12 +105,16 @@ loop:
 		if !ok {
 			return
 		}
+		if !protocol.SupportsAction(version.get(), msg.Action) {
+			LogInfo("skip %v message, server protocol version %v does not support it", msg.Action, version.get())
+			goto loop
+		}
 		LogInfo("--> %v", msg.Action)
 		if connClosed {
 			logger.Error.Printf("send message failed: connection is closed")
 			goto loop
 		}
-		if err := protocol.SendMessage(ws, msg); err == nil {
+		if err := protocol.SendMessageTo(ws, msg, version.get()); err == nil {
 			waitForMessageAck(msg.AckId, ack)
 			goto loop
 		} else {
@@ -107,7 +145,7 @@ func waitForMessageAck(ackId string, ack chan string) {
 	}
 }
 
-func startReceiveMessage(ws *websocket.Conn, received chan *protocol.Message, ack chan string) {
+func startReceiveMessage(ws *websocket.Conn, received chan *protocol.Message, ack chan string, version *serverVersion) {
 	defer LogDebug("! exit goroutine: receive message")
 	defer close(received)
 	for {
@@ -117,9 +155,17 @@ func startReceiveMessage(ws *websocket.Conn, received chan *protocol.Message, ac
 			return
 		}
 		LogInfo("<-- %v", msg.Action)
+		if protocol.SupportedVersion(msg.Version) {
+			version.set(msg.Version)
+		}
 
 		if msg.Action == "ack" {
-			ack <- msg.DataString()
+			ackId, err := msg.StringData()
+			if err != nil {
+				logger.Error.Printf("ignore ack message: %v", err)
+				continue
+			}
+			ack <- ackId
 		} else {
 			received <- msg
 		}
@@ -17,16 +17,36 @@
 package main
 
 import (
+	"fmt"
 	"github.com/gocd-contrib/gocd-golang-agent/agent"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "--version" {
+		fmt.Println(agent.Version)
+		return
+	}
 	agent.Initialize()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-signals
+		agent.Stop()
+	}()
 	for {
 		err := agent.Start()
+		if err == agent.ErrIdleTimeout || err == agent.ErrStopped {
+			return
+		}
+		if err == agent.ErrUpdated {
+			err = agent.RestartAgent()
+		}
 		if err != nil {
-			agent.LogInfo("something wrong: %v", err.Error())
+			agent.LogError("something wrong: %v", err.Error())
 		}
 		agent.LogInfo("sleep 10 seconds and restart")
 		time.Sleep(10 * time.Second)
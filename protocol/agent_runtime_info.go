@@ -33,6 +33,9 @@ type AgentRuntimeInfo struct {
 	RuntimeStatus                string             `json:"runtimeStatus"`
 	Location                     string             `json:"location"`
 	UsableSpace                  int64              `json:"usableSpace"`
+	LoadAverage                  float64            `json:"loadAverage"`
+	FreeMemory                   int64              `json:"freeMemory"`
+	ActiveBuilds                 int                `json:"activeBuilds"`
 	OperatingSystemName          string             `json:"operatingSystemName"`
 	Cookie                       string             `json:"cookie"`
 	AgentLauncherVersion         string             `json:"agentLauncherVersion"`
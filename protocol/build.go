@@ -16,18 +16,61 @@
 
 package protocol
 
+import (
+	"time"
+)
+
 const (
 	BuildPassed   = "Passed"
 	BuildFailed   = "Failed"
 	BuildCanceled = "Cancelled"
+	// BuildTimeout is the result of builds the server stops because
+	// they run longer than its max build duration.
+	BuildTimeout = "Timeout"
 )
 
+// Build is the data of a build message, json field names follow the
+// GoCD wire format.
 type Build struct {
-	BuildId                string
-	BuildLocator           string
-	BuildLocatorForDisplay string
-	ConsoleUrl             string
-	ArtifactUploadBaseUrl  string
-	PropertyBaseUrl        string
-	BuildCommand           *BuildCommand
+	BuildId                string            `json:"buildId"`
+	BuildLocator           string            `json:"buildLocator"`
+	BuildLocatorForDisplay string            `json:"buildLocatorForDisplay"`
+	ConsoleUrl             string            `json:"consoleUrl"`
+	ArtifactUploadBaseUrl  string            `json:"artifactUploadBaseUrl"`
+	PropertyBaseUrl        string            `json:"propertyBaseUrl"`
+	BuildCommand           *BuildCommand     `json:"buildCommand"`
+	Env                    map[string]string `json:"env"`
+	SecureEnv              map[string]string `json:"secureEnv"`
+	// Timeout is the max duration of the whole build, zero means no
+	// limit.
+	Timeout time.Duration `json:"timeout"`
+	Resume  *Resume       `json:"resume,omitempty"`
+}
+
+// Resume starts a build from the top level build command at Index,
+// skipping the commands before it. Env restores the environment the
+// skipped commands exported.
+type Resume struct {
+	Index int               `json:"index"`
+	Env   map[string]string `json:"env"`
+}
+
+func (b *Build) SetEnv(env map[string]string) *Build {
+	b.Env = env
+	return b
+}
+
+func (b *Build) SetSecureEnv(env map[string]string) *Build {
+	b.SecureEnv = env
+	return b
+}
+
+func (b *Build) SetTimeout(timeout time.Duration) *Build {
+	b.Timeout = timeout
+	return b
+}
+
+func (b *Build) SetResume(resume *Resume) *Build {
+	b.Resume = resume
+	return b
 }
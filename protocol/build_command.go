@@ -17,8 +17,12 @@
 package protocol
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -27,6 +31,11 @@ const (
 	RunIfConfigAny    = "any"
 	RunIfConfigPassed = "passed"
 
+	ArchiveZip = "zip"
+
+	UploadOnlyOnFailure = "onlyOnFailure"
+	UploadOnlyOnSuccess = "onlyOnSuccess"
+
 	CommandCompose             = "compose"
 	CommandCond                = "cond"
 	CommandAnd                 = "and"
@@ -46,16 +55,28 @@ const (
 	CommandDownloadDir         = "downloadDir"
 	CommandGenerateTestReport  = "generateTestReport"
 	CommandGenerateProperty    = "generateProperty"
+	CommandDumpEnv             = "dumpEnv"
+	CommandWriteFile           = "writeFile"
+	CommandScript              = "script"
+	CommandWaitFor             = "waitFor"
+
+	WaitForURL  = "url"
+	WaitForPort = "port"
+	WaitForFile = "file"
+
+	// RevisionProperty is the build property of the revision checked out
+	// by CheckoutCommand.
+	RevisionProperty = "revision"
 )
 
 type BuildCommand struct {
-	Name             string
-	Args             map[string]string
-	RunIfConfig      string
-	SubCommands      []*BuildCommand
-	WorkingDirectory string
-	Test             *BuildCommand
-	OnCancel         *BuildCommand
+	Name             string            `json:"name"`
+	Args             map[string]string `json:"args"`
+	RunIfConfig      string            `json:"runIfConfig"`
+	SubCommands      []*BuildCommand   `json:"subCommands"`
+	WorkingDirectory string            `json:"workingDirectory"`
+	Test             *BuildCommand     `json:"test"`
+	OnCancel         *BuildCommand     `json:"onCancel"`
 }
 
 func NewBuildCommand(name string) *BuildCommand {
@@ -103,6 +124,50 @@ func ExecCommand(args ...string) *BuildCommand {
 	return NewBuildCommand(CommandExec).AddArg("command", args[0]).AddListArg("args", args[1:])
 }
 
+// ExecPropertyCommand runs the executable like ExecCommand, and sets its
+// output without surrounding spaces as the build property name when it
+// succeeds.
+func ExecPropertyCommand(name string, args ...string) *BuildCommand {
+	return ExecCommand(args...).AddArg("property", name)
+}
+
+// ShellExecCommand runs the command line by the shell of the agent,
+// which is "/bin/sh -c" or "cmd /C" on windows agents by default, so it
+// may use pipes and globs; ExecCommand runs the executable directly.
+func ShellExecCommand(line string) *BuildCommand {
+	return ExecCommand(line).AddArg("shell", "true")
+}
+
+// ShellCommand runs the script by the shell of the agent operating
+// system, which is reported as runtime.GOOS when the agent registers.
+func ShellCommand(os, script string) *BuildCommand {
+	if os == "windows" {
+		return ExecCommand("cmd", "/c", script)
+	}
+	return ExecCommand("sh", "-c", script)
+}
+
+// ScriptCommand writes the multi-line script body to a temp file in the
+// agent sandbox and runs it by shell, which is one of "sh", "bash",
+// "cmd" and "powershell". An empty shell runs the script by sh, or by
+// cmd on windows agents.
+func ScriptCommand(shell, body string) *BuildCommand {
+	return NewBuildCommand(CommandScript).AddArg("shell", shell).AddArg("body", body)
+}
+
+// WaitForCommand blocks the build until the target is ready, polling
+// every interval and failing after timeout. The target is a url that
+// responds 200 for WaitForURL, a host:port accepting tcp connections for
+// WaitForPort, or a path relative to the working directory that exists
+// for WaitForFile.
+func WaitForCommand(kind, target string, interval, timeout time.Duration) *BuildCommand {
+	return NewBuildCommand(CommandWaitFor).SetArgs(map[string]string{
+		kind:       target,
+		"interval": interval.String(),
+		"timeout":  timeout.String(),
+	})
+}
+
 func ExportCommand(kvs ...string) *BuildCommand {
 	args := map[string]string{"name": kvs[0]}
 	if len(kvs) == 3 {
@@ -112,6 +177,10 @@ func ExportCommand(kvs ...string) *BuildCommand {
 	return NewBuildCommand(CommandExport).SetArgs(args)
 }
 
+func DumpEnvCommand() *BuildCommand {
+	return NewBuildCommand(CommandDumpEnv)
+}
+
 func ReportCurrentStatusCommand(jobState string) *BuildCommand {
 	args := map[string]string{"status": jobState}
 	return NewBuildCommand(CommandReportCurrentStatus).SetArgs(args)
@@ -151,6 +220,16 @@ func MkdirsCommand(path string) *BuildCommand {
 	return NewBuildCommand(CommandMkdirs).SetArgs(args)
 }
 
+// WriteFileCommand writes content to dest relative to the working
+// directory, content is masked in console log when secure is true.
+func WriteFileCommand(dest string, content []byte, secure bool) *BuildCommand {
+	return NewBuildCommand(CommandWriteFile).SetArgs(map[string]string{
+		"dest":    dest,
+		"content": base64.StdEncoding.EncodeToString(content),
+		"secure":  strconv.FormatBool(secure),
+	})
+}
+
 func CleandirCommand(path string, allows ...string) *BuildCommand {
 	return NewBuildCommand(CommandCleandir).AddArg("path", path).AddListArg("allowed", allows)
 }
@@ -164,6 +243,25 @@ func UploadArtifactCommand(src, dest, ignoreUnmatchError string) *BuildCommand {
 	return NewBuildCommand(CommandUploadArtifact).SetArgs(args)
 }
 
+// UploadArchiveCommand uploads the directory src as a single zip
+// artifact named after it, e.g. "dest/node_modules.zip", which is
+// extracted by DownloadArchiveCommand.
+func UploadArchiveCommand(src, dest, ignoreUnmatchError string) *BuildCommand {
+	return UploadArtifactCommand(src, dest, ignoreUnmatchError).AddArg("archive", ArchiveZip)
+}
+
+// UploadArtifactOnFailureCommand uploads src only when the build has
+// failed by the time the command runs, e.g. heap dumps or screenshots.
+func UploadArtifactOnFailureCommand(src, dest, ignoreUnmatchError string) *BuildCommand {
+	return UploadArtifactCommand(src, dest, ignoreUnmatchError).AddArg(UploadOnlyOnFailure, "true").RunIf(RunIfConfigAny)
+}
+
+// UploadArtifactOnSuccessCommand uploads src only when the build has
+// passed by the time the command runs.
+func UploadArtifactOnSuccessCommand(src, dest, ignoreUnmatchError string) *BuildCommand {
+	return UploadArtifactCommand(src, dest, ignoreUnmatchError).AddArg(UploadOnlyOnSuccess, "true").RunIf(RunIfConfigAny)
+}
+
 func DownloadFileCommand(src, url, dest, checksumUrl, checksumPath string) *BuildCommand {
 	return DownloadCommand(CommandDownloadFile, src, url, dest, checksumUrl, checksumPath)
 }
@@ -172,6 +270,12 @@ func DownloadDirCommand(src, url, dest, checksumUrl, checksumPath string) *Build
 	return DownloadCommand(CommandDownloadDir, src, url, dest, checksumUrl, checksumPath)
 }
 
+// DownloadArchiveCommand downloads the zip artifact uploaded by
+// UploadArchiveCommand and extracts the archived directory into dest.
+func DownloadArchiveCommand(src, url, dest, checksumUrl, checksumPath string) *BuildCommand {
+	return DownloadDirCommand(src, url, dest, checksumUrl, checksumPath).AddArg("archive", ArchiveZip)
+}
+
 func DownloadCommand(file_or_dir, src, url, dest, checksumUrl, checksumPath string) *BuildCommand {
 	args := map[string]string{
 		"src":          src,
@@ -187,6 +291,82 @@ func GenerateTestReportCommand(args ...string) *BuildCommand {
 	return NewBuildCommand(CommandGenerateTestReport).AddArg("uploadPath", args[0]).AddListArg("srcs", args[1:])
 }
 
+// CheckoutCommand checks out revision of the git repository repoURL into
+// dest, or of the mercurial repository when repoURL has the "hg+" prefix,
+// e.g. "hg+https://hg.example.com/repo". Revision is HEAD, or tip of
+// mercurial repositories, when empty. The password in repoURL, or the
+// user name when there is no password as it is a token, is masked as
+// written in repoURL and unescaped, and the revision checked out is set
+// as RevisionProperty. "$" in repoURL is escaped from environment
+// variable expansion of exec args.
+func CheckoutCommand(repoURL, revision, dest string) (*BuildCommand, error) {
+	scm := "git"
+	if strings.HasPrefix(repoURL, "hg+") {
+		scm, repoURL = "hg", strings.TrimPrefix(repoURL, "hg+")
+	}
+	commands := []*BuildCommand{MkdirsCommand(dest)}
+	if strings.Contains(repoURL, "://") {
+		u, err := url.Parse(repoURL)
+		if err != nil {
+			return nil, err
+		}
+		if u.User != nil {
+			credential, ok := u.User.Password()
+			if !ok {
+				credential = u.User.Username()
+			}
+			if credential != "" {
+				commands = append(commands, SecretCommand(credential))
+			}
+			if raw := rawCredential(repoURL); raw != "" && raw != credential {
+				commands = append(commands, SecretCommand(raw))
+			}
+		}
+	}
+	repoURL = strings.Replace(repoURL, "$", "$$", -1)
+	if scm == "hg" {
+		if revision == "" {
+			revision = "tip"
+		}
+		commands = append(commands,
+			ExecCommand("hg", "init").SetTest(TestCommand("-nd", ".hg").Setwd(dest)),
+			ExecCommand("hg", "pull", "--force", "-r", revision, repoURL),
+			ExecCommand("hg", "update", "--clean", "-r", revision),
+			ExecPropertyCommand(RevisionProperty, "hg", "log", "-r", ".", "--template", "{node}"))
+	} else {
+		if revision == "" {
+			revision = "HEAD"
+		}
+		commands = append(commands,
+			ExecCommand("git", "init"),
+			ExecCommand("git", "fetch", "--force", repoURL, revision),
+			ExecCommand("git", "checkout", "--force", "FETCH_HEAD"),
+			ExecPropertyCommand(RevisionProperty, "git", "rev-parse", "HEAD"))
+	}
+	for _, cmd := range commands[1:] {
+		cmd.Setwd(dest)
+	}
+	return ComposeCommand(commands...), nil
+}
+
+// rawCredential returns the password of the url, or the user name when
+// there is no password, as it is written in the url without unescaping.
+func rawCredential(repoURL string) string {
+	authority := repoURL[strings.Index(repoURL, "://")+3:]
+	if i := strings.IndexAny(authority, "/?#"); i >= 0 {
+		authority = authority[:i]
+	}
+	i := strings.LastIndex(authority, "@")
+	if i < 0 {
+		return ""
+	}
+	userinfo := authority[:i]
+	if j := strings.Index(userinfo, ":"); j >= 0 {
+		return userinfo[j+1:]
+	}
+	return userinfo
+}
+
 func (cmd *BuildCommand) RunIfAny() bool {
 	return strings.EqualFold(RunIfConfigAny, cmd.RunIfConfig)
 }
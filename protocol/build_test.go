@@ -0,0 +1,75 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+import (
+	"encoding/json"
+	"github.com/xli/assert"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBuildJSONRoundTripThroughMessage(t *testing.T) {
+	build := NewBuild("b1", "/builds/b1", "/builds/b1", "/console/b1", "/artifacts/b1", "/properties/b1",
+		ComposeCommand(
+			EchoCommand("hello").Setwd("src"),
+			ExecCommand("make", "test").SetTest(TestCommand("-f", "Makefile")),
+		).SetOnCancel(ExecCommand("make", "clean")),
+		EchoCommand("failed").RunIf("failed"),
+		EchoCommand("done").RunIf(RunIfConfigAny),
+	).SetEnv(map[string]string{"A": "1"}).SetSecureEnv(map[string]string{"TOKEN": "secret"}).SetTimeout(time.Hour)
+
+	for _, marshal := range []func(interface{}) ([]byte, byte, error){messageMarshal, versionedMessageMarshal} {
+		data, payloadType, err := marshal(BuildMessage(build))
+		assert.Nil(t, err)
+		var msg Message
+		assert.Nil(t, messageUnmarshal(data, payloadType, &msg))
+		received, err := msg.BuildData()
+		assert.Nil(t, err)
+		assert.Equal(t, build, received)
+	}
+}
+
+func TestBuildJSONFieldNames(t *testing.T) {
+	build := NewBuild("b1", "", "", "", "", "", EchoCommand("hello"))
+	var fields map[string]json.RawMessage
+	assert.Nil(t, json.Unmarshal([]byte(BuildMessage(build).Data), &fields))
+	assert.Equal(t, []string{"artifactUploadBaseUrl", "buildCommand", "buildId", "buildLocator",
+		"buildLocatorForDisplay", "consoleUrl", "env", "propertyBaseUrl", "secureEnv", "timeout"}, keys(fields))
+
+	var command map[string]json.RawMessage
+	assert.Nil(t, json.Unmarshal(fields["buildCommand"], &command))
+	assert.Equal(t, []string{"args", "name", "onCancel", "runIfConfig", "subCommands", "test", "workingDirectory"}, keys(command))
+}
+
+func TestBuildDecodesLegacyFieldNames(t *testing.T) {
+	msg := &Message{Action: BuildAction, Data: `{"BuildId":"b1","BuildCommand":{"Name":"echo","Args":{"line":"hello"},"RunIfConfig":"passed"}}`}
+	build, err := msg.BuildData()
+	assert.Nil(t, err)
+	assert.Equal(t, "b1", build.BuildId)
+	assert.Equal(t, EchoCommand("hello"), build.BuildCommand)
+}
+
+func keys(m map[string]json.RawMessage) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// UnknownSize is the size of checksums parsed from "path=md5" lines of
+// the legacy checksum file format.
+const UnknownSize = -1
+
+const (
+	ChecksumMd5    = "md5"
+	ChecksumSha256 = "sha256"
+)
+
+// ArtifactChecksum is an entry of the checksum manifest of a build, it
+// has the md5 or the sha256 of the artifact, or both.
+type ArtifactChecksum struct {
+	Path   string
+	Md5    string
+	Sha256 string
+	Size   int64
+}
+
+// Matches returns whether c and other have the same digest, compared by
+// sha256 when both have it, otherwise by md5. Checksums of different
+// algorithms do not match.
+func (c *ArtifactChecksum) Matches(other *ArtifactChecksum) bool {
+	if c.Sha256 != "" && other.Sha256 != "" {
+		return c.Sha256 == other.Sha256
+	}
+	return c.Md5 != "" && c.Md5 == other.Md5
+}
+
+// digest returns the sha256 prefixed by "sha256:" when c has it,
+// otherwise the md5.
+func (c *ArtifactChecksum) digest() string {
+	if c.Sha256 != "" {
+		return ChecksumSha256 + ":" + c.Sha256
+	}
+	return c.Md5
+}
+
+// WriteChecksums writes checksums as manifest lines of
+// "path<TAB>digest<TAB>size", the digest is the md5, or the sha256
+// prefixed by "sha256:" for checksums having it.
+func WriteChecksums(w io.Writer, checksums []*ArtifactChecksum) error {
+	var buf bytes.Buffer
+	for _, c := range checksums {
+		fmt.Fprintf(&buf, "%v\t%v\t%v\n", c.Path, c.digest(), c.Size)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ParseChecksums parses manifest lines, and "path=md5" lines of the
+// legacy format with UnknownSize. Empty lines and lines starting with
+// "#" are ignored.
+func ParseChecksums(data []byte) ([]*ArtifactChecksum, error) {
+	var checksums []*ArtifactChecksum
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		c, err := parseChecksum(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checksum at line %v: %v", n, err)
+		}
+		checksums = append(checksums, c)
+	}
+	return checksums, scanner.Err()
+}
+
+func parseChecksum(line string) (*ArtifactChecksum, error) {
+	if !strings.Contains(line, "\t") {
+		i := strings.LastIndex(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is neither path<TAB>md5<TAB>size nor path=md5", line)
+		}
+		return &ArtifactChecksum{Path: line[:i], Md5: line[i+1:], Size: UnknownSize}, nil
+	}
+	// the path may contain tabs, digest and size are the last two fields
+	sizeStart := strings.LastIndex(line, "\t")
+	digestStart := strings.LastIndex(line[:sizeStart], "\t")
+	if digestStart <= 0 {
+		return nil, fmt.Errorf("%q is not path<TAB>digest<TAB>size", line)
+	}
+	path := line[:digestStart]
+	size, err := strconv.ParseInt(line[sizeStart+1:], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size of %v: %v", path, err)
+	}
+	c := &ArtifactChecksum{Path: path, Size: size}
+	digest := line[digestStart+1 : sizeStart]
+	algorithm := ChecksumMd5
+	if i := strings.Index(digest, ":"); i >= 0 {
+		algorithm, digest = digest[:i], digest[i+1:]
+	}
+	switch algorithm {
+	case ChecksumMd5:
+		c.Md5 = digest
+	case ChecksumSha256:
+		c.Sha256 = digest
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %v of %v", algorithm, path)
+	}
+	return c, nil
+}
+
+// ChecksumsByPath returns md5 of checksums by path, later entries win.
+// Checksums without md5 are skipped.
+func ChecksumsByPath(checksums []*ArtifactChecksum) map[string]string {
+	ret := make(map[string]string, len(checksums))
+	for _, c := range checksums {
+		if c.Md5 != "" {
+			ret[c.Path] = c.Md5
+		}
+	}
+	return ret
+}
+
+// IndexChecksums returns checksums by path, later entries win.
+func IndexChecksums(checksums []*ArtifactChecksum) map[string]*ArtifactChecksum {
+	ret := make(map[string]*ArtifactChecksum, len(checksums))
+	for _, c := range checksums {
+		ret[c.Path] = c
+	}
+	return ret
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+import (
+	"bytes"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestWriteAndParseChecksums(t *testing.T) {
+	checksums := []*ArtifactChecksum{
+		{Path: "a.txt", Md5: "md5-a", Size: 10},
+		{Path: "libs/b c.txt", Md5: "md5-b", Size: 0},
+		{Path: "tab\tin name", Md5: "md5-c", Size: 3},
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, WriteChecksums(&buf, checksums))
+	assert.Equal(t, "a.txt\tmd5-a\t10\nlibs/b c.txt\tmd5-b\t0\ntab\tin name\tmd5-c\t3\n", buf.String())
+
+	parsed, err := ParseChecksums(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, checksums, parsed)
+}
+
+func TestParseChecksumsToleratesLegacyFormat(t *testing.T) {
+	data := "#comment\r\na.txt=md5-a\r\n\nlibs/b=c.txt=md5-b\nc.txt\tmd5-c\t3\n"
+	parsed, err := ParseChecksums([]byte(data))
+	assert.Nil(t, err)
+	assert.Equal(t, []*ArtifactChecksum{
+		{Path: "a.txt", Md5: "md5-a", Size: UnknownSize},
+		{Path: "libs/b=c.txt", Md5: "md5-b", Size: UnknownSize},
+		{Path: "c.txt", Md5: "md5-c", Size: 3},
+	}, parsed)
+	assert.Equal(t, map[string]string{"a.txt": "md5-a", "libs/b=c.txt": "md5-b", "c.txt": "md5-c"}, ChecksumsByPath(parsed))
+}
+
+func TestWriteAndParseMixedAlgorithmChecksums(t *testing.T) {
+	checksums := []*ArtifactChecksum{
+		{Path: "a.txt", Md5: "md5-a", Size: 10},
+		{Path: "b.txt", Sha256: "sha256-b", Size: 3},
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, WriteChecksums(&buf, checksums))
+	assert.Equal(t, "a.txt\tmd5-a\t10\nb.txt\tsha256:sha256-b\t3\n", buf.String())
+
+	parsed, err := ParseChecksums(append(buf.Bytes(), "c.txt=md5-c\nd.txt\tmd5:md5-d\t1\n"...))
+	assert.Nil(t, err)
+	assert.Equal(t, append(checksums,
+		&ArtifactChecksum{Path: "c.txt", Md5: "md5-c", Size: UnknownSize},
+		&ArtifactChecksum{Path: "d.txt", Md5: "md5-d", Size: 1},
+	), parsed)
+	assert.Equal(t, map[string]string{"a.txt": "md5-a", "c.txt": "md5-c", "d.txt": "md5-d"}, ChecksumsByPath(parsed))
+
+	both := &ArtifactChecksum{Md5: "md5-b", Sha256: "sha256-b"}
+	assert.True(t, parsed[1].Matches(both))
+	assert.True(t, both.Matches(&ArtifactChecksum{Md5: "md5-b"}))
+	assert.False(t, both.Matches(&ArtifactChecksum{Md5: "md5-b", Sha256: "other"}))
+	assert.False(t, parsed[0].Matches(parsed[1]))
+}
+
+func TestParseChecksumsRejectsMalformedLines(t *testing.T) {
+	for _, data := range []string{"a.txt", "=md5", "a.txt\tmd5", "a.txt\tmd5\tlarge", "\tmd5\t1", "a.txt\tsha1:digest\t1"} {
+		_, err := ParseChecksums([]byte(data + "\n"))
+		assert.NotNil(t, err, data)
+	}
+}
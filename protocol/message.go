@@ -18,6 +18,7 @@ package protocol
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/satori/go.uuid"
 )
 
@@ -31,12 +32,53 @@ const (
 	ReportCurrentStatusAction = "reportCurrentStatus"
 	ReportCompletingAction    = "reportCompleting"
 	ReportCompletedAction     = "reportCompleted"
+	ExecResultAction          = "execResult"
+	BuildResultAction         = "buildResult"
+	DeregisterAction          = "deregister"
 )
 
 type Message struct {
-	Action string `json:"action"`
-	Data   string `json:"data"`
-	AckId  string `json:"ackId"`
+	Action  string `json:"action"`
+	Data    string `json:"data"`
+	AckId   string `json:"ackId"`
+	Version int    `json:"version,omitempty"`
+}
+
+// DecodeData unmarshals message data into v, returns error when data
+// is not valid json of v's type.
+func (m *Message) DecodeData(v interface{}) error {
+	if err := json.Unmarshal([]byte(m.Data), v); err != nil {
+		return fmt.Errorf("invalid %v message data: %v", m.Action, err)
+	}
+	return nil
+}
+
+func (m *Message) StringData() (string, error) {
+	var str string
+	err := m.DecodeData(&str)
+	return str, err
+}
+
+func (m *Message) MapData() (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if err := m.DecodeData(&data); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("invalid %v message data: null", m.Action)
+	}
+	return data, nil
+}
+
+func (m *Message) BuildData() (*Build, error) {
+	var build Build
+	if err := m.DecodeData(&build); err != nil {
+		return nil, err
+	}
+	if build.BuildCommand == nil {
+		return nil, fmt.Errorf("invalid %v message data: no build command", m.Action)
+	}
+	return &build, nil
 }
 
 func (m *Message) DataBuild() *Build {
@@ -63,6 +105,18 @@ func (m *Message) Report() *Report {
 	return &report
 }
 
+func (m *Message) ExecResult() *ExecResult {
+	var result ExecResult
+	json.Unmarshal([]byte(m.Data), &result)
+	return &result
+}
+
+func (m *Message) BuildResult() *BuildResult {
+	var result BuildResult
+	json.Unmarshal([]byte(m.Data), &result)
+	return &result
+}
+
 func newMessage(action string, data interface{}) *Message {
 	json, err := json.Marshal(data)
 	if err != nil {
@@ -70,9 +124,10 @@ func newMessage(action string, data interface{}) *Message {
 	}
 
 	return &Message{
-		Action: action,
-		Data:   string(json),
-		AckId:  uuid.NewV4().String(),
+		Action:  action,
+		Data:    string(json),
+		AckId:   uuid.NewV4().String(),
+		Version: Version,
 	}
 }
 
@@ -100,10 +155,22 @@ func CompletedMessage(report *Report) *Message {
 	return ReportMessage(ReportCompletedAction, report)
 }
 
+func ExecResultMessage(result *ExecResult) *Message {
+	return newMessage(ExecResultAction, result)
+}
+
+func BuildResultMessage(result *BuildResult) *Message {
+	return newMessage(BuildResultAction, result)
+}
+
 func ReregisterMessage() *Message {
-	return &Message{Action: ReregisterAction}
+	return &Message{Action: ReregisterAction, Version: Version}
+}
+
+func DeregisterMessage(agentId string) *Message {
+	return newMessage(DeregisterAction, agentId)
 }
 
 func CancelMessage() *Message {
-	return &Message{Action: CancelBuildAction}
+	return &Message{Action: CancelBuildAction, Version: Version}
 }
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+import (
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestMessageStringData(t *testing.T) {
+	str, err := SetCookieMessage("cookie").StringData()
+	assert.Nil(t, err)
+	assert.Equal(t, "cookie", str)
+
+	_, err = PingMessage(&AgentRuntimeInfo{}).StringData()
+	assert.NotNil(t, err)
+	_, err = (&Message{Action: SetCookieAction, Data: "1"}).StringData()
+	assert.NotNil(t, err)
+	_, err = (&Message{Action: SetCookieAction}).StringData()
+	assert.NotNil(t, err)
+}
+
+func TestMessageMapData(t *testing.T) {
+	data, err := PingMessage(&AgentRuntimeInfo{Location: "/tmp"}).MapData()
+	assert.Nil(t, err)
+	assert.Equal(t, "/tmp", data["location"])
+
+	_, err = SetCookieMessage("cookie").MapData()
+	assert.NotNil(t, err)
+	_, err = (&Message{Action: PingAction, Data: "null"}).MapData()
+	assert.NotNil(t, err)
+	_, err = (&Message{Action: PingAction, Data: "[1]"}).MapData()
+	assert.NotNil(t, err)
+}
+
+func TestMessageBuildData(t *testing.T) {
+	msg := BuildMessage(&Build{BuildId: "1", BuildCommand: EchoCommand("hello")})
+	build, err := msg.BuildData()
+	assert.Nil(t, err)
+	assert.Equal(t, "1", build.BuildId)
+	assert.Equal(t, CommandEcho, build.BuildCommand.Name)
+
+	_, err = SetCookieMessage("cookie").BuildData()
+	assert.NotNil(t, err)
+	_, err = (&Message{Action: BuildAction, Data: `{"BuildId": 1}`}).BuildData()
+	assert.NotNil(t, err)
+	_, err = (&Message{Action: BuildAction, Data: `{"BuildId": "1"}`}).BuildData()
+	assert.NotNil(t, err)
+	_, err = (&Message{Action: BuildAction, Data: `{"BuildId": "1", "BuildCommand": "echo"}`}).BuildData()
+	assert.NotNil(t, err)
+}
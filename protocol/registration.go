@@ -16,6 +16,18 @@
 
 package protocol
 
+// Registration is the registration response of the server. PathPrefix
+// is the path the server is mounted under, build URLs sent by the
+// server include it.
 type Registration struct {
 	AgentPrivateKey, AgentCertificate string
+	PathPrefix                        string
 }
+
+const (
+	// AgentBinaryVersionHeader and AgentBinarySha256Header advertise the
+	// version and the hex sha256 digest of the agent binary the server
+	// expects agents to run, in responses of its agent binary endpoint.
+	AgentBinaryVersionHeader = "X-Agent-Binary-Version"
+	AgentBinarySha256Header  = "X-Agent-Binary-Sha256"
+)
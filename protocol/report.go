@@ -22,3 +22,34 @@ type Report struct {
 	JobState         string            `json:"jobState"`
 	AgentRuntimeInfo *AgentRuntimeInfo `json:"agentRuntimeInfo"`
 }
+
+type ExecResult struct {
+	BuildId  string `json:"buildId"`
+	Command  string `json:"command"`
+	ExitCode int    `json:"exitCode"`
+	Signal   string `json:"signal,omitempty"`
+}
+
+// BuildSummaryPath is the artifact path of the build result uploaded by
+// agents when it is enabled.
+const BuildSummaryPath = "cruise-output/result.json"
+
+// BuildResult is the result of a build and of the commands it ran, in
+// the order they were started. Composite commands are not listed, only
+// the commands they contain. Agents send it when a build completes.
+type BuildResult struct {
+	BuildId    string           `json:"buildId"`
+	Result     string           `json:"result"`
+	DurationMs int64            `json:"durationMs"`
+	Commands   []*CommandResult `json:"commands"`
+}
+
+type CommandResult struct {
+	Name          string `json:"name"`
+	Command       string `json:"command,omitempty"`
+	Result        string `json:"result"`
+	DurationMs    int64  `json:"durationMs"`
+	ExitCode      *int   `json:"exitCode,omitempty"`
+	Signal        string `json:"signal,omitempty"`
+	BytesUploaded int64  `json:"bytesUploaded,omitempty"`
+}
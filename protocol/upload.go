@@ -0,0 +1,39 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+const (
+	// A large artifact file is uploaded in chunks: each chunk is PUT to
+	// the artifacts url with ChunkedUploadParam naming the upload and
+	// ChunkIndexParam, then a POST with ChunkedUploadParam,
+	// ChunkCountParam, ArtifactFileParam and ArtifactMd5Param or
+	// ArtifactSha256Param assembles the chunks into the artifact file.
+	// A chunk PUT with ChunkMd5Param or ChunkSha256Param is verified as
+	// it is received, a corrupt chunk is not stored and responded with
+	// ChunkChecksumMismatchStatus, so that it can be sent again.
+	ChunkedUploadParam  = "upload"
+	ChunkIndexParam     = "chunk"
+	ChunkCountParam     = "chunks"
+	ChunkMd5Param       = "chunkMd5"
+	ChunkSha256Param    = "chunkSha256"
+	ArtifactFileParam   = "file"
+	ArtifactMd5Param    = "md5"
+	ArtifactSha256Param = "sha256"
+
+	// ChunkChecksumMismatchStatus is http.StatusUnprocessableEntity.
+	ChunkChecksumMismatchStatus = 422
+)
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// LegacyVersion is the protocol version of agents and servers that
+	// do not send their version.
+	LegacyVersion = 0
+	Version       = 1
+
+	// VersionHeader is the websocket handshake header and VersionParam
+	// is the registration form field for the agent protocol version.
+	VersionHeader = "X-Agent-Protocol-Version"
+	VersionParam  = "protocolVersion"
+)
+
+// ParseVersion parses the protocol version sent by the other side, an
+// empty version is LegacyVersion.
+func ParseVersion(version string) (int, error) {
+	if version == "" {
+		return LegacyVersion, nil
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol version %q", version)
+	}
+	if !SupportedVersion(v) {
+		return v, fmt.Errorf("unsupported protocol version %v, supported versions are %v to %v", v, LegacyVersion, Version)
+	}
+	return v, nil
+}
+
+func SupportedVersion(version int) bool {
+	return version >= LegacyVersion && version <= Version
+}
+
+// actionVersions are the protocol versions that introduced actions,
+// peers of older versions do not understand their messages.
+var actionVersions = map[string]int{
+	ExecResultAction:  1,
+	BuildResultAction: 1,
+}
+
+// SupportsAction returns whether a peer of the protocol version
+// understands messages of the action.
+func SupportsAction(version int, action string) bool {
+	return version >= actionVersions[action]
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+import (
+	"encoding/json"
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion("")
+	assert.Nil(t, err)
+	assert.Equal(t, LegacyVersion, v)
+
+	v, err = ParseVersion("1")
+	assert.Nil(t, err)
+	assert.Equal(t, Version, v)
+
+	_, err = ParseVersion("99")
+	assert.NotNil(t, err)
+	_, err = ParseVersion("v1")
+	assert.NotNil(t, err)
+}
+
+func TestMessageVersion(t *testing.T) {
+	data, err := json.Marshal(PingMessage(&AgentRuntimeInfo{}))
+	assert.Nil(t, err)
+	var msg Message
+	assert.Nil(t, json.Unmarshal(data, &msg))
+	assert.Equal(t, Version, msg.Version)
+
+	var legacy Message
+	assert.Nil(t, json.Unmarshal([]byte(`{"action":"ping","data":"{}"}`), &legacy))
+	assert.Equal(t, LegacyVersion, legacy.Version)
+}
+
+func TestSupportsAction(t *testing.T) {
+	assert.True(t, SupportsAction(LegacyVersion, PingAction))
+	assert.False(t, SupportsAction(LegacyVersion, BuildResultAction))
+	assert.False(t, SupportsAction(LegacyVersion, ExecResultAction))
+	assert.True(t, SupportsAction(Version, BuildResultAction))
+	assert.True(t, SupportsAction(Version, ExecResultAction))
+}
@@ -20,15 +20,45 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"golang.org/x/net/websocket"
+	"io"
 	"io/ioutil"
 )
 
+// CloseStatusMessageTooBig is the websocket close status of connections
+// closed for a message exceeding the size limit of the receiver.
+const CloseStatusMessageTooBig = 1009
+
+// ErrMessageTooLarge is returned by ReceiveMessageLimited for messages
+// exceeding the size limit.
+var ErrMessageTooLarge = errors.New("websocket message exceeds size limit")
+
+// CompressThreshold is the min JSON size of messages compressed when
+// sending to peers of protocol Version, smaller messages like pings are
+// sent as text frames. Messages to legacy peers are always compressed.
+var CompressThreshold = 512
+
 func messageMarshal(v interface{}) ([]byte, byte, error) {
 	json, jerr := json.Marshal(v)
 	if jerr != nil {
 		return []byte{}, websocket.BinaryFrame, jerr
 	}
+	return compress(json)
+}
+
+func versionedMessageMarshal(v interface{}) ([]byte, byte, error) {
+	json, err := json.Marshal(v)
+	if err != nil {
+		return []byte{}, websocket.BinaryFrame, err
+	}
+	if len(json) < CompressThreshold {
+		return json, websocket.TextFrame, nil
+	}
+	return compress(json)
+}
+
+func compress(json []byte) ([]byte, byte, error) {
 	var b bytes.Buffer
 	w := gzip.NewWriter(&b)
 	_, err := w.Write(json)
@@ -38,12 +68,40 @@ func messageMarshal(v interface{}) ([]byte, byte, error) {
 }
 
 func messageUnmarshal(msg []byte, payloadType byte, v interface{}) (err error) {
+	if payloadType == websocket.TextFrame {
+		return json.Unmarshal(msg, v)
+	}
 	reader, _ := gzip.NewReader(bytes.NewBuffer(msg))
 	jsonBytes, _ := ioutil.ReadAll(reader)
 	return json.Unmarshal(jsonBytes, v)
 }
 
-var messageCodec = websocket.Codec{messageMarshal, messageUnmarshal}
+// limitedMessageUnmarshal unmarshals messages like messageUnmarshal, but
+// stops decompressing a message once it exceeds maxSize bytes.
+func limitedMessageUnmarshal(maxSize int) func([]byte, byte, interface{}) error {
+	return func(msg []byte, payloadType byte, v interface{}) error {
+		if payloadType == websocket.TextFrame {
+			return json.Unmarshal(msg, v)
+		}
+		reader, err := gzip.NewReader(bytes.NewBuffer(msg))
+		if err != nil {
+			return err
+		}
+		jsonBytes, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+		if err != nil {
+			return err
+		}
+		if len(jsonBytes) > maxSize {
+			return ErrMessageTooLarge
+		}
+		return json.Unmarshal(jsonBytes, v)
+	}
+}
+
+var (
+	messageCodec          = websocket.Codec{Marshal: messageMarshal, Unmarshal: messageUnmarshal}
+	versionedMessageCodec = websocket.Codec{Marshal: versionedMessageMarshal, Unmarshal: messageUnmarshal}
+)
 
 func ReceiveMessage(conn *websocket.Conn) (*Message, error) {
 	var msg Message
@@ -51,6 +109,33 @@ func ReceiveMessage(conn *websocket.Conn) (*Message, error) {
 	return &msg, err
 }
 
+// ReceiveMessageLimited receives a message like ReceiveMessage, but
+// returns ErrMessageTooLarge instead of reading a frame of more than
+// maxSize bytes, or decompressing a message to more than maxSize bytes,
+// into memory. Non-positive maxSize is websocket.DefaultMaxPayloadBytes.
+func ReceiveMessageLimited(conn *websocket.Conn, maxSize int) (*Message, error) {
+	if maxSize <= 0 {
+		maxSize = websocket.DefaultMaxPayloadBytes
+	}
+	conn.MaxPayloadBytes = maxSize
+	codec := websocket.Codec{Marshal: messageMarshal, Unmarshal: limitedMessageUnmarshal(maxSize)}
+	var msg Message
+	err := codec.Receive(conn, &msg)
+	if err == websocket.ErrFrameTooLarge {
+		err = ErrMessageTooLarge
+	}
+	return &msg, err
+}
+
 func SendMessage(conn *websocket.Conn, msg *Message) error {
 	return messageCodec.Send(conn, msg)
 }
+
+// SendMessageTo sends the message to a peer of the protocol version,
+// only messages to legacy peers are always compressed.
+func SendMessageTo(conn *websocket.Conn, msg *Message, version int) error {
+	if version == LegacyVersion {
+		return messageCodec.Send(conn, msg)
+	}
+	return versionedMessageCodec.Send(conn, msg)
+}
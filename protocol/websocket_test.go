@@ -0,0 +1,63 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package protocol
+
+import (
+	"github.com/xli/assert"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSendMessageToCompressesLargeMessagesOnly(t *testing.T) {
+	payloadTypes := make(chan byte, 1)
+	received := make(chan *Message, 1)
+	typeCodec := websocket.Codec{Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		payloadTypes <- payloadType
+		return messageUnmarshal(data, payloadType, v)
+	}}
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		for {
+			var msg Message
+			if err := typeCodec.Receive(ws, &msg); err != nil {
+				return
+			}
+			received <- &msg
+		}
+	}))
+	defer ts.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", ts.URL)
+	assert.Nil(t, err)
+	defer ws.Close()
+
+	small := SetCookieMessage("cookie")
+	large := SetCookieMessage(strings.Repeat("x", CompressThreshold))
+	for _, c := range []struct {
+		msg         *Message
+		version     int
+		payloadType byte
+	}{
+		{small, Version, websocket.TextFrame},
+		{large, Version, websocket.BinaryFrame},
+		{small, LegacyVersion, websocket.BinaryFrame},
+	} {
+		assert.Nil(t, SendMessageTo(ws, c.msg, c.version))
+		assert.Equal(t, c.payloadType, <-payloadTypes)
+		assert.Equal(t, c.msg.Data, (<-received).Data)
+	}
+}
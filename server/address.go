@@ -0,0 +1,72 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+func (s *Server) listenAddress() string {
+	if s.BindAddress != "" {
+		return s.BindAddress
+	}
+	return s.Address
+}
+
+// URL is the https URL of the server advertised to agents, including
+// PathPrefix. Address is
+// "host:port" with IPv6 hosts in brackets like "[::1]:8154". The host of
+// the machine is advertised when the host of Address is empty or
+// unspecified like "0.0.0.0", so that the server can listen to all
+// interfaces by Address; use BindAddress to listen to them while
+// advertising another host by Address.
+func (s *Server) URL() (string, error) {
+	host, port, err := net.SplitHostPort(s.Address)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if host, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+	return "https://" + net.JoinHostPort(host, port) + s.prefixed(""), nil
+}
+
+// prefixed returns path mounted under PathPrefix, which is cleaned to
+// start with "/" and have no trailing "/".
+func (s *Server) prefixed(path string) string {
+	prefix := strings.Trim(s.PathPrefix, "/")
+	if prefix == "" {
+		return path
+	}
+	return "/" + prefix + path
+}
+
+// publicURL returns the url of path served by the server, which is
+// relative and mounted under PathPrefix unless PublicURL is set. Set
+// PublicURL, e.g. "https://proxy.example.com/ci", to the url a reverse
+// proxy forwards to PathPrefix of the server, so urls given to agents
+// and returned by ArtifactUrl and alike work behind the proxy.
+func (s *Server) publicURL(path string) string {
+	if s.PublicURL == "" {
+		return s.prefixed(path)
+	}
+	return strings.TrimSuffix(s.PublicURL, "/") + path
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLBracketsIPv6Host(t *testing.T) {
+	hostname, err := os.Hostname()
+	assert.Nil(t, err)
+	for address, url := range map[string]string{
+		"127.0.0.1:8154":        "https://127.0.0.1:8154",
+		"[::1]:8154":            "https://[::1]:8154",
+		"gocd.example.com:8154": "https://gocd.example.com:8154",
+		":8154":                 "https://" + net.JoinHostPort(hostname, "8154"),
+		"0.0.0.0:8154":          "https://" + net.JoinHostPort(hostname, "8154"),
+		"[::]:8154":             "https://" + net.JoinHostPort(hostname, "8154"),
+	} {
+		s := New(address, "", "", "", log.New(ioutil.Discard, "", 0))
+		u, err := s.URL()
+		assert.Nil(t, err)
+		assert.Equal(t, url, u, address)
+	}
+
+	_, err = New("::1:8154", "", "", "", log.New(ioutil.Discard, "", 0)).URL()
+	assert.NotNil(t, err)
+}
+
+func TestServerListensToBindAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "address-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "private.pem")
+	assert.Nil(t, NewCert("localhost").Generate(certFile, keyFile))
+
+	for _, host := range []string{"127.0.0.1", "::1", "localhost"} {
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			t.Logf("skip %v: %v", host, err)
+			continue
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+		bindAddress := net.JoinHostPort(host, strconv.Itoa(port))
+
+		s := New("gocd.example.com:8154", certFile, keyFile, dir, log.New(ioutil.Discard, "", 0))
+		s.BindAddress = bindAddress
+		started := make(chan error, 1)
+		go func() { started <- s.Start() }()
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		var resp *http.Response
+		for i := 0; i < 100; i++ {
+			if resp, err = client.Get("https://" + bindAddress + StatusPath); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Nil(t, err, bindAddress)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, bindAddress)
+		u, err := s.URL()
+		assert.Nil(t, err)
+		assert.Equal(t, "https://gocd.example.com:8154", u)
+
+		assert.Nil(t, s.Shutdown(context.Background()))
+		assert.Nil(t, <-started)
+	}
+}
+
+func TestServerMountedUnderPathPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "address-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "private.pem")
+	assert.Nil(t, NewCert("localhost").Generate(certFile, keyFile))
+	s := New("gocd.example.com:8154", certFile, keyFile, dir, log.New(ioutil.Discard, "", 0))
+	s.PathPrefix = "/gocd/"
+	s.Listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	started := make(chan error, 1)
+	go func() { started <- s.Start() }()
+	defer func() {
+		assert.Nil(t, s.Shutdown(context.Background()))
+		assert.Nil(t, <-started)
+	}()
+
+	u, err := s.URL()
+	assert.Nil(t, err)
+	assert.Equal(t, "https://gocd.example.com:8154/gocd", u)
+	build := s.NewBuild("b1")
+	assert.Equal(t, "/gocd/console/builds/b1", build.ConsoleUrl)
+	assert.Equal(t, "/gocd/artifacts/builds/b1", build.ArtifactUploadBaseUrl)
+	assert.Equal(t, "b1", parseBuildId(build.ConsoleUrl))
+
+	host := "https://" + s.Listener.Addr().String()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	upload := uploadRequest(t, "b1", "", "libs/foo.jar")
+	resp, err := client.Post(host+build.ArtifactUploadBaseUrl, upload.Header.Get("Content-Type"), upload.Body)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = client.Get(host + s.ArtifactUrl("b1", "libs/foo.jar"))
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "libs/foo.jar", string(content))
+
+	resp, err = client.Get(host + ArtifactsPath + "/builds/b1?file=libs/foo.jar")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	agent, err := DialFakeAgent(host+"/gocd", "a1")
+	assert.Nil(t, err)
+	agent.Close()
+}
+
+func TestBuildUrlsBehindReverseProxy(t *testing.T) {
+	for _, prefix := range []string{"", "/gocd"} {
+		dir, err := ioutil.TempDir("", "address-test")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "private.pem")
+		assert.Nil(t, NewCert("localhost").Generate(certFile, keyFile))
+		s := New("gocd.example.com:8154", certFile, keyFile, dir, log.New(ioutil.Discard, "", 0))
+		s.PathPrefix = prefix
+		s.Listener, err = net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		started := make(chan error, 1)
+		go func() { started <- s.Start() }()
+		defer func() {
+			assert.Nil(t, s.Shutdown(context.Background()))
+			assert.Nil(t, <-started)
+		}()
+
+		backend := &url.URL{Scheme: "https", Host: s.Listener.Addr().String()}
+		proxy := httptest.NewServer(&httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme, req.URL.Host = backend.Scheme, backend.Host
+				req.URL.Path = prefix + strings.TrimPrefix(req.URL.Path, "/ci")
+			},
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		})
+		defer proxy.Close()
+		s.PublicURL = proxy.URL + "/ci/"
+
+		build := s.NewBuild("b1")
+		assert.Equal(t, proxy.URL+"/ci/console/builds/b1", build.ConsoleUrl)
+		assert.Equal(t, proxy.URL+"/ci/console/builds/b1", s.ConsoleUrl("b1"))
+		assert.Equal(t, proxy.URL+"/ci/artifacts/builds/b1", build.ArtifactUploadBaseUrl)
+		assert.Equal(t, proxy.URL+"/ci/properties/builds/b1", build.PropertyBaseUrl)
+		assert.Equal(t, proxy.URL+"/ci/artifacts/builds/b1", s.ChecksumUrl("b1"))
+		assert.Equal(t, "b1", parseBuildId(build.ConsoleUrl))
+
+		upload := uploadRequest(t, "b1", "", "libs/foo.jar")
+		resp, err := http.Post(build.ArtifactUploadBaseUrl, upload.Header.Get("Content-Type"), upload.Body)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode, prefix)
+
+		resp, err = http.Get(s.ArtifactUrl("b1", "libs/foo.jar"))
+		assert.Nil(t, err)
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, prefix)
+		assert.Equal(t, "libs/foo.jar", string(content))
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"net/http"
+	"os"
+)
+
+const AgentBinaryPath = "/agent-binary"
+
+// agentBinaryHandler serves AgentBinaryFile for agents to update
+// themselves, with its version and sha256 in the response headers, so
+// that agents can check whether they run the expected binary with a
+// HEAD request.
+func agentBinaryHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if s.AgentBinaryFile == "" {
+			http.NotFound(w, req)
+			return
+		}
+		file, err := os.Open(s.AgentBinaryFile)
+		if err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		w.Header().Set(protocol.AgentBinaryVersionHeader, s.AgentBinaryVersion)
+		w.Header().Set(protocol.AgentBinarySha256Header, fmt.Sprintf("%x", hash.Sum(nil)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, req, "", info.ModTime(), file)
+	}
+}
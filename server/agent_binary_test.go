@@ -0,0 +1,56 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAgentBinaryIsServedWithVersionAndChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-binary-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+
+	w := httptest.NewRecorder()
+	agentBinaryHandler(s)(w, httptest.NewRequest(http.MethodHead, AgentBinaryPath, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	s.AgentBinaryFile = filepath.Join(dir, "agent")
+	s.AgentBinaryVersion = "1.2"
+	assert.Nil(t, ioutil.WriteFile(s.AgentBinaryFile, []byte("binary"), 0755))
+	w = httptest.NewRecorder()
+	agentBinaryHandler(s)(w, httptest.NewRequest(http.MethodHead, AgentBinaryPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1.2", w.Header().Get(protocol.AgentBinaryVersionHeader))
+	assert.Equal(t, sha256Hex("binary"), w.Header().Get(protocol.AgentBinarySha256Header))
+	assert.Equal(t, "", w.Body.String())
+
+	w = httptest.NewRecorder()
+	agentBinaryHandler(s)(w, httptest.NewRequest(http.MethodGet, AgentBinaryPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, sha256Hex("binary"), w.Header().Get(protocol.AgentBinarySha256Header))
+	assert.Equal(t, "binary", w.Body.String())
+}
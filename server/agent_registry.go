@@ -0,0 +1,181 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// AgentRegistration is the agent information posted to the server
+// when the agent registers itself.
+type AgentRegistration struct {
+	Uuid            string
+	Hostname        string
+	OperatingSystem string
+	Resources       []string
+	Environments    []string
+	ProtocolVersion int
+}
+
+func (reg *AgentRegistration) HasResources(resources []string) bool {
+	for _, r := range resources {
+		if !containsString(reg.Resources, r) {
+			return false
+		}
+	}
+	return true
+}
+
+type resourceBuild struct {
+	resources []string
+	build     *protocol.Build
+	agentId   chan string
+}
+
+func parseRegistration(req *http.Request) (*AgentRegistration, error) {
+	version, err := protocol.ParseVersion(req.FormValue(protocol.VersionParam))
+	if err != nil {
+		return nil, err
+	}
+	return &AgentRegistration{
+		Uuid:            req.FormValue("uuid"),
+		Hostname:        req.FormValue("hostname"),
+		OperatingSystem: req.FormValue("operatingSystem"),
+		Resources:       splitList(req.FormValue("agentAutoRegisterResources")),
+		Environments:    splitList(req.FormValue("agentAutoRegisterEnvironments")),
+		ProtocolVersion: version,
+	}, nil
+}
+
+func (s *Server) register(reg *AgentRegistration) {
+	if reg.Uuid == "" {
+		return
+	}
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.registrations[reg.Uuid] = reg
+}
+
+func (s *Server) Registration(agentId string) *AgentRegistration {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.registrations[agentId]
+}
+
+func (s *Server) updateRuntimeInfo(info *protocol.AgentRuntimeInfo) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.runtimeInfos[info.Identifier.Uuid] = info
+}
+
+func (s *Server) removeRuntimeInfo(agentId string) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	delete(s.runtimeInfos, agentId)
+}
+
+// AgentRuntimeInfo returns the runtime info of the agent's last ping.
+func (s *Server) AgentRuntimeInfo(agentId string) *protocol.AgentRuntimeInfo {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.runtimeInfos[agentId]
+}
+
+func (s *Server) agentStatuses() []*AgentStatus {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	statuses := make([]*AgentStatus, 0, len(s.runtimeInfos))
+	for id, info := range s.runtimeInfos {
+		statuses = append(statuses, &AgentStatus{
+			Uuid:          id,
+			RuntimeStatus: info.RuntimeStatus,
+			UsableSpace:   info.UsableSpace,
+			LoadAverage:   info.LoadAverage,
+			FreeMemory:    info.FreeMemory,
+			ActiveBuilds:  info.ActiveBuilds,
+		})
+	}
+	sort.Sort(byUuid(statuses))
+	return statuses
+}
+
+type byUuid []*AgentStatus
+
+func (a byUuid) Len() int           { return len(a) }
+func (a byUuid) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byUuid) Less(i, j int) bool { return a[i].Uuid < a[j].Uuid }
+
+// SendBuildToResource sends the build to an idle agent that has all the
+// given resources.
+func (s *Server) SendBuildToResource(resources []string, buildId string, commands ...*protocol.BuildCommand) error {
+	commands, err := s.interceptCommands(commands)
+	if err != nil {
+		return err
+	}
+	rb := &resourceBuild{
+		resources: resources,
+		build:     s.NewBuild(buildId, commands...),
+		agentId:   make(chan string),
+	}
+	s.routeBuild <- rb
+	if agentId := <-rb.agentId; agentId == "" {
+		return fmt.Errorf("no idle agent matches resources %v", resources)
+	}
+	return nil
+}
+
+// selectAgent returns the id of the first idle agent, in id order, that
+// has all the resources, or "" if there is none.
+func selectAgent(agents map[string]*RemoteAgent, builds *buildQueue, resources []string, registration func(string) *AgentRegistration) string {
+	ids := make([]string, 0, len(agents))
+	for id := range agents {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if !builds.idle(id) {
+			continue
+		}
+		if reg := registration(id); reg != nil && reg.HasResources(resources) {
+			return id
+		}
+	}
+	return ""
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/xli/assert"
+	"testing"
+)
+
+func TestSelectAgentMatchingAllResources(t *testing.T) {
+	agents, registration := testAgents(map[string][]string{
+		"a1": {"linux"},
+		"a2": {"docker", "linux"},
+	})
+	builds := newBuildQueue(0)
+	assert.Equal(t, "a2", selectAgent(agents, builds, []string{"linux", "docker"}, registration))
+	assert.Equal(t, "a1", selectAgent(agents, builds, []string{}, registration))
+}
+
+func TestSelectAgentReturnsEmptyWhenNoAgentMatches(t *testing.T) {
+	agents, registration := testAgents(map[string][]string{
+		"a1": {"linux"},
+	})
+	builds := newBuildQueue(0)
+	assert.Equal(t, "", selectAgent(agents, builds, []string{"windows"}, registration))
+	assert.Equal(t, "", selectAgent(agents, builds, []string{"linux", "docker"}, registration))
+}
+
+func TestSelectAgentSkipsBusyCandidates(t *testing.T) {
+	agents, registration := testAgents(map[string][]string{
+		"a1": {"docker"},
+		"a2": {"docker"},
+		"a3": {"docker"},
+	})
+	builds := newBuildQueue(0)
+	builds.running["a1"] = "build1"
+	builds.enqueue(&AgentMessage{agentId: "a2"})
+	assert.Equal(t, "a3", selectAgent(agents, builds, []string{"docker"}, registration))
+
+	builds.complete("a1", "build1")
+	assert.Equal(t, "a1", selectAgent(agents, builds, []string{"docker"}, registration))
+}
+
+func testAgents(resources map[string][]string) (map[string]*RemoteAgent, func(string) *AgentRegistration) {
+	agents := make(map[string]*RemoteAgent)
+	regs := make(map[string]*AgentRegistration)
+	for id, r := range resources {
+		agents[id] = &RemoteAgent{id: id}
+		regs[id] = &AgentRegistration{Uuid: id, Resources: r}
+	}
+	return agents, func(id string) *AgentRegistration { return regs[id] }
+}
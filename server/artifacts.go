@@ -19,19 +19,71 @@ package server
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"hash"
 	"io"
 	"io/ioutil"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+var (
+	errInvalidArtifactPath = errors.New("artifact path is outside of the artifacts directory")
+	errInvalidBuildId      = errors.New("build id must be a single path element")
+	errChecksumMismatch    = errors.New("artifact checksum does not match")
+)
+
+// artifactFile returns the artifact file path, it rejects absolute paths
+// and paths escaping the build artifacts directory, e.g. "../console.log".
+func (s *Server) artifactFile(buildId, file string) (string, error) {
+	if isAbsArtifactPath(file) {
+		return "", errInvalidArtifactPath
+	}
+	dir := s.ArtifactsDir(buildId)
+	fullPath := s.ArtifactFile(buildId, file)
+	rel, err := filepath.Rel(dir, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errInvalidArtifactPath
+	}
+	return fullPath, nil
+}
+
+// isAbsArtifactPath returns whether the slash separated artifact path is
+// absolute on any platform, e.g. "/etc/passwd", "\\host\share" or "C:/x".
+func isAbsArtifactPath(file string) bool {
+	return strings.HasPrefix(file, "/") || strings.HasPrefix(file, `\`) ||
+		len(file) > 1 && file[1] == ':' || filepath.IsAbs(filepath.FromSlash(file))
+}
+
+// validBuildId returns whether the build id names a directory in the
+// server working directory.
+func validBuildId(buildId string) bool {
+	return buildId != "" && buildId != "." && buildId != ".." && !strings.ContainsAny(buildId, `/\`)
+}
+
 func artifactsHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
+		if !validBuildId(parseBuildId(req.URL.Path)) {
+			s.responseBadRequest(errInvalidBuildId, w)
+			return
+		}
 		switch req.Method {
 		case http.MethodPost:
-			handleArtifactsUpload(s, w, req)
+			if _, ok := req.URL.Query()[protocol.ChunkedUploadParam]; ok {
+				handleChunkedUploadComplete(s, w, req)
+			} else {
+				handleArtifactsUpload(s, w, req)
+			}
+		case http.MethodPut:
+			handleArtifactChunk(s, w, req)
 		case http.MethodGet:
 			handleArtifactDownload(s, w, req)
 		default:
@@ -45,7 +97,14 @@ func handleArtifactDownload(s *Server, w http.ResponseWriter, req *http.Request)
 	file := req.URL.Query()["file"]
 	var fullPath string
 	if len(file) == 1 {
-		fullPath = s.ArtifactFile(buildId, file[0])
+		var err error
+		fullPath, err = s.artifactFile(buildId, file[0])
+		if err != nil {
+			s.responseBadRequest(err, w)
+			return
+		}
+	} else if _, ok := req.URL.Query()["manifest"]; ok {
+		fullPath = s.ChecksumManifestFile(buildId)
 	} else {
 		fullPath = s.ChecksumFile(buildId)
 	}
@@ -56,19 +115,25 @@ func handleArtifactDownload(s *Server, w http.ResponseWriter, req *http.Request)
 	}
 	if info.IsDir() {
 		s.log("Downloading directory %v", fullPath)
-		zipfile, err := zipDirecotry(fullPath)
-		if err != nil {
-			s.responseBadRequest(err, w)
-			return
-		}
-		f, err := os.Open(zipfile)
+		w.Header().Set("Content-Type", "application/zip")
+		err := zipDirectory(w, fullPath)
 		if err != nil {
-			s.responseBadRequest(err, w)
-			return
+			s.error("zip directory %v failed: %v", fullPath, err)
 		}
-		defer f.Close()
-		io.Copy(w, f)
 	} else {
+		if len(file) == 1 {
+			etag, err := s.artifactETag(buildId, file[0], fullPath)
+			if err != nil {
+				s.responseInternalError(err, w)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			if etagMatch(req.Header.Get("If-None-Match"), etag) {
+				s.log("%v is not modified", fullPath)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
 		s.log("Downloading %v", fullPath)
 		f, err := os.Open(fullPath)
 		if err != nil {
@@ -76,8 +141,85 @@ func handleArtifactDownload(s *Server, w http.ResponseWriter, req *http.Request)
 			return
 		}
 		defer f.Close()
-		io.Copy(w, f)
+		if len(file) == 1 {
+			w.Header().Set("Content-Type", artifactContentType(info.Name()))
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			if _, ok := req.URL.Query()["download"]; ok {
+				w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+			}
+		}
+		http.ServeContent(w, req, info.Name(), info.ModTime(), f)
+	}
+}
+
+// checksumWriter computes both the md5 and the sha256 of the data
+// written, so uploads checksummed by either algorithm can be verified.
+type checksumWriter struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	size   int64
+}
+
+func newChecksumWriter() *checksumWriter {
+	return &checksumWriter{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	w.md5.Write(p)
+	w.sha256.Write(p)
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+func (w *checksumWriter) checksum(path string) *protocol.ArtifactChecksum {
+	return &protocol.ArtifactChecksum{
+		Path:   path,
+		Md5:    fmt.Sprintf("%x", w.md5.Sum(nil)),
+		Sha256: fmt.Sprintf("%x", w.sha256.Sum(nil)),
+		Size:   w.size,
+	}
+}
+
+// artifactContentType returns the content type of the artifact by its
+// extension, e.g. html reports render in browsers. Unknown extensions
+// fall back to application/octet-stream instead of sniffing the content,
+// so an artifact is never rendered as html unless it is named so.
+func artifactContentType(name string) string {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype
 	}
+	return "application/octet-stream"
+}
+
+// artifactETag returns the quoted md5 of the artifact, the md5 recorded
+// in the build checksum file is used when there is one.
+func (s *Server) artifactETag(buildId, file, fullPath string) (string, error) {
+	if data, err := ioutil.ReadFile(s.ChecksumFile(buildId)); err == nil {
+		checksums, err := protocol.ParseChecksums(data)
+		if md5, ok := protocol.ChecksumsByPath(checksums)[file]; err == nil && ok {
+			return `"` + md5 + `"`, nil
+		}
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`"%x"`, hash.Sum(nil)), nil
+}
+
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
 }
 
 func handleArtifactsUpload(s *Server, w http.ResponseWriter, req *http.Request) {
@@ -87,84 +229,201 @@ func handleArtifactsUpload(s *Server, w http.ResponseWriter, req *http.Request)
 		s.responseBadRequest(err, w)
 		return
 	}
+	// files are extracted to a staging directory and moved into the
+	// artifacts directory after their checksums are verified, so that a
+	// rejected upload leaves nothing behind
+	if err := os.MkdirAll(filepath.Join(s.UploadsDir(), buildId), 0755); err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	staging, err := ioutil.TempDir(filepath.Join(s.UploadsDir(), buildId), "zip")
+	if err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	defer s.removeChunkedUpload(staging)
+	var checksums []*protocol.ArtifactChecksum
+	var uploadedChecksums map[string]*protocol.ArtifactChecksum
 	for {
 		part, err := form.NextPart()
 		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			s.responseBadRequest(err, w)
+			return
+		}
 		switch part.FormName() {
 		case "zipfile":
-			err = extractToArtifactDir(s, buildId, part)
+			extracted, err := extractToArtifactDir(s, buildId, staging, part)
+			checksums = append(checksums, extracted...)
+			if err == errInvalidArtifactPath {
+				s.responseBadRequest(err, w)
+				return
+			}
 			if err != nil {
 				s.responseInternalError(err, w)
 				return
 			}
 		case "file_checksum":
-			bytes, err := ioutil.ReadAll(part)
+			data, err := ioutil.ReadAll(part)
 			if err != nil {
 				s.responseInternalError(err, w)
 				return
 			}
-			err = s.appendToFile(s.ChecksumFile(buildId), bytes)
+			uploaded, err := protocol.ParseChecksums(data)
 			if err != nil {
-				s.responseInternalError(err, w)
+				s.responseBadRequest(err, w)
 				return
 			}
+			uploadedChecksums = protocol.IndexChecksums(uploaded)
+		}
+	}
+	for _, c := range checksums {
+		if uploaded, ok := uploadedChecksums[c.Path]; ok && !uploaded.Matches(c) {
+			s.responseBadRequest(fmt.Errorf("%v: %v", errChecksumMismatch, c.Path), w)
+			return
+		}
+	}
+	moved := make(map[string]bool)
+	for _, c := range checksums {
+		if moved[c.Path] {
+			continue
 		}
+		moved[c.Path] = true
+		if err := replaceArtifact(stagedArtifactFile(staging, c.Path), s.ArtifactFile(buildId, c.Path)); err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+	}
+	err = s.appendChecksums(buildId, checksums)
+	if err != nil {
+		s.responseInternalError(err, w)
+		return
 	}
 	w.WriteHeader(http.StatusCreated)
 }
 
-func extractToArtifactDir(s *Server, buildId string, part *multipart.Part) error {
-	// TODO: find out the right way to unzip multipart.Part in memory
-	data, err := ioutil.ReadAll(part)
-	if err != nil {
+// appendChecksums appends "file=md5" lines of the uploaded artifacts to
+// the build checksum file, which is served for verifying downloads, and
+// their manifest lines with the digest of ChecksumAlgorithm to the build
+// checksum manifest.
+func (s *Server) appendChecksums(buildId string, checksums []*protocol.ArtifactChecksum) error {
+	if len(checksums) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	manifest := make([]*protocol.ArtifactChecksum, len(checksums))
+	for i, c := range checksums {
+		fmt.Fprintf(&buf, "%v=%v\n", c.Path, c.Md5)
+		entry := *c
+		if s.ChecksumAlgorithm != protocol.ChecksumSha256 {
+			entry.Sha256 = ""
+		}
+		manifest[i] = &entry
+	}
+	if err := s.appendToFile(s.ChecksumFile(buildId), buf.Bytes()); err != nil {
 		return err
 	}
-	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
-	if err != nil {
+	buf.Reset()
+	if err := protocol.WriteChecksums(&buf, manifest); err != nil {
 		return err
 	}
+	return s.appendToFile(s.ChecksumManifestFile(buildId), buf.Bytes())
+}
+
+// stagedArtifactFile returns the path of the artifact file extracted to
+// the staging directory.
+func stagedArtifactFile(staging, file string) string {
+	return filepath.Join(staging, filepath.FromSlash(file))
+}
+
+// extractToArtifactDir extracts the zip part to the staging directory,
+// rejecting files that would be outside of the build artifacts
+// directory once moved there.
+func extractToArtifactDir(s *Server, buildId, staging string, part *multipart.Part) ([]*protocol.ArtifactChecksum, error) {
+	tmp, err := ioutil.TempFile("", "artifact.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, part)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return nil, err
+	}
+	zipReader, err := zip.OpenReader(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer zipReader.Close()
+	extract := extractArtifactFile
+	if s.DedupArtifacts {
+		extract = s.extractArtifactBlob
+	}
+	var checksums []*protocol.ArtifactChecksum
 	for _, file := range zipReader.File {
-		dest := s.ArtifactFile(buildId, file.FileHeader.Name)
-		err := extractArtifactFile(file, dest)
+		if _, err := s.artifactFile(buildId, file.FileHeader.Name); err != nil {
+			return checksums, err
+		}
+		checksum, err := extract(file, stagedArtifactFile(staging, file.FileHeader.Name))
 		if err != nil {
-			return err
+			return checksums, err
 		}
+		checksums = append(checksums, checksum)
+	}
+	return checksums, nil
+}
+
+func artifactPerm(file *zip.File) os.FileMode {
+	if perm := file.Mode().Perm(); perm != 0 {
+		return perm
 	}
-	return nil
+	return 0644
 }
 
-func extractArtifactFile(file *zip.File, dest string) error {
+// extractArtifactFile extracts the file to dest and returns its
+// checksum. An existing dest is removed first instead of truncated, it
+// may be a hard link to a blob shared with other builds.
+func extractArtifactFile(file *zip.File, dest string) (*protocol.ArtifactChecksum, error) {
 	rc, err := file.Open()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rc.Close()
 
 	err = os.MkdirAll(filepath.Dir(dest), 0755)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
-	destFile, err := os.Create(dest)
+	perm := artifactPerm(file)
+	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	hash := newChecksumWriter()
+	_, err = io.Copy(io.MultiWriter(destFile, hash), rc)
+	if err1 := destFile.Close(); err == nil {
+		err = err1
 	}
-	defer destFile.Close()
-	_, err = io.Copy(destFile, rc)
-	return err
-}
-
-func zipDirecotry(source string) (string, error) {
-	zipfile, err := ioutil.TempFile("", "tmp.zip")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer zipfile.Close()
-	w := zip.NewWriter(zipfile)
-	defer w.Close()
+	return hash.checksum(file.FileHeader.Name), os.Chmod(dest, perm)
+}
+
+// zipDirectory streams the directory as a zip to w, entries are named
+// by their path relative to the parent of the directory and keep their
+// file modes.
+func zipDirectory(w io.Writer, source string) error {
+	zw := zip.NewWriter(w)
 	_, dirName := filepath.Split(source)
-	err = filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -177,8 +436,13 @@ func zipDirecotry(source string) (string, error) {
 			return err
 		}
 		defer file.Close()
-		destFile := dirName + path[len(source):]
-		writer, err := w.Create(destFile)
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(dirName + path[len(source):])
+		header.Method = zip.Deflate
+		writer, err := zw.CreateHeader(header)
 		if err != nil {
 			return err
 		}
@@ -186,6 +450,8 @@ func zipDirecotry(source string) (string, error) {
 		_, err = io.Copy(writer, file)
 		return err
 	})
-	return zipfile.Name(), err
-
+	if err1 := zw.Close(); err == nil {
+		err = err1
+	}
+	return err
 }
@@ -0,0 +1,480 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUploadRejectsArtifactOutsideOfArtifactsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, uploadRequest(t, "b1", "", "../../evil.txt"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	_, err = os.Stat(filepath.Join(dir, "evil.txt"))
+	assert.True(t, os.IsNotExist(err), "artifact should not be extracted outside of artifacts dir")
+
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, uploadRequest(t, "b1", "", "libs/nested/foo.jar"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	_, err = os.Stat(s.ArtifactFile("b1", "libs/nested/foo.jar"))
+	assert.Nil(t, err)
+}
+
+func TestDownloadRejectsArtifactOutsideOfArtifactsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	assert.Nil(t, s.appendToFile(s.ConsoleLogFile("b1"), []byte("secret")))
+
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, httptest.NewRequest(http.MethodGet, s.ArtifactUrl("b1", "../console.log"), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "", w.Body.String())
+}
+
+func TestBuildResultOfInvalidBuildIdIsRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", filepath.Join(dir, "work"), log.New(ioutil.Discard, "", 0))
+
+	for _, buildId := range []string{"", ".", "..", "../evil", `..\evil`} {
+		err := s.writeBuildResult(&protocol.BuildResult{BuildId: buildId, Result: protocol.BuildPassed})
+		assert.Equal(t, errInvalidBuildId, err, buildId)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+
+	assert.Nil(t, s.writeBuildResult(&protocol.BuildResult{BuildId: "b1", Result: protocol.BuildPassed}))
+	result, err := s.BuildResult("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, protocol.BuildPassed, result.Result)
+}
+
+func TestArtifactPathTraversalIsRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+
+	for _, file := range []string{"..", "../console.log", "libs/../../console.log", "/etc/passwd", `\\host\share`, "C:/evil.txt"} {
+		_, err := s.artifactFile("b1", file)
+		assert.Equal(t, errInvalidArtifactPath, err, file)
+	}
+	path, err := s.artifactFile("b1", "libs/../foo.jar")
+	assert.Nil(t, err)
+	assert.Equal(t, s.ArtifactFile("b1", "foo.jar"), path)
+
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, uploadRequest(t, "b1", "", "/evil.txt"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	_, err = os.Stat(s.ArtifactFile("b1", "evil.txt"))
+	assert.True(t, os.IsNotExist(err), "absolute artifact path should not be extracted")
+
+	assert.Nil(t, s.appendToFile(s.ConsoleLogFile("b1"), []byte("secret")))
+	for _, target := range []string{
+		ArtifactsPath + "/builds/b1?file=..%2Fconsole.log",
+		ArtifactsPath + "/builds/b1?file=%2E%2E%2Fconsole.log",
+		ArtifactsPath + "/builds/b1?file=" + url.QueryEscape(s.ConsoleLogFile("b1")),
+		ArtifactsPath + "/builds/..?file=b1%2Fconsole.log",
+	} {
+		w := httptest.NewRecorder()
+		artifactsHandler(s)(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, target)
+		assert.False(t, strings.Contains(w.Body.String(), "secret"), target)
+	}
+}
+
+func TestArtifactUrlRoundTripsSpecialCharactersInNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	names := []string{"my report (1).html", "a+b.txt", "x&y=z.txt", "100%.txt", "#1?.txt", "报告.txt"}
+
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, uploadRequest(t, "b1", "", names...))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	for _, name := range names {
+		w := httptest.NewRecorder()
+		artifactsHandler(s)(w, httptest.NewRequest(http.MethodGet, s.ArtifactUrl("b1", name), nil))
+		assert.Equal(t, http.StatusOK, w.Code, name)
+		assert.Equal(t, name, w.Body.String())
+	}
+}
+
+func TestUploadAppendsChecksumsOfArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, uploadRequest(t, "b1", "", "a.txt", "libs/b.txt"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	checksum, err := s.Checksum("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, "a.txt="+md5Hex("a.txt")+"\nlibs/b.txt="+md5Hex("libs/b.txt")+"\n", checksum)
+
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, httptest.NewRequest(http.MethodGet, s.ChecksumUrl("b1"), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, checksum, w.Body.String())
+
+	manifest := "a.txt\t" + md5Hex("a.txt") + "\t5\nlibs/b.txt\t" + md5Hex("libs/b.txt") + "\t10\n"
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, httptest.NewRequest(http.MethodGet, s.ChecksumManifestUrl("b1"), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, manifest, w.Body.String())
+
+	checksums, err := s.ChecksumManifest("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, []*protocol.ArtifactChecksum{
+		{Path: "a.txt", Md5: md5Hex("a.txt"), Size: 5},
+		{Path: "libs/b.txt", Md5: md5Hex("libs/b.txt"), Size: 10},
+	}, checksums)
+}
+
+func TestChecksumManifestFallsBackToLegacyChecksumFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	assert.Nil(t, s.appendToFile(s.ChecksumFile("b1"), []byte("#comment\na.txt=md5-a\n")))
+
+	checksums, err := s.ChecksumManifest("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, []*protocol.ArtifactChecksum{
+		{Path: "a.txt", Md5: "md5-a", Size: protocol.UnknownSize},
+	}, checksums)
+}
+
+func TestSha256ChecksumsAreRecordedAndVerified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.ChecksumAlgorithm = protocol.ChecksumSha256
+
+	uploaded := "a.txt\tsha256:" + sha256Hex("a.txt") + "\t5\nb.txt=" + md5Hex("b.txt") + "\n"
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, uploadRequest(t, "b1", uploaded, "a.txt", "b.txt"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	checksums, err := s.ChecksumManifest("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, []*protocol.ArtifactChecksum{
+		{Path: "a.txt", Sha256: sha256Hex("a.txt"), Size: 5},
+		{Path: "b.txt", Sha256: sha256Hex("b.txt"), Size: 5},
+	}, checksums)
+	checksum, err := s.Checksum("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, "a.txt="+md5Hex("a.txt")+"\nb.txt="+md5Hex("b.txt")+"\n", checksum)
+
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, uploadRequest(t, "b2", "a.txt\tsha256:"+sha256Hex("other")+"\t5\n", "a.txt"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUploadRejectsMismatchedChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, uploadRequest(t, "b1", "#comment\na.txt=0123456789abcdef\n", "a.txt", "libs/b.txt"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	_, err = s.Checksum("b1")
+	assert.NotNil(t, err)
+	for _, file := range []string{"a.txt", "libs/b.txt"} {
+		_, err = os.Stat(s.ArtifactFile("b1", file))
+		assert.True(t, os.IsNotExist(err), "rejected artifact should not be kept: "+file)
+	}
+	_, err = os.Stat(filepath.Join(s.UploadsDir(), "b1"))
+	assert.True(t, os.IsNotExist(err), "staged artifacts should be removed")
+
+	s.DedupArtifacts = true
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, uploadRequest(t, "b1", "a.txt="+md5Hex("a.txt")+"\n", "a.txt", "libs/b.txt"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	content, err := ioutil.ReadFile(s.ArtifactFile("b1", "libs/b.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "libs/b.txt", string(content))
+}
+
+func TestDownloadArtifactRespondsNotModifiedForMatchedETag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, uploadRequest(t, "b1", "", "a.txt"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	etag := `"` + md5Hex("a.txt") + `"`
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, httptest.NewRequest(http.MethodGet, s.ArtifactUrl("b1", "a.txt"), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, "a.txt", w.Body.String())
+
+	req := httptest.NewRequest(http.MethodGet, s.ArtifactUrl("b1", "a.txt"), nil)
+	req.Header.Set("If-None-Match", `"stale", `+etag)
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, req)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, "", w.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, s.ArtifactUrl("b1", "a.txt"), nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "a.txt", w.Body.String())
+}
+
+func TestDownloadArtifactContentTypeByExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	for _, file := range []string{"report/index.html", "heap.unknownext"} {
+		assert.Nil(t, s.appendToFile(s.ArtifactFile("b1", file), []byte("<html></html>")))
+	}
+
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, httptest.NewRequest(http.MethodGet, s.ArtifactUrl("b1", "report/index.html"), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "", w.Header().Get("Content-Disposition"))
+
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, httptest.NewRequest(http.MethodGet, s.ArtifactUrl("b1", "heap.unknownext"), nil))
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, httptest.NewRequest(http.MethodGet, s.ArtifactUrl("b1", "report/index.html")+"&download", nil))
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=index.html`, w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "<html></html>", w.Body.String())
+}
+
+func TestDownloadArtifactETagWithoutChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	assert.Nil(t, s.appendToFile(s.ArtifactFile("b1", "a.txt"), []byte("hello")))
+
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, httptest.NewRequest(http.MethodGet, s.ArtifactUrl("b1", "a.txt"), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"`+md5Hex("hello")+`"`, w.Header().Get("ETag"))
+}
+
+func TestDedupArtifactsStoresSameContentOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.DedupArtifacts = true
+
+	for _, buildId := range []string{"b1", "b2"} {
+		w := httptest.NewRecorder()
+		artifactsHandler(s)(w, uploadRequest(t, buildId, "", "libs/foo.jar"))
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+
+	blobs, err := ioutil.ReadDir(s.BlobsDir())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(blobs))
+	f1, err := os.Stat(s.ArtifactFile("b1", "libs/foo.jar"))
+	assert.Nil(t, err)
+	f2, err := os.Stat(s.ArtifactFile("b2", "libs/foo.jar"))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(f1, f2), "artifacts of same content should share the blob")
+
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, httptest.NewRequest(http.MethodGet, s.ArtifactUrl("b2", "libs/foo.jar"), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "libs/foo.jar", w.Body.String())
+	checksum, err := s.Checksum("b2")
+	assert.Nil(t, err)
+	assert.Equal(t, "libs/foo.jar="+md5Hex("libs/foo.jar")+"\n", checksum)
+}
+
+func TestChunkedUploadAssemblesChunksIntoArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+
+	chunks := []string{"hello ", "chunked ", "world"}
+	for _, i := range []int{2, 0, 1, 0} {
+		w := httptest.NewRecorder()
+		artifactsHandler(s)(w, chunkRequest("b1", "u1", i, chunks[i]))
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, completeChunkedUploadRequest("b1", "u1", 3, "dist/app.bin", md5Hex("hello chunked world")))
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	content, err := ioutil.ReadFile(s.ArtifactFile("b1", "dist/app.bin"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello chunked world", string(content))
+	checksums, err := s.ChecksumManifest("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(checksums))
+	assert.Equal(t, "dist/app.bin", checksums[0].Path)
+	assert.Equal(t, int64(19), checksums[0].Size)
+	_, err = os.Stat(filepath.Join(s.UploadsDir(), "b1"))
+	assert.True(t, os.IsNotExist(err), "chunks should be removed after upload is completed")
+}
+
+func TestChunkedUploadRejectsMissingChunkAndMismatchedChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, chunkRequest("b1", "u1", 0, "hello"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, completeChunkedUploadRequest("b1", "u1", 2, "app.bin", ""))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, completeChunkedUploadRequest("b1", "u1", 1, "app.bin", md5Hex("world")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	_, err = os.Stat(s.ArtifactFile("b1", "app.bin"))
+	assert.True(t, os.IsNotExist(err), "mismatched artifact should not be kept")
+
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, chunkRequest("b1", "../u1", 0, "hello"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestChunkedUploadRejectsCorruptedChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, chunkRequest("b1", "u1", 0, "hello "))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	corrupted := chunkRequest("b1", "u1", 1, "wOrld")
+	corrupted.URL.RawQuery += "&" + protocol.ChunkSha256Param + "=" + sha256Hex("world")
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, corrupted)
+	assert.Equal(t, protocol.ChunkChecksumMismatchStatus, w.Code)
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, completeChunkedUploadRequest("b1", "u1", 2, "app.bin", md5Hex("hello world")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	resent := chunkRequest("b1", "u1", 1, "world")
+	resent.URL.RawQuery += "&" + protocol.ChunkMd5Param + "=" + md5Hex("world")
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, resent)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = httptest.NewRecorder()
+	artifactsHandler(s)(w, completeChunkedUploadRequest("b1", "u1", 2, "app.bin", md5Hex("hello world")))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	content, err := ioutil.ReadFile(s.ArtifactFile("b1", "app.bin"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(content))
+}
+
+func md5Hex(content string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(content)))
+}
+
+func sha256Hex(content string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+}
+
+// uploadRequest uploads files with their names as content.
+func uploadRequest(t *testing.T, buildId, checksum string, names ...string) *http.Request {
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for _, name := range names {
+		f, err := zw.Create(name)
+		assert.Nil(t, err)
+		f.Write([]byte(name))
+	}
+	assert.Nil(t, zw.Close())
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("zipfile", "artifact.zip")
+	assert.Nil(t, err)
+	part.Write(zipped.Bytes())
+	if checksum != "" {
+		part, err = mw.CreateFormFile("file_checksum", "checksum_file")
+		assert.Nil(t, err)
+		part.Write([]byte(checksum))
+	}
+	assert.Nil(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, ArtifactsPath+"/builds/"+buildId, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func chunkRequest(buildId, uploadId string, index int, content string) *http.Request {
+	return httptest.NewRequest(http.MethodPut, fmt.Sprintf("%v/builds/%v?%v=%v&%v=%v", ArtifactsPath, buildId,
+		protocol.ChunkedUploadParam, url.QueryEscape(uploadId), protocol.ChunkIndexParam, index), strings.NewReader(content))
+}
+
+func completeChunkedUploadRequest(buildId, uploadId string, count int, file, md5 string) *http.Request {
+	query := url.Values{
+		protocol.ChunkedUploadParam: {uploadId},
+		protocol.ChunkCountParam:    {strconv.Itoa(count)},
+		protocol.ArtifactFileParam:  {file},
+		protocol.ArtifactMd5Param:   {md5},
+	}
+	return httptest.NewRequest(http.MethodPost, ArtifactsPath+"/builds/"+buildId+"?"+query.Encode(), nil)
+}
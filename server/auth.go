@@ -0,0 +1,79 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authenticator authenticates requests to the console log, artifacts
+// and properties endpoints, the request is rejected when it returns an
+// error.
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+type AuthenticatorFunc func(req *http.Request) error
+
+func (f AuthenticatorFunc) Authenticate(req *http.Request) error {
+	return f(req)
+}
+
+// BearerToken requires requests to have header "Authorization: Bearer <token>".
+func BearerToken(token string) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) error {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return ErrUnauthorized
+		}
+		if subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			return ErrUnauthorized
+		}
+		return nil
+	})
+}
+
+func (s *Server) SetAuthenticator(auth Authenticator) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.authenticator = auth
+}
+
+func (s *Server) Authenticator() Authenticator {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.authenticator
+}
+
+// Authenticated rejects requests not accepted by the server
+// Authenticator, all requests are accepted when there is none.
+func (s *Server) Authenticated(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if auth := s.Authenticator(); auth != nil {
+			if err := auth.Authenticate(req); err != nil {
+				s.responseUnauthorized(err, w)
+				return
+			}
+		}
+		handler(w, req)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticatedAllowsAllRequestsByDefault(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	assert.Equal(t, http.StatusOK, authTestRequest(s, ""))
+}
+
+func TestBearerTokenAuthenticator(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.SetAuthenticator(BearerToken("secret"))
+
+	assert.Equal(t, http.StatusUnauthorized, authTestRequest(s, ""))
+	assert.Equal(t, http.StatusUnauthorized, authTestRequest(s, "Bearer wrong"))
+	assert.Equal(t, http.StatusUnauthorized, authTestRequest(s, "Basic secret"))
+	assert.Equal(t, http.StatusOK, authTestRequest(s, "Bearer secret"))
+}
+
+func authTestRequest(s *Server, authorization string) int {
+	handler := s.Authenticated(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	req := httptest.NewRequest(http.MethodGet, ConsoleLogPath+"/builds/b1", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w.Code
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"archive/zip"
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// BlobsDir is the directory under the server working directory storing
+// artifact contents by their sha256 when Server.DedupArtifacts is set.
+const BlobsDir = ".blobs"
+
+func (s *Server) BlobsDir() string {
+	return filepath.Join(s.WorkingDir, BlobsDir)
+}
+
+// extractArtifactBlob extracts the file into the blob of its content and
+// mode, creating the blob when there is none, and hard links dest to it.
+// It returns the checksum of the file.
+func (s *Server) extractArtifactBlob(file *zip.File, dest string) (*protocol.ArtifactChecksum, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// pruneBlobs waits until the blob is linked from dest
+	s.blobsMu.RLock()
+	defer s.blobsMu.RUnlock()
+	dir := s.BlobsDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(dir, "upload")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	hash := newChecksumWriter()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), rc)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return nil, err
+	}
+	checksum := hash.checksum(file.FileHeader.Name)
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	perm := artifactPerm(file)
+	blob := filepath.Join(dir, fmt.Sprintf("%v-%o", checksum.Sha256, perm))
+	if err := os.Link(blob, dest); err == nil {
+		return checksum, nil
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), blob); err != nil {
+		return nil, err
+	}
+	return checksum, os.Link(blob, dest)
+}
+
+// pruneBlobs removes blobs not linked from the artifacts of any build,
+// or of uploads staged in UploadsDir, and returns their names. Uploads
+// linking blobs wait until it is done.
+func (s *Server) pruneBlobs() ([]string, error) {
+	s.blobsMu.Lock()
+	defer s.blobsMu.Unlock()
+	infos, err := ioutil.ReadDir(s.BlobsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	blobsBySize := make(map[int64][]os.FileInfo)
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			blobsBySize[info.Size()] = append(blobsBySize[info.Size()], info)
+		}
+	}
+	referenced := make(map[string]bool)
+	dirs, err := s.buildDirs()
+	if err != nil {
+		return nil, err
+	}
+	roots := []string{s.UploadsDir()}
+	for _, dir := range dirs {
+		roots = append(roots, s.ArtifactsDir(dir.id))
+	}
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			for _, blob := range blobsBySize[info.Size()] {
+				if os.SameFile(info, blob) {
+					referenced[blob.Name()] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var removed []string
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || referenced[info.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.BlobsDir(), info.Name())); err != nil {
+			return removed, err
+		}
+		removed = append(removed, info.Name())
+	}
+	return removed, nil
+}
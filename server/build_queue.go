@@ -0,0 +1,338 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"sort"
+	"time"
+)
+
+// BuildTimeoutGrace is added to the build timeout before the server
+// fails a build that is not completed, so the agent gets the chance to
+// time it out and report first.
+var BuildTimeoutGrace = time.Minute
+
+// DefaultQueuedBuildTTL is how long builds are kept queued for an agent
+// that is not connected, before they are failed.
+const DefaultQueuedBuildTTL = time.Hour
+
+type buildCompletion struct {
+	agentId string
+	buildId string
+	result  string
+}
+
+type queueDepthQuery struct {
+	agentId string
+	depth   chan int
+}
+
+type bySeq []*AgentMessage
+
+func (s bySeq) Len() int           { return len(s) }
+func (s bySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySeq) Less(i, j int) bool { return s[i].seq < s[j].seq }
+
+// buildQueue tracks the build running on each agent and holds builds
+// sent to a busy agent until its current build is completed, or until
+// fewer than max builds are running when max is positive. It is owned
+// by the manageAgents goroutine.
+type buildQueue struct {
+	max        int
+	seq        uint64
+	changes    uint64
+	running    map[string]string
+	dispatched map[string]*AgentMessage
+	recovering map[string]bool
+	queued     map[string][]*AgentMessage
+	deadlines  map[string]*time.Timer
+	expiries   map[string]*time.Timer
+}
+
+func newBuildQueue(max int) *buildQueue {
+	return &buildQueue{
+		max:        max,
+		running:    make(map[string]string),
+		dispatched: make(map[string]*AgentMessage),
+		recovering: make(map[string]bool),
+		queued:     make(map[string][]*AgentMessage),
+		deadlines:  make(map[string]*time.Timer),
+		expiries:   make(map[string]*time.Timer),
+	}
+}
+
+func (q *buildQueue) enqueue(am *AgentMessage) {
+	q.seq++
+	q.changes++
+	am.seq = q.seq
+	q.queued[am.agentId] = append(q.queued[am.agentId], am)
+}
+
+// next returns the build to dispatch to the agent, or nil when the
+// agent is busy, max builds are running or nothing is queued for it.
+func (q *buildQueue) next(agentId string) *AgentMessage {
+	if _, busy := q.running[agentId]; busy || q.full() {
+		return nil
+	}
+	queue := q.queued[agentId]
+	if len(queue) == 0 {
+		return nil
+	}
+	am := queue[0]
+	if len(queue) == 1 {
+		delete(q.queued, agentId)
+	} else {
+		q.queued[agentId] = queue[1:]
+	}
+	q.running[agentId] = am.Msg.DataBuild().BuildId
+	q.dispatched[agentId] = am
+	q.changes++
+	q.stopExpiry(q.running[agentId])
+	return am
+}
+
+// dequeue removes the build queued for the agent, or the next build
+// queued for it when buildId is empty, and returns it. It returns nil
+// when the build is not queued.
+func (q *buildQueue) dequeue(agentId, buildId string) *AgentMessage {
+	queue := q.queued[agentId]
+	for i, am := range queue {
+		id := am.Msg.DataBuild().BuildId
+		if buildId != "" && id != buildId {
+			continue
+		}
+		if len(queue) == 1 {
+			delete(q.queued, agentId)
+		} else {
+			q.queued[agentId] = append(queue[:i:i], queue[i+1:]...)
+		}
+		q.stopExpiry(id)
+		q.changes++
+		return am
+	}
+	return nil
+}
+
+// expireQueued calls expired with each build queued for the agent that
+// is not dispatched in d, e.g. when the agent is not connected.
+func (q *buildQueue) expireQueued(agentId string, d time.Duration, expired func(buildId string)) {
+	for _, am := range q.queued[agentId] {
+		buildId := am.Msg.DataBuild().BuildId
+		if q.expiries[buildId] == nil {
+			q.expiries[buildId] = time.AfterFunc(d, func() { expired(buildId) })
+		}
+	}
+}
+
+// keepQueued stops expiring the builds queued for the agent.
+func (q *buildQueue) keepQueued(agentId string) {
+	for _, am := range q.queued[agentId] {
+		q.stopExpiry(am.Msg.DataBuild().BuildId)
+	}
+}
+
+func (q *buildQueue) stopExpiry(buildId string) {
+	if timer := q.expiries[buildId]; timer != nil {
+		timer.Stop()
+		delete(q.expiries, buildId)
+	}
+}
+
+// requeue puts the build running on the agent back to the head of its
+// queue, so it is dispatched again.
+func (q *buildQueue) requeue(agentId string) *AgentMessage {
+	am := q.dispatched[agentId]
+	delete(q.recovering, agentId)
+	if am == nil {
+		return nil
+	}
+	q.release(agentId)
+	q.queued[agentId] = append([]*AgentMessage{am}, q.queued[agentId]...)
+	return am
+}
+
+// release forgets the build running on the agent.
+func (q *buildQueue) release(agentId string) {
+	delete(q.running, agentId)
+	delete(q.dispatched, agentId)
+	delete(q.recovering, agentId)
+	q.changes++
+}
+
+func (q *buildQueue) full() bool {
+	return q.max > 0 && len(q.running) >= q.max
+}
+
+// waiting returns ids of agents having queued builds, ordered by when
+// their next build was queued.
+func (q *buildQueue) waiting() []string {
+	var heads []*AgentMessage
+	for _, queue := range q.queued {
+		heads = append(heads, queue[0])
+	}
+	sort.Sort(bySeq(heads))
+	ids := make([]string, len(heads))
+	for i, am := range heads {
+		ids[i] = am.agentId
+	}
+	return ids
+}
+
+func (q *buildQueue) complete(agentId, buildId string) {
+	if q.running[agentId] == buildId {
+		q.release(agentId)
+	}
+	if timer := q.deadlines[buildId]; timer != nil {
+		timer.Stop()
+		delete(q.deadlines, buildId)
+	}
+}
+
+// stop forgets the build running on the agent, unless the build is
+// restored from a snapshot and not reconciled yet, then it is queued
+// again.
+func (q *buildQueue) stop(agentId string) {
+	if q.recovering[agentId] {
+		q.requeue(agentId)
+		return
+	}
+	if _, ok := q.running[agentId]; ok {
+		q.release(agentId)
+	}
+}
+
+// deadline calls timeout unless the build is completed in d, it keeps
+// running after the agent is stopped, so the build of a dead agent
+// still times out.
+func (q *buildQueue) deadline(buildId string, d time.Duration, timeout func()) {
+	if timer := q.deadlines[buildId]; timer != nil {
+		timer.Stop()
+	}
+	q.deadlines[buildId] = time.AfterFunc(d, timeout)
+}
+
+// expire returns whether the build has a deadline and is not completed
+// yet, and stops it.
+func (q *buildQueue) expire(agentId, buildId string) bool {
+	if _, ok := q.deadlines[buildId]; !ok {
+		return false
+	}
+	delete(q.deadlines, buildId)
+	if q.running[agentId] == buildId {
+		q.release(agentId)
+	}
+	return true
+}
+
+func (q *buildQueue) busy(agentId string) bool {
+	_, busy := q.running[agentId]
+	return busy
+}
+
+func (q *buildQueue) idle(agentId string) bool {
+	_, busy := q.running[agentId]
+	return !busy && len(q.queued[agentId]) == 0
+}
+
+// active returns ids of the running and queued builds.
+func (q *buildQueue) active() map[string]bool {
+	ids := make(map[string]bool)
+	for _, buildId := range q.running {
+		ids[buildId] = true
+	}
+	for _, queue := range q.queued {
+		for _, am := range queue {
+			ids[am.Msg.DataBuild().BuildId] = true
+		}
+	}
+	return ids
+}
+
+// snapshot returns the running and queued builds to persist.
+func (q *buildQueue) snapshot() *QueueSnapshot {
+	snapshot := &QueueSnapshot{}
+	for agentId, am := range q.dispatched {
+		snapshot.Running = append(snapshot.Running, &QueuedBuild{AgentId: agentId, Msg: am.Msg})
+	}
+	var queued []*AgentMessage
+	for _, queue := range q.queued {
+		queued = append(queued, queue...)
+	}
+	sort.Sort(bySeq(queued))
+	for _, am := range queued {
+		snapshot.Queued = append(snapshot.Queued, &QueuedBuild{AgentId: am.agentId, Msg: am.Msg})
+	}
+	return snapshot
+}
+
+// restore loads the snapshot into the empty queue, the running builds
+// are kept running on their agents until the agents are reconciled.
+func (q *buildQueue) restore(snapshot *QueueSnapshot) {
+	for _, b := range snapshot.Running {
+		q.running[b.AgentId] = b.Msg.DataBuild().BuildId
+		q.dispatched[b.AgentId] = &AgentMessage{agentId: b.AgentId, Msg: b.Msg}
+		q.recovering[b.AgentId] = true
+	}
+	for _, b := range snapshot.Queued {
+		q.enqueue(&AgentMessage{agentId: b.AgentId, Msg: b.Msg})
+	}
+}
+
+func (q *buildQueue) depth(agentId string) int {
+	return len(q.queued[agentId])
+}
+
+func (s *Server) QueueDepth(agentId string) int {
+	query := &queueDepthQuery{agentId: agentId, depth: make(chan int)}
+	s.queueDepth <- query
+	return <-query.depth
+}
+
+// ActiveBuildCount returns the number of builds dispatched to agents
+// and not completed yet.
+func (s *Server) ActiveBuildCount() int {
+	count := make(chan int)
+	s.activeBuildCount <- count
+	return <-count
+}
+
+func (s *Server) activeBuilds() map[string]bool {
+	ids := make(chan map[string]bool)
+	s.activeBuildsQuery <- ids
+	return <-ids
+}
+
+func (s *Server) completeBuild(agentId, buildId, result string) {
+	s.forgetConsoleTail(buildId)
+	s.forgetConsoleOffset(buildId)
+	s.buildCompleted <- &buildCompletion{agentId: agentId, buildId: buildId, result: result}
+}
+
+func (s *Server) timeoutBuild(agentId, buildId, result string) {
+	select {
+	case s.buildTimedOut <- &buildCompletion{agentId: agentId, buildId: buildId, result: result}:
+	case <-s.shutdownDone:
+	}
+}
+
+func (s *Server) expireQueuedBuild(agentId, buildId string) {
+	select {
+	case s.buildExpired <- &buildCompletion{agentId: agentId, buildId: buildId, result: protocol.BuildFailed}:
+	case <-s.shutdownDone:
+	}
+}
@@ -0,0 +1,328 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"errors"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerFailsBuildNotCompletedInTime(t *testing.T) {
+	BuildTimeoutGrace = 100 * time.Millisecond
+	defer func() { BuildTimeoutGrace = time.Minute }()
+
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	listener := NewChannelStateListener(10, false)
+	s.StateListeners = []StateListener{listener}
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	ws, err := dialAgent(ts.URL, "1")
+	assert.Nil(t, err)
+	defer ws.Close()
+	info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1"}}
+	assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+	assert.Nil(t, listener.WaitFor("agent", "a1", "", time.Second))
+
+	s.SendBuildWithTimeout("a1", "b1", 100*time.Millisecond, protocol.EchoCommand("hello"))
+	assert.Nil(t, listener.WaitFor("build", "b1", protocol.BuildFailed, time.Second))
+
+	var actions []string
+	for len(actions) == 0 || actions[len(actions)-1] != protocol.CancelBuildAction {
+		msg, err := protocol.ReceiveMessage(ws)
+		assert.Nil(t, err)
+		actions = append(actions, msg.Action)
+	}
+	assert.Equal(t, []string{protocol.AckAction, protocol.SetCookieAction, protocol.BuildAction, protocol.CancelBuildAction}, actions)
+	assert.Equal(t, 0, len(s.activeBuilds()))
+}
+
+func TestServerTimesOutBuildRunningLongerThanMaxBuildDuration(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.MaxBuildDuration = 100 * time.Millisecond
+	listener := NewChannelStateListener(10, false)
+	s.StateListeners = []StateListener{listener}
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	ws, err := dialAgent(ts.URL, "1")
+	assert.Nil(t, err)
+	defer ws.Close()
+	info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1"}}
+	assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+	assert.Nil(t, listener.WaitFor("agent", "a1", "", time.Second))
+
+	s.SendBuildWithTimeout("a1", "b1", time.Hour, protocol.EchoCommand("hello"))
+	assert.Nil(t, listener.WaitFor("build", "b1", protocol.BuildTimeout, time.Second))
+
+	var actions []string
+	for len(actions) == 0 || actions[len(actions)-1] != protocol.CancelBuildAction {
+		msg, err := protocol.ReceiveMessage(ws)
+		assert.Nil(t, err)
+		actions = append(actions, msg.Action)
+	}
+	assert.Equal(t, []string{protocol.AckAction, protocol.SetCookieAction, protocol.BuildAction, protocol.CancelBuildAction}, actions)
+	assert.Equal(t, 0, len(s.activeBuilds()))
+
+	s.SendBuild("a1", "b2", protocol.EchoCommand("hello"))
+	assert.Nil(t, listener.WaitFor("build", "b2", protocol.BuildTimeout, time.Second))
+}
+
+func TestBuildDeadlineOutlivesStoppedAgent(t *testing.T) {
+	builds := newBuildQueue(0)
+	builds.enqueue(&AgentMessage{agentId: "a1", Msg: protocol.BuildMessage(&protocol.Build{BuildId: "b1"})})
+	assert.NotNil(t, builds.next("a1"))
+	builds.deadline("b1", time.Hour, func() {})
+	builds.stop("a1")
+
+	assert.True(t, builds.expire("a1", "b1"))
+	assert.False(t, builds.expire("a1", "b1"))
+}
+
+func TestCompletedBuildDoesNotExpire(t *testing.T) {
+	builds := newBuildQueue(0)
+	builds.enqueue(&AgentMessage{agentId: "a1", Msg: protocol.BuildMessage(&protocol.Build{BuildId: "b1"})})
+	assert.NotNil(t, builds.next("a1"))
+	builds.deadline("b1", time.Hour, func() {})
+	builds.complete("a1", "b1")
+
+	assert.False(t, builds.expire("a1", "b1"))
+}
+
+func TestBuildQueuedForDisconnectedAgentExpires(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.QueuedBuildTTL = 100 * time.Millisecond
+	listener := NewChannelStateListener(10, false)
+	s.StateListeners = []StateListener{listener}
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	s.SendBuild("a1", "b1", protocol.EchoCommand("hello"))
+	assert.Nil(t, listener.WaitFor("build", "b1", protocol.BuildFailed, time.Second))
+	assert.Equal(t, 0, s.QueueDepth("a1"))
+
+	s.SendBuild("a2", "b2", protocol.EchoCommand("hello"))
+	ws, err := dialAgent(ts.URL, "1")
+	assert.Nil(t, err)
+	defer ws.Close()
+	info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a2"}}
+	assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+	assert.Equal(t, "b2", receiveBuildId(t, ws))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, s.ActiveBuildCount())
+}
+
+func TestCancelMessageDequeuesQueuedBuild(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	listener := NewChannelStateListener(10, false)
+	s.StateListeners = []StateListener{listener}
+	s.startNotifier()
+	go manageAgents(s)
+
+	s.SendBuild("a1", "b1", protocol.EchoCommand("hello"))
+	s.SendBuild("a1", "b2", protocol.EchoCommand("hello"))
+	assert.Equal(t, 2, s.QueueDepth("a1"))
+	s.Send("a1", protocol.CancelMessage())
+	assert.Nil(t, listener.WaitFor("build", "b1", protocol.BuildCanceled, time.Second))
+	assert.Equal(t, 1, s.QueueDepth("a1"))
+	assert.Equal(t, map[string]bool{"b2": true}, s.activeBuilds())
+}
+
+func TestMaxConcurrentBuildsHoldsBuildsInQueue(t *testing.T) {
+	builds := newBuildQueue(2)
+	for _, id := range []string{"a1", "a2", "a3"} {
+		builds.enqueue(&AgentMessage{agentId: id, Msg: protocol.BuildMessage(&protocol.Build{BuildId: "b-" + id})})
+	}
+	assert.NotNil(t, builds.next("a1"))
+	assert.NotNil(t, builds.next("a2"))
+	assert.Nil(t, builds.next("a3"))
+	assert.True(t, builds.full())
+
+	builds.complete("a1", "b-a1")
+	assert.Equal(t, []string{"a3"}, builds.waiting())
+	assert.NotNil(t, builds.next("a3"))
+}
+
+func TestSendBuildWaitsForMaxConcurrentBuilds(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.MaxConcurrentBuilds = 2
+	listener := NewChannelStateListener(10, false)
+	s.StateListeners = []StateListener{listener}
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	agents := make(map[string]*websocket.Conn)
+	for _, id := range []string{"a1", "a2", "a3"} {
+		ws, err := dialAgent(ts.URL, "1")
+		assert.Nil(t, err)
+		defer ws.Close()
+		info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: id}}
+		assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+		assert.Nil(t, listener.WaitFor("agent", id, "", time.Second))
+		agents[id] = ws
+	}
+
+	for _, id := range []string{"a1", "a2", "a3"} {
+		s.SendBuild(id, "b-"+id, protocol.EchoCommand("hello"))
+	}
+	assert.Equal(t, "b-a1", receiveBuildId(t, agents["a1"]))
+	assert.Equal(t, "b-a2", receiveBuildId(t, agents["a2"]))
+	assert.Equal(t, 2, s.ActiveBuildCount())
+	assert.Equal(t, 1, s.QueueDepth("a3"))
+
+	report := &protocol.Report{BuildId: "b-a1", Result: protocol.BuildPassed}
+	assert.Nil(t, protocol.SendMessage(agents["a1"], protocol.CompletedMessage(report)))
+	assert.Equal(t, "b-a3", receiveBuildId(t, agents["a3"]))
+	assert.Equal(t, 2, s.ActiveBuildCount())
+	assert.Equal(t, 0, s.QueueDepth("a3"))
+}
+
+func TestPersistedBuildQueueIsReconciledAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build-queue-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	store := NewFileQueueStore(filepath.Join(dir, "queue.json"))
+	buildMsg := func(buildId string) *protocol.Message {
+		return protocol.BuildMessage(&protocol.Build{BuildId: buildId, BuildLocator: "/builds/" + buildId})
+	}
+	assert.Nil(t, store.Save(&QueueSnapshot{
+		Running: []*QueuedBuild{{AgentId: "a1", Msg: buildMsg("b1")}, {AgentId: "a2", Msg: buildMsg("b2")}, {AgentId: "a3", Msg: buildMsg("b3")}, {AgentId: "a4", Msg: buildMsg("b5")}},
+		Queued:  []*QueuedBuild{{AgentId: "a1", Msg: buildMsg("b4")}},
+	}))
+
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.QueueStore = store
+	s.QueueRecoveryTimeout = 200 * time.Millisecond
+	listener := NewChannelStateListener(10, false)
+	s.StateListeners = []StateListener{listener}
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	agents := make(map[string]*websocket.Conn)
+	// a4 is building another build than the one restored as running
+	building := map[string]string{"a1": "", "a2": "/builds/b2", "a4": "/builds/b6"}
+	for id, locator := range building {
+		ws, err := dialAgent(ts.URL, "1")
+		assert.Nil(t, err)
+		defer ws.Close()
+		status := "Idle"
+		if locator != "" {
+			status = "Building"
+		}
+		info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: id}, RuntimeStatus: status,
+			BuildingInfo: &protocol.AgentBuildingInfo{BuildLocator: locator}}
+		assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+		assert.Nil(t, listener.WaitFor("agent", id, status, time.Second))
+		agents[id] = ws
+	}
+	assert.Equal(t, "b1", receiveBuildId(t, agents["a1"]))
+	assert.Equal(t, "b5", receiveBuildId(t, agents["a4"]))
+	assert.Equal(t, 1, s.QueueDepth("a1"))
+	assert.Equal(t, 0, s.QueueDepth("a2"))
+	assert.Equal(t, 4, s.ActiveBuildCount())
+
+	report := &protocol.Report{BuildId: "b1", Result: protocol.BuildPassed}
+	assert.Nil(t, protocol.SendMessage(agents["a1"], protocol.CompletedMessage(report)))
+	assert.Equal(t, "b4", receiveBuildId(t, agents["a1"]))
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 1, s.QueueDepth("a3"))
+	assert.Equal(t, 3, s.ActiveBuildCount())
+
+	snapshot, err := store.Load()
+	assert.Nil(t, err)
+	running := make(map[string]string)
+	for _, b := range snapshot.Running {
+		running[b.AgentId] = b.Msg.DataBuild().BuildId
+	}
+	assert.Equal(t, map[string]string{"a1": "b4", "a2": "b2", "a4": "b5"}, running)
+	assert.Equal(t, 1, len(snapshot.Queued))
+	assert.Equal(t, "b3", snapshot.Queued[0].Msg.DataBuild().BuildId)
+}
+
+func receiveBuildId(t *testing.T, ws *websocket.Conn) string {
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	defer ws.SetReadDeadline(time.Time{})
+	for {
+		msg, err := protocol.ReceiveMessage(ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Action == protocol.BuildAction {
+			return msg.DataBuild().BuildId
+		}
+	}
+}
+
+func TestCommandInterceptorRejectsAndRewritesBuildCommands(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	errForbidden := errors.New("rm -rf / is not allowed")
+	s.CommandInterceptor = func(commands []*protocol.BuildCommand) ([]*protocol.BuildCommand, error) {
+		for _, cmd := range commands {
+			if cmd.Name == protocol.CommandExec && cmd.Args["command"] == "rm" && cmd.Args["args"] == `["-rf","/"]` {
+				return nil, errForbidden
+			}
+		}
+		return append([]*protocol.BuildCommand{protocol.EchoCommand("setup")}, commands...), nil
+	}
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	ws, err := dialAgent(ts.URL, "1")
+	assert.Nil(t, err)
+	defer ws.Close()
+	info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1"}}
+	assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+
+	err = s.SendBuild("a1", "b1", protocol.EchoCommand("hello"), protocol.ExecCommand("rm", "-rf", "/"))
+	assert.Equal(t, errForbidden, err)
+	assert.Equal(t, errForbidden, s.SendBuildToResource(nil, "b1", protocol.ExecCommand("rm", "-rf", "/")))
+	assert.Equal(t, 0, s.QueueDepth("a1"))
+
+	assert.Nil(t, s.SendBuild("a1", "b2", protocol.EchoCommand("hello")))
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		msg, err := protocol.ReceiveMessage(ws)
+		assert.Nil(t, err)
+		if msg.Action == protocol.BuildAction {
+			build := msg.DataBuild()
+			assert.Equal(t, "b2", build.BuildId)
+			assert.Equal(t, []*protocol.BuildCommand{protocol.EchoCommand("setup"), protocol.EchoCommand("hello")}, build.BuildCommand.SubCommands)
+			break
+		}
+	}
+}
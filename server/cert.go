@@ -21,9 +21,12 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -33,6 +36,7 @@ type Cert struct {
 	ValidFrom    time.Time
 	ValidFor     time.Duration
 	IsCA         bool
+	ClientAuth   bool
 	RsaBits      int
 	Organization string
 }
@@ -66,7 +70,23 @@ func (c *Cert) pemBlockForKey(priv interface{}) *pem.Block {
 	}
 }
 
+// Generate writes a self-signed certificate and its private key.
 func (c *Cert) Generate(certFile, keyFile string) error {
+	return c.generate(certFile, keyFile, nil, nil)
+}
+
+// GenerateSigned writes a certificate signed by the CA certificate and
+// private key of caCertFile and caKeyFile, which are written by
+// Generate of a CA Cert.
+func (c *Cert) GenerateSigned(certFile, keyFile, caCertFile, caKeyFile string) error {
+	caCert, caKey, err := readCertAndKey(caCertFile, caKeyFile)
+	if err != nil {
+		return err
+	}
+	return c.generate(certFile, keyFile, caCert, caKey)
+}
+
+func (c *Cert) generate(certFile, keyFile string, parent *x509.Certificate, parentKey *rsa.PrivateKey) error {
 	priv, err := rsa.GenerateKey(rand.Reader, c.RsaBits)
 	if err != nil {
 		return err
@@ -108,7 +128,14 @@ func (c *Cert) Generate(certFile, keyFile string) error {
 		template.KeyUsage |= x509.KeyUsageCertSign
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, c.publicKey(priv), priv)
+	if c.ClientAuth {
+		template.ExtKeyUsage = append(template.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+	}
+
+	if parent == nil {
+		parent, parentKey = &template, priv
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, c.publicKey(priv), parentKey)
 	if err != nil {
 		return err
 	}
@@ -127,3 +154,82 @@ func (c *Cert) Generate(certFile, keyFile string) error {
 	keyOut.Close()
 	return nil
 }
+
+func readCertAndKey(certFile, keyFile string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certPem, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPem, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPem)
+	keyBlock, _ := pem.Decode(keyPem)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("no pem data found in %v or %v", certFile, keyFile)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// TestCerts are the files of a throwaway CA and of the server and agent
+// certificates it signs, for servers in tests. The agent certificate is
+// for servers requiring client certificates with the CA as ClientCAFile.
+type TestCerts struct {
+	Dir            string
+	CACertFile     string
+	CAKeyFile      string
+	ServerCertFile string
+	ServerKeyFile  string
+	AgentCertFile  string
+	AgentKeyFile   string
+}
+
+// GenerateTestCerts generates TestCerts into a new temp dir, the server
+// certificate is valid for host, which may list hosts and IPs separated
+// by ",". Remove Dir when done.
+func GenerateTestCerts(host string) (*TestCerts, error) {
+	dir, err := ioutil.TempDir("", "gocd-test-certs")
+	if err != nil {
+		return nil, err
+	}
+	certs := &TestCerts{
+		Dir:            dir,
+		CACertFile:     filepath.Join(dir, "ca-cert.pem"),
+		CAKeyFile:      filepath.Join(dir, "ca-key.pem"),
+		ServerCertFile: filepath.Join(dir, "server-cert.pem"),
+		ServerKeyFile:  filepath.Join(dir, "server-key.pem"),
+		AgentCertFile:  filepath.Join(dir, "agent-cert.pem"),
+		AgentKeyFile:   filepath.Join(dir, "agent-key.pem"),
+	}
+	ca := NewCert("gocd-test-ca")
+	ca.Organization = "GoCD Test"
+	// the extended key usages of a CA limit the certificates it signs
+	ca.ClientAuth = true
+	if err := ca.Generate(certs.CACertFile, certs.CAKeyFile); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	server := NewCert(host)
+	server.IsCA = false
+	agent := NewCert("agent")
+	agent.IsCA = false
+	agent.ClientAuth = true
+	if err := server.GenerateSigned(certs.ServerCertFile, certs.ServerKeyFile, certs.CACertFile, certs.CAKeyFile); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := agent.GenerateSigned(certs.AgentCertFile, certs.AgentKeyFile, certs.CACertFile, certs.CAKeyFile); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return certs, nil
+}
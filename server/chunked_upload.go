@@ -0,0 +1,272 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// UploadsDir is the directory under the server working directory
+// storing the chunks of artifact files being uploaded.
+const UploadsDir = ".uploads"
+
+// DefaultChunkedUploadTTL is how long the chunks of an upload that is
+// not completed are kept after the last chunk is received.
+const DefaultChunkedUploadTTL = time.Hour
+
+var (
+	errInvalidUploadId = errors.New("invalid chunked upload id")
+	errInvalidChunk    = errors.New("invalid chunk index or count")
+	errMissingChunk    = errors.New("chunk is missing")
+
+	uploadIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+func (s *Server) UploadsDir() string {
+	return filepath.Join(s.WorkingDir, UploadsDir)
+}
+
+func (s *Server) chunkedUploadDir(buildId, uploadId string) (string, error) {
+	if !uploadIdPattern.MatchString(uploadId) || buildId == "" || buildId == "." || buildId == ".." {
+		return "", errInvalidUploadId
+	}
+	return filepath.Join(s.UploadsDir(), buildId, uploadId), nil
+}
+
+func chunkFile(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("chunk-%d", index))
+}
+
+// handleArtifactChunk stores the request body as a chunk of the upload,
+// a chunk sent again replaces the previous one. A chunk not matching its
+// checksum param is rejected.
+func handleArtifactChunk(s *Server, w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	dir, err := s.chunkedUploadDir(parseBuildId(req.URL.Path), query.Get(protocol.ChunkedUploadParam))
+	if err != nil {
+		s.responseBadRequest(err, w)
+		return
+	}
+	index, err := strconv.Atoi(query.Get(protocol.ChunkIndexParam))
+	if err != nil || index < 0 {
+		s.responseBadRequest(errInvalidChunk, w)
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, ".chunk")
+	if err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	checksum := newChecksumWriter()
+	_, err = io.Copy(io.MultiWriter(tmp, checksum), req.Body)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	expected := &protocol.ArtifactChecksum{Md5: query.Get(protocol.ChunkMd5Param), Sha256: query.Get(protocol.ChunkSha256Param)}
+	if (expected.Md5 != "" || expected.Sha256 != "") && !expected.Matches(checksum.checksum("")) {
+		s.log("chunk %v of upload %v does not match its checksum", index, query.Get(protocol.ChunkedUploadParam))
+		w.WriteHeader(protocol.ChunkChecksumMismatchStatus)
+		return
+	}
+	if err := os.Rename(tmp.Name(), chunkFile(dir, index)); err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleChunkedUploadComplete assembles the chunks of the upload, moves
+// the assembled file into the artifacts directory and records its
+// checksum. The chunks are removed once the upload is completed or its
+// checksum does not match.
+func handleChunkedUploadComplete(s *Server, w http.ResponseWriter, req *http.Request) {
+	buildId := parseBuildId(req.URL.Path)
+	query := req.URL.Query()
+	dir, err := s.chunkedUploadDir(buildId, query.Get(protocol.ChunkedUploadParam))
+	if err != nil {
+		s.responseBadRequest(err, w)
+		return
+	}
+	count, err := strconv.Atoi(query.Get(protocol.ChunkCountParam))
+	if err != nil || count < 1 {
+		s.responseBadRequest(errInvalidChunk, w)
+		return
+	}
+	file := query.Get(protocol.ArtifactFileParam)
+	dest, err := s.artifactFile(buildId, file)
+	if err == nil && file == "" {
+		err = errInvalidArtifactPath
+	}
+	if err != nil {
+		s.responseBadRequest(err, w)
+		return
+	}
+	assembled, checksum, err := assembleChunks(dir, count)
+	if err == errMissingChunk {
+		s.responseBadRequest(err, w)
+		return
+	}
+	if err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	defer s.removeChunkedUpload(dir)
+	uploaded := &protocol.ArtifactChecksum{Md5: query.Get(protocol.ArtifactMd5Param), Sha256: query.Get(protocol.ArtifactSha256Param)}
+	if (uploaded.Md5 != "" || uploaded.Sha256 != "") && !uploaded.Matches(checksum) {
+		s.responseBadRequest(fmt.Errorf("%v: %v", errChecksumMismatch, file), w)
+		return
+	}
+	checksum.Path = file
+	if err := moveArtifact(assembled, dest); err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	if err := s.appendChecksums(buildId, []*protocol.ArtifactChecksum{checksum}); err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// assembleChunks concatenates chunks 0 to count-1 into a file in dir and
+// returns its path and checksum.
+func assembleChunks(dir string, count int) (string, *protocol.ArtifactChecksum, error) {
+	tmp, err := ioutil.TempFile(dir, ".assembled")
+	if os.IsNotExist(err) {
+		return "", nil, errMissingChunk
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	hash := newChecksumWriter()
+	for i := 0; i < count && err == nil; i++ {
+		_, err = copyChunk(io.MultiWriter(tmp, hash), chunkFile(dir, i))
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), hash.checksum(""), nil
+}
+
+func copyChunk(w io.Writer, chunk string) (int64, error) {
+	f, err := os.Open(chunk)
+	if os.IsNotExist(err) {
+		return 0, errMissingChunk
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// moveArtifact makes the file readable by everyone and renames it to
+// dest, see replaceArtifact.
+func moveArtifact(file, dest string) error {
+	if err := os.Chmod(file, 0644); err != nil {
+		return err
+	}
+	return replaceArtifact(file, dest)
+}
+
+// replaceArtifact renames the file to dest keeping its mode, an existing
+// dest is removed first, it may be a hard link to a blob shared with
+// other builds.
+func replaceArtifact(file, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(file, dest)
+}
+
+// removeChunkedUpload removes the upload directory, and the directory
+// of the build uploads when it is empty.
+func (s *Server) removeChunkedUpload(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		s.error("remove chunked upload %v failed: %v", dir, err)
+	}
+	os.Remove(filepath.Dir(dir))
+}
+
+// pruneUploads removes the uploads not modified within ChunkedUploadTTL
+// and returns them as "buildId/uploadId".
+func (s *Server) pruneUploads() ([]string, error) {
+	if s.ChunkedUploadTTL <= 0 {
+		return nil, nil
+	}
+	builds, err := ioutil.ReadDir(s.UploadsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	expiry := time.Now().Add(-s.ChunkedUploadTTL)
+	var removed []string
+	for _, build := range builds {
+		if !build.IsDir() {
+			continue
+		}
+		buildDir := filepath.Join(s.UploadsDir(), build.Name())
+		uploads, err := ioutil.ReadDir(buildDir)
+		if err != nil {
+			return removed, err
+		}
+		for _, upload := range uploads {
+			if !upload.IsDir() {
+				continue
+			}
+			dir := filepath.Join(buildDir, upload.Name())
+			modTime, err := lastModified(dir, upload)
+			if err != nil {
+				return removed, err
+			}
+			if modTime.After(expiry) {
+				continue
+			}
+			s.removeChunkedUpload(dir)
+			removed = append(removed, build.Name()+"/"+upload.Name())
+		}
+	}
+	return removed, nil
+}
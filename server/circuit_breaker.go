@@ -0,0 +1,106 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+)
+
+// CircuitBreaker disables an agent when more than FailureRate of its
+// last Builds completed builds failed, so a broken agent stops taking
+// builds until EnableAgent is called. Zero Builds turns it off.
+type CircuitBreaker struct {
+	Builds      int
+	FailureRate float64
+}
+
+// agentHealth tracks recent build results of agents and the agents
+// disabled by the circuit breaker. It is owned by the manageAgents
+// goroutine.
+type agentHealth struct {
+	breaker  CircuitBreaker
+	results  map[string][]bool
+	disabled map[string]bool
+}
+
+func newAgentHealth(breaker CircuitBreaker) *agentHealth {
+	return &agentHealth{
+		breaker:  breaker,
+		results:  make(map[string][]bool),
+		disabled: make(map[string]bool),
+	}
+}
+
+// record adds the build result of the agent, it returns true when the
+// agent is disabled by it. Canceled builds are not counted.
+func (h *agentHealth) record(agentId, result string) bool {
+	if h.breaker.Builds <= 0 || h.disabled[agentId] {
+		return false
+	}
+	if result != protocol.BuildPassed && result != protocol.BuildFailed {
+		return false
+	}
+	results := append(h.results[agentId], result == protocol.BuildFailed)
+	if len(results) > h.breaker.Builds {
+		results = results[len(results)-h.breaker.Builds:]
+	}
+	h.results[agentId] = results
+	if len(results) < h.breaker.Builds {
+		return false
+	}
+	failures := 0
+	for _, failed := range results {
+		if failed {
+			failures++
+		}
+	}
+	if float64(failures)/float64(len(results)) <= h.breaker.FailureRate {
+		return false
+	}
+	h.disabled[agentId] = true
+	delete(h.results, agentId)
+	return true
+}
+
+// enable returns false when the agent is not disabled.
+func (h *agentHealth) enable(agentId string) bool {
+	if !h.disabled[agentId] {
+		return false
+	}
+	delete(h.disabled, agentId)
+	return true
+}
+
+// enabled returns the agents not disabled.
+func (h *agentHealth) enabled(agents map[string]*RemoteAgent) map[string]*RemoteAgent {
+	if len(h.disabled) == 0 {
+		return agents
+	}
+	enabled := make(map[string]*RemoteAgent, len(agents))
+	for id, agent := range agents {
+		if !h.disabled[id] {
+			enabled[id] = agent
+		}
+	}
+	return enabled
+}
+
+// EnableAgent enables the agent disabled by the circuit breaker, its
+// queued builds are dispatched again.
+func (s *Server) EnableAgent(agentId string) {
+	s.enableAgent <- agentId
+}
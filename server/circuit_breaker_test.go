@@ -0,0 +1,87 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAgentHealthDisablesAgentOverFailureRate(t *testing.T) {
+	health := newAgentHealth(CircuitBreaker{Builds: 3, FailureRate: 0.5})
+	assert.False(t, health.record("a1", protocol.BuildFailed))
+	assert.False(t, health.record("a1", protocol.BuildPassed))
+	assert.False(t, health.record("a1", protocol.BuildCanceled))
+	assert.False(t, health.record("a2", protocol.BuildFailed))
+	assert.False(t, health.record("a1", protocol.BuildPassed))
+	assert.False(t, health.record("a1", protocol.BuildFailed))
+	assert.True(t, health.record("a1", protocol.BuildFailed))
+	assert.True(t, health.disabled["a1"])
+	assert.False(t, health.disabled["a2"])
+
+	agents := map[string]*RemoteAgent{"a1": {id: "a1"}, "a2": {id: "a2"}}
+	assert.Equal(t, 1, len(health.enabled(agents)))
+	assert.True(t, health.enable("a1"))
+	assert.False(t, health.enable("a1"))
+	assert.Equal(t, 2, len(health.enabled(agents)))
+}
+
+func TestCircuitBreakerIsOffByDefault(t *testing.T) {
+	health := newAgentHealth(CircuitBreaker{})
+	for i := 0; i < 10; i++ {
+		assert.False(t, health.record("a1", protocol.BuildFailed))
+	}
+}
+
+func TestServerStopsSendingBuildsToDisabledAgent(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.CircuitBreaker = CircuitBreaker{Builds: 2, FailureRate: 0.5}
+	listener := NewChannelStateListener(10, false)
+	s.StateListeners = []StateListener{listener}
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	ws, err := dialAgent(ts.URL, "1")
+	assert.Nil(t, err)
+	defer ws.Close()
+	info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1"}}
+	assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+	assert.Nil(t, listener.WaitFor("agent", "a1", "", time.Second))
+
+	for _, buildId := range []string{"b1", "b2"} {
+		s.SendBuild("a1", buildId, protocol.EchoCommand("hello"))
+		assert.Equal(t, buildId, receiveBuildId(t, ws))
+		report := &protocol.Report{BuildId: buildId, Result: protocol.BuildFailed}
+		assert.Nil(t, protocol.SendMessage(ws, protocol.CompletedMessage(report)))
+	}
+	assert.Nil(t, listener.WaitFor("agent", "a1", "Disabled", time.Second))
+
+	assert.NotNil(t, s.SendBuildToResource(nil, "b3", protocol.EchoCommand("hello")))
+	s.SendBuild("a1", "b3", protocol.EchoCommand("hello"))
+	assert.Equal(t, 1, s.QueueDepth("a1"))
+
+	s.EnableAgent("a1")
+	assert.Nil(t, listener.WaitFor("agent", "a1", "Enabled", time.Second))
+	assert.Equal(t, "b3", receiveBuildId(t, ws))
+}
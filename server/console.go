@@ -17,21 +17,322 @@
 package server
 
 import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
 )
 
+const (
+	ConsoleTruncatedMarker = "\n[console truncated]\n"
+
+	consoleFormatGzip = "gz"
+
+	maxConsoleLineSize = 1024 * 1024
+)
+
+var errConsoleOffsetGap = errors.New("console offset is beyond the received bytes")
+
 func consoleHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		buildId := parseBuildId(req.URL.Path)
+		if req.Method == http.MethodGet {
+			if _, ok := req.URL.Query()["q"]; ok {
+				searchConsoleLog(s, buildId, w, req)
+			} else {
+				serveConsoleLog(s, buildId, w, req)
+			}
+			return
+		}
+		if req.Method != http.MethodPut && req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 		bytes, err := ioutil.ReadAll(req.Body)
 		if err != nil {
 			s.responseBadRequest(err, w)
 			return
 		}
-		err = s.appendToFile(s.ConsoleLogFile(buildId), bytes)
-		if err != nil {
+		// appends without offset, e.g. of plugins, are written whole
+		// between the uploads of the agent running the build, whose
+		// offset is tracked apart, see appendConsoleLogAt
+		offsetParam := req.URL.Query().Get(protocol.ConsoleOffsetParam)
+		if offsetParam == "" {
+			err = s.appendConsoleLog(buildId, bytes)
+			if err != nil {
+				s.responseInternalError(err, w)
+			}
+			return
+		}
+		offset, err := strconv.ParseInt(offsetParam, 10, 64)
+		if err != nil || offset < 0 {
+			s.responseBadRequest(fmt.Errorf("invalid console offset %q", offsetParam), w)
+			return
+		}
+		received, err := s.appendConsoleLogAt(buildId, offset, bytes)
+		w.Header().Set(protocol.ConsoleOffsetHeader, strconv.FormatInt(received, 10))
+		if err == errConsoleOffsetGap {
+			s.log("console upload of build %v at offset %v is out of order, received %v bytes", buildId, offset, received)
+			w.WriteHeader(http.StatusConflict)
+		} else if err != nil {
 			s.responseInternalError(err, w)
 		}
 	}
 }
+
+// buildConsole is the console state of a build. Appends of the build
+// are serialized by mu, so that they do not block appends of other
+// builds while writing files and sinks.
+type buildConsole struct {
+	mu sync.Mutex
+	// size is the received size of the console output when sized, see
+	// consoleLogSize.
+	size  int64
+	sized bool
+	// offset is the received offset of the console output streamed by
+	// the agent, see appendConsoleLogAt.
+	offset int64
+	tail   *consoleTail
+}
+
+// buildConsole returns the console state of the build, which is created
+// on the first append.
+func (s *Server) buildConsole(buildId string) *buildConsole {
+	s.consoleMu.Lock()
+	defer s.consoleMu.Unlock()
+	console := s.consoles[buildId]
+	if console == nil {
+		console = &buildConsole{}
+		s.consoles[buildId] = console
+	}
+	return console
+}
+
+func (s *Server) lookupBuildConsole(buildId string) *buildConsole {
+	s.consoleMu.Lock()
+	defer s.consoleMu.Unlock()
+	return s.consoles[buildId]
+}
+
+// appendConsoleLog appends data to the console log of the build within
+// MaxConsoleLogSize. Appends of a build are serialized, so that
+// concurrent requests of the build can not grow the log over the limit
+// or write the truncated marker twice.
+func (s *Server) appendConsoleLog(buildId string, data []byte) error {
+	console := s.buildConsole(buildId)
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	_, err := s.writeConsoleLog(buildId, console, data)
+	return err
+}
+
+// appendConsoleLogAt appends data uploaded at offset of the console
+// output the agent running the build streams, and returns the offset
+// the stream has been received up to. Bytes before the received offset
+// were uploaded already and are skipped, so that an agent can retry an
+// upload it does not know the result of. An offset beyond the received
+// bytes would leave a gap and is rejected with errConsoleOffsetGap. The
+// received offset is tracked apart from the size of the console log, so
+// that appends without offset, e.g. of plugins, are interleaved with
+// the stream, and is forgotten when the build completes. Once the log
+// is truncated, all data is dropped and acknowledged.
+func (s *Server) appendConsoleLogAt(buildId string, offset int64, data []byte) (int64, error) {
+	console := s.buildConsole(buildId)
+	console.mu.Lock()
+	defer console.mu.Unlock()
+	size, err := s.consoleLogSize(buildId, console)
+	if err != nil {
+		return 0, err
+	}
+	end := offset + int64(len(data))
+	if s.MaxConsoleLogSize > 0 && size > s.MaxConsoleLogSize {
+		return end, nil
+	}
+	received := console.offset
+	if offset > received {
+		return received, errConsoleOffsetGap
+	}
+	if end <= received {
+		return received, nil
+	}
+	accepted, err := s.writeConsoleLog(buildId, console, data[received-offset:])
+	if accepted {
+		// data accepted by some sinks is received even when others
+		// failed, so that a retry does not write it to them again
+		console.offset = end
+		return end, err
+	}
+	return received, err
+}
+
+// forgetConsoleOffset forgets the received offset of the console output
+// streamed by the agent, a build run again starts at offset 0.
+func (s *Server) forgetConsoleOffset(buildId string) {
+	if console := s.lookupBuildConsole(buildId); console != nil {
+		console.mu.Lock()
+		defer console.mu.Unlock()
+		console.offset = 0
+	}
+}
+
+// writeConsoleLog writes data to the console sinks within
+// MaxConsoleLogSize, and returns whether any sink accepted it. The
+// caller holds the lock of the build console.
+func (s *Server) writeConsoleLog(buildId string, console *buildConsole, data []byte) (bool, error) {
+	data, err := s.limitConsoleLog(buildId, console, data)
+	if err != nil || len(data) == 0 {
+		return err == nil, err
+	}
+	size, err := s.consoleLogSize(buildId, console)
+	if err != nil {
+		return false, err
+	}
+	accepted, err := s.appendToConsoleSinks(buildId, data)
+	if !accepted {
+		return false, err
+	}
+	if len(s.ConsoleSinks) > 0 {
+		console.size = size + int64(len(data))
+	}
+	s.appendConsoleTail(console, size, data)
+	s.notifySubscribers(&StateChange{Class: "console", Id: buildId, State: "Appended"})
+	return true, err
+}
+
+// consoleLogSize returns the size of the console output received of the
+// build, which is the size of the console log file unless ConsoleSinks
+// are set. Sinks may not write the file, so their received size is
+// counted in memory, starting from the size of the file, e.g. after the
+// server is restarted.
+func (s *Server) consoleLogSize(buildId string, console *buildConsole) (int64, error) {
+	if console.sized {
+		return console.size, nil
+	}
+	var size int64
+	info, err := os.Stat(s.ConsoleLogFile(buildId))
+	if err == nil {
+		size = info.Size()
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	if len(s.ConsoleSinks) > 0 {
+		console.size, console.sized = size, true
+	}
+	return size, nil
+}
+
+func (s *Server) forgetConsoleLog(buildId string) {
+	s.consoleMu.Lock()
+	defer s.consoleMu.Unlock()
+	delete(s.consoles, buildId)
+}
+
+// limitConsoleLog returns the part of data that fits in the console log
+// of the build under MaxConsoleLogSize. The truncated marker is appended
+// when the log reaches the limit, after which all data is dropped.
+func (s *Server) limitConsoleLog(buildId string, console *buildConsole, data []byte) ([]byte, error) {
+	if s.MaxConsoleLogSize <= 0 {
+		return data, nil
+	}
+	size, err := s.consoleLogSize(buildId, console)
+	if err != nil {
+		return nil, err
+	}
+	if size > s.MaxConsoleLogSize {
+		return nil, nil
+	}
+	if size+int64(len(data)) <= s.MaxConsoleLogSize {
+		return data, nil
+	}
+	s.log("console log of build %v reached limit %v, truncate", buildId, s.MaxConsoleLogSize)
+	limited := append([]byte{}, data[:s.MaxConsoleLogSize-size]...)
+	return append(limited, ConsoleTruncatedMarker...), nil
+}
+
+// serveConsoleLog serves the console log as text, or gzipped with query
+// param "format=gz". Query param "download" serves it as an attachment
+// named "console-<buildId>.log", with ".gz" appended when gzipped.
+func serveConsoleLog(s *Server, buildId string, w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != consoleFormatGzip {
+		s.responseBadRequest(fmt.Errorf("unsupported console log format %q", format), w)
+		return
+	}
+	f, err := os.Open(s.ConsoleLogFile(buildId))
+	if err != nil {
+		s.responseBadRequest(err, w)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	filename := "console-" + buildId + ".log"
+	if format == consoleFormatGzip {
+		filename += ".gz"
+	}
+	if _, ok := query["download"]; ok {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	if format != consoleFormatGzip {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(w, req, info.Name(), info.ModTime(), f)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	gw := gzip.NewWriter(w)
+	_, err = io.Copy(gw, f)
+	if err1 := gw.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		s.error("serve gzipped console log of build %v failed: %v", buildId, err)
+	}
+}
+
+// searchConsoleLog responds lines of the build console log matching
+// regexp of query param "q", prefixed by their line numbers like
+// "grep -n". At most MaxConsoleSearchMatches lines are returned.
+func searchConsoleLog(s *Server, buildId string, w http.ResponseWriter, req *http.Request) {
+	query, err := regexp.Compile(req.URL.Query().Get("q"))
+	if err != nil {
+		s.responseBadRequest(err, w)
+		return
+	}
+	f, err := s.ConsoleLogReader(buildId)
+	if err != nil {
+		s.responseBadRequest(err, w)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxConsoleLineSize)
+	matches := 0
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if !query.Match(scanner.Bytes()) {
+			continue
+		}
+		fmt.Fprintf(w, "%v:%s\n", lineNum, scanner.Bytes())
+		matches++
+		if s.MaxConsoleSearchMatches > 0 && matches >= s.MaxConsoleSearchMatches {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		s.error("search console log of build %v failed: %v", buildId, err)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package server
+
+// ConsoleSink receives the console output agents upload, after it is
+// limited by MaxConsoleLogSize, e.g. to forward it to a log aggregator.
+type ConsoleSink interface {
+	Append(buildId string, data []byte) error
+}
+
+// ConsoleSinkFunc adapts a function to ConsoleSink.
+type ConsoleSinkFunc func(buildId string, data []byte) error
+
+func (f ConsoleSinkFunc) Append(buildId string, data []byte) error {
+	return f(buildId, data)
+}
+
+// ConsoleFileSink returns the sink appending console output to
+// ConsoleLogFile, which serves console logs of builds and is the only
+// sink when ConsoleSinks is empty.
+func (s *Server) ConsoleFileSink() ConsoleSink {
+	return ConsoleSinkFunc(func(buildId string, data []byte) error {
+		return s.appendToFile(s.ConsoleLogFile(buildId), data)
+	})
+}
+
+func (s *Server) consoleSinks() []ConsoleSink {
+	if len(s.ConsoleSinks) == 0 {
+		return []ConsoleSink{s.ConsoleFileSink()}
+	}
+	return s.ConsoleSinks
+}
+
+// appendToConsoleSinks appends data to every sink, and returns whether
+// any sink accepted data and the first error after all sinks are tried.
+func (s *Server) appendToConsoleSinks(buildId string, data []byte) (bool, error) {
+	var firstErr error
+	accepted := false
+	for _, sink := range s.consoleSinks() {
+		if err := sink.Append(buildId, data); err != nil {
+			s.error("append console log of build %v failed: %v", buildId, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			accepted = true
+		}
+	}
+	return accepted, firstErr
+}
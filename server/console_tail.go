@@ -0,0 +1,165 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// DefaultConsoleTailSize is the bytes of the latest console output kept
+// in memory for each running build.
+const DefaultConsoleTailSize = 64 * 1024
+
+const consoleTailReadSize = 4096
+
+// consoleTail is a ring buffer of the latest console output of a build,
+// which is written from the start of the console log.
+type consoleTail struct {
+	buf  []byte
+	end  int
+	full bool
+}
+
+func newConsoleTail(size int) *consoleTail {
+	return &consoleTail{buf: make([]byte, size)}
+}
+
+func (t *consoleTail) Write(p []byte) {
+	size := len(t.buf)
+	if len(p) >= size {
+		copy(t.buf, p[len(p)-size:])
+		t.end, t.full = 0, true
+		return
+	}
+	n := copy(t.buf[t.end:], p)
+	copy(t.buf, p[n:])
+	if t.end+len(p) >= size {
+		t.full = true
+	}
+	t.end = (t.end + len(p)) % size
+}
+
+// Bytes returns the buffered output, and whether it is the whole console
+// log of the build.
+func (t *consoleTail) Bytes() ([]byte, bool) {
+	if !t.full {
+		return append([]byte{}, t.buf[:t.end]...), true
+	}
+	return append(append([]byte{}, t.buf[t.end:]...), t.buf[:t.end]...), false
+}
+
+// appendConsoleTail buffers data appended at offset of the console log
+// of the build. Only builds whose console log starts after the server
+// is started are buffered, until they are completed, time out or their
+// agent is disconnected.
+func (s *Server) appendConsoleTail(console *buildConsole, offset int64, data []byte) {
+	if s.ConsoleTailSize <= 0 {
+		return
+	}
+	if console.tail == nil {
+		if offset > 0 {
+			return
+		}
+		console.tail = newConsoleTail(s.ConsoleTailSize)
+	}
+	console.tail.Write(data)
+}
+
+func (s *Server) forgetConsoleTail(buildId string) {
+	if console := s.lookupBuildConsole(buildId); console != nil {
+		console.mu.Lock()
+		defer console.mu.Unlock()
+		console.tail = nil
+	}
+}
+
+// ConsoleLogTail returns the last lines of the console log of the build.
+// They are read from the output buffered in memory for running builds,
+// and from the console log file when the buffer does not have enough
+// lines or the build is completed.
+func (s *Server) ConsoleLogTail(buildId string, lines int) (string, error) {
+	var data []byte
+	var buffered, whole bool
+	if console := s.lookupBuildConsole(buildId); console != nil {
+		console.mu.Lock()
+		if console.tail != nil {
+			data, whole = console.tail.Bytes()
+			buffered = true
+		}
+		console.mu.Unlock()
+	}
+	if buffered {
+		if start, ok := lastLines(data, lines); ok || whole {
+			return string(data[start:]), nil
+		}
+	}
+	return tailFile(s.ConsoleLogFile(buildId), lines)
+}
+
+// lastLines returns where the last n lines of data start, and whether
+// data has more than n lines, so the n lines are complete. A trailing
+// line break does not start a line.
+func lastLines(data []byte, n int) (int, bool) {
+	if n <= 0 {
+		return len(data), true
+	}
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+	for ; n > 0; n-- {
+		i := bytes.LastIndexByte(data[:end], '\n')
+		if i < 0 {
+			return 0, false
+		}
+		end = i
+	}
+	return end + 1, true
+}
+
+// tailFile returns the last lines of the file, which is read backwards
+// until it has enough lines.
+func tailFile(path string, lines int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size()
+	var data []byte
+	for offset > 0 {
+		n := int64(consoleTailReadSize)
+		if n > offset {
+			n = offset
+		}
+		offset -= n
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return "", err
+		}
+		data = append(chunk, data...)
+		if start, ok := lastLines(data, lines); ok {
+			return string(data[start:]), nil
+		}
+	}
+	return string(data), nil
+}
@@ -0,0 +1,581 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsoleLogIsTruncatedAtMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.MaxConsoleLogSize = 10
+	handler := consoleHandler(s)
+
+	for _, data := range []string{"12345", "67890", "abcde", "fghij"} {
+		req := httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b1", strings.NewReader(data))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	log, err := s.ConsoleLog("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1234567890"+ConsoleTruncatedMarker, log)
+}
+
+func TestConsoleLogIsTruncatedInTheMiddleOfData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.MaxConsoleLogSize = 8
+	handler := consoleHandler(s)
+
+	for _, data := range []string{"12345", "67890", "abcde"} {
+		req := httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b1", strings.NewReader(data))
+		handler(httptest.NewRecorder(), req)
+	}
+
+	log, err := s.ConsoleLog("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, "12345678"+ConsoleTruncatedMarker, log)
+}
+
+func TestConsoleLogIsUnlimitedWhenMaxSizeIsZero(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.MaxConsoleLogSize = 0
+	handler := consoleHandler(s)
+
+	data := strings.Repeat("x", 1024)
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b1", strings.NewReader(data))
+		handler(httptest.NewRecorder(), req)
+	}
+
+	log, err := s.ConsoleLog("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, 3*1024, len(log))
+}
+
+func TestAppendConsoleLogByPutAndPost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.MaxConsoleRequestSize = 10
+	handler := s.limitRequestEntitySize("console", s.MaxConsoleRequestSize, consoleHandler(s))
+
+	for _, r := range []struct{ method, data string }{
+		{http.MethodPut, "hello\n"},
+		{http.MethodPost, "world\n"},
+		{http.MethodPut, "too large chunk\n"},
+		{http.MethodDelete, ""},
+	} {
+		req := httptest.NewRequest(r.method, ConsoleLogPath+"/builds/b1", strings.NewReader(r.data))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		switch {
+		case r.method == http.MethodDelete:
+			assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+		case len(r.data) > 10:
+			assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		default:
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+	}
+
+	log, err := s.ConsoleLog("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\nworld\n", log)
+}
+
+func TestSearchConsoleLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	assert.Nil(t, s.appendToFile(s.ConsoleLogFile("b1"), []byte("compiling\nERROR: a\ntesting\nerror: b\nERROR: c\n")))
+
+	w := httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodGet, ConsoleLogPath+"/builds/b1?q=(?i)^error", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2:ERROR: a\n4:error: b\n5:ERROR: c\n", w.Body.String())
+
+	s.MaxConsoleSearchMatches = 2
+	w = httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodGet, ConsoleLogPath+"/builds/b1?q=ERROR", nil))
+	assert.Equal(t, "2:ERROR: a\n5:ERROR: c\n", w.Body.String())
+
+	s.MaxConsoleSearchMatches = 1
+	w = httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodGet, ConsoleLogPath+"/builds/b1?q=ERROR", nil))
+	assert.Equal(t, "2:ERROR: a\n", w.Body.String())
+}
+
+func TestSearchConsoleLogWithInvalidQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	assert.Nil(t, s.appendToFile(s.ConsoleLogFile("b1"), []byte("hello\n")))
+
+	w := httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodGet, ConsoleLogPath+"/builds/b1?q=%5B", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDownloadConsoleLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	assert.Nil(t, s.appendToFile(s.ConsoleLogFile("b1"), []byte("hello\nworld\n")))
+
+	w := httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodGet, ConsoleLogPath+"/builds/b1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello\nworld\n", w.Body.String())
+
+	req := httptest.NewRequest(http.MethodGet, ConsoleLogPath+"/builds/b1", nil)
+	req.Header.Set("Range", "bytes=6-")
+	w = httptest.NewRecorder()
+	consoleHandler(s)(w, req)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "world\n", w.Body.String())
+
+	r, err := s.ConsoleLogReader("b1")
+	assert.Nil(t, err)
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\nworld\n", string(content))
+}
+
+func TestDownloadConsoleLogAsAttachment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	assert.Nil(t, s.appendToFile(s.ConsoleLogFile("b1"), []byte("hello\nworld\n")))
+
+	w := httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodGet, ConsoleLogPath+"/builds/b1", nil))
+	assert.Equal(t, "", w.Header().Get("Content-Disposition"))
+
+	w = httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodGet, ConsoleLogPath+"/builds/b1?download=1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	disposition, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	assert.Nil(t, err)
+	assert.Equal(t, "attachment", disposition)
+	assert.Equal(t, "console-b1.log", params["filename"])
+	assert.Equal(t, "hello\nworld\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodGet, ConsoleLogPath+"/builds/b1?download=1&format=gz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/gzip", w.Header().Get("Content-Type"))
+	_, params, err = mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	assert.Nil(t, err)
+	assert.Equal(t, "console-b1.log.gz", params["filename"])
+	gr, err := gzip.NewReader(w.Body)
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(gr)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\nworld\n", string(content))
+
+	w = httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodGet, ConsoleLogPath+"/builds/b1?format=zip", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestConsoleLogIsTruncatedOnceWithConcurrentAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.MaxConsoleLogSize = 100
+	handler := consoleHandler(s)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b1", strings.NewReader("0123456789"))
+			handler(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	log, err := s.ConsoleLog("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, 100+len(ConsoleTruncatedMarker), len(log))
+	assert.Equal(t, 1, strings.Count(log, ConsoleTruncatedMarker))
+
+	req := httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b2", strings.NewReader("other build"))
+	handler(httptest.NewRecorder(), req)
+	log, err = s.ConsoleLog("b2")
+	assert.Nil(t, err)
+	assert.Equal(t, "other build", log)
+}
+
+func TestConsoleUploadAtOffsetSkipsReceivedBytesAndRejectsGap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	handler := consoleHandler(s)
+
+	upload := func(offset, data string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b1?offset="+offset, strings.NewReader(data))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	w := upload("0", "12345")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5", w.Header().Get(protocol.ConsoleOffsetHeader))
+	// retry of an upload already received
+	w = upload("0", "12345")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5", w.Header().Get(protocol.ConsoleOffsetHeader))
+	// partially received
+	w = upload("3", "45678")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "8", w.Header().Get(protocol.ConsoleOffsetHeader))
+	w = upload("10", "abc")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "8", w.Header().Get(protocol.ConsoleOffsetHeader))
+	w = upload("-1", "abc")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	log, err := s.ConsoleLog("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, "12345678", log)
+}
+
+func TestConsoleUploadAtOffsetIsTrackedApartFromConsoleLogSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	go manageAgents(s)
+	defer close(s.managerStop)
+
+	received, err := s.appendConsoleLogAt("b1", 0, []byte("agent1\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), received)
+	assert.Nil(t, s.appendConsoleLog("b1", []byte("plugin\n")))
+	received, err = s.appendConsoleLogAt("b1", 7, []byte("agent2\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(14), received)
+	log, err := s.ConsoleLog("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, "agent1\nplugin\nagent2\n", log)
+
+	// the build is run again with the same build id
+	s.completeBuild("a1", "b1", protocol.BuildPassed)
+	received, err = s.appendConsoleLogAt("b1", 0, []byte("rerun\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), received)
+	log, err = s.ConsoleLog("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, "agent1\nplugin\nagent2\nrerun\n", log)
+}
+
+func TestConsoleAppendsByPutAreInterleavedWithAgentUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	handler := consoleHandler(s)
+	put := func(method, query, data string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, ConsoleLogPath+"/builds/b1"+query, strings.NewReader(data))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			method := http.MethodPut
+			if i%2 == 0 {
+				method = http.MethodPost
+			}
+			assert.Equal(t, http.StatusOK, put(method, "", fmt.Sprintf("plugin %v\n", i)).Code)
+		}(i)
+	}
+	var offset int64
+	for i := 0; i < 10; i++ {
+		line := fmt.Sprintf("agent %v\n", i)
+		w := put(http.MethodPut, fmt.Sprintf("?offset=%v", offset), line)
+		assert.Equal(t, http.StatusOK, w.Code)
+		// a retry of the upload is not appended again
+		w = put(http.MethodPut, fmt.Sprintf("?offset=%v", offset), line)
+		offset += int64(len(line))
+		assert.Equal(t, fmt.Sprint(offset), w.Header().Get(protocol.ConsoleOffsetHeader))
+	}
+	wg.Wait()
+
+	log, err := s.ConsoleLog("b1")
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(log, "\n"), "\n")
+	assert.Equal(t, 20, len(lines))
+	var agent []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "agent ") {
+			agent = append(agent, line)
+		} else {
+			assert.True(t, strings.HasPrefix(line, "plugin "), line)
+		}
+	}
+	assert.Equal(t, []string{"agent 0", "agent 1", "agent 2", "agent 3", "agent 4",
+		"agent 5", "agent 6", "agent 7", "agent 8", "agent 9"}, agent)
+}
+
+func TestConsoleLogIsAppendedToAllSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.MaxConsoleLogSize = 8
+	var mu sync.Mutex
+	forwarded := make(map[string]string)
+	s.ConsoleSinks = []ConsoleSink{ConsoleSinkFunc(func(buildId string, data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		forwarded[buildId] += string(data)
+		return nil
+	})}
+	handler := consoleHandler(s)
+
+	upload := func(offset, data string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b1?offset="+offset, strings.NewReader(data))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	assert.Equal(t, "5", upload("0", "12345").Header().Get(protocol.ConsoleOffsetHeader))
+	assert.Equal(t, "5", upload("0", "12345").Header().Get(protocol.ConsoleOffsetHeader))
+	assert.Equal(t, http.StatusConflict, upload("10", "abc").Code)
+	assert.Equal(t, "10", upload("5", "67890").Header().Get(protocol.ConsoleOffsetHeader))
+
+	assert.Equal(t, "12345678"+ConsoleTruncatedMarker, forwarded["b1"])
+	assert.False(t, s.ConsoleLogExists("b1"), "console log file is written by the file sink only")
+
+	s.ConsoleSinks = append(s.ConsoleSinks, s.ConsoleFileSink())
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b2", strings.NewReader("hello")))
+	log, err := s.ConsoleLog("b2")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", log)
+	assert.Equal(t, "hello", forwarded["b2"])
+}
+
+func TestConsoleSinkErrorFailsUploadAfterOtherSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.ConsoleSinks = []ConsoleSink{
+		ConsoleSinkFunc(func(string, []byte) error { return errors.New("unavailable") }),
+		s.ConsoleFileSink(),
+	}
+
+	w := httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b1?offset=0", strings.NewReader("hello")))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "5", w.Header().Get(protocol.ConsoleOffsetHeader))
+	// the retry is not written again to the sink that accepted it
+	w = httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b1?offset=0", strings.NewReader("hello")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5", w.Header().Get(protocol.ConsoleOffsetHeader))
+	log, err := s.ConsoleLog("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", log)
+
+	s.ConsoleSinks[1] = ConsoleSinkFunc(func(string, []byte) error { return errors.New("unavailable") })
+	w = httptest.NewRecorder()
+	consoleHandler(s)(w, httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b1?offset=5", strings.NewReader("world")))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "5", w.Header().Get(protocol.ConsoleOffsetHeader))
+}
+
+func TestSlowConsoleSinkDoesNotBlockAppendsOfOtherBuilds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	blocked := make(chan bool)
+	release := make(chan bool)
+	s.ConsoleSinks = []ConsoleSink{ConsoleSinkFunc(func(buildId string, data []byte) error {
+		if buildId == "b1" {
+			blocked <- true
+			<-release
+		}
+		return nil
+	})}
+
+	done := make(chan error)
+	go func() {
+		done <- s.appendConsoleLog("b1", []byte("hello"))
+	}()
+	<-blocked
+	appended := make(chan error)
+	go func() {
+		_, err := s.appendConsoleLogAt("b2", 0, []byte("world"))
+		appended <- err
+	}()
+	select {
+	case err := <-appended:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("append of b2 should not wait for the sink of b1")
+	}
+	close(release)
+	assert.Nil(t, <-done)
+}
+
+func TestConsoleLogTailOfRunningBuildIsBufferedInMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.ConsoleTailSize = 16
+	handler := consoleHandler(s)
+
+	for i := 1; i <= 5; i++ {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, ConsoleLogPath+"/builds/b1", strings.NewReader(fmt.Sprintf("line %v\n", i))))
+	}
+	assert.Equal(t, 16, len(s.consoles["b1"].tail.buf))
+	// the tail is read from memory, not from the file
+	assert.Nil(t, os.Truncate(s.ConsoleLogFile("b1"), 0))
+	tail, err := s.ConsoleLogTail("b1", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "line 4\nline 5\n", tail)
+
+	// more lines than buffered are read from the file
+	assert.Nil(t, s.appendToFile(s.ConsoleLogFile("b1"), []byte("a\nb\nc\nd\n")))
+	tail, err = s.ConsoleLogTail("b1", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, "b\nc\nd\n", tail)
+
+	go manageAgents(s)
+	defer close(s.managerStop)
+	s.completeBuild("a1", "b1", protocol.BuildPassed)
+	assert.Nil(t, s.consoles["b1"].tail)
+	tail, err = s.ConsoleLogTail("b1", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "d\n", tail)
+}
+
+func TestConsoleLogTailIsForgottenWhenBuildTimesOutOrAgentIsDisconnected(t *testing.T) {
+	for _, timeout := range []bool{true, false} {
+		dir, err := ioutil.TempDir("", "console-test")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+		s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+		if timeout {
+			s.MaxBuildDuration = 100 * time.Millisecond
+		}
+		s.startNotifier()
+		go manageAgents(s)
+		ts := httptest.NewServer(websocketHandler(s))
+		defer ts.Close()
+		changes, cancel := s.Subscribe(10)
+		defer cancel()
+
+		ws, err := dialAgent(ts.URL, "1")
+		assert.Nil(t, err)
+		defer ws.Close()
+		info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1"}}
+		assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+		s.SendBuild("a1", "b1", protocol.EchoCommand("hello"))
+		assert.Equal(t, "b1", receiveBuildId(t, ws))
+		assert.Nil(t, s.appendConsoleLog("b1", []byte("hello\n")))
+		console := s.lookupBuildConsole("b1")
+		console.mu.Lock()
+		assert.NotNil(t, console.tail)
+		console.mu.Unlock()
+
+		expected := "build b1 " + protocol.BuildTimeout
+		if !timeout {
+			ws.Close()
+			expected = "agent a1 Disconnected"
+		}
+		for change := range changes {
+			if change.String() == expected {
+				break
+			}
+		}
+		console.mu.Lock()
+		assert.Nil(t, console.tail)
+		console.mu.Unlock()
+	}
+}
+
+func TestConsoleLogTailOfCompletedBuildIsReadFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "console-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	var content bytes.Buffer
+	for i := 1; i <= 2000; i++ {
+		fmt.Fprintf(&content, "line %v\n", i)
+	}
+	assert.Nil(t, s.appendToFile(s.ConsoleLogFile("b1"), content.Bytes()))
+
+	for lines, expected := range map[int]string{
+		0:    "",
+		1:    "line 2000\n",
+		3:    "line 1998\nline 1999\nline 2000\n",
+		5000: content.String(),
+	} {
+		tail, err := s.ConsoleLogTail("b1", lines)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, tail)
+	}
+	_, err = s.ConsoleLogTail("b2", 1)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"golang.org/x/net/websocket"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeAgent connects to the websocket endpoint of a server like an
+// agent and records every message it receives, for testing servers
+// without running builds.
+type FakeAgent struct {
+	Uuid string
+
+	conn     *websocket.Conn
+	mu       sync.Mutex
+	messages []*protocol.Message
+	next     int
+	received chan bool
+	closed   chan bool
+}
+
+// DialFakeAgent connects to the server at url, e.g. "https://localhost:8154"
+// or the url of an httptest.Server, and pings it as an idle agent.
+// Server certificates are not verified.
+func DialFakeAgent(url, uuid string) (*FakeAgent, error) {
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(url, "http")+WebSocketPath, url)
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	config.Header.Set(protocol.VersionHeader, strconv.Itoa(protocol.Version))
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	agent := &FakeAgent{
+		Uuid:     uuid,
+		conn:     conn,
+		received: make(chan bool, 1),
+		closed:   make(chan bool),
+	}
+	go agent.receive()
+	if err := agent.Ping("Idle"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return agent, nil
+}
+
+func (a *FakeAgent) receive() {
+	defer close(a.closed)
+	for {
+		msg, err := protocol.ReceiveMessage(a.conn)
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		a.messages = append(a.messages, msg)
+		a.mu.Unlock()
+		select {
+		case a.received <- true:
+		default:
+		}
+	}
+}
+
+// Messages returns all messages received so far.
+func (a *FakeAgent) Messages() []*protocol.Message {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*protocol.Message{}, a.messages...)
+}
+
+// WaitForAction returns the first message of the action received after
+// the message returned by the last WaitForAction call, waiting for it
+// until timeout.
+func (a *FakeAgent) WaitForAction(action string, timeout time.Duration) (*protocol.Message, error) {
+	deadline := time.After(timeout)
+	for {
+		a.mu.Lock()
+		for ; a.next < len(a.messages); a.next++ {
+			if msg := a.messages[a.next]; msg.Action == action {
+				a.next++
+				a.mu.Unlock()
+				return msg, nil
+			}
+		}
+		a.mu.Unlock()
+		select {
+		case <-a.received:
+		case <-a.closed:
+			return nil, fmt.Errorf("connection is closed while waiting for %v", action)
+		case <-deadline:
+			return nil, fmt.Errorf("wait for %v timeout", action)
+		}
+	}
+}
+
+// LastBuild returns the last build received, or nil when there is none.
+func (a *FakeAgent) LastBuild() *protocol.Build {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := len(a.messages) - 1; i >= 0; i-- {
+		if a.messages[i].Action == protocol.BuildAction {
+			return a.messages[i].DataBuild()
+		}
+	}
+	return nil
+}
+
+// LastBuildCommands returns the commands of the last build received,
+// as they were passed to SendBuild.
+func (a *FakeAgent) LastBuildCommands() []*protocol.BuildCommand {
+	build := a.LastBuild()
+	if build == nil || build.BuildCommand == nil {
+		return nil
+	}
+	return build.BuildCommand.SubCommands
+}
+
+func (a *FakeAgent) Send(msg *protocol.Message) error {
+	return protocol.SendMessage(a.conn, msg)
+}
+
+// Ping reports the agent runtime status, e.g. "Idle" or "Building".
+func (a *FakeAgent) Ping(runtimeStatus string) error {
+	return a.Send(protocol.PingMessage(&protocol.AgentRuntimeInfo{
+		Identifier:                   &protocol.AgentIdentifier{Uuid: a.Uuid},
+		RuntimeStatus:                runtimeStatus,
+		SupportsBuildCommandProtocol: true,
+	}))
+}
+
+// Complete reports the build completed with result, e.g. protocol.BuildPassed.
+func (a *FakeAgent) Complete(buildId, result string) error {
+	return a.Send(protocol.CompletedMessage(&protocol.Report{BuildId: buildId, Result: result}))
+}
+
+func (a *FakeAgent) Close() error {
+	err := a.conn.Close()
+	<-a.closed
+	return err
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFakeAgentRecordsMessagesFromServer(t *testing.T) {
+	certs, err := GenerateTestCerts("localhost")
+	assert.Nil(t, err)
+	defer os.RemoveAll(certs.Dir)
+	s := New("", certs.ServerCertFile, certs.ServerKeyFile, certs.Dir, log.New(ioutil.Discard, "", 0))
+	listener := NewChannelStateListener(10, false)
+	s.StateListeners = []StateListener{listener}
+	s.Listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	started := make(chan error)
+	go func() { started <- s.Start() }()
+	defer func() {
+		assert.Nil(t, s.Shutdown(context.Background()))
+		assert.Nil(t, <-started)
+	}()
+
+	agent, err := DialFakeAgent("https://"+s.Listener.Addr().String(), "a1")
+	assert.Nil(t, err)
+	defer agent.Close()
+	assert.Nil(t, listener.WaitFor("agent", "a1", "Idle", time.Second))
+
+	s.SendBuild("a1", "b1", protocol.EchoCommand("hello"), protocol.ExecCommand("make"))
+	msg, err := agent.WaitForAction(protocol.BuildAction, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "b1", msg.DataBuild().BuildId)
+	assert.Equal(t, []*protocol.BuildCommand{protocol.EchoCommand("hello"), protocol.ExecCommand("make")}, agent.LastBuildCommands())
+
+	assert.Nil(t, agent.Complete("b1", protocol.BuildPassed))
+	assert.Nil(t, listener.WaitFor("build", "b1", protocol.BuildPassed, time.Second))
+	s.Send("a1", protocol.CancelMessage())
+	_, err = agent.WaitForAction(protocol.CancelBuildAction, time.Second)
+	assert.Nil(t, err)
+	_, err = agent.WaitForAction(protocol.BuildAction, 50*time.Millisecond)
+	assert.NotNil(t, err)
+
+	var actions []string
+	for _, msg := range agent.Messages() {
+		actions = append(actions, msg.Action)
+	}
+	assert.Equal(t, []string{protocol.AckAction, protocol.SetCookieAction, protocol.BuildAction, protocol.AckAction, protocol.CancelBuildAction}, actions)
+}
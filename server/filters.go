@@ -17,17 +17,68 @@
 package server
 
 import (
+	"fmt"
+	"io"
 	"net/http"
 )
 
+// requestEntityTooLargeError is returned by reading a request body
+// larger than the limit of its endpoint.
+type requestEntityTooLargeError struct {
+	endpoint string
+	limit    int64
+}
+
+func (e *requestEntityTooLargeError) Error() string {
+	return fmt.Sprintf("%v entity is larger than the limit of %d bytes", e.endpoint, e.limit)
+}
+
 func (s *Server) LimittedRequestEntitySize(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return s.limitRequestEntitySize("request", 0, handler)
+}
+
+// limitRequestEntitySize rejects requests of the endpoint with entities
+// larger than limit, or MaxRequestEntitySize when limit is not positive.
+func (s *Server) limitRequestEntitySize(endpoint string, limit int64, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
-		limit := s.MaxRequestEntitySize()
-		if limit > 0 && req.ContentLength > limit {
+		limit := limit
+		if limit <= 0 {
+			limit = s.MaxRequestEntitySize()
+		}
+		if limit <= 0 {
+			handler(w, req)
+			return
+		}
+		tooLarge := &requestEntityTooLargeError{endpoint: endpoint, limit: limit}
+		if req.ContentLength > limit {
 			s.log("Request content length (%v) is larger than acceptable size (%d)", req.ContentLength, limit)
-			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			s.responseRequestEntityTooLarge(tooLarge, w)
 			return
 		}
+		req.Body = &limitedBody{ReadCloser: req.Body, remaining: limit, err: tooLarge}
 		handler(w, req)
 	}
 }
+
+// limitedBody counts the bytes read from a request body, it guards
+// requests sent without a content length, e.g. chunked uploads.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, b.err
+	}
+	return n, err
+}
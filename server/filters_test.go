@@ -0,0 +1,66 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestEntitySizeIsLimitedPerEndpoint(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.SetMaxRequestEntitySize(100)
+	read := func(w http.ResponseWriter, req *http.Request) {
+		if _, err := ioutil.ReadAll(req.Body); err != nil {
+			s.responseBadRequest(err, w)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+	post := func(handler func(http.ResponseWriter, *http.Request), size int, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("x", size)))
+		if chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	property := s.limitRequestEntitySize("property", 10, read)
+	assert.Equal(t, http.StatusCreated, post(property, 10, false).Code)
+	w := post(property, 11, false)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "property entity is larger than the limit of 10 bytes\n", w.Body.String())
+	w = post(property, 11, true)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "property entity is larger than the limit of 10 bytes\n", w.Body.String())
+
+	artifact := s.limitRequestEntitySize("artifact", 1000, read)
+	assert.Equal(t, http.StatusCreated, post(artifact, 500, false).Code)
+
+	console := s.limitRequestEntitySize("console", 0, read)
+	assert.Equal(t, http.StatusCreated, post(console, 100, true).Code)
+	w = post(console, 101, false)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "console entity is larger than the limit of 100 bytes\n", w.Body.String())
+}
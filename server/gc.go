@@ -0,0 +1,177 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultGCInterval is used when GCConfig.Interval is not positive.
+const DefaultGCInterval = time.Hour
+
+// GCConfig configures garbage collection of build directories under
+// the server working directory.
+type GCConfig struct {
+	// Retention is how long a build directory is kept after it is
+	// last modified.
+	Retention time.Duration
+	// KeepLast is the number of most recent builds kept regardless of
+	// their age.
+	KeepLast int
+	// Interval is how often build directories are checked, defaults to
+	// DefaultGCInterval.
+	Interval time.Duration
+}
+
+// StartGC starts removing expired build directories in background
+// every config.Interval, until StopGC is called.
+func (s *Server) StartGC(config GCConfig) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	if s.gcStop != nil {
+		return
+	}
+	interval := config.Interval
+	if interval <= 0 {
+		interval = DefaultGCInterval
+	}
+	stop := make(chan bool)
+	s.gcStop = stop
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				removed, err := s.CollectGarbage(config.Retention, config.KeepLast)
+				if err != nil {
+					s.error("collect garbage failed: %v", err)
+				} else if len(removed) > 0 {
+					s.log("removed expired builds: %v", removed)
+				}
+			}
+		}
+	}()
+}
+
+func (s *Server) StopGC() {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	if s.gcStop != nil {
+		close(s.gcStop)
+		s.gcStop = nil
+	}
+}
+
+type buildDir struct {
+	id      string
+	modTime time.Time
+}
+
+type byModTime []*buildDir
+
+func (a byModTime) Len() int           { return len(a) }
+func (a byModTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byModTime) Less(i, j int) bool { return a[i].modTime.After(a[j].modTime) }
+
+// CollectGarbage removes build directories not modified within retention,
+// except the keepLast most recent builds and the builds that are running
+// or queued, and then the artifact blobs no build links to and the chunked
+// uploads not completed within ChunkedUploadTTL. It returns ids of the
+// removed builds.
+func (s *Server) CollectGarbage(retention time.Duration, keepLast int) ([]string, error) {
+	dirs, err := s.buildDirs()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byModTime(dirs))
+	active := s.activeBuilds()
+	expiry := time.Now().Add(-retention)
+	var removed []string
+	for i, dir := range dirs {
+		if i < keepLast || active[dir.id] || dir.modTime.After(expiry) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.WorkingDir, dir.id)); err != nil {
+			return removed, err
+		}
+		if err := os.RemoveAll(filepath.Join(s.UploadsDir(), dir.id)); err != nil {
+			return removed, err
+		}
+		s.forgetConsoleLog(dir.id)
+		removed = append(removed, dir.id)
+	}
+	if len(removed) > 0 {
+		if _, err := s.pruneBlobs(); err != nil {
+			return removed, err
+		}
+	}
+	uploads, err := s.pruneUploads()
+	if len(uploads) > 0 {
+		s.log("removed abandoned uploads: %v", uploads)
+	}
+	return removed, err
+}
+
+func (s *Server) buildDirs() ([]*buildDir, error) {
+	infos, err := ioutil.ReadDir(s.WorkingDir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []*buildDir
+	for _, info := range infos {
+		if !isBuildDir(info) {
+			continue
+		}
+		modTime, err := lastModified(filepath.Join(s.WorkingDir, info.Name()), info)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, &buildDir{id: info.Name(), modTime: modTime})
+	}
+	return dirs, nil
+}
+
+// isBuildDir tells whether the entry of WorkingDir is a build directory,
+// hidden directories like BlobsDir are not.
+func isBuildDir(info os.FileInfo) bool {
+	return info.IsDir() && !strings.HasPrefix(info.Name(), ".")
+}
+
+// lastModified returns the latest modification time of the directory and
+// its direct entries, console log is appended without touching the
+// directory.
+func lastModified(dir string, info os.FileInfo) (time.Time, error) {
+	modTime := info.ModTime()
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return modTime, err
+	}
+	for _, entry := range entries {
+		if entry.ModTime().After(modTime) {
+			modTime = entry.ModTime()
+		}
+	}
+	return modTime, nil
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbageRemovesExpiredBuilds(t *testing.T) {
+	s, dir := gcTestServer(t)
+	defer os.RemoveAll(dir)
+	old := time.Now().Add(-2 * time.Hour)
+	createBuildDir(t, s, "b1", old)
+	createBuildDir(t, s, "b2", old)
+	createBuildDir(t, s, "b3", time.Now())
+
+	removed, err := s.CollectGarbage(time.Hour, 0)
+	assert.Nil(t, err)
+	sort.Strings(removed)
+	assert.Equal(t, []string{"b1", "b2"}, removed)
+	assert.True(t, exists(s.ConsoleLogFile("b3")), "recent build should be kept")
+	assert.True(t, !exists(s.ConsoleLogFile("b1")), "expired build should be removed")
+	assert.True(t, exists(s.CertPemFile), "files in working dir should be kept")
+}
+
+func TestCollectGarbageKeepsLastBuilds(t *testing.T) {
+	s, dir := gcTestServer(t)
+	defer os.RemoveAll(dir)
+	createBuildDir(t, s, "b1", time.Now().Add(-3*time.Hour))
+	createBuildDir(t, s, "b2", time.Now().Add(-2*time.Hour))
+
+	removed, err := s.CollectGarbage(time.Hour, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b1"}, removed)
+	assert.True(t, exists(s.ConsoleLogFile("b2")), "last build should be kept")
+}
+
+func TestCollectGarbageSkipsActiveBuilds(t *testing.T) {
+	s, dir := gcTestServer(t)
+	defer os.RemoveAll(dir)
+	createBuildDir(t, s, "b1", time.Now().Add(-2*time.Hour))
+	createBuildDir(t, s, "b2", time.Now().Add(-2*time.Hour))
+	s.SendBuild("a1", "b1", protocol.EchoCommand("hello"))
+
+	removed, err := s.CollectGarbage(time.Hour, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b2"}, removed)
+	assert.True(t, exists(s.ConsoleLogFile("b1")), "queued build should be kept")
+}
+
+func TestStartGCRemovesExpiredBuildsInBackground(t *testing.T) {
+	s, dir := gcTestServer(t)
+	defer os.RemoveAll(dir)
+	createBuildDir(t, s, "b1", time.Now().Add(-2*time.Hour))
+
+	s.StartGC(GCConfig{Retention: time.Hour, Interval: 10 * time.Millisecond})
+	defer s.StopGC()
+	timeout := time.After(time.Second)
+	for exists(s.ConsoleLogFile("b1")) {
+		select {
+		case <-timeout:
+			t.Fatal("expired build is not removed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestStartGCWithoutIntervalUsesDefault(t *testing.T) {
+	s, dir := gcTestServer(t)
+	defer os.RemoveAll(dir)
+	createBuildDir(t, s, "b1", time.Now().Add(-2*time.Hour))
+
+	s.StartGC(GCConfig{Retention: time.Hour})
+	time.Sleep(50 * time.Millisecond)
+	s.StopGC()
+	assert.True(t, exists(s.ConsoleLogFile("b1")), "build should be kept until the default interval")
+}
+
+func TestCollectGarbageRemovesBlobsNotLinkedByAnyBuild(t *testing.T) {
+	s, dir := gcTestServer(t)
+	defer os.RemoveAll(dir)
+	s.DedupArtifacts = true
+	for _, buildId := range []string{"b1", "b2"} {
+		w := httptest.NewRecorder()
+		artifactsHandler(s)(w, uploadRequest(t, buildId, "", "foo.jar"))
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+	for i, buildId := range []string{"b2", "b1"} {
+		modTime := time.Now().Add(-time.Duration(i+2) * time.Hour)
+		entries, err := ioutil.ReadDir(filepath.Join(dir, buildId))
+		assert.Nil(t, err)
+		for _, entry := range entries {
+			assert.Nil(t, os.Chtimes(filepath.Join(dir, buildId, entry.Name()), modTime, modTime))
+		}
+		assert.Nil(t, os.Chtimes(filepath.Join(dir, buildId), modTime, modTime))
+	}
+
+	removed, err := s.CollectGarbage(time.Hour, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b1"}, removed)
+	blobs, err := ioutil.ReadDir(s.BlobsDir())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(blobs))
+
+	removed, err = s.CollectGarbage(time.Hour, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b2"}, removed)
+	blobs, err = ioutil.ReadDir(s.BlobsDir())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(blobs))
+}
+
+func TestPruneBlobsKeepsBlobsLinkedByUploads(t *testing.T) {
+	s, dir := gcTestServer(t)
+	defer os.RemoveAll(dir)
+	s.DedupArtifacts = true
+	w := httptest.NewRecorder()
+	artifactsHandler(s)(w, uploadRequest(t, "b1", "", "foo.jar"))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	staged := filepath.Join(s.UploadsDir(), "b2", "zip1", "foo.jar")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(staged), 0755))
+	assert.Nil(t, os.Link(s.ArtifactFile("b1", "foo.jar"), staged))
+	assert.Nil(t, os.RemoveAll(filepath.Join(dir, "b1")))
+
+	// an upload linking a blob holds pruneBlobs off
+	s.blobsMu.RLock()
+	done := make(chan []string)
+	go func() {
+		removed, err := s.pruneBlobs()
+		assert.Nil(t, err)
+		done <- removed
+	}()
+	select {
+	case <-done:
+		t.Fatal("pruneBlobs should wait for the upload")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.blobsMu.RUnlock()
+	assert.Equal(t, 0, len(<-done))
+	blobs, err := ioutil.ReadDir(s.BlobsDir())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(blobs))
+
+	assert.Nil(t, os.RemoveAll(s.UploadsDir()))
+	removed, err := s.pruneBlobs()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(removed))
+}
+
+func TestCollectGarbageRemovesAbandonedUploads(t *testing.T) {
+	s, dir := gcTestServer(t)
+	defer os.RemoveAll(dir)
+	createBuildDir(t, s, "b1", time.Now())
+	for _, uploadId := range []string{"abandoned", "active"} {
+		w := httptest.NewRecorder()
+		artifactsHandler(s)(w, chunkRequest("b1", uploadId, 0, "chunk"))
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+	old := time.Now().Add(-2 * s.ChunkedUploadTTL)
+	abandoned := filepath.Join(s.UploadsDir(), "b1", "abandoned")
+	assert.Nil(t, os.Chtimes(filepath.Join(abandoned, "chunk-0"), old, old))
+	assert.Nil(t, os.Chtimes(abandoned, old, old))
+
+	removed, err := s.CollectGarbage(time.Hour, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(removed))
+	assert.False(t, exists(abandoned), "abandoned upload should be removed")
+	assert.True(t, exists(filepath.Join(s.UploadsDir(), "b1", "active")), "active upload should be kept")
+	assert.True(t, exists(s.ConsoleLogFile("b1")), "build should be kept")
+}
+
+func TestListBuildsAndConsoleLogExists(t *testing.T) {
+	s, dir := gcTestServer(t)
+	defer os.RemoveAll(dir)
+	createBuildDir(t, s, "b2", time.Now())
+	createBuildDir(t, s, "b1", time.Now())
+	assert.Nil(t, os.MkdirAll(s.ArtifactsDir("b3"), 0755))
+	assert.Nil(t, os.MkdirAll(s.BlobsDir(), 0755))
+
+	builds, err := s.ListBuilds()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b1", "b2", "b3"}, builds)
+	assert.True(t, s.ConsoleLogExists("b1"), "b1 has console log")
+	assert.False(t, s.ConsoleLogExists("b3"), "b3 has no console log")
+	assert.False(t, s.ConsoleLogExists("b4"), "b4 does not exist")
+
+	s.WorkingDir = filepath.Join(dir, "missing")
+	builds, err = s.ListBuilds()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(builds))
+}
+
+func gcTestServer(t *testing.T) (*Server, string) {
+	dir, err := ioutil.TempDir("", "gc-test")
+	assert.Nil(t, err)
+	s := New("", filepath.Join(dir, "cert.pem"), "", dir, log.New(ioutil.Discard, "", 0))
+	assert.Nil(t, ioutil.WriteFile(s.CertPemFile, []byte("cert"), 0644))
+	if err := os.Chtimes(s.CertPemFile, time.Time{}, time.Now().Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	go manageAgents(s)
+	return s, dir
+}
+
+func createBuildDir(t *testing.T, s *Server, buildId string, modTime time.Time) {
+	assert.Nil(t, s.appendToFile(s.ConsoleLogFile(buildId), []byte("log")))
+	assert.Nil(t, os.Chtimes(s.ConsoleLogFile(buildId), modTime, modTime))
+	assert.Nil(t, os.Chtimes(filepath.Dir(s.ConsoleLogFile(buildId)), modTime, modTime))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGzippedPropertiesAboveMinSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gzip-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.GzipMinSize = 100
+	handler := s.Gzipped(propertiesHandler(s))
+	assert.Equal(t, http.StatusCreated, postProperty(s, "b1", "version", "1.2.3"))
+
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, PropertiesPath+"/builds/b1", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		return w
+	}
+
+	w := get("gzip")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, `{"version":"1.2.3"}`, w.Body.String())
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusCreated, postProperty(s, "b1", fmt.Sprintf("property%v", i), strings.Repeat("v", 10)))
+	}
+	w = get("deflate, gzip")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	var properties map[string]string
+	assert.Nil(t, json.Unmarshal(gunzip(t, w.Body.Bytes()), &properties))
+	assert.Equal(t, 11, len(properties))
+
+	for _, acceptEncoding := range []string{"", "deflate", "gzip;q=0"} {
+		w = get(acceptEncoding)
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"), acceptEncoding)
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &properties))
+	}
+}
+
+func TestGzippedArtifactsDoesNotCompressGzipArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gzip-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.GzipMinSize = 10
+	handler := s.Gzipped(artifactsHandler(s))
+
+	var content bytes.Buffer
+	gz := gzip.NewWriter(&content)
+	gz.Write([]byte(strings.Repeat("artifact ", 100)))
+	gz.Close()
+	assert.Nil(t, os.MkdirAll(s.ArtifactsDir("b1"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(s.ArtifactsDir("b1"), "dist.tar.gz"), content.Bytes(), 0644))
+	checksums := strings.Repeat("dist.tar.gz=d41d8cd98f00b204e9800998ecf8427e\n", 10)
+	assert.Nil(t, ioutil.WriteFile(s.ChecksumFile("b1"), []byte(checksums), 0644))
+
+	req := httptest.NewRequest(http.MethodGet, s.ArtifactUrl("b1", "dist.tar.gz"), nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, content.Bytes(), w.Body.Bytes())
+
+	req = httptest.NewRequest(http.MethodGet, s.ChecksumUrl("b1"), nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header().Get("Content-Length"))
+	assert.Equal(t, checksums, string(gunzip(t, w.Body.Bytes())))
+}
+
+func gunzip(t *testing.T, data []byte) []byte {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	content, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	return content
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	ReadinessPath = "/readyz"
+	HealthPath    = "/healthz"
+
+	DefaultMinFreeDiskSpace = 10 * 1024 * 1024
+	DefaultHealthCheckTTL   = 5 * time.Second
+)
+
+// Health is the storage health of the server reported by HealthPath.
+type Health struct {
+	Healthy       bool   `json:"healthy"`
+	Reason        string `json:"reason,omitempty"`
+	FreeDiskSpace uint64 `json:"freeDiskSpace"`
+}
+
+var ReadinessCheckTimeout = time.Second
+
+func (s *Server) setListening(listening bool) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	s.listening = listening
+}
+
+func (s *Server) isListening() bool {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.listening
+}
+
+// Ready returns the reason why the server is not ready to serve agents,
+// or nil when it is listening, the agents manager is running and the
+// working directory is writable with at least MinFreeDiskSpace.
+func (s *Server) Ready() error {
+	if !s.isListening() {
+		return errors.New("server is not listening")
+	}
+	ids := make(chan map[string]bool, 1)
+	select {
+	case s.activeBuildsQuery <- ids:
+		<-ids
+	case <-time.After(ReadinessCheckTimeout):
+		return errors.New("agents manager is not running")
+	}
+	_, err := s.checkStorage()
+	return err
+}
+
+// checkStorage returns the free disk space of the working directory, and
+// the error when it is not writable or has less than MinFreeDiskSpace.
+func (s *Server) checkStorage() (uint64, error) {
+	if err := os.MkdirAll(s.WorkingDir, 0755); err != nil {
+		return 0, fmt.Errorf("working directory is not writable: %v", err)
+	}
+	f, err := ioutil.TempFile(s.WorkingDir, ".readyz")
+	if err != nil {
+		return 0, fmt.Errorf("working directory is not writable: %v", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	free, err := freeDiskSpace(s.WorkingDir)
+	if err != nil {
+		return 0, err
+	}
+	if s.MinFreeDiskSpace > 0 && free < uint64(s.MinFreeDiskSpace) {
+		return free, fmt.Errorf("free disk space %v bytes is less than %v bytes", free, s.MinFreeDiskSpace)
+	}
+	return free, nil
+}
+
+// Health checks the storage of the server, the result is cached for
+// HealthCheckTTL so that frequent health checks do not hammer the disk.
+func (s *Server) Health() *Health {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	if s.health != nil && time.Since(s.healthCheckedAt) < s.HealthCheckTTL {
+		return s.health
+	}
+	free, err := s.checkStorage()
+	s.health = &Health{Healthy: err == nil, FreeDiskSpace: free}
+	if err != nil {
+		s.health.Reason = err.Error()
+	}
+	s.healthCheckedAt = time.Now()
+	return s.health
+}
+
+func healthHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		health := s.Health()
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Healthy {
+			s.log("unhealthy: %v", health.Reason)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(health)
+	}
+}
+
+func readinessHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := s.Ready(); err != nil {
+			s.log("not ready: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	ReadinessCheckTimeout = 10 * time.Millisecond
+	defer func() { ReadinessCheckTimeout = time.Second }()
+	dir, err := ioutil.TempDir("", "health-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+
+	w := readiness(s)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "server is not listening", w.Body.String())
+
+	s.setListening(true)
+	w = readiness(s)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "agents manager is not running", w.Body.String())
+
+	go manageAgents(s)
+	w = readiness(s)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(files))
+
+	s.MinFreeDiskSpace = math.MaxInt64
+	w = readiness(s)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.True(t, strings.HasPrefix(w.Body.String(), "free disk space"), w.Body.String())
+}
+
+func TestHealthReportsUnwritableWorkingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.HealthCheckTTL = 0
+
+	w := healthz(s)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var health Health
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.True(t, health.Healthy, w.Body.String())
+	assert.True(t, health.FreeDiskSpace > 0, w.Body.String())
+
+	// a working dir under a regular file can not be created or written
+	file := filepath.Join(dir, "file")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("file"), 0644))
+	s.WorkingDir = filepath.Join(file, "work")
+	w = healthz(s)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	health = Health{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.False(t, health.Healthy, w.Body.String())
+	assert.True(t, strings.HasPrefix(health.Reason, "working directory is not writable"), health.Reason)
+}
+
+func TestHealthIsCachedForHealthCheckTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.HealthCheckTTL = time.Hour
+
+	assert.True(t, s.Health().Healthy, "healthy")
+	s.MinFreeDiskSpace = math.MaxInt64
+	assert.True(t, s.Health().Healthy, "cached")
+	s.HealthCheckTTL = 0
+	assert.False(t, s.Health().Healthy, "not enough free disk space")
+}
+
+func healthz(s *Server) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	healthHandler(s)(w, httptest.NewRequest(http.MethodGet, HealthPath, nil))
+	return w
+}
+
+func readiness(s *Server) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	readinessHandler(s)(w, httptest.NewRequest(http.MethodGet, ReadinessPath, nil))
+	return w
+}
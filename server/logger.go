@@ -0,0 +1,51 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"log"
+)
+
+// Logger is the leveled logger used by Server, implement it to bridge
+// server logs to other logging libraries.
+type Logger interface {
+	Infof(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+	Debugf(format string, v ...interface{})
+}
+
+// StdLogger adapts a stdlib logger to Logger, error and debug logs are
+// prefixed with their level.
+func StdLogger(logger *log.Logger) Logger {
+	return &stdLogger{logger: logger}
+}
+
+type stdLogger struct {
+	logger *log.Logger
+}
+
+func (l *stdLogger) Infof(format string, v ...interface{}) {
+	l.logger.Printf(format, v...)
+}
+
+func (l *stdLogger) Errorf(format string, v ...interface{}) {
+	l.logger.Printf("ERROR: "+format, v...)
+}
+
+func (l *stdLogger) Debugf(format string, v ...interface{}) {
+	l.logger.Printf("DEBUG: "+format, v...)
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+type recordLogger struct {
+	lines []string
+}
+
+func (l *recordLogger) Infof(format string, v ...interface{}) {
+	l.lines = append(l.lines, "info: "+fmt.Sprintf(format, v...))
+}
+
+func (l *recordLogger) Errorf(format string, v ...interface{}) {
+	l.lines = append(l.lines, "error: "+fmt.Sprintf(format, v...))
+}
+
+func (l *recordLogger) Debugf(format string, v ...interface{}) {
+	l.lines = append(l.lines, "debug: "+fmt.Sprintf(format, v...))
+}
+
+func TestServerLogsToPluggableLogger(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	logger := &recordLogger{}
+	s.Logger = logger
+
+	s.log("hello %v", 1)
+	s.error("failed %v", 2)
+	s.debug("detail %v", 3)
+	assert.Equal(t, []string{"info: hello 1", "error: failed 2", "debug: detail 3"}, logger.lines)
+}
+
+func TestStdLoggerPrefixesLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := StdLogger(log.New(&buf, "", 0))
+	logger.Infof("hello")
+	logger.Errorf("failed")
+	logger.Debugf("detail")
+	assert.Equal(t, "hello\nERROR: failed\nDEBUG: detail\n", buf.String())
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+type slowListener struct {
+	delay    time.Duration
+	notified chan string
+}
+
+func (l *slowListener) Notify(class, id, state string) {
+	time.Sleep(l.delay)
+	l.notified <- class + " " + id + " " + state
+}
+
+func TestNotifyDoesNotBlockOnSlowListener(t *testing.T) {
+	listener := &slowListener{delay: 100 * time.Millisecond, notified: make(chan string, 10)}
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.StateListeners = []StateListener{listener}
+	s.startNotifier()
+
+	start := time.Now()
+	s.notifyBuild("b1", "Building")
+	s.notifyBuild("b1", "Passed")
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "notify should not block")
+	assert.Equal(t, "build b1 Building", <-listener.notified)
+	assert.Equal(t, "build b1 Passed", <-listener.notified)
+}
+
+func TestNotifyDropsWhenBufferIsFull(t *testing.T) {
+	listener := &slowListener{delay: 100 * time.Millisecond, notified: make(chan string, 10)}
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.StateListeners = []StateListener{listener}
+	s.NotifyBufferSize = 1
+	s.NotifyPolicy = NotifyDrop
+	s.startNotifier()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		s.notifyAgent(&RemoteAgent{id: "a1"}, "Idle")
+	}
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "notify should not block")
+	time.Sleep(300 * time.Millisecond)
+	assert.True(t, len(listener.notified) <= 2, "expected notifications to be dropped")
+}
+
+func TestSubscribersReceiveStateChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	changes1, cancel1 := s.Subscribe(10)
+	changes2, cancel2 := s.Subscribe(10)
+	defer cancel2()
+
+	ws, err := dialAgent(ts.URL, "1")
+	assert.Nil(t, err)
+	info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1"}, RuntimeStatus: "Idle"}
+	assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+	for _, changes := range []<-chan *StateChange{changes1, changes2} {
+		assert.Equal(t, "agent a1 Connected", (<-changes).String())
+		assert.Equal(t, "agent a1 Idle", (<-changes).String())
+	}
+
+	cancel1()
+	_, ok := <-changes1
+	assert.False(t, ok)
+
+	s.notifyBuild("b1", "Building")
+	assert.Nil(t, s.appendConsoleLog("b1", []byte("hello\n")))
+	ws.Close()
+	assert.Equal(t, "build b1 Building", (<-changes2).String())
+	assert.Equal(t, "console b1 Appended", (<-changes2).String())
+	assert.Equal(t, "agent a1 Disconnected", (<-changes2).String())
+}
+
+func TestConsoleAppendsDoNotCrowdOutStateChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	listener := &slowListener{delay: 100 * time.Millisecond, notified: make(chan string, 10)}
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.StateListeners = []StateListener{listener}
+	s.NotifyBufferSize = 2
+	s.NotifyPolicy = NotifyDrop
+	s.startNotifier()
+	changes, cancel := s.Subscribe(100)
+	defer cancel()
+
+	s.notifyBuild("b1", "Building")
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, s.appendConsoleLog("b1", []byte("hello\n")))
+	}
+	s.notifyBuild("b1", "Passed")
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "console appends should not block")
+	assert.Equal(t, "build b1 Building", <-listener.notified)
+	assert.Equal(t, "build b1 Passed", <-listener.notified)
+	appended := 0
+	for len(changes) > 0 {
+		if (<-changes).Class == "console" {
+			appended++
+		}
+	}
+	assert.Equal(t, 10, appended)
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	errInvalidProperty = errors.New("property name must not be empty or contain '=', and value must not contain line breaks")
+	errPropertyExists  = errors.New("property is already defined")
+)
+
+// propertiesHandler serves properties of a build as a JSON object, or
+// the value of query param "name" as text. POST defines property
+// "name" with form value "value", a property can not be redefined.
+func propertiesHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		buildId := parseBuildId(req.URL.Path)
+		name := req.URL.Query().Get("name")
+		switch req.Method {
+		case http.MethodGet:
+			serveProperties(s, buildId, name, w)
+		case http.MethodPost:
+			err := s.SetProperty(buildId, name, req.FormValue("value"))
+			if err == errPropertyExists {
+				s.log("property %v of build %v is already defined", name, buildId)
+				w.WriteHeader(http.StatusConflict)
+			} else if err == errInvalidProperty {
+				s.responseBadRequest(err, w)
+			} else if err != nil {
+				s.responseInternalError(err, w)
+			} else {
+				w.WriteHeader(http.StatusCreated)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func serveProperties(s *Server, buildId, name string, w http.ResponseWriter) {
+	properties, err := s.Properties(buildId)
+	if err != nil {
+		s.responseInternalError(err, w)
+		return
+	}
+	if name == "" {
+		data, err := json.Marshal(properties)
+		if err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+	value, ok := properties[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(value))
+}
+
+// Properties returns the properties defined for the build, which is
+// empty when there is none.
+func (s *Server) Properties(buildId string) (map[string]string, error) {
+	s.propertiesMu.Lock()
+	defer s.propertiesMu.Unlock()
+	return s.readProperties(buildId)
+}
+
+// SetProperty defines the property of the build, it is an error to
+// define a property twice.
+func (s *Server) SetProperty(buildId, name, value string) error {
+	if name == "" || strings.ContainsAny(name, "=\r\n") || strings.ContainsAny(value, "\r\n") {
+		return errInvalidProperty
+	}
+	s.propertiesMu.Lock()
+	defer s.propertiesMu.Unlock()
+	properties, err := s.readProperties(buildId)
+	if err != nil {
+		return err
+	}
+	if _, ok := properties[name]; ok {
+		return errPropertyExists
+	}
+	return s.appendToFile(s.PropertiesFile(buildId), []byte(fmt.Sprintf("%v=%v\n", name, value)))
+}
+
+func (s *Server) readProperties(buildId string) (map[string]string, error) {
+	properties := make(map[string]string)
+	f, err := os.Open(s.PropertiesFile(buildId))
+	if os.IsNotExist(err) {
+		return properties, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if i := bytes.IndexByte(scanner.Bytes(), '='); i > 0 {
+			properties[scanner.Text()[:i]] = scanner.Text()[i+1:]
+		}
+	}
+	return properties, scanner.Err()
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFetchBuildProperties(t *testing.T) {
+	dir, err := ioutil.TempDir("", "properties-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+
+	w := httptest.NewRecorder()
+	propertiesHandler(s)(w, httptest.NewRequest(http.MethodGet, PropertiesPath+"/builds/b1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "{}", w.Body.String())
+
+	assert.Equal(t, http.StatusCreated, postProperty(s, "b1", "version", "1.2.3"))
+	assert.Equal(t, http.StatusCreated, postProperty(s, "b1", "url", "http://example.com/?a=b"))
+	assert.Equal(t, http.StatusConflict, postProperty(s, "b1", "version", "1.2.4"))
+	assert.Equal(t, http.StatusBadRequest, postProperty(s, "b1", "bad=name", "v"))
+	assert.Equal(t, http.StatusBadRequest, postProperty(s, "b1", "multiline", "a\nb"))
+
+	w = httptest.NewRecorder()
+	propertiesHandler(s)(w, httptest.NewRequest(http.MethodGet, PropertiesPath+"/builds/b1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"url":"http://example.com/?a=b","version":"1.2.3"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	propertiesHandler(s)(w, httptest.NewRequest(http.MethodGet, s.PropertyUrl("b1", "version"), nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1.2.3", w.Body.String())
+
+	w = httptest.NewRecorder()
+	propertiesHandler(s)(w, httptest.NewRequest(http.MethodGet, s.PropertyUrl("b1", "missing"), nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func postProperty(s *Server, buildId, name, value string) int {
+	form := url.Values{"value": {value}}
+	req := httptest.NewRequest(http.MethodPost, s.PropertyUrl(buildId, name), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	propertiesHandler(s)(w, req)
+	return w.Code
+}
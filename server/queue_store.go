@@ -0,0 +1,120 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package server
+
+import (
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultQueueRecoveryTimeout is how long builds restored as running
+// wait for their agent to reconnect after a server restart, before they
+// are queued again.
+const DefaultQueueRecoveryTimeout = time.Minute
+
+// QueueStore persists the build queue, so builds dispatched or queued
+// to agents survive a server restart. Save is called by the agents
+// manager after each change of the queue, Load once when it starts.
+type QueueStore interface {
+	Save(snapshot *QueueSnapshot) error
+	Load() (*QueueSnapshot, error)
+}
+
+// QueueSnapshot holds the builds running on agents and the builds
+// queued for them, in the order they were queued.
+type QueueSnapshot struct {
+	Running []*QueuedBuild `json:"running"`
+	Queued  []*QueuedBuild `json:"queued"`
+}
+
+type QueuedBuild struct {
+	AgentId string            `json:"agentId"`
+	Msg     *protocol.Message `json:"message"`
+}
+
+// FileQueueStore stores the queue snapshot as json in a file, it is
+// replaced on each save so a crash never leaves a partial snapshot.
+type FileQueueStore struct {
+	Path string
+}
+
+func NewFileQueueStore(path string) *FileQueueStore {
+	return &FileQueueStore{Path: path}
+}
+
+func (f *FileQueueStore) Save(snapshot *QueueSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(f.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".queue")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// Load returns an empty snapshot when nothing was saved yet.
+func (f *FileQueueStore) Load() (*QueueSnapshot, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return &QueueSnapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot QueueSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+type agentRuntimeStatus struct {
+	agentId      string
+	status       string
+	buildLocator string
+}
+
+// reconcileAgent tells the agents manager the runtime status an agent
+// pinged, so a build restored as running on it is dispatched again when
+// the agent is not building it anymore.
+func (s *Server) reconcileAgent(agentId string, info *protocol.AgentRuntimeInfo) {
+	if s.QueueStore == nil {
+		return
+	}
+	status := &agentRuntimeStatus{agentId: agentId, status: info.RuntimeStatus}
+	if info.BuildingInfo != nil {
+		status.buildLocator = info.BuildingInfo.BuildLocator
+	}
+	s.agentStatus <- status
+}
@@ -17,23 +17,76 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"github.com/satori/go.uuid"
 	"golang.org/x/net/websocket"
 	"io"
+	"net"
+	"time"
 )
 
+var (
+	errSendQueueFull = errors.New("send queue is full")
+	errAgentClosed   = errors.New("agent connection is closed")
+)
+
+var pingCodec = websocket.Codec{Marshal: func(v interface{}) ([]byte, byte, error) {
+	return nil, websocket.PingFrame, nil
+}}
+
 type RemoteAgent struct {
-	conn *websocket.Conn
-	id   string
+	conn           *websocket.Conn
+	id             string
+	version        int
+	registration   *AgentRegistration
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	maxMessageSize int
+	outbox         chan *protocol.Message
+	closed         chan bool
+}
+
+func newRemoteAgent(s *Server, conn *websocket.Conn, version int) *RemoteAgent {
+	// an unbuffered outbox would disconnect the agent on its first message
+	queueSize := s.AgentSendQueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultAgentSendQueueSize
+	}
+	// a zero read timeout would expire every read immediately
+	readTimeout := s.AgentReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = DefaultAgentReadTimeout
+	}
+	return &RemoteAgent{
+		conn:           conn,
+		version:        version,
+		readTimeout:    readTimeout,
+		writeTimeout:   s.AgentWriteTimeout,
+		maxMessageSize: s.MaxWebSocketMessageSize,
+		outbox:         make(chan *protocol.Message, queueSize),
+		closed:         make(chan bool),
+	}
 }
 
 func (agent *RemoteAgent) Listen(server *Server) error {
 	for {
-		msg, err := protocol.ReceiveMessage(agent.conn)
+		agent.conn.SetReadDeadline(time.Now().Add(agent.readTimeout))
+		msg, err := protocol.ReceiveMessageLimited(agent.conn, agent.maxMessageSize)
 		if err == io.EOF {
 			return err
+		} else if err == protocol.ErrMessageTooLarge {
+			server.error("%v sent a message larger than %v bytes", agent, agent.maxMessageSize)
+			agent.conn.WriteClose(protocol.CloseStatusMessageTooBig)
+			return err
+		} else if err != nil && server.isShuttingDown() {
+			return err
+		} else if netErr, ok := err.(net.Error); ok {
+			if netErr.Timeout() {
+				server.error("no message from %v in %v", agent, agent.readTimeout)
+			}
+			return err
 		} else if err != nil {
 			server.error("receive error: %v", err)
 		} else {
@@ -44,6 +97,10 @@ func (agent *RemoteAgent) Listen(server *Server) error {
 
 func (agent *RemoteAgent) processMessage(server *Server, msg *protocol.Message) {
 	server.log("received message: %v", msg.Action)
+	if msg.Version > agent.version {
+		server.error("%v sent %v message of protocol version %v, but connected with version %v",
+			agent, msg.Action, msg.Version, agent.version)
+	}
 	err := agent.Ack(msg)
 	if err != nil {
 		server.error("ack error: %v", err)
@@ -53,22 +110,136 @@ func (agent *RemoteAgent) processMessage(server *Server, msg *protocol.Message)
 		info := msg.AgentRuntimeInfo()
 		if agent.id == "" {
 			agent.id = info.Identifier.Uuid
+			agent.registration = agentRegistration(server.Registration(agent.id), info)
 			server.add(agent)
 			agent.SetCookie()
 		}
+		server.updateRuntimeInfo(info)
+		server.reconcileAgent(agent.id, info)
 		agentState := info.RuntimeStatus
-		server.notifyAgent(agent.id, agentState)
+		server.notifyAgent(agent, agentState)
 	case "reportCurrentStatus":
 		report := msg.Report()
 		server.notifyBuild(report.BuildId, report.JobState)
 	case "reportCompleting", "reportCompleted":
 		report := msg.Report()
 		server.notifyBuild(report.BuildId, report.Result)
+		if msg.Action == protocol.ReportCompletedAction {
+			server.completeBuild(agent.id, report.BuildId, report.Result)
+		}
+	case protocol.DeregisterAction:
+		server.deregister(agent)
+	case protocol.ExecResultAction:
+		if err := server.writeExecResult(msg.ExecResult()); err != nil {
+			server.error("record exec result error: %v", err)
+		}
+	case protocol.BuildResultAction:
+		if err := server.writeBuildResult(msg.BuildResult()); err != nil {
+			server.error("record build result error: %v", err)
+		}
+	}
+}
+
+// writeExecResult appends the exec result sent by an agent to the exec
+// results file of its build, it rejects build ids that are not a single
+// path element.
+func (s *Server) writeExecResult(result *protocol.ExecResult) error {
+	if !validBuildId(result.BuildId) {
+		return errInvalidBuildId
+	}
+	return s.appendToFile(s.ExecResultsFile(result.BuildId), []byte(formatExecResult(result)))
+}
+
+func formatExecResult(result *protocol.ExecResult) string {
+	if result.Signal != "" {
+		return fmt.Sprintf("%v exit %v (signal: %v)\n", result.Command, result.ExitCode, result.Signal)
 	}
+	return fmt.Sprintf("%v exit %v\n", result.Command, result.ExitCode)
 }
 
+// agentRegistration returns the registration of the agent, or the one
+// reported by its runtime info when the agent did not register to this
+// server, e.g. the server restarted after the agent registered.
+func agentRegistration(reg *AgentRegistration, info *protocol.AgentRuntimeInfo) *AgentRegistration {
+	if reg != nil {
+		return reg
+	}
+	return &AgentRegistration{
+		Uuid:            info.Identifier.Uuid,
+		Hostname:        info.Identifier.HostName,
+		OperatingSystem: info.OperatingSystemName,
+	}
+}
+
+// Send queues the message for writeMessages, so that an agent slow to
+// read does not block the caller, e.g. the agents manager. The agent is
+// disconnected when it has AgentSendQueueSize messages not sent yet.
 func (agent *RemoteAgent) Send(msg *protocol.Message) error {
-	return protocol.SendMessage(agent.conn, msg)
+	select {
+	case <-agent.closed:
+		return errAgentClosed
+	default:
+	}
+	select {
+	case agent.outbox <- msg:
+		return nil
+	default:
+		agent.conn.Close()
+		return errSendQueueFull
+	}
+}
+
+// writeMessages sends the queued messages until the connection is
+// closed.
+func (agent *RemoteAgent) writeMessages(server *Server) {
+	for {
+		select {
+		case msg := <-agent.outbox:
+			if err := agent.write(msg); err != nil {
+				server.error("send %v to %v failed: %v", msg.Action, agent, err)
+			}
+		case <-agent.closed:
+			return
+		}
+	}
+}
+
+// write sends the message without protocol version to legacy agents.
+func (agent *RemoteAgent) write(msg *protocol.Message) error {
+	if agent.version == protocol.LegacyVersion && msg.Version != protocol.LegacyVersion {
+		legacy := *msg
+		legacy.Version = protocol.LegacyVersion
+		msg = &legacy
+	}
+	agent.conn.SetWriteDeadline(time.Now().Add(agent.writeTimeout))
+	err := protocol.SendMessageTo(agent.conn, msg, agent.version)
+	if _, ok := err.(net.Error); ok {
+		agent.conn.Close()
+	}
+	return err
+}
+
+// keepalive sends ping frames in interval until stop is closed, the
+// connection is closed when a ping could not be sent.
+func (agent *RemoteAgent) keepalive(server *Server, interval time.Duration, stop chan bool) {
+	if interval <= 0 {
+		interval = DefaultAgentPingInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			agent.conn.SetWriteDeadline(time.Now().Add(agent.writeTimeout))
+			if err := pingCodec.Send(agent.conn, nil); err != nil {
+				server.error("ping %v failed: %v", agent, err)
+				agent.conn.Close()
+				return
+			}
+		}
+	}
 }
 
 func (agent *RemoteAgent) SetCookie() error {
@@ -21,11 +21,29 @@ import (
 )
 
 func (s *Server) responseBadRequest(err error, w http.ResponseWriter) {
+	if tooLarge, ok := err.(*requestEntityTooLargeError); ok {
+		s.responseRequestEntityTooLarge(tooLarge, w)
+		return
+	}
 	s.log("Bad request: %v", err)
 	w.WriteHeader(http.StatusBadRequest)
 }
 
 func (s *Server) responseInternalError(err error, w http.ResponseWriter) {
+	if tooLarge, ok := err.(*requestEntityTooLargeError); ok {
+		s.responseRequestEntityTooLarge(tooLarge, w)
+		return
+	}
 	s.error("Server internal error: %v", err)
 	w.WriteHeader(http.StatusInternalServerError)
 }
+
+func (s *Server) responseUnauthorized(err error, w http.ResponseWriter) {
+	s.log("Unauthorized request: %v", err)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (s *Server) responseRequestEntityTooLarge(err *requestEntityTooLargeError, w http.ResponseWriter) {
+	s.log("Request content is larger than acceptable size: %v", err)
+	http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+}
@@ -17,17 +17,21 @@
 package server
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"github.com/gocd-contrib/gocd-golang-agent/protocol"
 	"golang.org/x/net/websocket"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -38,71 +42,336 @@ const (
 	ConsoleLogPath = "/console"
 	ArtifactsPath  = "/artifacts"
 	PropertiesPath = "/properties"
+
+	DefaultNotifyBufferSize        = 1000
+	DefaultMaxConsoleLogSize       = 100 * 1024 * 1024
+	DefaultMaxConsoleSearchMatches = 1000
+	DefaultGzipMinSize             = 1024
+	DefaultMaxPropertyRequestSize  = 64 * 1024
+
+	// agents ping every 10 seconds, an agent sending nothing in
+	// DefaultAgentReadTimeout is disconnected; pings are sent to agents
+	// to keep idle connections open through proxies
+	DefaultAgentReadTimeout  = 60 * time.Second
+	DefaultAgentWriteTimeout = 10 * time.Second
+	DefaultAgentPingInterval = 20 * time.Second
+
+	// agents send console logs and artifacts over http, their websocket
+	// messages are pings and build status reports of a few KB, larger
+	// messages are rejected to protect the server from running out of
+	// memory
+	DefaultMaxWebSocketMessageSize = 1024 * 1024
+
+	// messages to an agent are queued, the agent is disconnected when
+	// it does not read them fast enough to keep the queue from filling
+	DefaultAgentSendQueueSize = 100
 )
 
+// StateListener is notified of agent and build state changes. Notify
+// is called from a single dispatching goroutine, so implementations
+// should return quickly, a slow listener delays the notifications of
+// all other listeners.
 type StateListener interface {
 	Notify(class, id, state string)
 }
 
+// AgentStateListener is notified of agent state changes with the
+// registration of the agent through NotifyAgent instead of Notify,
+// build state changes are still notified through Notify.
+type AgentStateListener interface {
+	StateListener
+	NotifyAgent(agent *AgentRegistration, state string)
+}
+
+type NotifyPolicy int
+
+const (
+	// NotifyBlock blocks the notifying goroutine until there is room
+	// in the notification buffer.
+	NotifyBlock NotifyPolicy = iota
+	// NotifyDrop drops notifications when the buffer is full.
+	NotifyDrop
+)
+
 type AgentMessage struct {
 	agentId string
+	seq     uint64
 	Msg     *protocol.Message
 }
 
 type Server struct {
-	Address              string
-	CertPemFile          string
-	KeyPemFile           string
-	WorkingDir           string
-	Logger               *log.Logger
-	StateListeners       []StateListener
-	maxRequestEntitySize int64
-	fieldChangeMu        sync.Mutex
-
-	addAgent    chan *RemoteAgent
-	delAgent    chan *RemoteAgent
-	sendMessage chan *AgentMessage
+	Address                 string
+	BindAddress             string
+	PathPrefix              string
+	PublicURL               string
+	AgentBinaryFile         string
+	AgentBinaryVersion      string
+	CertPemFile             string
+	KeyPemFile              string
+	TLSMinVersion           uint16
+	CipherSuites            []uint16
+	ClientAuth              tls.ClientAuthType
+	ClientCAFile            string
+	Listener                net.Listener
+	WorkingDir              string
+	Logger                  Logger
+	StateListeners          []StateListener
+	NotifyBufferSize        int
+	NotifyPolicy            NotifyPolicy
+	MaxConsoleLogSize       int64
+	ConsoleSinks            []ConsoleSink
+	ConsoleTailSize         int
+	MaxConsoleSearchMatches int
+	MaxConsoleRequestSize   int64
+	MaxArtifactRequestSize  int64
+	MaxPropertyRequestSize  int64
+	GzipMinSize             int
+	MinFreeDiskSpace        int64
+	HealthCheckTTL          time.Duration
+	AgentReadTimeout        time.Duration
+	AgentWriteTimeout       time.Duration
+	AgentPingInterval       time.Duration
+	AgentSendQueueSize      int
+	MaxWebSocketMessageSize int
+	MaxConcurrentBuilds     int
+	QueueStore              QueueStore
+	QueueRecoveryTimeout    time.Duration
+	QueuedBuildTTL          time.Duration
+	MaxBuildDuration        time.Duration
+	DedupArtifacts          bool
+	ChecksumAlgorithm       string
+	ChunkedUploadTTL        time.Duration
+	CircuitBreaker          CircuitBreaker
+	CommandInterceptor      func([]*protocol.BuildCommand) ([]*protocol.BuildCommand, error)
+	maxRequestEntitySize    int64
+	authenticator           Authenticator
+	fieldChangeMu           sync.Mutex
+	registrations           map[string]*AgentRegistration
+	runtimeInfos            map[string]*protocol.AgentRuntimeInfo
+	listening               bool
+	consoleMu               sync.Mutex
+	consoles                map[string]*buildConsole
+	propertiesMu            sync.Mutex
+	blobsMu                 sync.RWMutex
+	healthMu                sync.Mutex
+	health                  *Health
+	healthCheckedAt         time.Time
+	mux                     *http.ServeMux
+	httpServer              *http.Server
+	shuttingDown            bool
+	conns                   map[*RemoteAgent]bool
+	connsWG                 sync.WaitGroup
+
+	notifications chan *StateChange
+	subscribersMu sync.Mutex
+	subscribers   map[chan *StateChange]bool
+
+	addAgent       chan *RemoteAgent
+	delAgent       chan *RemoteAgent
+	deregAgent     chan *RemoteAgent
+	sendMessage    chan *AgentMessage
+	buildCompleted chan *buildCompletion
+	buildTimedOut  chan *buildCompletion
+	buildExpired   chan *buildCompletion
+	queueDepth     chan *queueDepthQuery
+	routeBuild     chan *resourceBuild
+	agentStatus    chan *agentRuntimeStatus
+
+	activeBuildsQuery chan chan map[string]bool
+	activeBuildCount  chan chan int
+	enableAgent       chan string
+	gcStop            chan bool
+	notifierStop      chan bool
+	managerStop       chan bool
+	shutdownDone      chan bool
+	stopManagerOnce   sync.Once
+	shutdownOnce      sync.Once
 }
 
 func New(address, certFile, keyFile, workingDir string, logger *log.Logger) *Server {
 	return &Server{
-		Address:     address,
-		CertPemFile: certFile,
-		KeyPemFile:  keyFile,
-		WorkingDir:  workingDir,
-		Logger:      logger,
-		addAgent:    make(chan *RemoteAgent),
-		delAgent:    make(chan *RemoteAgent),
-		sendMessage: make(chan *AgentMessage),
+		Address:                 address,
+		CertPemFile:             certFile,
+		KeyPemFile:              keyFile,
+		TLSMinVersion:           DefaultTLSMinVersion,
+		WorkingDir:              workingDir,
+		Logger:                  StdLogger(logger),
+		NotifyBufferSize:        DefaultNotifyBufferSize,
+		MaxConsoleLogSize:       DefaultMaxConsoleLogSize,
+		ConsoleTailSize:         DefaultConsoleTailSize,
+		MaxConsoleSearchMatches: DefaultMaxConsoleSearchMatches,
+		MaxPropertyRequestSize:  DefaultMaxPropertyRequestSize,
+		GzipMinSize:             DefaultGzipMinSize,
+		MinFreeDiskSpace:        DefaultMinFreeDiskSpace,
+		HealthCheckTTL:          DefaultHealthCheckTTL,
+		AgentReadTimeout:        DefaultAgentReadTimeout,
+		AgentWriteTimeout:       DefaultAgentWriteTimeout,
+		AgentPingInterval:       DefaultAgentPingInterval,
+		AgentSendQueueSize:      DefaultAgentSendQueueSize,
+		MaxWebSocketMessageSize: DefaultMaxWebSocketMessageSize,
+		ChunkedUploadTTL:        DefaultChunkedUploadTTL,
+		ChecksumAlgorithm:       protocol.ChecksumMd5,
+		QueueRecoveryTimeout:    DefaultQueueRecoveryTimeout,
+		QueuedBuildTTL:          DefaultQueuedBuildTTL,
+		registrations:           make(map[string]*AgentRegistration),
+		runtimeInfos:            make(map[string]*protocol.AgentRuntimeInfo),
+		consoles:                make(map[string]*buildConsole),
+		subscribers:             make(map[chan *StateChange]bool),
+		addAgent:                make(chan *RemoteAgent),
+		delAgent:                make(chan *RemoteAgent),
+		deregAgent:              make(chan *RemoteAgent),
+		sendMessage:             make(chan *AgentMessage),
+		buildCompleted:          make(chan *buildCompletion),
+		buildTimedOut:           make(chan *buildCompletion),
+		buildExpired:            make(chan *buildCompletion),
+		queueDepth:              make(chan *queueDepthQuery),
+		routeBuild:              make(chan *resourceBuild),
+		agentStatus:             make(chan *agentRuntimeStatus),
+		activeBuildsQuery:       make(chan chan map[string]bool),
+		activeBuildCount:        make(chan chan int),
+		enableAgent:             make(chan string),
+		mux:                     http.NewServeMux(),
+		conns:                   make(map[*RemoteAgent]bool),
+		managerStop:             make(chan bool),
+		notifierStop:            make(chan bool),
+		shutdownDone:            make(chan bool),
 	}
 
 }
 
+// Start serves Listener when it is set, otherwise listens to BindAddress,
+// or Address when BindAddress is empty.
 func (s *Server) Start() error {
+	s.startNotifier()
 	go manageAgents(s)
-	http.Handle(WebSocketPath, websocketHandler(s))
+	s.mux.Handle(s.prefixed(WebSocketPath), websocketHandler(s))
 	s.HandleFunc(RegistrationPath, registorHandler(s))
-	s.HandleFunc(ConsoleLogPath+"/", consoleHandler(s))
-	s.HandleFunc(ArtifactsPath+"/", artifactsHandler(s))
-	s.HandleFunc(StatusPath, statusHandler())
-	s.log("listen to %v", s.Address)
-	return http.ListenAndServeTLS(s.Address, s.CertPemFile, s.KeyPemFile, nil)
+	s.HandleFunc(AgentBinaryPath, s.Authenticated(agentBinaryHandler(s)))
+	s.handleLimited(ConsoleLogPath+"/", "console", s.MaxConsoleRequestSize, s.Authenticated(consoleHandler(s)))
+	s.handleLimited(ArtifactsPath+"/", "artifact", s.MaxArtifactRequestSize, s.Authenticated(s.Gzipped(artifactsHandler(s))))
+	s.handleLimited(PropertiesPath+"/", "property", s.MaxPropertyRequestSize, s.Authenticated(s.Gzipped(propertiesHandler(s))))
+	s.HandleFunc(StatusPath, statusHandler(s))
+	s.HandleFunc(ReadinessPath, readinessHandler(s))
+	s.HandleFunc(HealthPath, healthHandler(s))
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	ln := s.Listener
+	if ln == nil {
+		address := s.listenAddress()
+		s.log("listen to %v", address)
+		ln, err = net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+	}
+	server := &http.Server{Handler: s.mux, TLSConfig: tlsConfig}
+	s.fieldChangeMu.Lock()
+	s.httpServer = server
+	s.fieldChangeMu.Unlock()
+	s.setListening(true)
+	defer s.setListening(false)
+	err = server.ServeTLS(ln, s.CertPemFile, s.KeyPemFile)
+	if err == http.ErrServerClosed {
+		<-s.shutdownDone
+		return nil
+	}
+	return err
 }
 
+// HandleFunc registers handler for path mounted under PathPrefix.
 func (s *Server) HandleFunc(path string, handler func(http.ResponseWriter, *http.Request)) {
-	http.HandleFunc(path,
+	s.mux.HandleFunc(s.prefixed(path),
 		s.LimittedRequestEntitySize(handler))
 }
 
-func (s *Server) SendBuild(agentId, buildId string, commands ...*protocol.BuildCommand) {
+// handleLimited registers handler for path like HandleFunc, but limits
+// request entities of the endpoint to limit instead of
+// MaxRequestEntitySize when limit is positive.
+func (s *Server) handleLimited(path, endpoint string, limit int64, handler func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(s.prefixed(path),
+		s.limitRequestEntitySize(endpoint, limit, handler))
+}
+
+// SendBuild queues the build for the agent, it is dispatched when the
+// agent is idle and fewer than MaxConcurrentBuilds builds are running,
+// zero MaxConcurrentBuilds means unlimited. Builds queued for an agent
+// that is not connected are failed after QueuedBuildTTL. It returns the
+// error of CommandInterceptor rejecting the commands.
+func (s *Server) SendBuild(agentId, buildId string, commands ...*protocol.BuildCommand) error {
+	commands, err := s.interceptCommands(commands)
+	if err != nil {
+		return err
+	}
+	s.Send(agentId, protocol.BuildMessage(s.NewBuild(buildId, commands...)))
+	return nil
+}
+
+// SendCheckout sends a build checking out revision of the repository
+// repoURL into the pipelines/<buildId> directory of the agent, see
+// protocol.CheckoutCommand. The revision checked out is set as the build
+// property protocol.RevisionProperty.
+func (s *Server) SendCheckout(agentId, buildId, repoURL, revision string) error {
+	checkout, err := protocol.CheckoutCommand(repoURL, revision, "pipelines/"+buildId)
+	if err != nil {
+		return err
+	}
+	return s.SendBuild(agentId, buildId, checkout)
+}
+
+// SendBuildWithTimeout sends a build the agent cancels and fails when
+// it runs longer than timeout. The server also fails the build when it
+// is not reported completed in timeout plus BuildTimeoutGrace.
+func (s *Server) SendBuildWithTimeout(agentId, buildId string, timeout time.Duration, commands ...*protocol.BuildCommand) error {
+	commands, err := s.interceptCommands(commands)
+	if err != nil {
+		return err
+	}
+	build := s.NewBuild(buildId, commands...).SetTimeout(timeout)
+	s.Send(agentId, protocol.BuildMessage(build))
+	return nil
+}
+
+func (s *Server) SendBuildWithEnv(agentId, buildId string, env map[string]string, commands ...*protocol.BuildCommand) error {
+	commands, err := s.interceptCommands(commands)
+	if err != nil {
+		return err
+	}
+	build := s.NewBuild(buildId, commands...).SetEnv(env)
+	s.Send(agentId, protocol.BuildMessage(build))
+	return nil
+}
+
+// SendResumedBuild sends a build that skips the top level commands
+// before resume.Index, e.g. to rerun the command a build failed at. The
+// index counts the commands after CommandInterceptor rewrites them.
+func (s *Server) SendResumedBuild(agentId, buildId string, resume *protocol.Resume, commands ...*protocol.BuildCommand) error {
+	commands, err := s.interceptCommands(commands)
+	if err != nil {
+		return err
+	}
+	build := s.NewBuild(buildId, commands...).SetResume(resume)
+	s.Send(agentId, protocol.BuildMessage(build))
+	return nil
+}
+
+// interceptCommands returns the commands rewritten by CommandInterceptor,
+// or its error when it rejects them.
+func (s *Server) interceptCommands(commands []*protocol.BuildCommand) ([]*protocol.BuildCommand, error) {
+	if s.CommandInterceptor == nil {
+		return commands, nil
+	}
+	return s.CommandInterceptor(commands)
+}
 
+func (s *Server) NewBuild(buildId string, commands ...*protocol.BuildCommand) *protocol.Build {
 	locator := "/builds/" + buildId
-	build := protocol.NewBuild(buildId, locator, locator,
-		ConsoleLogPath+locator,
-		ArtifactsPath+locator,
-		PropertiesPath+locator,
+	return protocol.NewBuild(buildId, locator, locator,
+		s.ConsoleUrl(buildId),
+		s.publicURL(ArtifactsPath+locator),
+		s.publicURL(PropertiesPath+locator),
 		commands...)
-	s.Send(agentId, protocol.BuildMessage(build))
 }
 
 func (s *Server) SetMaxRequestEntitySize(size int64) {
@@ -117,67 +386,257 @@ func (s *Server) MaxRequestEntitySize() int64 {
 	return s.maxRequestEntitySize
 }
 
+// ConsoleLog reads the whole console log of the build into memory, use
+// ConsoleLogReader for large logs.
 func (s *Server) ConsoleLog(buildId string) (string, error) {
 	bytes, err := ioutil.ReadFile(s.ConsoleLogFile(buildId))
 	return string(bytes), err
 }
 
+func (s *Server) ConsoleLogReader(buildId string) (io.ReadCloser, error) {
+	return os.Open(s.ConsoleLogFile(buildId))
+}
+
+// ListBuilds returns ids of the builds having a directory under
+// WorkingDir sorted by id, it is empty when WorkingDir does not exist.
+func (s *Server) ListBuilds() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.WorkingDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, info := range infos {
+		if isBuildDir(info) {
+			ids = append(ids, info.Name())
+		}
+	}
+	return ids, nil
+}
+
+func (s *Server) ConsoleLogExists(buildId string) bool {
+	info, err := os.Stat(s.ConsoleLogFile(buildId))
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (s *Server) ExecResults(buildId string) (string, error) {
+	bytes, err := ioutil.ReadFile(s.ExecResultsFile(buildId))
+	return string(bytes), err
+}
+
+// BuildResult reads the result of the build and its commands, which the
+// agent sends when the build completes.
+func (s *Server) BuildResult(buildId string) (*protocol.BuildResult, error) {
+	data, err := ioutil.ReadFile(s.BuildResultFile(buildId))
+	if err != nil {
+		return nil, err
+	}
+	var result protocol.BuildResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// writeBuildResult records the build result sent by an agent, it rejects
+// build ids that are not a single path element, as the artifacts handler
+// does.
+func (s *Server) writeBuildResult(result *protocol.BuildResult) error {
+	if !validBuildId(result.BuildId) {
+		return errInvalidBuildId
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	file := s.BuildResultFile(result.BuildId)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// Checksum reads the whole checksum file of the build into memory, use
+// ChecksumReader for builds with many artifacts.
 func (s *Server) Checksum(buildId string) (string, error) {
 	bytes, err := ioutil.ReadFile(s.ChecksumFile(buildId))
 	return string(bytes), err
 }
 
+func (s *Server) ChecksumReader(buildId string) (io.ReadCloser, error) {
+	return os.Open(s.ChecksumFile(buildId))
+}
+
 func (s *Server) ChecksumUrl(buildId string) string {
-	return ArtifactsPath + "/builds/" + buildId
+	return s.publicURL(ArtifactsPath + "/builds/" + buildId)
+}
+
+// ChecksumManifest returns the checksums of the build artifacts, which
+// are read from the checksum file of builds uploaded without manifest.
+func (s *Server) ChecksumManifest(buildId string) ([]*protocol.ArtifactChecksum, error) {
+	data, err := ioutil.ReadFile(s.ChecksumManifestFile(buildId))
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(s.ChecksumFile(buildId))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return protocol.ParseChecksums(data)
+}
+
+func (s *Server) ChecksumManifestUrl(buildId string) string {
+	return s.publicURL(ArtifactsPath+"/builds/"+buildId) + "?manifest"
 }
 
 func (s *Server) ArtifactFile(buildId, file string) string {
-	return filepath.Join(s.WorkingDir, buildId, "artifacts", file)
+	return filepath.Join(s.ArtifactsDir(buildId), filepath.FromSlash(file))
+}
+
+func (s *Server) ArtifactsDir(buildId string) string {
+	return filepath.Join(s.WorkingDir, buildId, "artifacts")
 }
 
 func (s *Server) ArtifactUrl(buildId, file string) string {
-	return ArtifactsPath + "/builds/" + buildId + "?file=" + file
+	return s.publicURL(ArtifactsPath+"/builds/"+buildId) + "?file=" + url.QueryEscape(file)
 }
 
 func (s *Server) ChecksumFile(buildId string) string {
 	return filepath.Join(s.WorkingDir, buildId, "md5.checksum")
 }
 
+func (s *Server) ChecksumManifestFile(buildId string) string {
+	return filepath.Join(s.WorkingDir, buildId, "checksums.manifest")
+}
+
+func (s *Server) PropertiesFile(buildId string) string {
+	return filepath.Join(s.WorkingDir, buildId, "properties")
+}
+
+func (s *Server) PropertyUrl(buildId, name string) string {
+	return s.publicURL(PropertiesPath+"/builds/"+buildId) + "?name=" + url.QueryEscape(name)
+}
+
+func (s *Server) ExecResultsFile(buildId string) string {
+	return filepath.Join(s.WorkingDir, buildId, "exec_results.log")
+}
+
+func (s *Server) BuildResultFile(buildId string) string {
+	return filepath.Join(s.WorkingDir, buildId, "result.json")
+}
+
+func (s *Server) ConsoleUrl(buildId string) string {
+	return s.publicURL(ConsoleLogPath + "/builds/" + buildId)
+}
+
 func (s *Server) ConsoleLogFile(buildId string) string {
 	return filepath.Join(s.WorkingDir, buildId, "console.log")
 }
 
+// Send sends the message to the agent, build messages are queued, see
+// SendBuild. A CancelMessage to an agent not running a build cancels
+// the build queued for it next.
 func (s *Server) Send(agentId string, msg *protocol.Message) {
 	s.sendMessage <- &AgentMessage{agentId: agentId, Msg: msg}
 }
 
 func (s *Server) log(format string, v ...interface{}) {
-	s.Logger.Printf(format, v...)
+	s.Logger.Infof(format, v...)
 }
 
 func (s *Server) error(format string, v ...interface{}) {
-	s.Logger.Printf(format, v...)
+	s.Logger.Errorf(format, v...)
+}
+
+func (s *Server) debug(format string, v ...interface{}) {
+	s.Logger.Debugf(format, v...)
 }
 
 func (s *Server) add(agent *RemoteAgent) {
 	s.addAgent <- agent
+	s.notifySubscribers(&StateChange{Class: "agent", Id: agent.id, State: "Connected", Agent: agent.registration})
 }
 
 func (s *Server) del(agent *RemoteAgent) {
 	s.delAgent <- agent
 }
 
-func (s *Server) notifyAgent(uuid, state string) {
-	s.notify("agent", uuid, state)
+func (s *Server) deregister(agent *RemoteAgent) {
+	s.deregAgent <- agent
+}
+
+func (s *Server) notifyAgent(agent *RemoteAgent, state string) {
+	s.notify(&StateChange{Class: "agent", Id: agent.id, State: state, Agent: agent.registration})
+}
+
+// notifyAgentId notifies the agent state by id when the agent may be
+// disconnected.
+func (s *Server) notifyAgentId(agent *RemoteAgent, agentId, state string) {
+	if agent != nil {
+		s.notifyAgent(agent, state)
+	} else {
+		s.notify(&StateChange{Class: "agent", Id: agentId, State: state})
+	}
 }
 
 func (s *Server) notifyBuild(uuid, state string) {
-	s.notify("build", uuid, state)
+	s.notify(&StateChange{Class: "build", Id: uuid, State: state})
 }
 
-func (s *Server) notify(class, uuid, state string) {
+// notify publishes the change to subscribers and queues it for the
+// notifier, changes notified after the notifier is stopped are dropped.
+func (s *Server) notify(change *StateChange) {
+	s.publish(change)
+	select {
+	case s.notifications <- change:
+		return
+	case <-s.notifierStop:
+		return
+	default:
+	}
+	if s.NotifyPolicy == NotifyDrop {
+		s.error("notification buffer is full, drop notification: %v", change)
+		return
+	}
+	s.error("notification buffer is full, wait for listeners to catch up: %v", change)
+	select {
+	case s.notifications <- change:
+	case <-s.notifierStop:
+	}
+}
+
+// startNotifier delivers notifications until notifierStop is closed,
+// notifications queued by then are still delivered. notifications is
+// never closed, as it may still be sent to.
+func (s *Server) startNotifier() {
+	s.notifications = make(chan *StateChange, s.NotifyBufferSize)
+	go func() {
+		for {
+			select {
+			case change := <-s.notifications:
+				s.notifyListeners(change)
+			case <-s.notifierStop:
+				for {
+					select {
+					case change := <-s.notifications:
+						s.notifyListeners(change)
+					default:
+						s.closeSubscribers()
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (s *Server) notifyListeners(change *StateChange) {
 	for _, listener := range s.StateListeners {
-		listener.Notify(class, uuid, state)
+		if l, ok := listener.(AgentStateListener); ok && change.Agent != nil {
+			l.NotifyAgent(change.Agent, change.State)
+		} else {
+			listener.Notify(change.Class, change.Id, change.State)
+		}
 	}
 }
 
@@ -190,7 +649,7 @@ func (s *Server) appendToFile(filename string, data []byte) error {
 	if err != nil {
 		return err
 	}
-	s.log("append data(%v) to %v", len(data), filename)
+	s.debug("append data(%v) to %v", len(data), filename)
 	n, err := f.Write(data)
 	if err == nil && n < len(data) {
 		err = io.ErrShortWrite
@@ -203,26 +662,236 @@ func (s *Server) appendToFile(filename string, data []byte) error {
 
 func manageAgents(s *Server) {
 	agents := make(map[string]*RemoteAgent)
+	builds := newBuildQueue(s.MaxConcurrentBuilds)
+	health := newAgentHealth(s.CircuitBreaker)
+	send := func(agent *RemoteAgent, msg *protocol.Message) {
+		if err := agent.Send(msg); err != nil {
+			s.error("send %v to %v failed: %v", msg.Action, agent, err)
+		}
+	}
+	// startDeadline fails the build when it is not completed in its
+	// timeout plus BuildTimeoutGrace, or times it out when it runs longer
+	// than MaxBuildDuration, whichever comes first.
+	startDeadline := func(agentId string, build *protocol.Build) {
+		d, result := build.Timeout+BuildTimeoutGrace, protocol.BuildFailed
+		if s.MaxBuildDuration > 0 && (build.Timeout <= 0 || s.MaxBuildDuration < d) {
+			d, result = s.MaxBuildDuration, protocol.BuildTimeout
+		} else if build.Timeout <= 0 {
+			return
+		}
+		builds.deadline(build.BuildId, d, func() {
+			s.timeoutBuild(agentId, build.BuildId, result)
+		})
+	}
+	dispatch := func(agentId string) {
+		agent := agents[agentId]
+		if agent == nil || health.disabled[agentId] {
+			return
+		}
+		if am := builds.next(agentId); am != nil {
+			send(agent, am.Msg)
+			startDeadline(agentId, am.Msg.DataBuild())
+		}
+	}
+	// dispatchWaiting dispatches queued builds in the order they were
+	// queued after a running build is completed or stopped.
+	dispatchWaiting := func() {
+		for _, agentId := range builds.waiting() {
+			if builds.full() {
+				return
+			}
+			dispatch(agentId)
+		}
+	}
+	record := func(agentId, result string) {
+		if health.record(agentId, result) {
+			s.error("agent %v failed too many builds, disable it", agentId)
+			s.notifyAgentId(agents[agentId], agentId, "Disabled")
+		}
+	}
+	// expireQueued fails the builds queued for the agent unless it
+	// connects in QueuedBuildTTL.
+	expireQueued := func(agentId string) {
+		if s.QueuedBuildTTL > 0 {
+			builds.expireQueued(agentId, s.QueuedBuildTTL, func(buildId string) {
+				s.expireQueuedBuild(agentId, buildId)
+			})
+		}
+	}
+	remove := func(agent *RemoteAgent) {
+		delete(agents, agent.id)
+		// builds running on agents closed on shutdown are kept in the
+		// persisted queue, for reconciling after restart.
+		if s.QueueStore == nil || !s.isShuttingDown() {
+			if buildId, ok := builds.running[agent.id]; ok {
+				s.forgetConsoleTail(buildId)
+			}
+			builds.stop(agent.id)
+		}
+		s.removeRuntimeInfo(agent.id)
+		expireQueued(agent.id)
+		dispatchWaiting()
+	}
+	var recoveryTimeout <-chan time.Time
+	if s.QueueStore != nil {
+		snapshot, err := s.QueueStore.Load()
+		if err != nil {
+			s.error("load build queue failed: %v", err)
+		} else if len(snapshot.Running) > 0 || len(snapshot.Queued) > 0 {
+			s.log("restore %v running and %v queued builds", len(snapshot.Running), len(snapshot.Queued))
+			builds.restore(snapshot)
+			for agentId, am := range builds.dispatched {
+				startDeadline(agentId, am.Msg.DataBuild())
+			}
+			for agentId := range builds.queued {
+				expireQueued(agentId)
+			}
+			recoveryTimeout = time.After(s.QueueRecoveryTimeout)
+		}
+	}
+	saved := builds.changes
+	save := func() {
+		if s.QueueStore == nil || builds.changes == saved {
+			return
+		}
+		if err := s.QueueStore.Save(builds.snapshot()); err != nil {
+			s.error("save build queue failed: %v", err)
+			return
+		}
+		saved = builds.changes
+	}
 	for {
 		select {
 		case agent := <-s.addAgent:
 			agents[agent.id] = agent
+			builds.keepQueued(agent.id)
+			dispatch(agent.id)
 		case agent := <-s.delAgent:
-			delete(agents, agent.id)
+			if agents[agent.id] == agent {
+				remove(agent)
+				s.notifySubscribers(&StateChange{Class: "agent", Id: agent.id, State: "Disconnected", Agent: agent.registration})
+			}
+		case agent := <-s.deregAgent:
+			if agents[agent.id] == agent {
+				remove(agent)
+				s.notifyAgent(agent, "Disconnected")
+			}
 		case am := <-s.sendMessage:
-			agent := agents[am.agentId]
-			if agent != nil {
-				agent.Send(am.Msg)
+			if am.Msg.Action == protocol.BuildAction {
+				builds.enqueue(am)
+				if agents[am.agentId] == nil {
+					s.log("agent %v is not connected, queue build %v until it connects", am.agentId, am.Msg.DataBuild().BuildId)
+					expireQueued(am.agentId)
+				}
+				dispatch(am.agentId)
+			} else if am.Msg.Action == protocol.CancelBuildAction && !builds.busy(am.agentId) && builds.depth(am.agentId) > 0 {
+				// nothing is running on the agent, cancel the build
+				// it would run next
+				buildId := builds.dequeue(am.agentId, "").Msg.DataBuild().BuildId
+				s.log("cancel build %v queued for agent %v", buildId, am.agentId)
+				s.notifyBuild(buildId, protocol.BuildCanceled)
+			} else if agent := agents[am.agentId]; agent != nil {
+				send(agent, am.Msg)
 			} else {
 				s.log("could not find agent by id %v for sending message: %v", am.agentId, am.Msg.Action)
 			}
+		case c := <-s.buildCompleted:
+			builds.complete(c.agentId, c.buildId)
+			record(c.agentId, c.result)
+			dispatchWaiting()
+		case c := <-s.buildTimedOut:
+			if builds.expire(c.agentId, c.buildId) {
+				s.forgetConsoleTail(c.buildId)
+				s.error("build %v on agent %v is not completed in time, mark it %v", c.buildId, c.agentId, c.result)
+				s.notifyBuild(c.buildId, c.result)
+				record(c.agentId, protocol.BuildFailed)
+				if agent := agents[c.agentId]; agent != nil {
+					send(agent, protocol.CancelMessage())
+				}
+				dispatchWaiting()
+			}
+		case c := <-s.buildExpired:
+			if builds.dequeue(c.agentId, c.buildId) != nil {
+				s.error("build %v is queued for agent %v not connected in %v, mark it %v", c.buildId, c.agentId, s.QueuedBuildTTL, c.result)
+				s.notifyBuild(c.buildId, c.result)
+			}
+		case q := <-s.queueDepth:
+			q.depth <- builds.depth(q.agentId)
+		case ids := <-s.activeBuildsQuery:
+			ids <- builds.active()
+		case count := <-s.activeBuildCount:
+			count <- len(builds.running)
+		case <-s.managerStop:
+			return
+		case agentId := <-s.enableAgent:
+			if health.enable(agentId) {
+				s.log("agent %v is enabled", agentId)
+				s.notifyAgentId(agents[agentId], agentId, "Enabled")
+				dispatch(agentId)
+			}
+		case rb := <-s.routeBuild:
+			agentId := selectAgent(health.enabled(agents), builds, rb.resources, s.Registration)
+			if agentId != "" {
+				builds.enqueue(&AgentMessage{agentId: agentId, Msg: protocol.BuildMessage(rb.build)})
+				dispatch(agentId)
+			}
+			rb.agentId <- agentId
+		case r := <-s.agentStatus:
+			if !builds.recovering[r.agentId] {
+				break
+			}
+			if r.status == "Building" && r.buildLocator == builds.dispatched[r.agentId].Msg.DataBuild().BuildLocator {
+				delete(builds.recovering, r.agentId)
+			} else if am := builds.requeue(r.agentId); am != nil {
+				s.log("agent %v is not building %v after restart, dispatch it again", r.agentId, am.Msg.DataBuild().BuildId)
+				dispatch(r.agentId)
+			}
+		case <-recoveryTimeout:
+			for agentId := range builds.recovering {
+				if am := builds.requeue(agentId); am != nil {
+					s.log("agent %v did not reconnect after restart, queue build %v again", agentId, am.Msg.DataBuild().BuildId)
+				}
+				if agents[agentId] == nil {
+					expireQueued(agentId)
+				}
+			}
+			dispatchWaiting()
 		}
+		save()
 	}
 }
 
-func statusHandler() func(http.ResponseWriter, *http.Request) {
+type AgentStatus struct {
+	Uuid          string  `json:"uuid"`
+	RuntimeStatus string  `json:"runtimeStatus"`
+	UsableSpace   int64   `json:"usableSpace"`
+	LoadAverage   float64 `json:"loadAverage"`
+	FreeMemory    int64   `json:"freeMemory"`
+	ActiveBuilds  int     `json:"activeBuilds"`
+}
+
+type Status struct {
+	Status string         `json:"status"`
+	Agents []*AgentStatus `json:"agents"`
+}
+
+// statusHandler responds "ok" like it always did, so that existing
+// health checks comparing the body keep working, or the Status with the
+// agents as JSON with query param "verbose".
+func statusHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
-		w.Write([]byte("ok"))
+		if _, verbose := req.URL.Query()["verbose"]; !verbose {
+			w.Write([]byte("ok"))
+			return
+		}
+		status := &Status{Status: "ok", Agents: s.agentStatuses()}
+		data, err := json.Marshal(status)
+		if err != nil {
+			s.responseInternalError(err, w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
 	}
 }
 
@@ -234,6 +903,12 @@ func registorHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 		var err error
 		var reg *protocol.Registration
 
+		registration, err := parseRegistration(req)
+		if err != nil {
+			s.responseBadRequest(err, w)
+			return
+		}
+		s.register(registration)
 		agentPrivateKey, err = ioutil.ReadFile(s.KeyPemFile)
 		if err != nil {
 			s.responseInternalError(err, w)
@@ -248,6 +923,7 @@ func registorHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 		reg = &protocol.Registration{
 			AgentPrivateKey:  string(agentPrivateKey),
 			AgentCertificate: string(agentCert),
+			PathPrefix:       s.prefixed(""),
 		}
 		regJson, err = json.Marshal(reg)
 		if err != nil {
@@ -258,11 +934,28 @@ func registorHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func websocketHandler(s *Server) websocket.Handler {
-	return websocket.Handler(func(ws *websocket.Conn) {
-		agent := &RemoteAgent{conn: ws}
+// websocketHandler rejects handshakes of agents with unsupported protocol
+// versions.
+func websocketHandler(s *Server) websocket.Server {
+	return websocket.Server{Handshake: func(config *websocket.Config, req *http.Request) error {
+		_, err := protocol.ParseVersion(req.Header.Get(protocol.VersionHeader))
+		if err != nil {
+			s.log("reject websocket connection from %v: %v", req.RemoteAddr, err)
+		}
+		return err
+	}, Handler: func(ws *websocket.Conn) {
+		version, _ := protocol.ParseVersion(ws.Request().Header.Get(protocol.VersionHeader))
+		agent := newRemoteAgent(s, ws, version)
+		if !s.trackConn(agent) {
+			ws.Close()
+			return
+		}
+		defer s.untrackConn(agent)
 		s.log("websocket connection is open for %v", agent)
+		go agent.writeMessages(s)
+		go agent.keepalive(s, s.AgentPingInterval, agent.closed)
 		err := agent.Listen(s)
+		close(agent.closed)
 		s.del(agent)
 		if err != io.EOF {
 			s.log("close websocket connection for %v", agent)
@@ -271,7 +964,7 @@ func websocketHandler(s *Server) websocket.Handler {
 				s.error("error when closing websocket connection for %v: %v", agent, err)
 			}
 		}
-	})
+	}}
 }
 
 func parseBuildId(path string) string {
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+)
+
+func (s *Server) trackConn(agent *RemoteAgent) bool {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[agent] = true
+	s.connsWG.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(agent *RemoteAgent) {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	delete(s.conns, agent)
+	s.connsWG.Done()
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.fieldChangeMu.Lock()
+	defer s.fieldChangeMu.Unlock()
+	return s.shuttingDown
+}
+
+// Shutdown stops accepting connections, waits for in-flight requests
+// like artifact and console uploads to finish, then closes all agent
+// websockets and stops the agents manager. Start returns after Shutdown
+// completes, the server can not be started again. Shutdown can be
+// called again, e.g. after the context is done, to wait for the
+// connections left and stop the agents manager.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.fieldChangeMu.Lock()
+	httpServer := s.httpServer
+	if httpServer == nil {
+		s.fieldChangeMu.Unlock()
+		return errors.New("server is not started")
+	}
+	s.shuttingDown = true
+	s.fieldChangeMu.Unlock()
+
+	err := httpServer.Shutdown(ctx)
+	s.fieldChangeMu.Lock()
+	for agent := range s.conns {
+		s.log("close websocket connection for %v on shutdown", agent)
+		agent.Close()
+	}
+	s.fieldChangeMu.Unlock()
+
+	closed := make(chan bool)
+	go func() {
+		s.connsWG.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		// the agents manager and notifier are kept running when the
+		// context is done first, for the websocket handlers left.
+		s.stopManagerOnce.Do(func() {
+			s.managerStop <- true
+			close(s.notifierStop)
+		})
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	s.shutdownOnce.Do(func() {
+		s.StopGC()
+		close(s.shutdownDone)
+	})
+	return err
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/xli/assert"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsRequestsAndClosesAgentConnections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "private.pem")
+	assert.Nil(t, NewCert("localhost").Generate(certFile, keyFile))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	s := New("", certFile, keyFile, dir, log.New(ioutil.Discard, "", 0))
+	s.Listener = ln
+	started := make(chan error)
+	go func() {
+		started <- s.Start()
+	}()
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	url := "https://" + ln.Addr().String()
+
+	wsConfig, err := websocket.NewConfig("wss://"+ln.Addr().String()+WebSocketPath, url)
+	assert.Nil(t, err)
+	wsConfig.TlsConfig = tlsConfig
+	ws, err := websocket.DialConfig(wsConfig)
+	assert.Nil(t, err)
+	defer ws.Close()
+
+	body, upload := io.Pipe()
+	uploaded := make(chan *http.Response)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		req, _ := http.NewRequest(http.MethodPut, url+ConsoleLogPath+"/builds/b1", body)
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		uploaded <- resp
+	}()
+	upload.Write([]byte("hello "))
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown should wait for in-flight upload")
+	case <-time.After(100 * time.Millisecond):
+	}
+	upload.Write([]byte("world"))
+	upload.Close()
+	resp := <-uploaded
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, <-shutdown)
+	assert.Nil(t, <-started)
+
+	log, err := s.ConsoleLog("b1")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", log)
+	var msg []byte
+	assert.NotNil(t, websocket.Message.Receive(ws, &msg))
+}
+
+func TestNotifyAfterShutdownDoesNotPanicOrBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "private.pem")
+	assert.Nil(t, NewCert("localhost").Generate(certFile, keyFile))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	s := New("", certFile, keyFile, dir, log.New(ioutil.Discard, "", 0))
+	s.Listener = ln
+	s.NotifyBufferSize = 1
+	started := make(chan error)
+	go func() {
+		started <- s.Start()
+	}()
+	for !s.isListening() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	changes, _ := s.Subscribe(1)
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.Nil(t, <-started)
+	for range changes {
+	}
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 3; i++ {
+			s.notifyBuild("b1", "Passed")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("notify should not block after shutdown")
+	}
+}
+
+func TestShutdownCanBeCalledAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shutdown-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "private.pem")
+	assert.Nil(t, NewCert("localhost").Generate(certFile, keyFile))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	s := New("", certFile, keyFile, dir, log.New(ioutil.Discard, "", 0))
+	s.Listener = ln
+	assert.NotNil(t, s.Shutdown(context.Background()))
+	assert.False(t, s.isShuttingDown())
+
+	started := make(chan error)
+	go func() {
+		started <- s.Start()
+	}()
+	for !s.isListening() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	url := "https://" + ln.Addr().String()
+	body, upload := io.Pipe()
+	uploaded := make(chan *http.Response)
+	go func() {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		req, _ := http.NewRequest(http.MethodPut, url+ConsoleLogPath+"/builds/b1", body)
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		uploaded <- resp
+	}()
+	upload.Write([]byte("hello"))
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+	assert.Nil(t, <-started)
+
+	upload.Close()
+	resp := <-uploaded
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
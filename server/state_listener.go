@@ -0,0 +1,84 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+type StateChange struct {
+	Class string
+	Id    string
+	State string
+	// Agent is the registration of the agent for agent state changes.
+	Agent *AgentRegistration
+}
+
+func (c *StateChange) String() string {
+	return fmt.Sprintf("%v %v %v", c.Class, c.Id, c.State)
+}
+
+// ChannelStateListener publishes every notification onto C. When
+// DropWhenFull is set, notifications are discarded instead of
+// blocking the notifier once the buffer of C is full.
+type ChannelStateListener struct {
+	C            chan *StateChange
+	DropWhenFull bool
+}
+
+func NewChannelStateListener(buffer int, dropWhenFull bool) *ChannelStateListener {
+	return &ChannelStateListener{
+		C:            make(chan *StateChange, buffer),
+		DropWhenFull: dropWhenFull,
+	}
+}
+
+func (l *ChannelStateListener) Notify(class, id, state string) {
+	l.publish(&StateChange{Class: class, Id: id, State: state})
+}
+
+func (l *ChannelStateListener) NotifyAgent(agent *AgentRegistration, state string) {
+	l.publish(&StateChange{Class: "agent", Id: agent.Uuid, State: state, Agent: agent})
+}
+
+func (l *ChannelStateListener) publish(change *StateChange) {
+	if l.DropWhenFull {
+		select {
+		case l.C <- change:
+		default:
+		}
+	} else {
+		l.C <- change
+	}
+}
+
+// WaitFor consumes state changes until one matches, changes received
+// before the match are discarded.
+func (l *ChannelStateListener) WaitFor(class, id, state string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case change := <-l.C:
+			if change.Class == class && change.Id == id && change.State == state {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("wait for %v %v %v timeout", class, id, state)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server_test
+
+import (
+	. "github.com/gocd-contrib/gocd-golang-agent/server"
+	"github.com/xli/assert"
+	"testing"
+	"time"
+)
+
+func TestChannelStateListenerWaitFor(t *testing.T) {
+	listener := NewChannelStateListener(10, false)
+	listener.Notify("agent", "a1", "Idle")
+	listener.Notify("build", "b1", "Building")
+	listener.Notify("build", "b1", "Passed")
+
+	assert.Nil(t, listener.WaitFor("build", "b1", "Passed", time.Second))
+	assert.Equal(t, 0, len(listener.C))
+}
+
+func TestChannelStateListenerWaitForTimeout(t *testing.T) {
+	listener := NewChannelStateListener(10, false)
+	listener.Notify("build", "b1", "Building")
+
+	err := listener.WaitFor("build", "b1", "Passed", 10*time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Equal(t, "wait for build b1 Passed timeout", err.Error())
+}
+
+func TestChannelStateListenerDropWhenFull(t *testing.T) {
+	listener := NewChannelStateListener(1, true)
+	listener.Notify("build", "b1", "Building")
+	listener.Notify("build", "b1", "Passed")
+
+	assert.Equal(t, 1, len(listener.C))
+	assert.Equal(t, "build b1 Building", (<-listener.C).String())
+}
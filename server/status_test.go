@@ -0,0 +1,82 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusReportsAgentLoad(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	for _, id := range []string{"a2", "a1"} {
+		s.updateRuntimeInfo(&protocol.AgentRuntimeInfo{
+			Identifier:    &protocol.AgentIdentifier{Uuid: id},
+			RuntimeStatus: "Idle",
+			UsableSpace:   1000,
+			LoadAverage:   0.5,
+			FreeMemory:    2048,
+		})
+	}
+
+	w := httptest.NewRecorder()
+	statusHandler(s)(w, httptest.NewRequest(http.MethodGet, StatusPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+
+	w = httptest.NewRecorder()
+	statusHandler(s)(w, httptest.NewRequest(http.MethodGet, StatusPath+"?verbose", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var status Status
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, "ok", status.Status)
+	assert.Equal(t, 2, len(status.Agents))
+	assert.Equal(t, "a1", status.Agents[0].Uuid)
+	assert.Equal(t, "a2", status.Agents[1].Uuid)
+	assert.Equal(t, 0.5, status.Agents[0].LoadAverage)
+	assert.Equal(t, int64(2048), status.Agents[0].FreeMemory)
+
+	s.removeRuntimeInfo("a1")
+	w = httptest.NewRecorder()
+	statusHandler(s)(w, httptest.NewRequest(http.MethodGet, StatusPath+"?verbose", nil))
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, 1, len(status.Agents))
+}
+
+func TestStatusAcceptsMinimalAndExtendedRuntimeInfo(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	for _, data := range []string{
+		`{"identifier":{"uuid":"a1"},"runtimeStatus":"Idle"}`,
+		`{"identifier":{"uuid":"a2"},"runtimeStatus":"Building","loadAverage":1.5,"freeMemory":1024,"activeBuilds":1}`,
+	} {
+		var info protocol.AgentRuntimeInfo
+		assert.Nil(t, json.Unmarshal([]byte(data), &info))
+		s.updateRuntimeInfo(&info)
+	}
+
+	statuses := s.agentStatuses()
+	assert.Equal(t, 2, len(statuses))
+	assert.Equal(t, &AgentStatus{Uuid: "a1", RuntimeStatus: "Idle"}, statuses[0])
+	assert.Equal(t, &AgentStatus{Uuid: "a2", RuntimeStatus: "Building", LoadAverage: 1.5, FreeMemory: 1024, ActiveBuilds: 1}, statuses[1])
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package server
+
+// Subscribe returns a channel receiving every agent and build state
+// change notified to StateListeners, plus events only published to
+// subscribers: agents "Connected" and "Disconnected" when their
+// websocket connections open and close, and "console" changes with the
+// build id and state "Appended" when build output is appended. Changes
+// are received in the order they are notified, possibly before
+// StateListeners are notified of them. Changes are dropped when the channel buffer is full, so a slow subscriber
+// never delays the server. cancel stops the subscription and closes the
+// channel, it is also closed when the server shuts down.
+func (s *Server) Subscribe(buffer int) (changes <-chan *StateChange, cancel func()) {
+	c := make(chan *StateChange, buffer)
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+	if s.subscribers == nil {
+		close(c)
+		return c, func() {}
+	}
+	s.subscribers[c] = true
+	return c, func() {
+		s.subscribersMu.Lock()
+		defer s.subscribersMu.Unlock()
+		if s.subscribers[c] {
+			delete(s.subscribers, c)
+			close(c)
+		}
+	}
+}
+
+// notifySubscribers publishes the change to subscribers only. It does
+// not go through the notifier, so frequent events like console appends
+// neither delay nor crowd out the state changes for StateListeners.
+func (s *Server) notifySubscribers(change *StateChange) {
+	s.publish(change)
+}
+
+// publish sends the change to every subscriber channel. State changes
+// for StateListeners are published when they are notified rather than
+// when the notifier delivers them, so that subscribers receive all
+// changes in the order they are notified.
+func (s *Server) publish(change *StateChange) {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+	for c := range s.subscribers {
+		select {
+		case c <- change:
+		default:
+		}
+	}
+}
+
+func (s *Server) closeSubscribers() {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+	for c := range s.subscribers {
+		close(c)
+	}
+	s.subscribers = nil
+}
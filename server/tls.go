@@ -0,0 +1,45 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+const DefaultTLSMinVersion = tls.VersionTLS12
+
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:   s.TLSMinVersion,
+		CipherSuites: s.CipherSuites,
+		ClientAuth:   s.ClientAuth,
+	}
+	if s.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in client CA file " + s.ClientCAFile)
+		}
+	}
+	return config, nil
+}
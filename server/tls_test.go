@@ -0,0 +1,114 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/xli/assert"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultTLSConfigRequiresTLS12(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	config, err := s.tlsConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+	assert.Nil(t, config.CipherSuites)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+	assert.Nil(t, config.ClientCAs)
+}
+
+func TestTLSConfigWithClientCAFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	assert.Nil(t, NewCert("localhost").Generate(certFile, filepath.Join(dir, "private.pem")))
+
+	s := New("", "", "", dir, log.New(ioutil.Discard, "", 0))
+	s.TLSMinVersion = tls.VersionTLS13
+	s.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	s.ClientAuth = tls.RequireAndVerifyClientCert
+	s.ClientCAFile = certFile
+	config, err := s.tlsConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), config.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, config.CipherSuites)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+	assert.NotNil(t, config.ClientCAs)
+
+	s.ClientCAFile = filepath.Join(dir, "private.pem")
+	_, err = s.tlsConfig()
+	assert.NotNil(t, err)
+}
+
+func TestGenerateTestCertsForMutualTLS(t *testing.T) {
+	certs, err := GenerateTestCerts("localhost,127.0.0.1")
+	assert.Nil(t, err)
+	defer os.RemoveAll(certs.Dir)
+
+	s := New("", certs.ServerCertFile, certs.ServerKeyFile, certs.Dir, log.New(ioutil.Discard, "", 0))
+	s.ClientAuth = tls.RequireAndVerifyClientCert
+	s.ClientCAFile = certs.CACertFile
+	s.Listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	started := make(chan error, 1)
+	go func() { started <- s.Start() }()
+	defer func() {
+		assert.Nil(t, s.Shutdown(context.Background()))
+		assert.Nil(t, <-started)
+	}()
+
+	caPem, err := ioutil.ReadFile(certs.CACertFile)
+	assert.Nil(t, err)
+	roots := x509.NewCertPool()
+	assert.True(t, roots.AppendCertsFromPEM(caPem))
+	agentCert, err := tls.LoadX509KeyPair(certs.AgentCertFile, certs.AgentKeyFile)
+	assert.Nil(t, err)
+	statusUrl := "https://" + s.Listener.Addr().String() + StatusPath
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{agentCert},
+	}}}
+	resp, err := client.Get(statusUrl)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	_, err = client.Get(statusUrl)
+	assert.NotNil(t, err)
+
+	for file, usage := range map[string][]x509.ExtKeyUsage{
+		certs.CACertFile:     {x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		certs.ServerCertFile: {x509.ExtKeyUsageServerAuth},
+		certs.AgentCertFile:  {x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	} {
+		cert, _, err := readCertAndKey(file, certs.CAKeyFile)
+		assert.Nil(t, err)
+		assert.Equal(t, usage, cert.ExtKeyUsage, file)
+	}
+}
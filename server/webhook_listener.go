@@ -0,0 +1,117 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type WebhookPayload struct {
+	Class     string    `json:"class"`
+	Id        string    `json:"id"`
+	State     string    `json:"state"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// WebhookStateListener posts state changes to Url as json. Posting
+// happens on a background goroutine reading from a bounded queue, so
+// a slow endpoint never blocks Notify; changes are dropped when the
+// queue is full.
+type WebhookStateListener struct {
+	Url         string
+	Client      *http.Client
+	MaxAttempts int
+	RetryDelay  time.Duration
+	Logger      Logger
+
+	queue chan *WebhookPayload
+	done  chan bool
+}
+
+func NewWebhookStateListener(url string, timeout time.Duration, queueSize int) *WebhookStateListener {
+	l := &WebhookStateListener{
+		Url:         url,
+		Client:      &http.Client{Timeout: timeout},
+		MaxAttempts: 3,
+		RetryDelay:  1 * time.Second,
+		queue:       make(chan *WebhookPayload, queueSize),
+		done:        make(chan bool),
+	}
+	go l.run()
+	return l
+}
+
+func (l *WebhookStateListener) Notify(class, id, state string) {
+	payload := &WebhookPayload{Class: class, Id: id, State: state, Timestamp: time.Now()}
+	select {
+	case l.queue <- payload:
+	default:
+		l.error("webhook queue is full, drop notification: %v %v %v", class, id, state)
+	}
+}
+
+// Close stops accepting notifications and waits for queued ones to be
+// posted.
+func (l *WebhookStateListener) Close() {
+	close(l.queue)
+	<-l.done
+}
+
+func (l *WebhookStateListener) run() {
+	defer close(l.done)
+	for payload := range l.queue {
+		if err := l.post(payload); err != nil {
+			l.error("webhook post to %v failed: %v", l.Url, err)
+		}
+	}
+}
+
+func (l *WebhookStateListener) post(payload *WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = l.postOnce(body)
+		if err == nil || attempt >= l.MaxAttempts {
+			return err
+		}
+		time.Sleep(l.RetryDelay * time.Duration(1<<uint(attempt-1)))
+	}
+}
+
+func (l *WebhookStateListener) postOnce(body []byte) error {
+	resp, err := l.Client.Post(l.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("server responded %v", resp.Status)
+	}
+	return nil
+}
+
+func (l *WebhookStateListener) error(format string, v ...interface{}) {
+	if l.Logger != nil {
+		l.Logger.Errorf(format, v...)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server_test
+
+import (
+	"encoding/json"
+	. "github.com/gocd-contrib/gocd-golang-agent/server"
+	"github.com/xli/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookStateListenerPostsPayload(t *testing.T) {
+	payloads := make(chan map[string]interface{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		var payload map[string]interface{}
+		assert.Nil(t, json.NewDecoder(req.Body).Decode(&payload))
+		payloads <- payload
+	}))
+	defer ts.Close()
+
+	listener := NewWebhookStateListener(ts.URL, time.Second, 10)
+	listener.Notify("build", "b1", "Passed")
+	listener.Close()
+
+	payload := <-payloads
+	assert.Equal(t, 4, len(payload))
+	assert.Equal(t, "build", payload["class"])
+	assert.Equal(t, "b1", payload["id"])
+	assert.Equal(t, "Passed", payload["state"])
+	_, err := time.Parse(time.RFC3339, payload["timestamp"].(string))
+	assert.Nil(t, err)
+}
+
+func TestWebhookStateListenerRetriesFailedPost(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	listener := NewWebhookStateListener(ts.URL, time.Second, 10)
+	listener.RetryDelay = time.Millisecond
+	listener.Notify("agent", "a1", "Idle")
+	listener.Close()
+
+	assert.Equal(t, 3, requests)
+}
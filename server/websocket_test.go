@@ -0,0 +1,293 @@
+/*
+ * Copyright 2016 ThoughtWorks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/gocd-contrib/gocd-golang-agent/protocol"
+	"github.com/xli/assert"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebsocketRejectsUnsupportedProtocolVersion(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	_, err := dialAgent(ts.URL, "99")
+	assert.NotNil(t, err)
+}
+
+func TestWebsocketSendsMessagesWithoutVersionToLegacyAgents(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	for version, expected := range map[string]int{"": protocol.LegacyVersion, "1": protocol.Version} {
+		ws, err := dialAgent(ts.URL, version)
+		assert.Nil(t, err)
+		info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "agent-" + version}}
+		assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+		ack, err := protocol.ReceiveMessage(ws)
+		assert.Nil(t, err)
+		assert.Equal(t, protocol.AckAction, ack.Action)
+		assert.Equal(t, expected, ack.Version)
+		ws.Close()
+	}
+}
+
+func TestConnectingAgentRegistrationIsDeliveredToStateListeners(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	listener := NewChannelStateListener(10, false)
+	plain := &slowListener{notified: make(chan string, 10)}
+	s.StateListeners = []StateListener{listener, plain}
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	s.register(&AgentRegistration{Uuid: "a1", Hostname: "host1", OperatingSystem: "linux", Resources: []string{"docker"}})
+
+	ws, err := dialAgent(ts.URL, "1")
+	assert.Nil(t, err)
+	defer ws.Close()
+	info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1"}, RuntimeStatus: "Idle"}
+	assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+
+	change := <-listener.C
+	assert.Equal(t, "agent a1 Idle", change.String())
+	assert.Equal(t, "host1", change.Agent.Hostname)
+	assert.Equal(t, "linux", change.Agent.OperatingSystem)
+	assert.Equal(t, []string{"docker"}, change.Agent.Resources)
+	assert.Equal(t, "agent a1 Idle", <-plain.notified)
+}
+
+func TestUnregisteredAgentMetadataComesFromRuntimeInfo(t *testing.T) {
+	info := &protocol.AgentRuntimeInfo{
+		Identifier:          &protocol.AgentIdentifier{Uuid: "a1", HostName: "host1"},
+		OperatingSystemName: "windows",
+	}
+	reg := agentRegistration(nil, info)
+	assert.Equal(t, "a1", reg.Uuid)
+	assert.Equal(t, "host1", reg.Hostname)
+	assert.Equal(t, "windows", reg.OperatingSystem)
+}
+
+func TestWebsocketClosesConnectionOfStalledAgent(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.AgentReadTimeout = 200 * time.Millisecond
+	s.AgentPingInterval = 50 * time.Millisecond
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	ws, err := dialAgent(ts.URL, "1")
+	assert.Nil(t, err)
+	defer ws.Close()
+	info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1"}}
+	assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+	start := time.Now()
+	for err == nil {
+		_, err = protocol.ReceiveMessage(ws)
+	}
+	assert.True(t, time.Since(start) < time.Second, "stalled connection should be closed after read timeout")
+
+	for i := 0; i < 100 && len(s.agentStatuses()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, len(s.agentStatuses()))
+}
+
+func TestWebsocketZeroReadTimeoutAndPingIntervalFallBackToDefaults(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.AgentReadTimeout = 0
+	s.AgentPingInterval = 0
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	ws, err := dialAgent(ts.URL, "1")
+	assert.Nil(t, err)
+	defer ws.Close()
+	info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1"}}
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		msg, err := protocol.ReceiveMessage(ws)
+		for err == nil && msg.Action != protocol.AckAction {
+			msg, err = protocol.ReceiveMessage(ws)
+		}
+		assert.Nil(t, err)
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, 1, len(s.agentStatuses()))
+}
+
+func TestExecResultOfInvalidBuildIdIsRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "websocket-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := New("", "", "", filepath.Join(dir, "work", "server"), log.New(ioutil.Discard, "", 0))
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	ws, err := dialAgent(ts.URL, "1")
+	assert.Nil(t, err)
+	defer ws.Close()
+	info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1"}}
+	for _, msg := range []*protocol.Message{
+		protocol.PingMessage(info),
+		protocol.ExecResultMessage(&protocol.ExecResult{BuildId: "../../x", Command: "echo"}),
+		protocol.ExecResultMessage(&protocol.ExecResult{BuildId: "b1", Command: "echo"}),
+		protocol.PingMessage(info),
+	} {
+		assert.Nil(t, protocol.SendMessage(ws, msg))
+	}
+	// messages are processed in order, the last ping is acked after the
+	// exec results are recorded
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	for acks := 0; acks < 4; {
+		msg, err := protocol.ReceiveMessage(ws)
+		assert.Nil(t, err)
+		if msg.Action == protocol.AckAction {
+			acks++
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "x"))
+	assert.True(t, os.IsNotExist(err), "exec result should not be written outside of the working directory")
+	results, err := ioutil.ReadFile(s.ExecResultsFile("b1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "echo exit 0\n", string(results))
+}
+
+func TestWebsocketClosesConnectionOfAgentSendingOversizedMessage(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.MaxWebSocketMessageSize = 1024
+	s.startNotifier()
+	go manageAgents(s)
+	ts := httptest.NewServer(websocketHandler(s))
+	defer ts.Close()
+
+	oversized := map[string]func(*websocket.Conn) error{
+		"frame": func(ws *websocket.Conn) error {
+			return websocket.Message.Send(ws, strings.Repeat("x", 2048))
+		},
+		"decompressed message": func(ws *websocket.Conn) error {
+			info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1", HostName: strings.Repeat("x", 2048)}}
+			return protocol.SendMessage(ws, protocol.PingMessage(info))
+		},
+	}
+	for name, send := range oversized {
+		ws, err := dialAgent(ts.URL, "1")
+		assert.Nil(t, err)
+		info := &protocol.AgentRuntimeInfo{Identifier: &protocol.AgentIdentifier{Uuid: "a1"}}
+		assert.Nil(t, protocol.SendMessage(ws, protocol.PingMessage(info)))
+		msg, err := protocol.ReceiveMessage(ws)
+		assert.Nil(t, err)
+		assert.Equal(t, protocol.AckAction, msg.Action)
+
+		assert.Nil(t, send(ws))
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		for err == nil {
+			_, err = protocol.ReceiveMessage(ws)
+		}
+		assert.Equal(t, io.EOF, err, name)
+		ws.Close()
+	}
+}
+
+func TestRegistrationRejectsUnsupportedProtocolVersion(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	form := url.Values{"uuid": {"a1"}, protocol.VersionParam: {"99"}}
+	req := httptest.NewRequest(http.MethodPost, RegistrationPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	registorHandler(s)(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Nil(t, s.Registration("a1"))
+}
+
+func TestAgentIsDisconnectedWhenSendQueueIsFull(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	s.AgentSendQueueSize = 2
+	go manageAgents(s)
+	conns := make(chan *websocket.Conn)
+	done := make(chan bool)
+	defer close(done)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		conns <- ws
+		<-done
+	}))
+	defer ts.Close()
+	client, err := dialAgent(ts.URL, "")
+	assert.Nil(t, err)
+	defer client.Close()
+
+	// the agent does not write messages, as if its socket is blocked
+	agent := newRemoteAgent(s, <-conns, protocol.Version)
+	agent.id = "a1"
+	s.add(agent)
+	for i := 0; i < 3; i++ {
+		s.Send("a1", protocol.CancelMessage())
+	}
+	assert.Equal(t, 0, s.ActiveBuildCount())
+	assert.Equal(t, errSendQueueFull, agent.Send(protocol.CancelMessage()))
+	_, err = protocol.ReceiveMessage(client)
+	assert.NotNil(t, err)
+
+	close(agent.closed)
+	assert.Equal(t, errAgentClosed, agent.Send(protocol.CancelMessage()))
+}
+
+func TestAgentSendQueueSizeNotPositiveFallsBackToDefault(t *testing.T) {
+	s := New("", "", "", "", log.New(ioutil.Discard, "", 0))
+	for _, size := range []int{0, -1} {
+		s.AgentSendQueueSize = size
+		agent := newRemoteAgent(s, nil, protocol.Version)
+		assert.Equal(t, DefaultAgentSendQueueSize, cap(agent.outbox))
+		assert.Nil(t, agent.Send(protocol.CancelMessage()))
+	}
+}
+
+func dialAgent(serverUrl, version string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(serverUrl, "http")+WebSocketPath, serverUrl)
+	if err != nil {
+		return nil, err
+	}
+	if version != "" {
+		config.Header.Set(protocol.VersionHeader, version)
+	}
+	return websocket.DialConfig(config)
+}